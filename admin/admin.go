@@ -0,0 +1,44 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"code.cloudfoundry.org/cc-uploader/uploads"
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/tedsuo/rata"
+)
+
+const (
+	ListUploadsRoute  = "ListUploads"
+	CancelUploadRoute = "CancelUpload"
+)
+
+var Routes = rata.Routes{
+	{Name: ListUploadsRoute, Method: "GET", Path: "/v1/uploads"},
+	{Name: CancelUploadRoute, Method: "DELETE", Path: "/v1/uploads/:id"},
+}
+
+// New returns the admin API, which lists in-flight uploads and lets
+// operators cancel them. It is meant to be served on the debug listener.
+func New(logger lager.Logger, tracker *uploads.Tracker) (http.Handler, error) {
+	logger = logger.Session("admin")
+
+	return rata.NewRouter(Routes, rata.Handlers{
+		ListUploadsRoute: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(tracker.Snapshots())
+		}),
+		CancelUploadRoute: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := rata.Param(r, "id")
+			if !tracker.Cancel(id, uploads.ErrCancelledByOperator) {
+				logger.Info("upload-not-found", lager.Data{"upload-id": id})
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			logger.Info("cancelled-upload", lager.Data{"upload-id": id})
+			w.WriteHeader(http.StatusAccepted)
+		}),
+	})
+}
@@ -0,0 +1,79 @@
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"code.cloudfoundry.org/cc-uploader/admin"
+	"code.cloudfoundry.org/cc-uploader/uploads"
+	"code.cloudfoundry.org/lager/v3/lagertest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Admin", func() {
+	var (
+		tracker *uploads.Tracker
+		handler http.Handler
+		upload  *uploads.Upload
+		ctx     context.Context
+	)
+
+	BeforeEach(func() {
+		logger := lagertest.NewTestLogger("test")
+		tracker = uploads.NewTracker(logger, 0)
+
+		var err error
+		handler, err = admin.New(logger, tracker)
+		Expect(err).NotTo(HaveOccurred())
+
+		uploadURL, err := url.Parse("https://cc.example.com/staging/droplets/app-guid/upload")
+		Expect(err).NotTo(HaveOccurred())
+		ctx, upload, err = tracker.Start(context.Background(), "UploadDroplet", "app-guid", uploadURL, 100)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		return recorder
+	}
+
+	Describe("listing uploads", func() {
+		It("returns every in-flight upload", func() {
+			upload.SetPhase(uploads.PhasePolling)
+
+			recorder := serve("GET", "/v1/uploads")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+
+			var listed []uploads.Snapshot
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &listed)).To(Succeed())
+			Expect(listed).To(HaveLen(1))
+			Expect(listed[0].ID).To(Equal(upload.ID))
+			Expect(listed[0].Guid).To(Equal("app-guid"))
+			Expect(listed[0].Route).To(Equal("UploadDroplet"))
+			Expect(listed[0].Host).To(Equal("cc.example.com"))
+			Expect(listed[0].Phase).To(Equal(uploads.PhasePolling))
+			Expect(listed[0].Age).NotTo(BeEmpty())
+		})
+	})
+
+	Describe("cancelling an upload", func() {
+		It("cancels the upload", func() {
+			recorder := serve("DELETE", "/v1/uploads/"+upload.ID)
+			Expect(recorder.Code).To(Equal(http.StatusAccepted))
+
+			Eventually(ctx.Done()).Should(BeClosed())
+			Expect(uploads.CancellationCause(ctx)).To(Equal(uploads.ErrCancelledByOperator))
+		})
+
+		It("responds with 404 for unknown uploads", func() {
+			recorder := serve("DELETE", "/v1/uploads/unknown")
+			Expect(recorder.Code).To(Equal(http.StatusNotFound))
+		})
+	})
+})
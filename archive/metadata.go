@@ -0,0 +1,58 @@
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"path"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// StagingInfoFile is written to the root of a droplet by the buildpack
+// lifecycle.
+const StagingInfoFile = "staging_info.yml"
+
+// maxStagingInfoSize bounds how much of the staging info file is buffered.
+const maxStagingInfoSize = 1024 * 1024
+
+// Metadata describes the contents of an archive. DetectedBuildpack and
+// StartCommand come from the staging info file of a droplet and are empty
+// if it has none.
+type Metadata struct {
+	DetectedBuildpack string
+	StartCommand      string
+	UncompressedSize  int64
+	FileCount         int
+}
+
+type stagingInfo struct {
+	DetectedBuildpack string `yaml:"detected_buildpack"`
+	StartCommand      string `yaml:"start_command"`
+}
+
+func (m *Metadata) add(header *tar.Header, contents io.Reader) error {
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	m.FileCount++
+	m.UncompressedSize += header.Size
+
+	if path.Clean(header.Name) != StagingInfoFile || header.Size > maxStagingInfoSize {
+		return nil
+	}
+
+	data, err := io.ReadAll(contents)
+	if err != nil {
+		return err
+	}
+
+	// The staging info is informational, so a file that cannot be parsed is
+	// ignored rather than failing the upload
+	var info stagingInfo
+	if yaml.Unmarshal(data, &info) == nil {
+		m.DetectedBuildpack = info.DetectedBuildpack
+		m.StartCommand = info.StartCommand
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package archive_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"code.cloudfoundry.org/cc-uploader/archive"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metadata", func() {
+	var body []byte
+	var validate bool
+	var reader *archive.Reader
+
+	BeforeEach(func() {
+		body = gzippedFiles(
+			"./staging_info.yml", `{"detected_buildpack":"ruby 1.2.3","start_command":"bundle exec rackup"}`,
+			"./app/config.ru", "run App",
+			"./app/Gemfile", "source 'https://rubygems.org'",
+		)
+		validate = false
+	})
+
+	JustBeforeEach(func() {
+		reader = archive.NewReader(io.NopCloser(bytes.NewReader(body)), validate)
+	})
+
+	It("is not available until the whole archive has been read", func() {
+		_, err := reader.Read(make([]byte, 10))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, ok := reader.Metadata()
+		Expect(ok).To(BeFalse())
+	})
+
+	It("describes the contents of the archive", func() {
+		read, err := io.ReadAll(reader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(read).To(Equal(body))
+
+		metadata, ok := reader.Metadata()
+		Expect(ok).To(BeTrue())
+		Expect(metadata).To(Equal(archive.Metadata{
+			DetectedBuildpack: "ruby 1.2.3",
+			StartCommand:      "bundle exec rackup",
+			UncompressedSize:  72 + 7 + 29,
+			FileCount:         3,
+		}))
+	})
+
+	It("keeps returning io.EOF once the body has been read", func() {
+		_, err := io.ReadAll(reader)
+		Expect(err).NotTo(HaveOccurred())
+
+		reads := make(chan error, 2)
+		go func() {
+			for range 2 {
+				_, err := reader.Read(make([]byte, 10))
+				reads <- err
+			}
+		}()
+		Eventually(reads).Should(Receive(Equal(io.EOF)))
+		Eventually(reads).Should(Receive(Equal(io.EOF)))
+
+		_, ok := reader.Metadata()
+		Expect(ok).To(BeTrue())
+	})
+
+	Context("when the staging info cannot be parsed", func() {
+		BeforeEach(func() {
+			body = gzippedFiles("staging_info.yml", "{not yaml")
+		})
+
+		It("still counts the files", func() {
+			_, err := io.ReadAll(reader)
+			Expect(err).NotTo(HaveOccurred())
+
+			metadata, ok := reader.Metadata()
+			Expect(ok).To(BeTrue())
+			Expect(metadata.DetectedBuildpack).To(BeEmpty())
+			Expect(metadata.FileCount).To(Equal(1))
+		})
+	})
+
+	Context("when the body is not an archive and validation is off", func() {
+		BeforeEach(func() {
+			body = bytes.Repeat([]byte("not-an-archive"), 10000)
+		})
+
+		It("passes the body through without metadata", func() {
+			read, err := io.ReadAll(reader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(read).To(Equal(body))
+
+			_, ok := reader.Metadata()
+			Expect(ok).To(BeFalse())
+		})
+	})
+})
+
+// gzippedFiles builds an archive from alternating file names and contents.
+func gzippedFiles(namesAndContents ...string) []byte {
+	buffer := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for i := 0; i < len(namesAndContents); i += 2 {
+		contents := namesAndContents[i+1]
+		header := &tar.Header{Name: namesAndContents[i], Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))}
+		Expect(tarWriter.WriteHeader(header)).To(Succeed())
+		_, err := tarWriter.Write([]byte(contents))
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(tarWriter.Close()).To(Succeed())
+	Expect(gzipWriter.Close()).To(Succeed())
+	return buffer.Bytes()
+}
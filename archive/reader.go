@@ -0,0 +1,146 @@
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+// Reader passes an upload body through unchanged while reading it as a
+// gzipped tarball, collecting Metadata about its contents and, if asked to,
+// validating its entries.
+type Reader struct {
+	body       io.ReadCloser
+	validate   bool
+	pipeWriter *io.PipeWriter
+	result     chan walkResult
+	err        error
+
+	lock     sync.Mutex
+	metadata *Metadata
+}
+
+type walkResult struct {
+	metadata Metadata
+	err      error
+}
+
+// NewReader starts reading body as a gzipped tarball. If validate is true,
+// reads fail with a *ValidationError once a problem is found, so that a
+// request streaming the body is aborted; a truncated archive is reported in
+// place of the final io.EOF. Otherwise a malformed archive only means that
+// no metadata is available.
+func NewReader(body io.ReadCloser, validate bool) *Reader {
+	pipeReader, pipeWriter := io.Pipe()
+	r := &Reader{
+		body:       body,
+		validate:   validate,
+		pipeWriter: pipeWriter,
+		result:     make(chan walkResult, 1),
+	}
+
+	go func() {
+		metadata, err := walk(pipeReader, validate)
+		if err != nil && !validate {
+			// Keep consuming the body so that it still flows through
+			io.Copy(io.Discard, pipeReader)
+		}
+		pipeReader.CloseWithError(err)
+		r.result <- walkResult{metadata: metadata, err: err}
+	}()
+
+	return r
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n, err := r.body.Read(p)
+	if n > 0 {
+		if _, writeErr := r.pipeWriter.Write(p[:n]); writeErr != nil {
+			// The walk only stops reading early once validation has failed
+			r.err = (<-r.result).err
+			return 0, r.err
+		}
+	}
+
+	switch {
+	case err == io.EOF:
+		r.pipeWriter.Close()
+		// The walk only sends one result, so later reads must not wait for it
+		r.err = io.EOF
+		result := <-r.result
+		if result.err != nil {
+			if r.validate {
+				r.err = result.err
+				return n, r.err
+			}
+			break
+		}
+		r.lock.Lock()
+		r.metadata = &result.metadata
+		r.lock.Unlock()
+	case err != nil:
+		r.pipeWriter.CloseWithError(err)
+	}
+	return n, err
+}
+
+func (r *Reader) Close() error {
+	r.pipeWriter.CloseWithError(io.ErrClosedPipe)
+	return r.body.Close()
+}
+
+// Metadata returns what was learned about the archive. It reports false
+// until the whole body has been read, and if the archive was malformed.
+func (r *Reader) Metadata() (Metadata, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.metadata == nil {
+		return Metadata{}, false
+	}
+	return *r.metadata, true
+}
+
+func walk(r io.Reader, validate bool) (Metadata, error) {
+	metadata := Metadata{}
+
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return metadata, invalid("not a gzip stream: %s", err)
+	}
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return metadata, invalid("malformed tar stream: %s", err)
+		}
+
+		if validate {
+			err = validateEntry(header)
+			if err != nil {
+				return metadata, err
+			}
+		}
+
+		err = metadata.add(header, tarReader)
+		if err != nil {
+			return metadata, invalid("malformed tar stream: %s", err)
+		}
+	}
+
+	// Read the remainder so that the gzip checksum and length are verified
+	_, err = io.Copy(io.Discard, gzipReader)
+	if err != nil {
+		return metadata, invalid("malformed gzip stream: %s", err)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,56 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ValidationError is returned when an archive is malformed or contains an
+// entry that is not allowed.
+type ValidationError struct {
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid archive: " + e.Reason
+}
+
+func invalid(format string, args ...interface{}) error {
+	return &ValidationError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// validateEntry rejects entries that would end up outside the directory the
+// archive is extracted into, and device files.
+func validateEntry(header *tar.Header) error {
+	if escapesRoot(header.Name) {
+		return invalid("entry %q is outside the archive root", header.Name)
+	}
+
+	switch header.Typeflag {
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return invalid("entry %q is a device file", header.Name)
+	case tar.TypeSymlink:
+		target := header.Linkname
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(header.Name), target)
+		}
+		if escapesRoot(target) {
+			return invalid("symlink %q points outside the archive root: %q", header.Name, header.Linkname)
+		}
+	case tar.TypeLink:
+		if escapesRoot(header.Linkname) {
+			return invalid("hard link %q points outside the archive root: %q", header.Name, header.Linkname)
+		}
+	}
+	return nil
+}
+
+func escapesRoot(name string) bool {
+	if path.IsAbs(name) {
+		return true
+	}
+	cleaned := path.Clean(name)
+	return cleaned == ".." || strings.HasPrefix(cleaned, "../")
+}
@@ -0,0 +1,147 @@
+package archive_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+
+	"code.cloudfoundry.org/cc-uploader/archive"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func gzippedTarball(headers ...*tar.Header) []byte {
+	buffer := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, header := range headers {
+		contents := []byte{}
+		if header.Typeflag == tar.TypeReg {
+			contents = []byte(header.Name)
+			header.Size = int64(len(contents))
+		}
+		Expect(tarWriter.WriteHeader(header)).To(Succeed())
+		_, err := tarWriter.Write(contents)
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(tarWriter.Close()).To(Succeed())
+	Expect(gzipWriter.Close()).To(Succeed())
+	return buffer.Bytes()
+}
+
+func file(name string) *tar.Header {
+	return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}
+}
+
+func validate(body []byte) ([]byte, error) {
+	return io.ReadAll(archive.NewReader(io.NopCloser(bytes.NewReader(body)), true))
+}
+
+var _ = Describe("Validation", func() {
+	It("passes a valid archive through unchanged", func() {
+		body := gzippedTarball(
+			&tar.Header{Name: "app/", Typeflag: tar.TypeDir, Mode: 0755},
+			file("app/main.rb"),
+			&tar.Header{Name: "app/current", Typeflag: tar.TypeSymlink, Linkname: "main.rb"},
+			&tar.Header{Name: "app/copy", Typeflag: tar.TypeLink, Linkname: "app/main.rb"},
+		)
+
+		read, err := validate(body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(read).To(Equal(body))
+	})
+
+	It("accepts an empty archive", func() {
+		_, err := validate(gzippedTarball())
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	DescribeTable("rejecting invalid archives",
+		func(body func() []byte, reason string) {
+			_, err := validate(body())
+
+			var validationErr *archive.ValidationError
+			Expect(errors.As(err, &validationErr)).To(BeTrue())
+			Expect(validationErr.Reason).To(ContainSubstring(reason))
+		},
+		Entry("not gzipped", func() []byte { return []byte("not-an-archive") }, "not a gzip stream"),
+		Entry("gzipped but not a tarball", func() []byte {
+			buffer := &bytes.Buffer{}
+			gzipWriter := gzip.NewWriter(buffer)
+			gzipWriter.Write(bytes.Repeat([]byte("x"), 1024))
+			gzipWriter.Close()
+			return buffer.Bytes()
+		}, "malformed tar stream"),
+		Entry("truncated", func() []byte {
+			body := gzippedTarball(file("app/main.rb"))
+			return body[:len(body)-4]
+		}, "malformed gzip stream"),
+		Entry("an absolute path", func() []byte {
+			return gzippedTarball(file("/etc/passwd"))
+		}, "outside the archive root"),
+		Entry("a parent directory path", func() []byte {
+			return gzippedTarball(file("app/../../etc/passwd"))
+		}, "outside the archive root"),
+		Entry("a symlink escaping the root", func() []byte {
+			return gzippedTarball(&tar.Header{Name: "app/link", Typeflag: tar.TypeSymlink, Linkname: "../../etc/passwd"})
+		}, "points outside the archive root"),
+		Entry("an absolute symlink", func() []byte {
+			return gzippedTarball(&tar.Header{Name: "app/link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"})
+		}, "points outside the archive root"),
+		Entry("a hard link escaping the root", func() []byte {
+			return gzippedTarball(&tar.Header{Name: "app/link", Typeflag: tar.TypeLink, Linkname: "../etc/passwd"})
+		}, "points outside the archive root"),
+		Entry("a character device", func() []byte {
+			return gzippedTarball(&tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666})
+		}, "device file"),
+		Entry("a block device", func() []byte {
+			return gzippedTarball(&tar.Header{Name: "dev/sda", Typeflag: tar.TypeBlock, Mode: 0660})
+		}, "device file"),
+	)
+
+	It("stops passing data through once the archive is invalid", func() {
+		body := append(gzippedTarball(file("/etc/passwd")), bytes.Repeat([]byte{0}, 1024*1024)...)
+
+		read, err := validate(body)
+		Expect(err).To(HaveOccurred())
+		Expect(len(read)).To(BeNumerically("<", len(body)))
+	})
+
+	It("aborts a request streaming an invalid archive", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.ReadAll(r.Body)
+		}))
+		defer server.Close()
+
+		body := gzippedTarball(file("../escape"))
+		request, err := http.NewRequest("POST", server.URL, archive.NewReader(io.NopCloser(bytes.NewReader(body)), true))
+		Expect(err).NotTo(HaveOccurred())
+		request.ContentLength = int64(len(body))
+
+		_, err = http.DefaultClient.Do(request)
+		var validationErr *archive.ValidationError
+		Expect(errors.As(err, &validationErr)).To(BeTrue())
+	})
+
+	It("passes read errors from the body through", func() {
+		reader := archive.NewReader(io.NopCloser(io.MultiReader(
+			bytes.NewReader(gzippedTarball(file("app/main.rb"))[:20]),
+			&failingReader{err: io.ErrUnexpectedEOF},
+		)), true)
+
+		_, err := io.ReadAll(reader)
+		Expect(err).To(Equal(io.ErrUnexpectedEOF))
+	})
+})
+
+type failingReader struct {
+	err error
+}
+
+func (f *failingReader) Read([]byte) (int, error) {
+	return 0, f.err
+}
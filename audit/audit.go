@@ -0,0 +1,146 @@
+package audit
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/requestid"
+	"code.cloudfoundry.org/lager/v3"
+)
+
+const (
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+)
+
+// Record is the audit record of a single upload.
+type Record struct {
+	Timestamp       time.Time `json:"timestamp"`
+	ClientIdentity  string    `json:"client_identity,omitempty"`
+	Route           string    `json:"route"`
+	Guid            string    `json:"guid"`
+	DestinationHost string    `json:"destination_host"`
+	Size            int64     `json:"size"`
+	Digest          string    `json:"digest,omitempty"`
+	Duration        string    `json:"duration"`
+	Outcome         string    `json:"outcome"`
+	StatusCode      int       `json:"status_code"`
+	Error           string    `json:"error,omitempty"`
+	CCJobGuid       string    `json:"cc_job_guid,omitempty"`
+	RequestID       string    `json:"request_id,omitempty"`
+}
+
+// Sink stores audit records.
+//
+//go:generate counterfeiter -o fake_audit/fake_sink.go . Sink
+type Sink interface {
+	Write(record Record) error
+}
+
+// Auditor writes an audit record for every upload to a sink, independently
+// of the log level. Auditing is off when the Auditor is nil: Begin then
+// returns a nil *Entry, whose methods do nothing.
+type Auditor struct {
+	logger lager.Logger
+	sink   Sink
+}
+
+func New(logger lager.Logger, sink Sink) *Auditor {
+	return &Auditor{
+		logger: logger.Session("audit"),
+		sink:   sink,
+	}
+}
+
+// Begin starts the audit record of an upload of r to uploadURL.
+func (a *Auditor) Begin(r *http.Request, route, guid string, uploadURL *url.URL) *Entry {
+	if a == nil {
+		return nil
+	}
+
+	return &Entry{
+		auditor: a,
+		logger:  a.logger.WithData(requestid.Data(r.Context())),
+		record: Record{
+			Timestamp:       time.Now(),
+			ClientIdentity:  clientIdentity(r),
+			Route:           route,
+			Guid:            guid,
+			DestinationHost: uploadURL.Host,
+			Digest:          digest(r),
+			RequestID:       requestid.FromContext(r.Context()),
+		},
+	}
+}
+
+// Entry collects the audit record of an upload in progress.
+type Entry struct {
+	auditor *Auditor
+	logger  lager.Logger
+
+	lock     sync.Mutex
+	record   Record
+	finished bool
+}
+
+// SetCCJobGuid records the CC job that processes the upload.
+func (e *Entry) SetCCJobGuid(guid string) {
+	if e == nil {
+		return
+	}
+
+	e.lock.Lock()
+	e.record.CCJobGuid = guid
+	e.lock.Unlock()
+}
+
+// Finish writes the record with the outcome of the upload. Only the first
+// call has an effect.
+func (e *Entry) Finish(statusCode int, message string, size int64) {
+	if e == nil {
+		return
+	}
+
+	e.lock.Lock()
+	if e.finished {
+		e.lock.Unlock()
+		return
+	}
+	e.finished = true
+
+	record := e.record
+	e.lock.Unlock()
+
+	record.Duration = time.Since(record.Timestamp).String()
+	record.Size = size
+	record.StatusCode = statusCode
+	record.Outcome = OutcomeSucceeded
+	if statusCode >= http.StatusBadRequest {
+		record.Outcome = OutcomeFailed
+		record.Error = message
+	}
+
+	err := e.auditor.sink.Write(record)
+	if err != nil {
+		e.logger.Error("failed-writing-record", err, lager.Data{"route": record.Route, "guid": record.Guid})
+	}
+}
+
+func clientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.String()
+}
+
+func digest(r *http.Request) string {
+	if digest := r.Header.Get("Content-Digest"); digest != "" {
+		return digest
+	}
+	if md5 := r.Header.Get("Content-MD5"); md5 != "" {
+		return "md5=" + md5
+	}
+	return ""
+}
@@ -0,0 +1,102 @@
+package audit_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/audit"
+	"code.cloudfoundry.org/cc-uploader/audit/fake_audit"
+	"code.cloudfoundry.org/cc-uploader/requestid"
+	"code.cloudfoundry.org/lager/v3/lagertest"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("Auditor", func() {
+	var (
+		logger    *lagertest.TestLogger
+		sink      *fake_audit.FakeSink
+		auditor   *audit.Auditor
+		request   *http.Request
+		uploadURL *url.URL
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		sink = &fake_audit.FakeSink{}
+		auditor = audit.New(logger, sink)
+
+		ctx := requestid.NewContext(context.Background(), "request-id")
+		request, _ = http.NewRequestWithContext(ctx, "POST", "http://cc-uploader.example.com/v1/droplet/some-guid", nil)
+		request.Header.Set("Content-Digest", "sha-256=:abc=:")
+		request.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "stager", Organization: []string{"Cloud Foundry"}}}},
+		}
+		uploadURL, _ = url.Parse("https://cc.example.com:9023/staging/droplets/some-guid/upload")
+	})
+
+	It("writes a record once the upload is finished", func() {
+		entry := auditor.Begin(request, "UploadDroplet", "some-guid", uploadURL)
+		entry.SetCCJobGuid("job-guid")
+		Expect(sink.WriteCallCount()).To(Equal(0))
+
+		entry.Finish(http.StatusCreated, "", 1024)
+
+		Expect(sink.WriteCallCount()).To(Equal(1))
+		record := sink.WriteArgsForCall(0)
+		Expect(record.Timestamp).To(BeTemporally("~", time.Now(), time.Second))
+		Expect(record.ClientIdentity).To(Equal("CN=stager,O=Cloud Foundry"))
+		Expect(record.Route).To(Equal("UploadDroplet"))
+		Expect(record.Guid).To(Equal("some-guid"))
+		Expect(record.DestinationHost).To(Equal("cc.example.com:9023"))
+		Expect(record.Size).To(Equal(int64(1024)))
+		Expect(record.Digest).To(Equal("sha-256=:abc=:"))
+		Expect(record.Duration).NotTo(BeEmpty())
+		Expect(record.Outcome).To(Equal(audit.OutcomeSucceeded))
+		Expect(record.StatusCode).To(Equal(http.StatusCreated))
+		Expect(record.Error).To(BeEmpty())
+		Expect(record.CCJobGuid).To(Equal("job-guid"))
+		Expect(record.RequestID).To(Equal("request-id"))
+	})
+
+	It("records failures with their error", func() {
+		entry := auditor.Begin(request, "UploadDroplet", "some-guid", uploadURL)
+		entry.Finish(http.StatusBadGateway, "cc is down", 0)
+
+		record := sink.WriteArgsForCall(0)
+		Expect(record.Outcome).To(Equal(audit.OutcomeFailed))
+		Expect(record.Error).To(Equal("cc is down"))
+	})
+
+	It("only writes the first outcome", func() {
+		entry := auditor.Begin(request, "UploadDroplet", "some-guid", uploadURL)
+		entry.Finish(http.StatusCreated, "", 0)
+		entry.Finish(http.StatusInternalServerError, "too late", 0)
+
+		Expect(sink.WriteCallCount()).To(Equal(1))
+	})
+
+	It("logs records that cannot be written", func() {
+		sink.WriteReturns(errors.New("disk full"))
+
+		auditor.Begin(request, "UploadDroplet", "some-guid", uploadURL).Finish(http.StatusCreated, "", 0)
+
+		Expect(logger).To(gbytes.Say("failed-writing-record"))
+	})
+
+	It("does nothing when it is nil", func() {
+		var nilAuditor *audit.Auditor
+		entry := nilAuditor.Begin(request, "UploadDroplet", "some-guid", uploadURL)
+		Expect(entry).To(BeNil())
+
+		entry.SetCCJobGuid("job-guid")
+		entry.Finish(http.StatusCreated, "", 0)
+	})
+})
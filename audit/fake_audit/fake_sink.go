@@ -0,0 +1,53 @@
+// This file was generated by counterfeiter
+package fake_audit
+
+import (
+	"sync"
+
+	"code.cloudfoundry.org/cc-uploader/audit"
+)
+
+type FakeSink struct {
+	WriteStub        func(record audit.Record) error
+	writeMutex       sync.RWMutex
+	writeArgsForCall []struct {
+		record audit.Record
+	}
+	writeReturns struct {
+		result1 error
+	}
+}
+
+func (fake *FakeSink) Write(record audit.Record) error {
+	fake.writeMutex.Lock()
+	fake.writeArgsForCall = append(fake.writeArgsForCall, struct {
+		record audit.Record
+	}{record})
+	fake.writeMutex.Unlock()
+	if fake.WriteStub != nil {
+		return fake.WriteStub(record)
+	} else {
+		return fake.writeReturns.result1
+	}
+}
+
+func (fake *FakeSink) WriteCallCount() int {
+	fake.writeMutex.RLock()
+	defer fake.writeMutex.RUnlock()
+	return len(fake.writeArgsForCall)
+}
+
+func (fake *FakeSink) WriteArgsForCall(i int) audit.Record {
+	fake.writeMutex.RLock()
+	defer fake.writeMutex.RUnlock()
+	return fake.writeArgsForCall[i].record
+}
+
+func (fake *FakeSink) WriteReturns(result1 error) {
+	fake.WriteStub = nil
+	fake.writeReturns = struct {
+		result1 error
+	}{result1}
+}
+
+var _ audit.Sink = new(FakeSink)
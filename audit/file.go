@@ -0,0 +1,124 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+type fileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewFileSink returns a sink that appends records as JSON lines to the file
+// at path, syncing every record to disk. Once the file reaches maxSize bytes
+// it is rotated to path.1, path.1 to path.2 and so on, keeping maxBackups
+// old files. A maxSize of zero disables rotation.
+func NewFileSink(path string, maxSize int64, maxBackups int) (Sink, error) {
+	sink := &fileSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	err := sink.open()
+	if err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (s *fileSink) open() error {
+	file, size, err := openAppending(s.path)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	s.size = size
+	return nil
+}
+
+func openAppending(path string) (*os.File, int64, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+func (s *fileSink) Write(record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var rotateErr error
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		rotateErr = s.rotate()
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	return errors.Join(rotateErr, err)
+}
+
+// rotate moves the full file out of the way and opens a new one at path.
+// If the file cannot be moved, path still holds it and it is reopened, so
+// that records keep being written to it, past maxSize, until a later
+// rotation succeeds. The current file is only closed once path has been
+// opened, so that a failure to open it does not stop the records.
+func (s *fileSink) rotate() error {
+	moveErr := s.moveToBackups()
+	if moveErr != nil {
+		moveErr = fmt.Errorf("rotating %s: %w", s.path, moveErr)
+	}
+
+	file, size, err := openAppending(s.path)
+	if err != nil {
+		return errors.Join(moveErr, fmt.Errorf("reopening %s: %w", s.path, err))
+	}
+
+	s.file.Close()
+	s.file = file
+	s.size = size
+	return moveErr
+}
+
+func (s *fileSink) moveToBackups() error {
+	if s.maxBackups == 0 {
+		return os.Remove(s.path)
+	}
+
+	for i := s.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(backupPath(s.path, i), backupPath(s.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(s.path, backupPath(s.path, 1))
+}
+
+func backupPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
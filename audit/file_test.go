@@ -0,0 +1,127 @@
+package audit_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/cc-uploader/audit"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func readRecords(path string) []audit.Record {
+	file, err := os.Open(path)
+	Expect(err).NotTo(HaveOccurred())
+	defer file.Close()
+
+	records := []audit.Record{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record audit.Record
+		Expect(json.Unmarshal(scanner.Bytes(), &record)).To(Succeed())
+		records = append(records, record)
+	}
+	Expect(scanner.Err()).NotTo(HaveOccurred())
+	return records
+}
+
+var _ = Describe("FileSink", func() {
+	var path string
+
+	BeforeEach(func() {
+		path = filepath.Join(GinkgoT().TempDir(), "audit.log")
+	})
+
+	It("appends records as JSON lines", func() {
+		sink, err := audit.NewFileSink(path, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(sink.Write(audit.Record{Guid: "first"})).To(Succeed())
+		Expect(sink.Write(audit.Record{Guid: "second"})).To(Succeed())
+
+		records := readRecords(path)
+		Expect(records).To(HaveLen(2))
+		Expect(records[0].Guid).To(Equal("first"))
+		Expect(records[1].Guid).To(Equal("second"))
+	})
+
+	It("appends to an existing file", func() {
+		Expect(os.WriteFile(path, []byte(`{"guid":"existing"}`+"\n"), 0600)).To(Succeed())
+
+		sink, err := audit.NewFileSink(path, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sink.Write(audit.Record{Guid: "new"})).To(Succeed())
+
+		Expect(readRecords(path)).To(HaveLen(2))
+	})
+
+	It("rotates the file once it is full, keeping the configured number of backups", func() {
+		line, _ := json.Marshal(audit.Record{Guid: "record-0"})
+		sink, err := audit.NewFileSink(path, int64(len(line)+1)*2, 2)
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, guid := range []string{"record-0", "record-1", "record-2", "record-3", "record-4", "record-5", "record-6"} {
+			Expect(sink.Write(audit.Record{Guid: guid})).To(Succeed())
+		}
+
+		guids := func(path string) []string {
+			result := []string{}
+			for _, record := range readRecords(path) {
+				result = append(result, record.Guid)
+			}
+			return result
+		}
+		Expect(guids(path)).To(Equal([]string{"record-6"}))
+		Expect(guids(path + ".1")).To(Equal([]string{"record-4", "record-5"}))
+		Expect(guids(path + ".2")).To(Equal([]string{"record-2", "record-3"}))
+		Expect(path + ".3").NotTo(BeAnExistingFile())
+	})
+
+	It("keeps writing to the original file if it cannot be rotated", func() {
+		line, _ := json.Marshal(audit.Record{Guid: "record-0"})
+		sink, err := audit.NewFileSink(path, int64(len(line)+1), 1)
+		Expect(err).NotTo(HaveOccurred())
+
+		// a non-empty directory cannot be replaced by the rotated file
+		Expect(os.MkdirAll(filepath.Join(path+".1", "blocker"), 0700)).To(Succeed())
+
+		Expect(sink.Write(audit.Record{Guid: "record-0"})).To(Succeed())
+		Expect(sink.Write(audit.Record{Guid: "record-1"})).To(MatchError(ContainSubstring("rotating")))
+		Expect(sink.Write(audit.Record{Guid: "record-2"})).To(MatchError(ContainSubstring("rotating")))
+		Expect(readRecords(path)).To(HaveLen(3))
+
+		Expect(os.RemoveAll(path + ".1")).To(Succeed())
+		Expect(sink.Write(audit.Record{Guid: "record-3"})).To(Succeed())
+		Expect(readRecords(path)).To(HaveLen(1))
+		Expect(readRecords(path + ".1")).To(HaveLen(3))
+	})
+
+	It("keeps writing to the current file until the new one can be opened", func() {
+		dir := filepath.Join(GinkgoT().TempDir(), "audit")
+		Expect(os.Mkdir(dir, 0700)).To(Succeed())
+		path = filepath.Join(dir, "audit.log")
+
+		line, _ := json.Marshal(audit.Record{Guid: "record-0"})
+		sink, err := audit.NewFileSink(path, int64(len(line)+1), 1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sink.Write(audit.Record{Guid: "record-0"})).To(Succeed())
+
+		Expect(os.RemoveAll(dir)).To(Succeed())
+		Expect(sink.Write(audit.Record{Guid: "record-1"})).To(MatchError(ContainSubstring("reopening")))
+		Expect(sink.Write(audit.Record{Guid: "record-2"})).To(MatchError(Not(ContainSubstring("closed"))))
+
+		Expect(os.Mkdir(dir, 0700)).To(Succeed())
+		Expect(sink.Write(audit.Record{Guid: "record-3"})).To(MatchError(ContainSubstring("rotating")))
+		Expect(readRecords(path)).To(HaveLen(1))
+		Expect(sink.Write(audit.Record{Guid: "record-4"})).To(Succeed())
+		Expect(readRecords(path)).To(HaveLen(1))
+		Expect(readRecords(path + ".1")).To(HaveLen(1))
+	})
+
+	It("fails if the file cannot be opened", func() {
+		_, err := audit.NewFileSink(filepath.Join(path, "missing", "audit.log"), 0, 0)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,28 @@
+package audit
+
+import (
+	"encoding/json"
+	"log/syslog"
+)
+
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogSink returns a sink that sends records as JSON to syslog with
+// the given tag. An empty network and address use the local syslog daemon.
+func NewSyslogSink(network, address, tag string) (Sink, error) {
+	writer, err := syslog.Dial(network, address, syslog.LOG_NOTICE|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) Write(record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.writer.Notice(string(line))
+}
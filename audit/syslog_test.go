@@ -0,0 +1,27 @@
+package audit_test
+
+import (
+	"net"
+
+	"code.cloudfoundry.org/cc-uploader/audit"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SyslogSink", func() {
+	It("sends each record as a JSON message", func() {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		sink, err := audit.NewSyslogSink("udp", conn.LocalAddr().String(), "cc-uploader-audit")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(sink.Write(audit.Record{Guid: "some-guid", Outcome: audit.OutcomeSucceeded})).To(Succeed())
+
+		buffer := make([]byte, 4096)
+		n, _, err := conn.ReadFrom(buffer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(buffer[:n])).To(MatchRegexp(`^<37>.*cc-uploader-audit\[\d+\]: \{.*"guid":"some-guid".*"outcome":"succeeded".*\}`))
+	})
+})
@@ -1,20 +1,36 @@
 package ccclient
 
 import (
+	"context"
 	"net/http"
 	"net/url"
 )
 
 //go:generate counterfeiter -o fake_ccclient/fake_uploader.go . Uploader
 type Uploader interface {
-	Upload(uploadURL *url.URL, filename string, r *http.Request, cancelChan <-chan struct{}) (*http.Response, error)
+	Upload(ctx context.Context, uploadURL *url.URL, options UploadOptions, r *http.Request) (*http.Response, error)
+}
+
+// UploadOptions describes the multipart form an upload is sent to CC in.
+// Filename and ContentType describe the form file; ContentType defaults to
+// DefaultContentType. Fields are sent ahead of the file and are included in
+// the Content-Length. Async asks the CC
+// destination to add async=true to the upload URI, so that CC processes the
+// upload in a background job; the other destinations ignore it.
+type UploadOptions struct {
+	Filename    string
+	ContentType string
+	Fields      map[string]string
+	Async       bool
 }
 
 //go:generate counterfeiter -o fake_ccclient/fake_poller.go . Poller
 type Poller interface {
-	Poll(fallbackURL *url.URL, res *http.Response, cancelChan <-chan struct{}) error
+	Poll(ctx context.Context, fallbackURL *url.URL, res *http.Response, onStatus func(JobStatus)) error
 }
 
-type requestCanceller interface {
-	CancelRequest(req *http.Request)
+// JobStatus is the state of a CC background job as seen by a single poll.
+type JobStatus struct {
+	Guid   string `json:"guid"`
+	Status string `json:"status"`
 }
@@ -2,6 +2,7 @@
 package fake_ccclient
 
 import (
+	"context"
 	"net/http"
 	"net/url"
 	"sync"
@@ -10,28 +11,30 @@ import (
 )
 
 type FakePoller struct {
-	PollStub        func(fallbackURL *url.URL, res *http.Response, cancelChan <-chan struct{}) error
+	PollStub        func(ctx context.Context, fallbackURL *url.URL, res *http.Response, onStatus func(ccclient.JobStatus)) error
 	pollMutex       sync.RWMutex
 	pollArgsForCall []struct {
+		ctx         context.Context
 		fallbackURL *url.URL
 		res         *http.Response
-		cancelChan  <-chan struct{}
+		onStatus    func(ccclient.JobStatus)
 	}
 	pollReturns struct {
 		result1 error
 	}
 }
 
-func (fake *FakePoller) Poll(fallbackURL *url.URL, res *http.Response, cancelChan <-chan struct{}) error {
+func (fake *FakePoller) Poll(ctx context.Context, fallbackURL *url.URL, res *http.Response, onStatus func(ccclient.JobStatus)) error {
 	fake.pollMutex.Lock()
 	fake.pollArgsForCall = append(fake.pollArgsForCall, struct {
+		ctx         context.Context
 		fallbackURL *url.URL
 		res         *http.Response
-		cancelChan  <-chan struct{}
-	}{fallbackURL, res, cancelChan})
+		onStatus    func(ccclient.JobStatus)
+	}{ctx, fallbackURL, res, onStatus})
 	fake.pollMutex.Unlock()
 	if fake.PollStub != nil {
-		return fake.PollStub(fallbackURL, res, cancelChan)
+		return fake.PollStub(ctx, fallbackURL, res, onStatus)
 	} else {
 		return fake.pollReturns.result1
 	}
@@ -43,10 +46,10 @@ func (fake *FakePoller) PollCallCount() int {
 	return len(fake.pollArgsForCall)
 }
 
-func (fake *FakePoller) PollArgsForCall(i int) (*url.URL, *http.Response, <-chan struct{}) {
+func (fake *FakePoller) PollArgsForCall(i int) (context.Context, *url.URL, *http.Response, func(ccclient.JobStatus)) {
 	fake.pollMutex.RLock()
 	defer fake.pollMutex.RUnlock()
-	return fake.pollArgsForCall[i].fallbackURL, fake.pollArgsForCall[i].res, fake.pollArgsForCall[i].cancelChan
+	return fake.pollArgsForCall[i].ctx, fake.pollArgsForCall[i].fallbackURL, fake.pollArgsForCall[i].res, fake.pollArgsForCall[i].onStatus
 }
 
 func (fake *FakePoller) PollReturns(result1 error) {
@@ -2,6 +2,7 @@
 package fake_ccclient
 
 import (
+	"context"
 	"net/http"
 	"net/url"
 	"sync"
@@ -10,13 +11,13 @@ import (
 )
 
 type FakeUploader struct {
-	UploadStub        func(uploadURL *url.URL, filename string, r *http.Request, cancelChan <-chan struct{}) (*http.Response, error)
+	UploadStub        func(ctx context.Context, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error)
 	uploadMutex       sync.RWMutex
 	uploadArgsForCall []struct {
-		uploadURL  *url.URL
-		filename   string
-		r          *http.Request
-		cancelChan <-chan struct{}
+		ctx       context.Context
+		uploadURL *url.URL
+		options   ccclient.UploadOptions
+		r         *http.Request
 	}
 	uploadReturns struct {
 		result1 *http.Response
@@ -24,17 +25,17 @@ type FakeUploader struct {
 	}
 }
 
-func (fake *FakeUploader) Upload(uploadURL *url.URL, filename string, r *http.Request, cancelChan <-chan struct{}) (*http.Response, error) {
+func (fake *FakeUploader) Upload(ctx context.Context, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
 	fake.uploadMutex.Lock()
 	fake.uploadArgsForCall = append(fake.uploadArgsForCall, struct {
-		uploadURL  *url.URL
-		filename   string
-		r          *http.Request
-		cancelChan <-chan struct{}
-	}{uploadURL, filename, r, cancelChan})
+		ctx       context.Context
+		uploadURL *url.URL
+		options   ccclient.UploadOptions
+		r         *http.Request
+	}{ctx, uploadURL, options, r})
 	fake.uploadMutex.Unlock()
 	if fake.UploadStub != nil {
-		return fake.UploadStub(uploadURL, filename, r, cancelChan)
+		return fake.UploadStub(ctx, uploadURL, options, r)
 	} else {
 		return fake.uploadReturns.result1, fake.uploadReturns.result2
 	}
@@ -46,10 +47,10 @@ func (fake *FakeUploader) UploadCallCount() int {
 	return len(fake.uploadArgsForCall)
 }
 
-func (fake *FakeUploader) UploadArgsForCall(i int) (*url.URL, string, *http.Request, <-chan struct{}) {
+func (fake *FakeUploader) UploadArgsForCall(i int) (context.Context, *url.URL, ccclient.UploadOptions, *http.Request) {
 	fake.uploadMutex.RLock()
 	defer fake.uploadMutex.RUnlock()
-	return fake.uploadArgsForCall[i].uploadURL, fake.uploadArgsForCall[i].filename, fake.uploadArgsForCall[i].r, fake.uploadArgsForCall[i].cancelChan
+	return fake.uploadArgsForCall[i].ctx, fake.uploadArgsForCall[i].uploadURL, fake.uploadArgsForCall[i].options, fake.uploadArgsForCall[i].r
 }
 
 func (fake *FakeUploader) UploadReturns(result1 *http.Response, result2 error) {
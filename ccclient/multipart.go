@@ -2,19 +2,24 @@ package ccclient
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"sort"
 )
 
 // FILE UPLOAD HELPERS
 
 const FormField = "file"
 
-func newMultipartRequestFromReader(contentLength int64, body io.Reader, fileName string) (*http.Request, error) {
+const DefaultContentType = "application/octet-stream"
+
+func newMultipartRequestFromReader(ctx context.Context, contentLength int64, body io.Reader, options UploadOptions) (*http.Request, error) {
 	pipeReader, pipeWriter := io.Pipe()
 
-	multipartLength, multipartBoundary, err := computeMultipartFormLength(fileName)
+	multipartLength, multipartBoundary, err := computeMultipartFormLength(options)
 	if err != nil {
 		return nil, err
 	}
@@ -27,7 +32,12 @@ func newMultipartRequestFromReader(contentLength int64, body io.Reader, fileName
 			pipeWriter.CloseWithError(err)
 		}()
 
-		filePartWriter, err := multipartWriter.CreateFormFile(FormField, fileName)
+		err = writeFields(multipartWriter, options.Fields)
+		if err != nil {
+			return
+		}
+
+		filePartWriter, err := createFormFile(multipartWriter, options)
 		if err != nil {
 			return
 		}
@@ -40,7 +50,7 @@ func newMultipartRequestFromReader(contentLength int64, body io.Reader, fileName
 		err = multipartWriter.Close()
 	}()
 
-	uploadReq, err := http.NewRequest("POST", "", pipeReader)
+	uploadReq, err := http.NewRequestWithContext(ctx, "POST", "", pipeReader)
 	if err != nil {
 		return nil, err
 	}
@@ -51,11 +61,42 @@ func newMultipartRequestFromReader(contentLength int64, body io.Reader, fileName
 	return uploadReq, nil
 }
 
-//computes the length of the multi-part form request, minus the content of the form itself
-func computeMultipartFormLength(fileName string) (int64, string, error) {
+func createFormFile(multipartWriter *multipart.Writer, options UploadOptions) (io.Writer, error) {
+	contentType := options.ContentType
+	if contentType == "" {
+		contentType = DefaultContentType
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", multipart.FileContentDisposition(FormField, options.Filename))
+	header.Set("Content-Type", contentType)
+	return multipartWriter.CreatePart(header)
+}
+
+func writeFields(multipartWriter *multipart.Writer, fields map[string]string) error {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		err := multipartWriter.WriteField(name, fields[name])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//computes the length of the multi-part form request, minus the content of the form file itself
+func computeMultipartFormLength(options UploadOptions) (int64, string, error) {
 	multipartBuffer := &bytes.Buffer{}
 	multipartWriter := multipart.NewWriter(multipartBuffer)
-	_, err := multipartWriter.CreateFormFile(FormField, fileName)
+	err := writeFields(multipartWriter, options.Fields)
+	if err == nil {
+		_, err = createFormFile(multipartWriter, options)
+	}
 	multipartWriter.Close()
 
 	return int64(multipartBuffer.Len()), multipartWriter.Boundary(), err
@@ -1,12 +1,15 @@
 package ccclient
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 	"time"
 
+	"code.cloudfoundry.org/cc-uploader/metrics"
+	"code.cloudfoundry.org/cc-uploader/requestid"
 	"code.cloudfoundry.org/lager/v3"
 )
 
@@ -17,6 +20,12 @@ const (
 	JOB_FINISHED = "finished"
 )
 
+const (
+	PollRequestsCounter = "CCPollRequests"
+	PollFailuresCounter = "CCPollFailures"
+	PollRequestDuration = "CCPollRequestDuration"
+)
+
 type poller struct {
 	logger lager.Logger
 
@@ -32,10 +41,15 @@ func NewPoller(logger lager.Logger, httpClient *http.Client, pollInterval time.D
 	}
 }
 
-func (p *poller) Poll(fallbackURL *url.URL, res *http.Response, cancelChan <-chan struct{}) error {
+// Poll follows the CC background job described by res until it finishes,
+// fails or ctx is done. If onStatus is not nil it is called with
+// every status that is read, including the initial one.
+func (p *poller) Poll(ctx context.Context, fallbackURL *url.URL, res *http.Response, onStatus func(JobStatus)) error {
+	logger := p.logger.WithData(requestid.Data(ctx))
+
 	body, err := p.parsePollingResponse(res)
 	if err != nil {
-		p.logger.Error("failed-parsing-polling-response", err)
+		logger.Error("failed-parsing-polling-response", err)
 		return err
 	}
 
@@ -43,21 +57,24 @@ func (p *poller) Poll(fallbackURL *url.URL, res *http.Response, cancelChan <-cha
 	defer ticker.Stop()
 
 	for i := 0; ; i++ {
-		p.logger.Info("checking-cc-job-status", lager.Data{"attempt-number": i, "status": body.Entity.Status})
+		logger.Info("checking-cc-job-status", lager.Data{"attempt-number": i, "status": body.Entity.Status})
+		if onStatus != nil {
+			onStatus(JobStatus{Guid: body.Metadata.Guid, Status: body.Entity.Status})
+		}
 
 		switch body.Entity.Status {
 		case JOB_QUEUED, JOB_RUNNING:
-			p.logger.Info("cc-job-queued-or-running", lager.Data{"status": body.Entity.Status})
+			logger.Info("cc-job-queued-or-running", lager.Data{"status": body.Entity.Status})
 		case JOB_FINISHED:
-			p.logger.Info("cc-job-finished")
+			logger.Info("cc-job-finished")
 			return nil
 		case JOB_FAILED:
 			err := fmt.Errorf("upload job failed")
-			p.logger.Error("cc-job-failed", err)
+			logger.Error("cc-job-failed", err)
 			return err
 		default:
 			err := fmt.Errorf("unknown job status: %s", body.Entity.Status)
-			p.logger.Error("cc-job-unknown-status", err)
+			logger.Error("cc-job-unknown-status", err)
 			return err
 		}
 
@@ -65,7 +82,7 @@ func (p *poller) Poll(fallbackURL *url.URL, res *http.Response, cancelChan <-cha
 		case <-ticker.C:
 			pollingUrl, err := url.Parse(body.Metadata.Url)
 			if err != nil {
-				p.logger.Error("failed-parsing-url", err, lager.Data{"url": body.Metadata.Url})
+				logger.Error("failed-parsing-url", err, lager.Data{"url": body.Metadata.Url})
 				return err
 			}
 
@@ -74,42 +91,33 @@ func (p *poller) Poll(fallbackURL *url.URL, res *http.Response, cancelChan <-cha
 				pollingUrl.Host = fallbackURL.Host
 			}
 
-			req, err := http.NewRequest("GET", pollingUrl.String(), nil)
+			req, err := http.NewRequestWithContext(ctx, "GET", pollingUrl.String(), nil)
 			if err != nil {
-				p.logger.Error("failed-generating-request", err, lager.Data{"url": pollingUrl.String()})
+				logger.Error("failed-generating-request", err, lager.Data{"url": pollingUrl.String()})
 				return err
 			}
+			requestid.Forward(req)
 
-			completion := make(chan struct{})
-			go func() {
-				select {
-				case <-cancelChan:
-					if canceller, ok := p.client.Transport.(requestCanceller); ok {
-						canceller.CancelRequest(req)
-					} else {
-						p.logger.Error("Invalid transport, does not support CancelRequest", nil, lager.Data{"transport": p.client.Transport})
-					}
-				case <-completion:
-				}
-			}()
-
-			p.logger.Info("making-request-to-polling-endpoint")
+			logger.Info("making-request-to-polling-endpoint")
+			requestStart := time.Now()
 			res, err := p.client.Do(req)
-			close(completion)
+			metrics.IncrementCounter(PollRequestsCounter)
+			metrics.SendDuration(PollRequestDuration, time.Since(requestStart))
 			if err != nil {
-				p.logger.Error("failed-making-request-to-polling-endpoint", err)
+				metrics.IncrementCounter(PollFailuresCounter)
+				logger.Error("failed-making-request-to-polling-endpoint", err)
 				return err
 			}
-			p.logger.Info("succeeded-making-request-to-polling-endpoint")
+			logger.Info("succeeded-making-request-to-polling-endpoint")
 
 			body, err = p.parsePollingResponse(res)
 			if err != nil {
-				p.logger.Error("failed-parsing-polling-response", err)
+				logger.Error("failed-parsing-polling-response", err)
 				return err
 			}
-		case <-cancelChan:
+		case <-ctx.Done():
 			err := fmt.Errorf("upstream request was cancelled")
-			p.logger.Error("upstream-request-cancelled", err)
+			logger.Error("upstream-request-cancelled", err)
 			return err
 		}
 	}
@@ -124,7 +132,8 @@ func (p *poller) parsePollingResponse(res *http.Response) (pollingResponseBody,
 
 type pollingResponseBody struct {
 	Metadata struct {
-		Url string
+		Guid string
+		Url  string
 	}
 	Entity struct {
 		Status string
@@ -2,6 +2,7 @@ package ccclient_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
@@ -11,6 +12,9 @@ import (
 
 	"code.cloudfoundry.org/cc-uploader/ccclient"
 	"code.cloudfoundry.org/cc-uploader/ccclient/test_helpers"
+	"code.cloudfoundry.org/cc-uploader/metrics"
+	"code.cloudfoundry.org/cc-uploader/metrics/fake_metrics"
+	"code.cloudfoundry.org/cc-uploader/requestid"
 	"code.cloudfoundry.org/lager/v3/lagertest"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -30,11 +34,14 @@ var _ = Describe("Poller", func() {
 
 			pollURL                *url.URL
 			originalUploadResponse *http.Response
-			closeChan              chan struct{}
+			ctx                    context.Context
+			cancel                 context.CancelFunc
+			statusChan             chan ccclient.JobStatus
 		)
 
 		BeforeEach(func() {
-			closeChan = make(chan struct{})
+			ctx, cancel = context.WithCancel(requestid.NewContext(context.Background(), "the-request-id"))
+			statusChan = make(chan ccclient.JobStatus, 10)
 		})
 
 		JustBeforeEach(func() {
@@ -45,7 +52,9 @@ var _ = Describe("Poller", func() {
 			pollErrChan = make(chan error, 1)
 			go func(pec chan error) {
 				defer GinkgoRecover()
-				pec <- u.Poll(pollURL, originalUploadResponse, closeChan)
+				pec <- u.Poll(ctx, pollURL, originalUploadResponse, func(status ccclient.JobStatus) {
+					statusChan <- status
+				})
 			}(pollErrChan)
 		})
 
@@ -97,14 +106,14 @@ var _ = Describe("Poller", func() {
 					jobStatus = ccclient.JOB_QUEUED
 				})
 
-				Context("when the cancel channel is written to", func() {
+				Context("when the context is cancelled", func() {
 					BeforeEach(func() {
 						originalUploadResponse = responseWithBody(pollingResponseBody("http://example.com", jobStatus))
 					})
 
 					Context("before the request is made", func() {
 						BeforeEach(func() {
-							close(closeChan)
+							cancel()
 						})
 
 						It("errors", func() {
@@ -113,23 +122,19 @@ var _ = Describe("Poller", func() {
 					})
 
 					Context("during a request", func() {
-						var cancelChan chan struct{}
-
 						BeforeEach(func() {
 							pollRequestChan = make(chan *http.Request)
-							cancelChan = make(chan struct{})
 							transport = test_helpers.NewFakeRoundTripper(
 								pollRequestChan,
 								map[string]test_helpers.RespErrorPair{
-									"example.com": {responseWithBody(pollingResponseBody("http://example.com", ccclient.JOB_QUEUED)), nil},
+									"example.com": {Resp: responseWithBody(pollingResponseBody("http://example.com", ccclient.JOB_QUEUED))},
 								},
 							)
 						})
 
 						It("errors", func() {
 							Eventually(pollRequestChan).Should(Receive())
-							close(cancelChan)
-							Eventually(pollRequestChan).Should(Receive())
+							cancel()
 							Eventually(pollErrChan).Should(Receive(HaveOccurred()))
 						})
 					})
@@ -146,19 +151,39 @@ var _ = Describe("Poller", func() {
 				})
 
 				Context("when the metadata URL includes a host", func() {
+					var emitter *fake_metrics.FakeEmitter
+
 					BeforeEach(func() {
+						emitter = &fake_metrics.FakeEmitter{}
+						metrics.Initialize(emitter)
 						originalUploadResponse = responseWithBody(pollingResponseBody("http://example.com", jobStatus))
 
 						pollRequestChan = make(chan *http.Request, 5)
 						transport = test_helpers.NewFakeRoundTripper(
 							pollRequestChan,
 							map[string]test_helpers.RespErrorPair{
-								"example.com":          {responseWithBody(pollingResponseBody("http://polling-endpoint.com", ccclient.JOB_QUEUED)), nil},
-								"polling-endpoint.com": {responseWithBody(pollingResponseBody("http://2nd-time.com", ccclient.JOB_FAILED)), nil},
+								"example.com":          {Resp: responseWithBody(pollingResponseBody("http://polling-endpoint.com", ccclient.JOB_QUEUED))},
+								"polling-endpoint.com": {Resp: responseWithBody(pollingResponseBody("http://2nd-time.com", ccclient.JOB_FAILED))},
 							},
 						)
 					})
 
+					AfterEach(func() {
+						metrics.Initialize(nil)
+					})
+
+					It("emits the polling requests' count and durations", func() {
+						Eventually(pollErrChan).Should(Receive(HaveOccurred()))
+
+						Expect(emitter.AddToCounterCallCount()).To(Equal(2))
+						name, delta := emitter.AddToCounterArgsForCall(1)
+						Expect(name).To(Equal(ccclient.PollRequestsCounter))
+						Expect(delta).To(Equal(uint64(1)))
+						Expect(emitter.SendDurationCallCount()).To(Equal(2))
+						name, _ = emitter.SendDurationArgsForCall(1)
+						Expect(name).To(Equal(ccclient.PollRequestDuration))
+					})
+
 					It("uses the metadata URL to make the request to the polling endpoint", func() {
 						var firstPollRequest *http.Request
 						Eventually(pollRequestChan).Should(Receive(&firstPollRequest))
@@ -168,6 +193,12 @@ var _ = Describe("Poller", func() {
 						Eventually(pollRequestChan).Should(Receive(&secondPollRequest))
 						Expect(secondPollRequest.URL.Host).To(Equal("polling-endpoint.com"))
 					})
+
+					It("forwards the request ID to the polling endpoint", func() {
+						var pollRequest *http.Request
+						Eventually(pollRequestChan).Should(Receive(&pollRequest))
+						Expect(pollRequest.Header.Get("X-Vcap-Request-Id")).To(Equal("the-request-id"))
+					})
 				})
 
 				Context("when the metadata URL is just a path", func() {
@@ -178,8 +209,8 @@ var _ = Describe("Poller", func() {
 						transport = test_helpers.NewFakeRoundTripper(
 							pollRequestChan,
 							map[string]test_helpers.RespErrorPair{
-								"fallback-url.com":     {responseWithBody(pollingResponseBody("http://polling-endpoint.com", ccclient.JOB_QUEUED)), nil},
-								"polling-endpoint.com": {responseWithBody(pollingResponseBody("http://2nd-time.com", ccclient.JOB_FAILED)), nil},
+								"fallback-url.com":     {Resp: responseWithBody(pollingResponseBody("http://polling-endpoint.com", ccclient.JOB_QUEUED))},
+								"polling-endpoint.com": {Resp: responseWithBody(pollingResponseBody("http://2nd-time.com", ccclient.JOB_FAILED))},
 							},
 						)
 
@@ -205,7 +236,7 @@ var _ = Describe("Poller", func() {
 						transport = test_helpers.NewFakeRoundTripper(
 							pollRequestChan,
 							map[string]test_helpers.RespErrorPair{
-								"example.com": {nil, errors.New("something bad")},
+								"example.com": {Err: errors.New("something bad")},
 							},
 						)
 					})
@@ -225,7 +256,7 @@ var _ = Describe("Poller", func() {
 						transport = test_helpers.NewFakeRoundTripper(
 							pollRequestChan,
 							map[string]test_helpers.RespErrorPair{
-								"example.com": {responseWithBody("garbage"), nil},
+								"example.com": {Resp: responseWithBody("garbage")},
 							},
 						)
 					})
@@ -243,11 +274,11 @@ var _ = Describe("Poller", func() {
 						transport = test_helpers.NewFakeRoundTripper(
 							pollRequestChan,
 							map[string]test_helpers.RespErrorPair{
-								"example.com": {responseWithBody(pollingResponseBody("http://1.com", ccclient.JOB_QUEUED)), nil},
-								"1.com":       {responseWithBody(pollingResponseBody("http://2.com", ccclient.JOB_RUNNING)), nil},
-								"2.com":       {responseWithBody(pollingResponseBody("http://3.com", ccclient.JOB_RUNNING)), nil},
-								"3.com":       {responseWithBody(pollingResponseBody("http://4.com", ccclient.JOB_RUNNING)), nil},
-								"4.com":       {responseWithBody("garbage"), nil},
+								"example.com": {Resp: responseWithBody(pollingResponseBody("http://1.com", ccclient.JOB_QUEUED))},
+								"1.com":       {Resp: responseWithBody(pollingResponseBody("http://2.com", ccclient.JOB_RUNNING))},
+								"2.com":       {Resp: responseWithBody(pollingResponseBody("http://3.com", ccclient.JOB_RUNNING))},
+								"3.com":       {Resp: responseWithBody(pollingResponseBody("http://4.com", ccclient.JOB_RUNNING))},
+								"4.com":       {Resp: responseWithBody("garbage")},
 							},
 						)
 					})
@@ -265,11 +296,11 @@ var _ = Describe("Poller", func() {
 						transport = test_helpers.NewFakeRoundTripper(
 							pollRequestChan,
 							map[string]test_helpers.RespErrorPair{
-								"example.com": {responseWithBody(pollingResponseBody("http://1.com", ccclient.JOB_QUEUED)), nil},
-								"1.com":       {responseWithBody(pollingResponseBody("http://2.com", ccclient.JOB_RUNNING)), nil},
-								"2.com":       {responseWithBody(pollingResponseBody("http://3.com", ccclient.JOB_RUNNING)), nil},
-								"3.com":       {responseWithBody(pollingResponseBody("http://4.com", ccclient.JOB_RUNNING)), nil},
-								"4.com":       {responseWithBody(pollingResponseBody("http://4.com", ccclient.JOB_FINISHED)), nil},
+								"example.com": {Resp: responseWithBody(pollingResponseBody("http://1.com", ccclient.JOB_QUEUED))},
+								"1.com":       {Resp: responseWithBody(pollingResponseBody("http://2.com", ccclient.JOB_RUNNING))},
+								"2.com":       {Resp: responseWithBody(pollingResponseBody("http://3.com", ccclient.JOB_RUNNING))},
+								"3.com":       {Resp: responseWithBody(pollingResponseBody("http://4.com", ccclient.JOB_RUNNING))},
+								"4.com":       {Resp: responseWithBody(pollingResponseBody("http://4.com", ccclient.JOB_FINISHED))},
 							},
 						)
 					})
@@ -277,6 +308,25 @@ var _ = Describe("Poller", func() {
 					It("returns with no error", func() {
 						Eventually(pollErrChan).Should(Receive(BeNil()))
 					})
+
+					It("reports every status it reads", func() {
+						Eventually(pollErrChan).Should(Receive(BeNil()))
+
+						statuses := []string{}
+						for len(statusChan) > 0 {
+							status := <-statusChan
+							Expect(status.Guid).To(Equal("job-guid"))
+							statuses = append(statuses, status.Status)
+						}
+						Expect(statuses).To(Equal([]string{
+							ccclient.JOB_QUEUED,
+							ccclient.JOB_QUEUED,
+							ccclient.JOB_RUNNING,
+							ccclient.JOB_RUNNING,
+							ccclient.JOB_RUNNING,
+							ccclient.JOB_FINISHED,
+						}))
+					})
 				})
 			})
 		})
@@ -291,5 +341,5 @@ func responseWithBody(body string) *http.Response {
 }
 
 func pollingResponseBody(url, status string) string {
-	return `{"metadata":{"url":"` + url + `"},"entity":{"status":"` + status + `"}}`
+	return `{"metadata":{"guid":"job-guid","url":"` + url + `"},"entity":{"status":"` + status + `"}}`
 }
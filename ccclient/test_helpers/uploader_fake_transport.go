@@ -1,9 +1,7 @@
 package test_helpers
 
 import (
-	"errors"
 	"net/http"
-	"sync"
 )
 
 type RespErrorPair struct {
@@ -11,48 +9,28 @@ type RespErrorPair struct {
 	Err  error
 }
 
+// fakeRoundTripper hands every request to reqChan and responds with the
+// pair for its host. Like a real transport, it gives up once the request's
+// context is done.
 type fakeRoundTripper struct {
 	reqChan chan *http.Request
 	respMap map[string]RespErrorPair
-
-	mu       sync.Mutex
-	requests map[*http.Request]chan struct{}
 }
 
 func (f *fakeRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
-	barrier := make(chan struct{})
-	f.mu.Lock()
-	f.requests[r] = barrier
 	pair := f.respMap[r.URL.Host]
-	f.mu.Unlock()
-
-	defer func() {
-		f.mu.Lock()
-		delete(f.requests, r)
-		f.mu.Unlock()
-	}()
 
 	select {
 	case f.reqChan <- r:
 		return pair.Resp, pair.Err
-	case <-barrier:
-		return nil, errors.New("cancelled")
-	}
-}
-
-func (f *fakeRoundTripper) CancelRequest(req *http.Request) {
-	f.mu.Lock()
-	barrier := f.requests[req]
-	f.mu.Unlock()
-
-	if barrier != nil {
-		close(barrier)
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
 	}
 }
 
 func NewFakeRoundTripper(reqChan chan *http.Request, responses map[string]RespErrorPair) *fakeRoundTripper {
 	return &fakeRoundTripper{
-		reqChan:  reqChan,
-		respMap:  responses,
-		requests: make(map[*http.Request]chan struct{})}
+		reqChan: reqChan,
+		respMap: responses,
+	}
 }
@@ -1,67 +1,92 @@
 package ccclient
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
 
+	"code.cloudfoundry.org/cc-uploader/metrics"
+	"code.cloudfoundry.org/cc-uploader/requestid"
 	"code.cloudfoundry.org/lager/v3"
 )
 
 const MAX_UPLOAD_RETRIES = 3
 
+const UploadRetriesCounter = "CCUploadRetries"
+
 type uploader struct {
-	logger    lager.Logger
-	client    *http.Client
-	tlsClient *http.Client
+	logger         lager.Logger
+	client         *http.Client
+	tlsClient      *http.Client
+	expectContinue bool
 }
 
-func NewUploader(logger lager.Logger, httpClient *http.Client) Uploader {
+// NewUploader returns an Uploader that streams uploads to CC through
+// httpClient. With expectContinue set, uploads are sent with
+// "Expect: 100-continue", so CC can reject them before the body is streamed;
+// httpClient's transport must then have an ExpectContinueTimeout.
+func NewUploader(logger lager.Logger, httpClient *http.Client, expectContinue bool) Uploader {
 	return &uploader{
-		client: httpClient,
-		logger: logger.Session("uploader"),
+		client:         httpClient,
+		logger:         logger.Session("uploader"),
+		expectContinue: expectContinue,
 	}
 }
 
 const contentMD5Header = "Content-MD5"
 const contentDigestHeader = "Content-Digest"
 
-func (u *uploader) Upload(uploadURL *url.URL, filename string, r *http.Request, cancelChan <-chan struct{}) (*http.Response, error) {
+func (u *uploader) Upload(ctx context.Context, uploadURL *url.URL, options UploadOptions, r *http.Request) (*http.Response, error) {
 	if r.ContentLength <= 0 {
 		return &http.Response{StatusCode: http.StatusLengthRequired}, fmt.Errorf("Missing Content Length")
 	}
 	defer r.Body.Close()
 
-	uploadReq, err := newMultipartRequestFromReader(r.ContentLength, r.Body, filename)
-	if err != nil {
-		return nil, err
-	}
-
-	uploadReq.Header.Set(contentMD5Header, r.Header.Get(contentMD5Header))
-	uploadReq.Header.Set(contentDigestHeader, r.Header.Get(contentDigestHeader))
-	uploadReq.URL = uploadURL
+	requestLogger := u.logger.WithData(requestid.Data(ctx))
 
 	var rsp *http.Response
 	var uploadErr error
 	for attempt := 0; attempt < MAX_UPLOAD_RETRIES; attempt++ {
-		logger := u.logger.WithData(lager.Data{"attempt-number": attempt})
+		logger := requestLogger.WithData(lager.Data{"attempt-number": attempt})
+		if attempt > 0 {
+			metrics.IncrementCounter(UploadRetriesCounter)
+		}
+
+		// each attempt streams through its own pipe, as the transport closes
+		// the request body when the attempt fails
+		body := &attemptBody{reader: r.Body}
+		uploadReq, err := newMultipartRequestFromReader(ctx, r.ContentLength, body, options)
+		if err != nil {
+			return nil, err
+		}
+
+		uploadReq.Header.Set(contentMD5Header, r.Header.Get(contentMD5Header))
+		uploadReq.Header.Set(contentDigestHeader, r.Header.Get(contentDigestHeader))
+		requestid.Forward(uploadReq)
+		if u.expectContinue {
+			uploadReq.Header.Set("Expect", "100-continue")
+		}
+		uploadReq.URL = uploadURL
+
 		logger.Info("uploading")
-		rsp, uploadErr = u.do(uploadReq, cancelChan)
+		rsp, uploadErr = u.do(uploadReq)
 		if uploadErr == nil {
 			logger.Info("succeeded-uploading")
 			break
 		}
 		logger.Error("failed-uploading", uploadErr)
 
-		// not a connect (dial) error
-		var nestedErr error = uploadErr
-		if urlErr, ok := nestedErr.(*url.Error); ok {
-			nestedErr = urlErr.Err
+		// once any of the body has been streamed it cannot be sent again
+		if body.end() {
+			break
 		}
 
-		if netErr, ok := nestedErr.(*net.OpError); !ok || netErr.Op != "dial" {
+		if !isDialError(uploadErr) && !u.rejectedBeforeBody(rsp) {
 			break
 		}
 	}
@@ -69,22 +94,57 @@ func (u *uploader) Upload(uploadURL *url.URL, filename string, r *http.Request,
 	return rsp, uploadErr
 }
 
-func (u *uploader) do(req *http.Request, cancelChan <-chan struct{}) (*http.Response, error) {
-	completion := make(chan struct{})
-	defer close(completion)
-
-	go func() {
-		select {
-		case <-cancelChan:
-			if canceller, ok := u.client.Transport.(requestCanceller); ok {
-				canceller.CancelRequest(req)
-			} else {
-				u.logger.Error("Invalid transport, does not support CancelRequest", nil, lager.Data{"transport": u.client.Transport})
-			}
-		case <-completion:
-		}
-	}()
+// rejectedBeforeBody reports whether CC answered the Expect: 100-continue
+// with a server error, which is worth retrying as the body was never sent.
+// Client errors (a bad signature, an unknown droplet) are final.
+func (u *uploader) rejectedBeforeBody(rsp *http.Response) bool {
+	return u.expectContinue && rsp != nil && rsp.StatusCode >= http.StatusInternalServerError
+}
+
+func isDialError(err error) bool {
+	var nestedErr error = err
+	if urlErr, ok := nestedErr.(*url.Error); ok {
+		nestedErr = urlErr.Err
+	}
+
+	netErr, ok := nestedErr.(*net.OpError)
+	return ok && netErr.Op == "dial"
+}
+
+// attemptBody passes reads through to the inbound body for a single upload
+// attempt. Once the attempt has ended no further reads reach the inbound
+// body, so it is known whether any of it was consumed.
+type attemptBody struct {
+	reader  io.Reader
+	lock    sync.Mutex
+	started bool
+	ended   bool
+}
+
+func (b *attemptBody) Read(p []byte) (int, error) {
+	b.lock.Lock()
+	if b.ended {
+		b.lock.Unlock()
+		return 0, errUploadAttemptEnded
+	}
+	b.started = true
+	b.lock.Unlock()
+
+	return b.reader.Read(p)
+}
+
+// end stops the attempt from reading the inbound body and reports whether it
+// had already started to.
+func (b *attemptBody) end() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.ended = true
+	return b.started
+}
+
+var errUploadAttemptEnded = errors.New("upload attempt ended")
 
+func (u *uploader) do(req *http.Request) (*http.Response, error) {
 	rsp, err := u.client.Do(req)
 
 	req.Body.Close()
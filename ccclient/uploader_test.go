@@ -2,14 +2,18 @@ package ccclient_test
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 
 	"code.cloudfoundry.org/cc-uploader/ccclient"
 	"code.cloudfoundry.org/cc-uploader/ccclient/test_helpers"
+	"code.cloudfoundry.org/cc-uploader/requestid"
 	"code.cloudfoundry.org/lager/v3/lagertest"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -28,13 +32,13 @@ var _ = Describe("Uploader", func() {
 			uploadErr error
 
 			uploadURL       *url.URL
-			filename        string
+			options         ccclient.UploadOptions
 			incomingRequest *http.Request
 		)
 
 		BeforeEach(func() {
 			uploadURL, _ = url.Parse("http://example.com")
-			filename = "filename"
+			options = ccclient.UploadOptions{Filename: "filename"}
 			incomingRequest = createValidRequest()
 		})
 
@@ -44,15 +48,16 @@ var _ = Describe("Uploader", func() {
 					Transport: transport,
 				}
 
-				u = ccclient.NewUploader(lagertest.NewTestLogger("test"), httpClient)
+				u = ccclient.NewUploader(lagertest.NewTestLogger("test"), httpClient, false)
 				fmt.Fprintf(GinkgoWriter, "Uploading to URL %s\n", uploadURL.String())
-				response, uploadErr = u.Upload(uploadURL, filename, incomingRequest, make(chan struct{}))
+				ctx := requestid.NewContext(context.Background(), "the-request-id")
+				response, uploadErr = u.Upload(ctx, uploadURL, options, incomingRequest)
 			})
 
 			Context("Validating the content length of the request", func() {
 				BeforeEach(func() {
 					transport = http.DefaultTransport
-					filename = "filename"
+					options = ccclient.UploadOptions{Filename: "filename"}
 					incomingRequest = &http.Request{}
 				})
 
@@ -71,7 +76,7 @@ var _ = Describe("Uploader", func() {
 					transport = test_helpers.NewFakeRoundTripper(
 						uploadRequestChan,
 						map[string]test_helpers.RespErrorPair{
-							"example.com": {responseWithCode(http.StatusOK), nil},
+							"example.com": {Resp: responseWithCode(http.StatusOK)},
 						},
 					)
 				})
@@ -94,6 +99,12 @@ var _ = Describe("Uploader", func() {
 					Expect(uploadRequest.Header.Get("Content-Digest")).To(Equal("the-digest"))
 				})
 
+				It("Forwards the request ID as X-Vcap-Request-Id onto the upload request", func() {
+					var uploadRequest *http.Request
+					Eventually(uploadRequestChan).Should(Receive(&uploadRequest))
+					Expect(uploadRequest.Header.Get("X-Vcap-Request-Id")).To(Equal("the-request-id"))
+				})
+
 				Context("When the upload URL has basic auth credentials", func() {
 					BeforeEach(func() {
 						uploadURL.User = url.UserPassword("bob", "cobb")
@@ -118,7 +129,7 @@ var _ = Describe("Uploader", func() {
 						transport = test_helpers.NewFakeRoundTripper(
 							uploadRequestChan,
 							map[string]test_helpers.RespErrorPair{
-								"example.com": {nil, &net.OpError{Op: "dial"}},
+								"example.com": {Err: &net.OpError{Op: "dial"}},
 							},
 						)
 					})
@@ -146,7 +157,7 @@ var _ = Describe("Uploader", func() {
 						transport = test_helpers.NewFakeRoundTripper(
 							uploadRequestChan,
 							map[string]test_helpers.RespErrorPair{
-								"example.com": {nil, &net.OpError{Op: "not-dial"}},
+								"example.com": {Err: &net.OpError{Op: "not-dial"}},
 							},
 						)
 					})
@@ -166,7 +177,7 @@ var _ = Describe("Uploader", func() {
 						transport = test_helpers.NewFakeRoundTripper(
 							uploadRequestChan,
 							map[string]test_helpers.RespErrorPair{
-								"example.com": {responseWithCode(http.StatusUnauthorized), nil},
+								"example.com": {Resp: responseWithCode(http.StatusUnauthorized)},
 							},
 						)
 					})
@@ -179,17 +190,18 @@ var _ = Describe("Uploader", func() {
 		})
 
 		Context("when cancelling uploads", func() {
-			var cancelChan chan struct{}
+			var ctx context.Context
+			var cancel context.CancelFunc
 			var uploadCompleted chan struct{}
 			var uploadRequestChan chan *http.Request
 
 			BeforeEach(func() {
-				cancelChan = make(chan struct{})
+				ctx, cancel = context.WithCancel(context.Background())
 				uploadRequestChan = make(chan *http.Request)
 				transport = test_helpers.NewFakeRoundTripper(
 					uploadRequestChan,
 					map[string]test_helpers.RespErrorPair{
-						"example.com": test_helpers.RespErrorPair{responseWithCode(http.StatusOK), nil},
+						"example.com": {Resp: responseWithCode(http.StatusOK)},
 					},
 				)
 			})
@@ -201,20 +213,148 @@ var _ = Describe("Uploader", func() {
 					httpClient := &http.Client{
 						Transport: transport,
 					}
-					u = ccclient.NewUploader(lagertest.NewTestLogger("test"), httpClient)
-					response, uploadErr = u.Upload(uploadURL, filename, incomingRequest, cancelChan)
+					u = ccclient.NewUploader(lagertest.NewTestLogger("test"), httpClient, false)
+					response, uploadErr = u.Upload(ctx, uploadURL, options, incomingRequest)
 					close(uploadCompleted)
 				}()
 			})
 
 			It("will fail with the uploadURL", func() {
 				Consistently(uploadCompleted).ShouldNot(BeClosed())
-				close(cancelChan)
+				cancel()
 
 				Eventually(uploadCompleted).Should(BeClosed())
 				Expect(uploadErr).To(HaveOccurred())
 			})
 		})
+
+		Context("when form fields and a content type are given", func() {
+			var server *httptest.Server
+			var form *multipart.Form
+			var fileContentType string
+			var contentLength int64
+			var bodyLength int
+
+			BeforeEach(func() {
+				server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					contentLength = r.ContentLength
+					body, err := io.ReadAll(r.Body)
+					Expect(err).NotTo(HaveOccurred())
+					bodyLength = len(body)
+
+					r.Body = io.NopCloser(bytes.NewReader(body))
+					Expect(r.ParseMultipartForm(1024)).To(Succeed())
+					form = r.MultipartForm
+					fileContentType = form.File[ccclient.FormField][0].Header.Get("Content-Type")
+				}))
+
+				uploadURL, _ = url.Parse(server.URL)
+				incomingRequest, _ = http.NewRequest("POST", "", bytes.NewBufferString("file-upload-contents"))
+				options = ccclient.UploadOptions{
+					Filename:    "app \"droplet\".tgz",
+					ContentType: "application/gzip",
+					Fields:      map[string]string{"stack": "cflinuxfs4", "build_guid": "some-build-guid"},
+				}
+			})
+
+			AfterEach(func() {
+				server.Close()
+			})
+
+			It("sends them with an exact Content-Length", func() {
+				u = ccclient.NewUploader(lagertest.NewTestLogger("test"), http.DefaultClient, false)
+				_, err := u.Upload(context.Background(), uploadURL, options, incomingRequest)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(contentLength).To(Equal(int64(bodyLength)))
+				Expect(form.Value).To(Equal(map[string][]string{
+					"stack":      {"cflinuxfs4"},
+					"build_guid": {"some-build-guid"},
+				}))
+				Expect(form.File[ccclient.FormField][0].Filename).To(Equal("app \"droplet\".tgz"))
+				Expect(fileContentType).To(Equal("application/gzip"))
+			})
+		})
+
+		Context("when expecting a 100 Continue", func() {
+			var server *httptest.Server
+			var statusCodes []int
+			var requests int
+			var expectHeader string
+			var uploadedContents []byte
+			var bodyRead bool
+
+			BeforeEach(func() {
+				statusCodes = []int{http.StatusCreated}
+				requests = 0
+				uploadedContents = nil
+				server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					expectHeader = r.Header.Get("Expect")
+					statusCode := statusCodes[requests]
+					requests++
+					if statusCode != http.StatusCreated {
+						w.WriteHeader(statusCode)
+						return
+					}
+
+					file, _, err := r.FormFile(ccclient.FormField)
+					Expect(err).NotTo(HaveOccurred())
+					uploadedContents, err = io.ReadAll(file)
+					Expect(err).NotTo(HaveOccurred())
+					w.WriteHeader(statusCode)
+				}))
+
+				uploadURL, _ = url.Parse(server.URL)
+				incomingRequest, _ = http.NewRequest("POST", "", bytes.NewBufferString("file-upload-contents"))
+
+				body := incomingRequest.Body
+				bodyRead = false
+				incomingRequest.Body = io.NopCloser(readFunc(func(p []byte) (int, error) {
+					bodyRead = true
+					return body.Read(p)
+				}))
+			})
+
+			AfterEach(func() {
+				server.Close()
+			})
+
+			JustBeforeEach(func() {
+				u = ccclient.NewUploader(lagertest.NewTestLogger("test"), http.DefaultClient, true)
+				response, uploadErr = u.Upload(context.Background(), uploadURL, options, incomingRequest)
+			})
+
+			It("sends the Expect header and then the file", func() {
+				Expect(uploadErr).NotTo(HaveOccurred())
+				Expect(expectHeader).To(Equal("100-continue"))
+				Expect(uploadedContents).To(Equal([]byte("file-upload-contents")))
+			})
+
+			Context("when CC rejects the upload", func() {
+				BeforeEach(func() {
+					statusCodes = []int{http.StatusForbidden}
+				})
+
+				It("returns the rejection without reading the body", func() {
+					Expect(uploadErr).To(HaveOccurred())
+					Expect(response.StatusCode).To(Equal(http.StatusForbidden))
+					Expect(requests).To(Equal(1))
+					Expect(bodyRead).To(BeFalse())
+				})
+			})
+
+			Context("when CC fails before the body is sent", func() {
+				BeforeEach(func() {
+					statusCodes = []int{http.StatusServiceUnavailable, http.StatusCreated}
+				})
+
+				It("retries the upload with the whole body", func() {
+					Expect(uploadErr).NotTo(HaveOccurred())
+					Expect(requests).To(Equal(2))
+					Expect(uploadedContents).To(Equal([]byte("file-upload-contents")))
+				})
+			})
+		})
 	})
 })
 
@@ -235,3 +375,9 @@ func createValidRequest() *http.Request {
 func responseWithCode(code int) *http.Response {
 	return &http.Response{StatusCode: code, Body: io.NopCloser(bytes.NewBufferString(""))}
 }
+
+type readFunc func(p []byte) (int, error)
+
+func (f readFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -10,23 +11,35 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"sync"
+	"slices"
 	"syscall"
 	"time"
 
 	"code.cloudfoundry.org/debugserver"
 	"code.cloudfoundry.org/tlsconfig"
 
+	"code.cloudfoundry.org/cc-uploader/admin"
+	"code.cloudfoundry.org/cc-uploader/audit"
 	"code.cloudfoundry.org/cc-uploader/ccclient"
+	"code.cloudfoundry.org/cc-uploader/coalesce"
 	"code.cloudfoundry.org/cc-uploader/config"
+	"code.cloudfoundry.org/cc-uploader/connstats"
+	"code.cloudfoundry.org/cc-uploader/dedup"
+	"code.cloudfoundry.org/cc-uploader/destination"
+	"code.cloudfoundry.org/cc-uploader/egressproxy"
 	"code.cloudfoundry.org/cc-uploader/handlers"
+	"code.cloudfoundry.org/cc-uploader/health"
+	"code.cloudfoundry.org/cc-uploader/metrics"
+	"code.cloudfoundry.org/cc-uploader/quota"
+	"code.cloudfoundry.org/cc-uploader/ratelimit"
+	"code.cloudfoundry.org/cc-uploader/server"
+	"code.cloudfoundry.org/cc-uploader/syslogsink"
+	"code.cloudfoundry.org/cc-uploader/uploads"
 	"code.cloudfoundry.org/lager/v3"
 	"code.cloudfoundry.org/lager/v3/lagerflags"
-	"github.com/cloudfoundry/dropsonde"
 	"github.com/tedsuo/ifrit"
 	"github.com/tedsuo/ifrit/grouper"
 	"github.com/tedsuo/ifrit/http_server"
-	"github.com/tedsuo/ifrit/sigmon"
 )
 
 var configPath = flag.String(
@@ -35,6 +48,12 @@ var configPath = flag.String(
 	"path to config",
 )
 
+var validateConfig = flag.Bool(
+	"validate-config",
+	false,
+	"validate the config file, report every problem found and exit",
+)
+
 var shutdownTimeoutInMinutes = flag.Int(
 	"shutdownTimeoutInMinutes",
 	15,
@@ -46,11 +65,10 @@ const (
 	ccUploadKeepAlive           = 30 * time.Second
 	ccUploadTLSHandshakeTimeout = 10 * time.Second
 	dropsondeOrigin             = "cc_uploader"
-)
 
-var (
-	// Global WaitGroup to track uploads
-	uploadWaitGroup sync.WaitGroup
+	drainProgressInterval        = 10 * time.Second
+	drainCancellationGracePeriod = 5 * time.Second
+	syslogFlushTimeout           = 5 * time.Second
 )
 
 func newShutdownSignalChannel() <-chan os.Signal {
@@ -60,15 +78,100 @@ func newShutdownSignalChannel() <-chan os.Signal {
 	return s
 }
 
-func initializeDropsonde(logger lager.Logger, uploaderConfig config.UploaderConfig) {
-	dropsondeDestination := fmt.Sprint("localhost:", uploaderConfig.DropsondePort)
-	err := dropsonde.Initialize(dropsondeDestination, dropsondeOrigin)
-	if err != nil {
-		logger.Error("failed to initialize dropsonde: %v", err)
+func initializeMetrics(logger lager.Logger, uploaderConfig config.UploaderConfig) {
+	metricsConfig := uploaderConfig.Metrics
+	logger = logger.Session("metrics", lager.Data{"backend": metricsConfig.Backend})
+
+	var emitter metrics.Emitter
+	switch metricsConfig.Backend {
+	case config.MetricsBackendLoggregator:
+		loggregatorConfig := metricsConfig.Loggregator
+		cert, err := tls.LoadX509KeyPair(loggregatorConfig.ClientCert, loggregatorConfig.ClientKey)
+		if err != nil {
+			logger.Error("failed-to-load-loggregator-client-cert", err)
+			os.Exit(1)
+		}
+		caCert, err := os.ReadFile(loggregatorConfig.CACert)
+		if err != nil {
+			logger.Error("failed-to-load-loggregator-ca-cert", err)
+			os.Exit(1)
+		}
+		rootCAs := x509.NewCertPool()
+		rootCAs.AppendCertsFromPEM(caCert)
+		tlsConfig := &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      rootCAs,
+			MinVersion:   tls.VersionTLS12,
+		}
+		loggregatorEmitter, err := metrics.NewLoggregatorEmitter(
+			logger,
+			loggregatorConfig.Address,
+			tlsConfig,
+			loggregatorConfig.SourceID,
+			metricsConfig.Tags,
+			time.Duration(loggregatorConfig.FlushInterval),
+		)
+		if err != nil {
+			logger.Error("failed-to-initialize-metrics", err, lager.Data{"address": loggregatorConfig.Address})
+			os.Exit(1)
+		}
+		emitter = loggregatorEmitter
+	case config.MetricsBackendStatsd:
+		statsdConfig := metricsConfig.Statsd
+		statsdEmitter, err := metrics.NewStatsdEmitter(statsdConfig.Address, statsdConfig.Prefix, metricsConfig.Tags, statsdConfig.DogStatsD)
+		if err != nil {
+			logger.Error("failed-to-initialize-metrics", err, lager.Data{"address": statsdConfig.Address})
+			os.Exit(1)
+		}
+		emitter = statsdEmitter
+	default:
+		dropsondeDestination := fmt.Sprint("localhost:", uploaderConfig.DropsondePort)
+		dropsondeEmitter, err := metrics.NewDropsondeEmitter(dropsondeDestination, dropsondeOrigin)
+		if err != nil {
+			logger.Error("failed-to-initialize-metrics", err, lager.Data{"address": dropsondeDestination})
+			os.Exit(1)
+		}
+		emitter = dropsondeEmitter
 	}
+
+	metrics.Initialize(emitter)
 }
 
 func initializeTlsTransport(uploaderConfig config.UploaderConfig, skipVerify bool) *http.Transport {
+	poolConfig := uploaderConfig.CCTransport
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   ccUploadDialTimeout,
+			KeepAlive: ccUploadKeepAlive,
+		}).DialContext,
+		TLSHandshakeTimeout:   ccUploadTLSHandshakeTimeout,
+		MaxIdleConnsPerHost:   poolConfig.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       poolConfig.MaxConnsPerHost,
+		IdleConnTimeout:       time.Duration(poolConfig.IdleConnTimeout),
+		ResponseHeaderTimeout: time.Duration(poolConfig.ResponseHeaderTimeout),
+		ExpectContinueTimeout: time.Duration(poolConfig.ExpectContinueTimeout),
+		WriteBufferSize:       poolConfig.WriteBufferSize,
+		ReadBufferSize:        poolConfig.ReadBufferSize,
+		// With a custom TLS config and dialer, HTTP/2 is only attempted
+		// when forced
+		ForceAttemptHTTP2: uploaderConfig.HTTP2.Outbound,
+	}
+
+	proxyConfig := uploaderConfig.CCProxy
+	if proxyConfig.URL != "" {
+		proxy, err := egressproxy.New(proxyConfig.URL, proxyConfig.Username, proxyConfig.Password, proxyConfig.NoProxy, proxyTLSConfig(proxyConfig))
+		if err != nil {
+			log.Fatalln("Unable to configure proxy", err)
+		}
+		proxy.Configure(transport)
+	}
+
+	if uploaderConfig.DevMode.Enabled() && uploaderConfig.CCClientCert == "" {
+		// Dev mode never talks to CC, so it may run without CC certificates.
+		return transport
+	}
+
 	cert, err := tls.LoadX509KeyPair(uploaderConfig.CCClientCert, uploaderConfig.CCClientKey)
 	if err != nil {
 		log.Fatalln("Unable to load cert", err)
@@ -86,36 +189,90 @@ func initializeTlsTransport(uploaderConfig config.UploaderConfig, skipVerify boo
 
 	clientCertPool.AppendCertsFromPEM(clientCACert)
 
-	return &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		Dial: (&net.Dialer{
-			Timeout:   ccUploadDialTimeout,
-			KeepAlive: ccUploadKeepAlive,
-		}).Dial,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: skipVerify,
-			Certificates:       []tls.Certificate{cert},
-			RootCAs:            clientCertPool,
-		},
-		TLSHandshakeTimeout: ccUploadTLSHandshakeTimeout,
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: skipVerify,
+		Certificates:       []tls.Certificate{cert},
+		RootCAs:            clientCertPool,
 	}
+	return transport
 }
 
-func initializeServer(logger lager.Logger, uploaderConfig config.UploaderConfig) ifrit.Runner {
-	uploader := ccclient.NewUploader(logger, &http.Client{Transport: initializeTlsTransport(uploaderConfig, false)})
+// proxyTLSConfig verifies an https proxy against its own CA, which is not
+// trusted for CC, or against the system pool if it has none.
+func proxyTLSConfig(proxyConfig config.Proxy) *tls.Config {
+	if proxyConfig.CACert == "" {
+		return nil
+	}
 
-	// To maintain backwards compatibility with hairpin polling URLs, skip SSL verification for now
-	poller := ccclient.NewPoller(logger, &http.Client{Transport: initializeTlsTransport(uploaderConfig, true)}, time.Duration(uploaderConfig.CCJobPollingInterval))
+	proxyCACert, err := os.ReadFile(proxyConfig.CACert)
+	if err != nil {
+		log.Fatal("Unable to open proxy CA cert", err)
+	}
 
-	ccUploaderHandler, err := handlers.New(uploader, poller, logger, &uploadWaitGroup)
+	proxyCertPool, err := x509.SystemCertPool()
+	if err != nil {
+		log.Fatal("Unable to open system certificate pool", err)
+	}
+	proxyCertPool.AppendCertsFromPEM(proxyCACert)
+
+	return &tls.Config{RootCAs: proxyCertPool}
+}
+
+// ccTransports are shared by all clients talking to CC, so that they reuse
+// each other's connections. Their pool stats are served by the debug server.
+type ccTransports struct {
+	upload  *connstats.Transport
+	polling *connstats.Transport
+}
+
+func initializeCCTransports(uploaderConfig config.UploaderConfig) ccTransports {
+	return ccTransports{
+		upload: connstats.NewTransport(initializeTlsTransport(uploaderConfig, false)),
+		// To maintain backwards compatibility with hairpin polling URLs, skip SSL verification for now
+		polling: connstats.NewTransport(initializeTlsTransport(uploaderConfig, true)),
+	}
+}
+
+func initializeHandlerOptions(logger lager.Logger, uploaderConfig config.UploaderConfig, tracker *uploads.Tracker, transports ccTransports) handlers.Options {
+	client := &http.Client{Transport: transports.upload}
+	uploader := ccclient.NewUploader(logger, client, uploaderConfig.CCTransport.ExpectContinue)
+	dropletDestination := initializeDestination(logger, uploaderConfig.DropletDestination, uploader, client)
+	buildArtifactsDestination := initializeDestination(logger, uploaderConfig.BuildArtifactsDestination, uploader, client)
+
+	poller := ccclient.NewPoller(logger, &http.Client{Transport: transports.polling}, time.Duration(uploaderConfig.CCJobPollingInterval))
+
+	return handlers.Options{
+		Logger:                    logger,
+		Tracker:                   tracker,
+		Poller:                    poller,
+		DropletDestination:        dropletDestination,
+		BuildArtifactsDestination: buildArtifactsDestination,
+		DropletTimeouts:           uploaderConfig.DropletTimeouts,
+		BuildArtifactsTimeouts:    uploaderConfig.BuildArtifactsTimeouts,
+		DropletForm:               uploaderConfig.DropletForm,
+		BuildArtifactsForm:        uploaderConfig.BuildArtifactsForm,
+		DropletMetadata:           uploaderConfig.DropletMetadata,
+		Deduplicator:              initializeDeduplicator(logger, uploaderConfig.Deduplication),
+		Coalescer:                 initializeCoalescer(uploaderConfig.DuplicateDropletUploads),
+		Auditor:                   initializeAuditor(logger, uploaderConfig.AuditLog),
+		Quotas:                    initializeQuotas(logger, uploaderConfig.UploadQuotas),
+		ValidateArchives:          uploaderConfig.ValidateArchives,
+	}
+}
+
+func initializeHandler(logger lager.Logger, handlerOptions handlers.Options) http.Handler {
+	ccUploaderHandler, err := handlers.New(handlerOptions)
 	if err != nil {
 		logger.Error("router-building-failed", err)
 		os.Exit(1)
 	}
+	return ccUploaderHandler
+}
 
+func initializeServer(logger lager.Logger, mutualTLS config.MutualTLS, enableHTTP2 bool, ccUploaderHandler http.Handler) ifrit.Runner {
 	tlsConfig, err := tlsconfig.Build(
-		tlsconfig.WithIdentityFromFile(uploaderConfig.MutualTLS.ServerCert, uploaderConfig.MutualTLS.ServerKey),
-	).Server(tlsconfig.WithClientAuthenticationFromFile(uploaderConfig.MutualTLS.CACert))
+		tlsconfig.WithIdentityFromFile(mutualTLS.ServerCert, mutualTLS.ServerKey),
+	).Server(tlsconfig.WithClientAuthenticationFromFile(mutualTLS.CACert))
 
 	if err != nil {
 		logger.Error("new-tls-config-failed", err)
@@ -128,52 +285,369 @@ func initializeServer(logger lager.Logger, uploaderConfig config.UploaderConfig)
 		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
 	}
 
-	return http_server.NewTLSServer(uploaderConfig.MutualTLS.ListenAddress, ccUploaderHandler, tlsConfig)
+	return server.NewTLS(mutualTLS.ListenAddress, ccUploaderHandler, tlsConfig, enableHTTP2)
 }
 
-func waitForDrainingToFinish() <-chan struct{} {
-	done := make(chan struct{})
-	go func() {
-		uploadWaitGroup.Wait() // wait for all in-flight uploads to call Done()
-		close(done)            // signal completion
-	}()
-	return done
+// initializeListenerServer serves the listener's routes, within its rate
+// limit, on its own mutual TLS address.
+func initializeListenerServer(logger lager.Logger, listenerConfig config.Listener, enableHTTP2 bool, handlerOptions handlers.Options) ifrit.Runner {
+	logger = logger.Session("listener", lager.Data{"name": listenerConfig.Name})
+
+	handlerOptions.Routes = listenerConfig.Routes
+	handler := initializeHandler(logger, handlerOptions)
+
+	var limiter *ratelimit.Limiter
+	if listenerConfig.RateLimit.RequestsPerSecond > 0 {
+		limiter = ratelimit.New(listenerConfig.RateLimit.RequestsPerSecond, listenerConfig.RateLimit.Burst)
+	}
+	handler = limiter.Handler(logger, handler)
+
+	return initializeServer(logger, listenerConfig.MutualTLS, enableHTTP2, handler)
+}
+
+func initializeUnixServer(logger lager.Logger, unixSocketConfig config.UnixSocket, ccUploaderHandler http.Handler) ifrit.Runner {
+	mode, err := unixSocketConfig.FileMode()
+	if err != nil {
+		logger.Error("invalid-unix-socket-mode", err)
+		os.Exit(1)
+	}
+	uid, err := unixSocketConfig.OwnerUID()
+	if err != nil {
+		logger.Error("unix-socket-owner-lookup-failed", err, lager.Data{"owner": unixSocketConfig.Owner})
+		os.Exit(1)
+	}
+	gid, err := unixSocketConfig.GroupGID()
+	if err != nil {
+		logger.Error("unix-socket-group-lookup-failed", err, lager.Data{"group": unixSocketConfig.Group})
+		os.Exit(1)
+	}
+
+	return server.NewUnix(logger, unixSocketConfig.Path, mode, uid, gid, unixSocketPeerAuthorizer(unixSocketConfig), ccUploaderHandler)
 }
 
-func configureServers(logger lager.Logger, uploaderConfig config.UploaderConfig, reconfigurableSink *lager.ReconfigurableSink) ifrit.Process {
+// unixSocketPeerAuthorizer accepts peers running as one of the allowed users
+// or in one of the allowed groups or, if there are none, as our own user.
+func unixSocketPeerAuthorizer(unixSocketConfig config.UnixSocket) func(server.PeerCredentials) bool {
+	allowedUIDs := unixSocketConfig.AllowedUIDs
+	allowedGIDs := unixSocketConfig.AllowedGIDs
+	if len(allowedUIDs) == 0 && len(allowedGIDs) == 0 {
+		allowedUIDs = []uint32{uint32(os.Getuid())}
+	}
 
-	tlsRunner := initializeServer(logger, uploaderConfig)
-	members := grouper.Members{
-		{Name: "cc-uploader-tls", Runner: tlsRunner},
+	return func(creds server.PeerCredentials) bool {
+		return slices.Contains(allowedUIDs, creds.UID) || slices.Contains(allowedGIDs, creds.GID)
+	}
+}
+
+func initializeDestination(logger lager.Logger, destinationConfig config.Destination, uploader ccclient.Uploader, client *http.Client) destination.Destination {
+	dest, err := destination.New(logger, destinationConfig, uploader, client)
+	if err != nil {
+		logger.Error("destination-building-failed", err, lager.Data{"type": destinationConfig.Type})
+		os.Exit(1)
+	}
+	return dest
+}
+
+func initializeDeduplicator(logger lager.Logger, dedupConfig config.Deduplication) *dedup.Deduplicator {
+	if !dedupConfig.Enabled {
+		return nil
+	}
+
+	var index dedup.Index = dedup.NewMemoryIndex(time.Duration(dedupConfig.TTL), dedupConfig.MaxEntries)
+	if dedupConfig.IndexPath != "" {
+		var err error
+		index, err = dedup.NewFileIndex(logger, dedupConfig.IndexPath, time.Duration(dedupConfig.TTL), dedupConfig.MaxEntries)
+		if err != nil {
+			logger.Error("dedup-index-loading-failed", err, lager.Data{"path": dedupConfig.IndexPath})
+			os.Exit(1)
+		}
+	}
+	return dedup.New(logger, index)
+}
+
+func initializeCoalescer(duplicateUploads string) *coalesce.Coalescer {
+	switch duplicateUploads {
+	case config.DuplicateUploadsWait:
+		return coalesce.New(true)
+	case config.DuplicateUploadsReject:
+		return coalesce.New(false)
+	}
+	return nil
+}
+
+func initializeQuotas(logger lager.Logger, quotasConfig config.UploadQuotas) *quota.Enforcer {
+	if !quotasConfig.Enabled() {
+		return nil
+	}
+
+	return quota.New(logger, quota.Limits{
+		MaxConcurrentUploads: quotasConfig.MaxConcurrentUploads,
+		MaxBytesPerWindow:    quotasConfig.MaxBytesPerWindow,
+		Window:               time.Duration(quotasConfig.Window),
+		MaxObjectSize:        quotasConfig.MaxObjectSize,
+	}, quota.NewMemoryBackend())
+}
+
+func initializeAuditor(logger lager.Logger, auditLogConfig config.AuditLog) *audit.Auditor {
+	var sink audit.Sink
+	var err error
+	switch auditLogConfig.Destination {
+	case config.AuditLogDestinationFile:
+		sink, err = audit.NewFileSink(auditLogConfig.Path, int64(auditLogConfig.MaxSizeMB)*1024*1024, auditLogConfig.MaxBackups)
+	case config.AuditLogDestinationSyslog:
+		sink, err = audit.NewSyslogSink(auditLogConfig.SyslogNetwork, auditLogConfig.SyslogAddress, auditLogConfig.SyslogTag)
+	default:
+		return nil
 	}
+	if err != nil {
+		logger.Error("audit-log-initialization-failed", err, lager.Data{"destination": auditLogConfig.Destination})
+		os.Exit(1)
+	}
+	return audit.New(logger, sink)
+}
+
+// levelFollowingSink drops log lines below the level of another sink, so
+// that changing the level through the debug server applies to it as well.
+type levelFollowingSink struct {
+	lager.Sink
+	levels *lager.ReconfigurableSink
+}
+
+func (s levelFollowingSink) Log(log lager.LogFormat) {
+	if log.LogLevel < s.levels.GetMinLevel() {
+		return
+	}
+	s.Sink.Log(log)
+}
+
+// initializeSyslogSink returns the sink to register with the logger, and the
+// syslog sink it wraps, which must be closed on exit.
+func initializeSyslogSink(logger lager.Logger, uploaderConfig config.UploaderConfig, reconfigurableSink *lager.ReconfigurableSink) (lager.Sink, *syslogsink.Sink) {
+	syslogConfig := uploaderConfig.LogSyslog
+
+	var tlsConfig *tls.Config
+	if syslogConfig.Network == syslogsink.NetworkTLS {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			logger.Error("syslog-ca-cert-loading-failed", err)
+			os.Exit(1)
+		}
+		if syslogConfig.CACert != "" {
+			caCert, err := os.ReadFile(syslogConfig.CACert)
+			if err != nil {
+				logger.Error("syslog-ca-cert-loading-failed", err)
+				os.Exit(1)
+			}
+			rootCAs.AppendCertsFromPEM(caCert)
+		}
+		tlsConfig = &tls.Config{RootCAs: rootCAs, MinVersion: tls.VersionTLS12}
+	}
+
+	syslogSink, err := syslogsink.New(syslogConfig.Network, syslogConfig.Address, tlsConfig, syslogConfig.AppName)
+	if err != nil {
+		logger.Error("syslog-sink-initialization-failed", err, lager.Data{"address": syslogConfig.Address})
+		os.Exit(1)
+	}
+
+	var sink lager.Sink = syslogSink
+	lagerConfig := uploaderConfig.LagerConfig
+	if lagerConfig.RedactSecrets {
+		sink, err = lager.NewRedactingSink(sink, nil, lagerConfig.RedactPatterns)
+		if err != nil {
+			logger.Error("syslog-sink-initialization-failed", err)
+			os.Exit(1)
+		}
+	}
+	if lagerConfig.MaxDataStringLength > 0 {
+		sink = lager.NewTruncatingSink(sink, lagerConfig.MaxDataStringLength)
+	}
+
+	return levelFollowingSink{Sink: sink, levels: reconfigurableSink}, syslogSink
+}
+
+func initializeDebugServer(logger lager.Logger, uploaderConfig config.UploaderConfig, reconfigurableSink *lager.ReconfigurableSink, tracker *uploads.Tracker, transports ccTransports) ifrit.Runner {
+	adminHandler, err := admin.New(logger, tracker)
+	if err != nil {
+		logger.Error("admin-router-building-failed", err)
+		os.Exit(1)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", debugserver.Handler(reconfigurableSink))
+	mux.Handle("/drain-status", uploads.NewStatusHandler(tracker))
+	mux.Handle("/transport-stats", connstats.NewHandler(map[string]*connstats.Transport{
+		"upload":  transports.upload,
+		"polling": transports.polling,
+	}))
+	mux.Handle("/v1/uploads", adminHandler)
+	mux.Handle("/v1/uploads/", adminHandler)
+
+	return http_server.New(uploaderConfig.DebugServerConfig.DebugAddress, mux)
+}
+
+func initializeHealthServer(logger lager.Logger, uploaderConfig config.UploaderConfig, tracker *uploads.Tracker, transports ccTransports) ifrit.Runner {
+	healthConfig := uploaderConfig.HealthCheck
+
+	checks := []health.Check{
+		health.NewDrainingCheck(tracker),
+		health.NewAdmissionCheck(tracker),
+	}
+	if healthConfig.CCProbeURL != "" {
+		probeClient := &http.Client{Transport: transports.upload}
+		checks = append(checks, health.NewCCProbe(probeClient, healthConfig.CCProbeURL, time.Duration(healthConfig.CCProbeTimeout)))
+	}
+	healthHandler := health.New(logger, checks...)
+
+	if healthConfig.ServerCert == "" {
+		return http_server.New(healthConfig.ListenAddress, healthHandler)
+	}
+
+	var serverOptions []tlsconfig.ServerOption
+	if healthConfig.CACert != "" {
+		serverOptions = append(serverOptions, tlsconfig.WithClientAuthenticationFromFile(healthConfig.CACert))
+	}
+	tlsConfig, err := tlsconfig.Build(
+		tlsconfig.WithIdentityFromFile(healthConfig.ServerCert, healthConfig.ServerKey),
+	).Server(serverOptions...)
+	if err != nil {
+		logger.Error("new-health-check-tls-config-failed", err)
+		os.Exit(1)
+	}
+
+	return http_server.NewTLSServer(healthConfig.ListenAddress, healthHandler, tlsConfig)
+}
+
+// drain waits for in-flight uploads to finish, and cancels the ones still
+// running once the shutdown timeout has passed.
+func drain(logger lager.Logger, tracker *uploads.Tracker) {
+	// Create channel to signal when uploads (including polling) are done
+	done := tracker.Drained()
+
+	stopProgress := make(chan struct{})
+	defer close(stopProgress)
+	go tracker.LogProgress(drainProgressInterval, stopProgress)
+
+	select {
+	case <-done:
+		logger.Info("all-uploads-finished")
+		return
+	case <-time.After(time.Duration(*shutdownTimeoutInMinutes) * time.Minute):
+		logger.Info("graceful-shutdown-timed-out",
+			lager.Data{"timeout": fmt.Sprintf("%d minutes", *shutdownTimeoutInMinutes)})
+	}
+
+	cancelled := tracker.CancelAll(uploads.ErrDrainTimeout)
+	logger.Info("cancelled-remaining-uploads", lager.Data{"count": cancelled})
+
+	select {
+	case <-done:
+	case <-time.After(drainCancellationGracePeriod):
+		logger.Info("cancelled-uploads-did-not-finish", lager.Data{"remaining-uploads": tracker.Status().RemainingUploads})
+	}
+}
+
+// configureAuxiliaryServers starts the debug and health check servers. They
+// are kept out of the main group so that they stay up while uploads drain.
+func configureAuxiliaryServers(logger lager.Logger, uploaderConfig config.UploaderConfig, reconfigurableSink *lager.ReconfigurableSink, tracker *uploads.Tracker, transports ccTransports) ifrit.Process {
+	members := grouper.Members{}
 	if uploaderConfig.DebugServerConfig.DebugAddress != "" {
-		members = append(grouper.Members{
-			{Name: "debug-server", Runner: debugserver.Runner(uploaderConfig.DebugServerConfig.DebugAddress, reconfigurableSink)},
-		}, members...)
+		members = append(members, grouper.Member{
+			Name: "debug-server", Runner: initializeDebugServer(logger, uploaderConfig, reconfigurableSink, tracker, transports),
+		})
+	}
+	if uploaderConfig.HealthCheck.ListenAddress != "" {
+		members = append(members, grouper.Member{
+			Name: "health-check-server", Runner: initializeHealthServer(logger, uploaderConfig, tracker, transports),
+		})
+	}
+
+	return ifrit.Invoke(grouper.NewOrdered(os.Interrupt, members))
+}
+
+func configureServers(logger lager.Logger, uploaderConfig config.UploaderConfig, tracker *uploads.Tracker, transports ccTransports) ifrit.Process {
+
+	handlerOptions := initializeHandlerOptions(logger, uploaderConfig, tracker, transports)
+	ccUploaderHandler := initializeHandler(logger, handlerOptions)
+	members := grouper.Members{
+		{Name: "cc-uploader-tls", Runner: initializeServer(logger, uploaderConfig.MutualTLS, uploaderConfig.HTTP2.Inbound, ccUploaderHandler)},
+	}
+	for _, listenerConfig := range uploaderConfig.Listeners {
+		members = append(members, grouper.Member{
+			Name:   "cc-uploader-tls-" + listenerConfig.Name,
+			Runner: initializeListenerServer(logger, listenerConfig, uploaderConfig.HTTP2.Inbound, handlerOptions),
+		})
+	}
+	if uploaderConfig.UnixSocket.Path != "" {
+		members = append(members, grouper.Member{
+			Name:   "cc-uploader-unix",
+			Runner: initializeUnixServer(logger, uploaderConfig.UnixSocket, ccUploaderHandler),
+		})
 	}
 
-	group := grouper.NewOrdered(os.Interrupt, members)
-	monitor := ifrit.Invoke(sigmon.New(group))
+	// main signals the servers itself once readiness has had time to fail,
+	// so they must not react to the shutdown signal on their own
+	monitor := ifrit.Invoke(grouper.NewOrdered(os.Interrupt, members))
 	logger.Info("ready")
 
 	return monitor
 }
 
+func runConfigValidation(configPath string) int {
+	uploaderConfig, err := config.ReadUploaderConfig(configPath)
+	if err == nil {
+		err = uploaderConfig.Validate()
+	}
+
+	var validationErr *config.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		for _, problem := range validationErr.Problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		return 1
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Println("config is valid")
+	return 0
+}
+
 func main() {
 	flag.Parse()
 
+	if *validateConfig {
+		os.Exit(runConfigValidation(*configPath))
+	}
+
 	uploaderConfig, err := config.NewUploaderConfig(*configPath)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	logger, reconfigurableSink := lagerflags.NewFromConfig("cc-uploader", uploaderConfig.LagerConfig)
+	var syslogSink *syslogsink.Sink
+	if uploaderConfig.LogSyslog.Address != "" {
+		var sink lager.Sink
+		sink, syslogSink = initializeSyslogSink(logger, uploaderConfig, reconfigurableSink)
+		logger.RegisterSink(sink)
+	}
+
+	initializeMetrics(logger, uploaderConfig)
 
-	initializeDropsonde(logger, uploaderConfig)
+	if uploaderConfig.DevMode.Enabled() {
+		logger.Info("dev-mode-enabled", lager.Data{"directory": uploaderConfig.DevMode.Directory})
+	}
 
 	shutdownSignal := newShutdownSignalChannel()
 
-	monitor := configureServers(logger, uploaderConfig, reconfigurableSink)
+	tracker := uploads.NewTracker(logger, uploaderConfig.MaxInFlightUploads)
+
+	transports := initializeCCTransports(uploaderConfig)
+
+	auxiliaryServers := configureAuxiliaryServers(logger, uploaderConfig, reconfigurableSink, tracker, transports)
+	monitor := configureServers(logger, uploaderConfig, tracker, transports)
 
 	select {
 	case err := <-monitor.Wait():
@@ -183,20 +657,32 @@ func main() {
 	case s := <-shutdownSignal:
 		logger.Info("shutdown-signal-received", lager.Data{"signal": s})
 
+		// Fail readiness checks and reject new uploads before the listeners
+		// go away, and give load balancers and clients time to notice
+		tracker.StartDraining()
+		if drainDelay := time.Duration(uploaderConfig.HealthCheck.DrainDelay); drainDelay > 0 {
+			logger.Info("waiting-for-readiness-to-propagate", lager.Data{"drain-delay": drainDelay.String()})
+			time.Sleep(drainDelay)
+		}
+
 		// Stop accepting new connections, Ifrit will close the listeners
 		monitor.Signal(os.Interrupt)
 
-		// Create channel to signal when uploads (including polling) are done
-		done := waitForDrainingToFinish()
+		drain(logger, tracker)
+	}
 
-		select {
-		case <-done:
-			logger.Info("all-uploads-finished")
-		case <-time.After(time.Duration(*shutdownTimeoutInMinutes) * time.Minute):
-			logger.Info("graceful-shutdown-timed-out",
-				lager.Data{"timeout": fmt.Sprintf("%d minutes", *shutdownTimeoutInMinutes)})
-		}
+	auxiliaryServers.Signal(os.Interrupt)
+	<-auxiliaryServers.Wait()
+
+	if err := metrics.Close(); err != nil {
+		logger.Error("failed-to-flush-metrics", err)
 	}
 
 	logger.Info("exited")
+
+	if syslogSink != nil {
+		if err := syslogSink.Close(syslogFlushTimeout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
 }
@@ -1,14 +1,17 @@
 package main_test
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/exec"
@@ -99,7 +102,7 @@ var _ = Describe("CC Uploader", func() {
 			ServerCert:    filepath.Join("..", "..", "fixtures", "certs", "server.crt"),
 			ServerKey:     filepath.Join("..", "..", "fixtures", "certs", "server.key"),
 		}
-
+		uploaderConfig.HealthCheck.DrainDelay = 0
 	})
 
 	JustBeforeEach(func() {
@@ -131,6 +134,7 @@ var _ = Describe("CC Uploader", func() {
 			contentLength     = 100
 			postRequest       *http.Request
 			ccUploaderAddress string
+			clientTLSConfig   *tls.Config
 			httpClient        *http.Client
 		)
 
@@ -144,13 +148,14 @@ var _ = Describe("CC Uploader", func() {
 			clientKeyFilePath := filepath.Join("..", "..", "fixtures", "certs", "client.key")
 			clientCAFilePath := filepath.Join("..", "..", "fixtures", "certs", "ca.crt")
 
-			clientTlSConfig, err := tlsconfig.Build(
+			var err error
+			clientTLSConfig, err = tlsconfig.Build(
 				tlsconfig.WithIdentityFromFile(clientCertFilePath, clientKeyFilePath),
 			).Client(tlsconfig.WithAuthorityFromFile(clientCAFilePath))
 
 			Expect(err).NotTo(HaveOccurred())
 
-			httpClient = cfhttp.NewClient(cfhttp.WithTLSConfig(clientTlSConfig))
+			httpClient = cfhttp.NewClient(cfhttp.WithTLSConfig(clientTLSConfig))
 		})
 
 		AfterEach(func() {
@@ -190,10 +195,158 @@ var _ = Describe("CC Uploader", func() {
 				Expect(resp.StatusCode).To(Equal(http.StatusCreated))
 				Expect(len(fakeCC.UploadedDroplets[appGuid])).To(Equal(contentLength))
 			})
+
+			Context("when an additional listener is configured", func() {
+				var listenerAddress string
+
+				BeforeEach(func() {
+					listenerPort := 9292 + GinkgoParallelProcess()
+					listenerAddress = fmt.Sprintf("https://localhost:%d", listenerPort)
+
+					listenerTLS := uploaderConfig.MutualTLS
+					listenerTLS.ListenAddress = fmt.Sprintf("localhost:%d", listenerPort)
+					uploaderConfig.Listeners = []config.Listener{{
+						Name:      "build-service",
+						MutualTLS: listenerTLS,
+						Routes:    []string{ccuploader.UploadBuildArtifactsRoute},
+						RateLimit: config.RateLimit{RequestsPerSecond: 0.1, Burst: 1},
+					}}
+				})
+
+				It("only serves the listener's routes, within its rate limit", func() {
+					resp, err := httpClient.Do(dropletUploadRequest(appGuid, NewEmitter(contentLength), contentLength, listenerAddress))
+					Expect(err).NotTo(HaveOccurred())
+					resp.Body.Close()
+					Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+
+					resp, err = httpClient.Do(dropletUploadRequest(appGuid, NewEmitter(contentLength), contentLength, listenerAddress))
+					Expect(err).NotTo(HaveOccurred())
+					resp.Body.Close()
+					Expect(resp.StatusCode).To(Equal(http.StatusTooManyRequests))
+				})
+
+				It("still serves every route on the primary listener", func() {
+					resp, err := httpClient.Do(postRequest)
+					Expect(err).NotTo(HaveOccurred())
+					defer resp.Body.Close()
+
+					Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+				})
+			})
+
+			Context("when a unix socket is configured", func() {
+				var socketPath string
+
+				BeforeEach(func() {
+					socketPath = filepath.Join(GinkgoT().TempDir(), "cc-uploader.sock")
+					uploaderConfig.UnixSocket.Path = socketPath
+				})
+
+				It("uploads the file from peers running as the same user", func() {
+					unixClient := &http.Client{Transport: &http.Transport{
+						DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+							return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+						},
+					}}
+
+					resp, err := unixClient.Do(dropletUploadRequest(appGuid, NewEmitter(contentLength), contentLength, "http://cc-uploader"))
+					Expect(err).NotTo(HaveOccurred())
+					defer resp.Body.Close()
+
+					Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+					Expect(len(fakeCC.UploadedDroplets[appGuid])).To(Equal(contentLength))
+				})
+			})
+
+			Context("when the statsd metrics backend is configured", func() {
+				var statsdConn net.PacketConn
+
+				BeforeEach(func() {
+					var err error
+					statsdConn, err = net.ListenPacket("udp", "127.0.0.1:0")
+					Expect(err).NotTo(HaveOccurred())
+
+					uploaderConfig.Metrics.Backend = config.MetricsBackendStatsd
+					uploaderConfig.Metrics.Statsd.Address = statsdConn.LocalAddr().String()
+				})
+
+				AfterEach(func() {
+					statsdConn.Close()
+				})
+
+				It("emits the upload metrics to statsd", func() {
+					resp, err := httpClient.Do(postRequest)
+					Expect(err).NotTo(HaveOccurred())
+					defer resp.Body.Close()
+					Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+					received := make(chan string, 100)
+					go func() {
+						defer GinkgoRecover()
+						buffer := make([]byte, 1500)
+						for {
+							n, _, err := statsdConn.ReadFrom(buffer)
+							if err != nil {
+								return
+							}
+							received <- string(buffer[:n])
+						}
+					}()
+
+					Eventually(received).Should(Receive(Equal("cc_uploader.UploadDropletSucceeded:1|c")))
+				})
+			})
+
+			Context("when a proxy is configured", func() {
+				var proxyServer *httptest.Server
+				var proxiedHosts chan string
+
+				BeforeEach(func() {
+					proxiedHosts = make(chan string, 10)
+					proxyServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						proxiedHosts <- r.URL.Host
+						// loopback hosts are never proxied, so CC is addressed
+						// by a name that only the proxy resolves
+						(&httputil.ReverseProxy{Rewrite: func(pr *httputil.ProxyRequest) {
+							pr.SetURL(&url.URL{Scheme: "http", Host: net.JoinHostPort("127.0.0.1", r.URL.Port())})
+						}}).ServeHTTP(w, r)
+					}))
+
+					uploaderConfig.CCProxy = config.Proxy{URL: proxyServer.URL}
+				})
+
+				AfterEach(func() {
+					proxyServer.Close()
+				})
+
+				It("sends the upload to CC through the proxy", func() {
+					_, ccPort, err := net.SplitHostPort(fakeCCServer.Listener.Addr().String())
+					Expect(err).NotTo(HaveOccurred())
+					ccHost := net.JoinHostPort("cc.example.test", ccPort)
+					query := postRequest.URL.Query()
+					ccUrl, err := url.Parse(query.Get(cc_messages.CcDropletUploadUriKey))
+					Expect(err).NotTo(HaveOccurred())
+					ccUrl.Host = ccHost
+					query.Set(cc_messages.CcDropletUploadUriKey, ccUrl.String())
+					postRequest.URL.RawQuery = query.Encode()
+
+					resp, err := httpClient.Do(postRequest)
+					Expect(err).NotTo(HaveOccurred())
+					defer resp.Body.Close()
+
+					Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+					Expect(len(fakeCC.UploadedDroplets[appGuid])).To(Equal(contentLength))
+					Expect(proxiedHosts).To(Receive(Equal(ccHost)))
+				})
+			})
 		})
 
 		Context("when the CC callback URI is HTTPS", func() {
+			var ccRequestProtos chan string
+
 			BeforeEach(func() {
+				ccRequestProtos = make(chan string, 10)
+
 				cert, err := tls.LoadX509KeyPair(uploaderConfig.CCClientCert, uploaderConfig.CCClientKey)
 				if err != nil {
 					log.Fatalln("Unable to load cert", err)
@@ -218,6 +371,11 @@ var _ = Describe("CC Uploader", func() {
 				}
 
 				fakeCCServer.TLS = tlsConfig
+				fakeCCServer.EnableHTTP2 = true
+				fakeCCServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					ccRequestProtos <- r.Proto
+					fakeCC.ServeHTTP(w, r)
+				})
 				fakeCCServer.StartTLS()
 			})
 
@@ -228,7 +386,60 @@ var _ = Describe("CC Uploader", func() {
 
 				Expect(resp.StatusCode).To(Equal(http.StatusCreated))
 				Expect(len(fakeCC.UploadedDroplets[appGuid])).To(Equal(contentLength))
+				Expect(ccRequestProtos).To(Receive(Equal("HTTP/1.1")))
 			})
+
+			Context("when HTTP/2 is enabled", func() {
+				BeforeEach(func() {
+					uploaderConfig.HTTP2 = config.HTTP2{Inbound: true, Outbound: true}
+					httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLSConfig, ForceAttemptHTTP2: true}}
+				})
+
+				It("uses HTTP/2 for the upload and the connection to CC", func() {
+					resp, err := httpClient.Do(postRequest)
+					Expect(err).NotTo(HaveOccurred())
+					defer resp.Body.Close()
+
+					Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+					Expect(resp.Proto).To(Equal("HTTP/2.0"))
+					Expect(len(fakeCC.UploadedDroplets[appGuid])).To(Equal(contentLength))
+					Expect(ccRequestProtos).To(Receive(Equal("HTTP/2.0")))
+				})
+			})
+		})
+	})
+
+	Describe("Dev mode", func() {
+		var devModeDirectory string
+
+		BeforeEach(func() {
+			devModeDirectory = GinkgoT().TempDir()
+			uploaderConfig.DevMode = config.DevMode{Directory: devModeDirectory}
+			uploaderConfig.CCCACert = ""
+			uploaderConfig.CCClientCert = ""
+			uploaderConfig.CCClientKey = ""
+
+			// Never started, dev mode must not talk to CC
+			fakeCCServer = httptest.NewUnstartedServer(fake_cc.New())
+		})
+
+		It("writes droplets to the dev mode directory", func() {
+			clientTLSConfig, err := tlsconfig.Build(
+				tlsconfig.WithIdentityFromFile(
+					filepath.Join("..", "..", "fixtures", "certs", "client.crt"),
+					filepath.Join("..", "..", "fixtures", "certs", "client.key"),
+				),
+			).Client(tlsconfig.WithAuthorityFromFile(filepath.Join("..", "..", "fixtures", "certs", "ca.crt")))
+			Expect(err).NotTo(HaveOccurred())
+			httpClient := cfhttp.NewClient(cfhttp.WithTLSConfig(clientTLSConfig))
+
+			postRequest := dropletUploadRequest(appGuid, NewEmitter(10), 10, fmt.Sprintf("https://localhost:%d", httpsListenPort))
+			resp, err := httpClient.Do(postRequest)
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+			Expect(os.ReadFile(filepath.Join(devModeDirectory, appGuid, "droplet.tgz"))).To(HaveLen(10))
 		})
 	})
 
@@ -301,6 +512,190 @@ var _ = Describe("CC Uploader", func() {
 		})
 	})
 
+	Describe("Debug server", func() {
+		var debugAddress string
+
+		BeforeEach(func() {
+			debugAddress = fmt.Sprintf("localhost:%d", 17017+GinkgoParallelProcess())
+			uploaderConfig.DebugServerConfig.DebugAddress = debugAddress
+		})
+
+		It("is served by the debug server", func() {
+			resp, err := http.Get(fmt.Sprintf("http://%s/drain-status", debugAddress))
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+
+			var status map[string]interface{}
+			Expect(json.NewDecoder(resp.Body).Decode(&status)).To(Succeed())
+			Expect(status).To(HaveKeyWithValue("draining", false))
+			Expect(status).To(HaveKeyWithValue("remaining_uploads", BeNumerically("==", 0)))
+		})
+
+		It("serves the CC connection pool stats", func() {
+			resp, err := http.Get(fmt.Sprintf("http://%s/transport-stats", debugAddress))
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+
+			var stats map[string]map[string]interface{}
+			Expect(json.NewDecoder(resp.Body).Decode(&stats)).To(Succeed())
+			Expect(stats).To(HaveKey("upload"))
+			Expect(stats).To(HaveKey("polling"))
+			Expect(stats["upload"]).To(HaveKeyWithValue("new_connections", BeNumerically("==", 0)))
+		})
+
+		It("serves the admin API on the debug server", func() {
+			resp, err := http.Get(fmt.Sprintf("http://%s/v1/uploads", debugAddress))
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s/v1/uploads/unknown", debugAddress), nil)
+			Expect(err).NotTo(HaveOccurred())
+			resp, err = http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("Syslog logging", func() {
+		var syslogConn net.PacketConn
+
+		BeforeEach(func() {
+			var err error
+			syslogConn, err = net.ListenPacket("udp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			uploaderConfig.LogSyslog.Address = syslogConn.LocalAddr().String()
+		})
+
+		AfterEach(func() {
+			syslogConn.Close()
+		})
+
+		It("sends logs to the syslog endpoint as well as stdout", func() {
+			buffer := make([]byte, 65536)
+			Eventually(func() string {
+				syslogConn.SetReadDeadline(time.Now().Add(time.Second))
+				n, _, err := syslogConn.ReadFrom(buffer)
+				if err != nil {
+					return ""
+				}
+				return string(buffer[:n])
+			}, 5*time.Second).Should(MatchRegexp(`^<14>1 \S+ \S+ cc-uploader \d+ - \[lager@47450 .*\] cc-uploader\.ready$`))
+		})
+
+		It("sends the last log lines before exiting", func() {
+			session.Signal(os.Interrupt)
+			Eventually(session, 5*time.Second).Should(gexec.Exit(0))
+
+			buffer := make([]byte, 65536)
+			messages := []string{}
+			for {
+				syslogConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				n, _, err := syslogConn.ReadFrom(buffer)
+				if err != nil {
+					break
+				}
+				messages = append(messages, string(buffer[:n]))
+			}
+			Expect(messages).To(ContainElement(HaveSuffix("cc-uploader.exited")))
+		})
+
+		Context("when a TCP endpoint is unreachable", func() {
+			BeforeEach(func() {
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				Expect(err).NotTo(HaveOccurred())
+				uploaderConfig.LogSyslog.Network = "tcp"
+				uploaderConfig.LogSyslog.Address = listener.Addr().String()
+				listener.Close()
+			})
+
+			It("starts anyway", func() {
+				Consistently(session).ShouldNot(gexec.Exit())
+			})
+		})
+	})
+
+	Describe("Health checks", func() {
+		var healthAddress string
+
+		BeforeEach(func() {
+			healthAddress = fmt.Sprintf("localhost:%d", 17117+GinkgoParallelProcess())
+			uploaderConfig.HealthCheck.ListenAddress = healthAddress
+			uploaderConfig.HealthCheck.DrainDelay = config.Duration(time.Second)
+		})
+
+		It("serves liveness and readiness on the health check listener", func() {
+			resp, err := http.Get(fmt.Sprintf("http://%s/healthz", healthAddress))
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			resp, err = http.Get(fmt.Sprintf("http://%s/readyz", healthAddress))
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("fails readiness while draining", func() {
+			fakeCCServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.Copy(io.Discard, r.Body)
+				w.WriteHeader(http.StatusCreated)
+			}))
+			defer fakeCCServer.Close()
+
+			clientTLSConfig, err := tlsconfig.Build(
+				tlsconfig.WithIdentityFromFile(
+					filepath.Join("..", "..", "fixtures", "certs", "client.crt"),
+					filepath.Join("..", "..", "fixtures", "certs", "client.key"),
+				),
+			).Client(tlsconfig.WithAuthorityFromFile(filepath.Join("..", "..", "fixtures", "certs", "ca.crt")))
+			Expect(err).NotTo(HaveOccurred())
+			httpClient := cfhttp.NewClient(cfhttp.WithTLSConfig(clientTLSConfig))
+
+			contentLength := 5000
+			req := dropletUploadRequest(appGuid, NewEmitter(contentLength), contentLength, fmt.Sprintf("https://localhost:%d", httpsListenPort))
+			go func() { _, _ = httpClient.Do(req) }()
+
+			time.Sleep(200 * time.Millisecond)
+			session.Signal(os.Interrupt)
+			Eventually(session, time.Second).Should(gbytes.Say("shutdown-signal-received"))
+
+			resp, err := http.Get(fmt.Sprintf("http://%s/readyz", healthAddress))
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		})
+
+		It("rejects new uploads while waiting for readiness to propagate", func() {
+			fakeCCServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.Copy(io.Discard, r.Body)
+				w.WriteHeader(http.StatusCreated)
+			}))
+			defer fakeCCServer.Close()
+
+			clientTLSConfig, err := tlsconfig.Build(
+				tlsconfig.WithIdentityFromFile(
+					filepath.Join("..", "..", "fixtures", "certs", "client.crt"),
+					filepath.Join("..", "..", "fixtures", "certs", "client.key"),
+				),
+			).Client(tlsconfig.WithAuthorityFromFile(filepath.Join("..", "..", "fixtures", "certs", "ca.crt")))
+			Expect(err).NotTo(HaveOccurred())
+			httpClient := cfhttp.NewClient(cfhttp.WithTLSConfig(clientTLSConfig))
+
+			session.Signal(os.Interrupt)
+			Eventually(session, time.Second).Should(gbytes.Say("waiting-for-readiness-to-propagate"))
+
+			req := dropletUploadRequest(appGuid, NewEmitter(100), 100, fmt.Sprintf("https://localhost:%d", httpsListenPort))
+			resp, err := httpClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+
+			Eventually(session, 5*time.Second).Should(gexec.Exit(0))
+		})
+	})
+
 	Describe("After SIGTERM", func() {
 		var ccUploaderAddress string
 
@@ -330,6 +725,90 @@ var _ = Describe("CC Uploader", func() {
 			_, err := client.Do(newReq)
 			Expect(err).To(HaveOccurred())
 		})
+
+		Context("with a drain delay but no health check listener", func() {
+			BeforeEach(func() {
+				uploaderConfig.HealthCheck.DrainDelay = config.Duration(time.Second)
+			})
+
+			It("rejects new uploads during the drain delay", func() {
+				clientTLSConfig, err := tlsconfig.Build(
+					tlsconfig.WithIdentityFromFile(
+						filepath.Join("..", "..", "fixtures", "certs", "client.crt"),
+						filepath.Join("..", "..", "fixtures", "certs", "client.key"),
+					),
+				).Client(tlsconfig.WithAuthorityFromFile(filepath.Join("..", "..", "fixtures", "certs", "ca.crt")))
+				Expect(err).NotTo(HaveOccurred())
+				httpClient := cfhttp.NewClient(cfhttp.WithTLSConfig(clientTLSConfig))
+
+				session.Signal(os.Interrupt)
+				Eventually(session, time.Second).Should(gbytes.Say("waiting-for-readiness-to-propagate"))
+
+				req := dropletUploadRequest(appGuid, NewEmitter(100), 100, fmt.Sprintf("https://localhost:%d", httpsListenPort))
+				resp, err := httpClient.Do(req)
+				Expect(err).NotTo(HaveOccurred())
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+
+				Eventually(session, 5*time.Second).Should(gexec.Exit(0))
+			})
+		})
 	})
 
 })
+
+var _ = Describe("Validating the config", func() {
+	var (
+		uploaderConfig config.UploaderConfig
+		configFile     *os.File
+		session        *gexec.Session
+	)
+
+	BeforeEach(func() {
+		uploaderConfig = config.DefaultUploaderConfig()
+		uploaderConfig.CCCACert = filepath.Join("..", "..", "fixtures", "cc_uploader_ca_cn.crt")
+		uploaderConfig.CCClientCert = filepath.Join("..", "..", "fixtures", "cc_uploader_cn.crt")
+		uploaderConfig.CCClientKey = filepath.Join("..", "..", "fixtures", "cc_uploader_cn.key")
+		uploaderConfig.MutualTLS = config.MutualTLS{
+			ListenAddress: "localhost:9090",
+			CACert:        filepath.Join("..", "..", "fixtures", "certs", "ca.crt"),
+			ServerCert:    filepath.Join("..", "..", "fixtures", "certs", "server.crt"),
+			ServerKey:     filepath.Join("..", "..", "fixtures", "certs", "server.key"),
+		}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		configFile, err = os.CreateTemp("", "uploader_config")
+		Expect(err).NotTo(HaveOccurred())
+		configJson, err := json.Marshal(uploaderConfig)
+		Expect(err).NotTo(HaveOccurred())
+		err = os.WriteFile(configFile.Name(), configJson, 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		session, err = gexec.Start(exec.Command(ccUploaderBinary, "-configPath", configFile.Name(), "-validate-config"), GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.Remove(configFile.Name())
+	})
+
+	It("exits successfully when the config is valid", func() {
+		Eventually(session).Should(gexec.Exit(0))
+		Expect(session.Out).To(gbytes.Say("config is valid"))
+	})
+
+	Context("when the config has several problems", func() {
+		BeforeEach(func() {
+			uploaderConfig.CCClientCert = ""
+			uploaderConfig.MutualTLS.ServerKey = filepath.Join("..", "..", "fixtures", "certs", "missing.key")
+		})
+
+		It("reports all of them and exits with a failure", func() {
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say("'mutual_tls.server_key': cannot be read"))
+			Expect(session.Err).To(gbytes.Say("'cc_client_cert': is required"))
+		})
+	})
+})
@@ -0,0 +1,113 @@
+package coalesce
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"code.cloudfoundry.org/cc-uploader/dedup"
+)
+
+// ErrCancelled is returned by Wait when the waiting request went away
+// before the upload it was waiting for finished.
+var ErrCancelled = errors.New("cancelled while waiting for a concurrent upload of the same content")
+
+// Result is the outcome of an upload, as reported to its client.
+type Result struct {
+	StatusCode int
+	Message    string
+}
+
+// Coalescer tracks uploads in progress so that a concurrent duplicate of an
+// upload, e.g. from a retried staging task, can share its result instead of
+// uploading the same content again. A nil *Coalescer never coalesces.
+type Coalescer struct {
+	wait bool
+
+	lock  sync.Mutex
+	calls map[string]*Call
+}
+
+// New returns a coalescer. If wait is true duplicates are expected to wait
+// for the upload in progress, otherwise they are expected to be rejected.
+func New(wait bool) *Coalescer {
+	return &Coalescer{
+		wait:  wait,
+		calls: map[string]*Call{},
+	}
+}
+
+// Key identifies the content of an upload for guid. It reports false if the
+// request carries neither a Content-Digest nor a Content-MD5, in which case
+// duplicates cannot be recognised.
+func Key(guid string, r *http.Request) (string, bool) {
+	if digest, ok := dedup.ParseContentDigest(r.Header.Get(dedup.ContentDigestHeader)); ok {
+		return guid + " " + digest.String(), true
+	}
+	if md5 := r.Header.Get("Content-MD5"); md5 != "" {
+		return guid + " md5=" + md5, true
+	}
+	return "", false
+}
+
+// Waits reports whether duplicates should wait for the upload in progress.
+func (c *Coalescer) Waits() bool {
+	return c != nil && c.wait
+}
+
+// Join returns the call for key and reports whether the caller leads it.
+// The leader must call Done once it has a result; everyone else may Wait
+// for it.
+func (c *Coalescer) Join(key string) (*Call, bool) {
+	if c == nil {
+		return nil, true
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if call, ok := c.calls[key]; ok {
+		return call, false
+	}
+
+	call := &Call{coalescer: c, key: key, done: make(chan struct{})}
+	c.calls[key] = call
+	return call, true
+}
+
+type Call struct {
+	coalescer *Coalescer
+	key       string
+
+	once   sync.Once
+	done   chan struct{}
+	result Result
+}
+
+// Done publishes the result of the upload to anyone waiting for it. Only
+// the first result is kept.
+func (c *Call) Done(result Result) {
+	if c == nil {
+		return
+	}
+
+	c.once.Do(func() {
+		c.coalescer.lock.Lock()
+		delete(c.coalescer.calls, c.key)
+		c.coalescer.lock.Unlock()
+
+		c.result = result
+		close(c.done)
+	})
+}
+
+// Wait blocks until the leader of the call is done, or until cancel is
+// closed.
+func (c *Call) Wait(cancel <-chan struct{}) (Result, error) {
+	select {
+	case <-c.done:
+		return c.result, nil
+	case <-cancel:
+		return Result{}, ErrCancelled
+	}
+}
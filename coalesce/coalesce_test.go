@@ -0,0 +1,87 @@
+package coalesce_test
+
+import (
+	"net/http"
+
+	"code.cloudfoundry.org/cc-uploader/coalesce"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Coalescer", func() {
+	var coalescer *coalesce.Coalescer
+
+	BeforeEach(func() {
+		coalescer = coalesce.New(true)
+	})
+
+	It("makes the first caller the leader and shares its result", func() {
+		leaderCall, leader := coalescer.Join("key")
+		Expect(leader).To(BeTrue())
+
+		call, leader := coalescer.Join("key")
+		Expect(leader).To(BeFalse())
+
+		results := make(chan coalesce.Result, 1)
+		go func() {
+			defer GinkgoRecover()
+			result, err := call.Wait(nil)
+			Expect(err).NotTo(HaveOccurred())
+			results <- result
+		}()
+
+		Consistently(results).ShouldNot(Receive())
+		leaderCall.Done(coalesce.Result{StatusCode: http.StatusCreated})
+		leaderCall.Done(coalesce.Result{StatusCode: http.StatusInternalServerError})
+		Eventually(results).Should(Receive(Equal(coalesce.Result{StatusCode: http.StatusCreated})))
+	})
+
+	It("starts a new call once the previous one is done", func() {
+		call, _ := coalescer.Join("key")
+		call.Done(coalesce.Result{StatusCode: http.StatusCreated})
+
+		_, leader := coalescer.Join("key")
+		Expect(leader).To(BeTrue())
+	})
+
+	It("stops waiting when cancelled", func() {
+		coalescer.Join("key")
+		call, _ := coalescer.Join("key")
+
+		cancel := make(chan struct{})
+		close(cancel)
+		_, err := call.Wait(cancel)
+		Expect(err).To(Equal(coalesce.ErrCancelled))
+	})
+
+	It("never coalesces when nil", func() {
+		var disabled *coalesce.Coalescer
+		call, leader := disabled.Join("key")
+		Expect(leader).To(BeTrue())
+		Expect(disabled.Waits()).To(BeFalse())
+
+		call.Done(coalesce.Result{})
+	})
+
+	Describe("Key", func() {
+		It("prefers the Content-Digest over the Content-MD5", func() {
+			request, _ := http.NewRequest("POST", "", nil)
+			request.Header.Set("Content-MD5", "the-md5")
+
+			key, ok := coalesce.Key("guid", request)
+			Expect(ok).To(BeTrue())
+			Expect(key).To(Equal("guid md5=the-md5"))
+
+			request.Header.Set("Content-Digest", "sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:")
+			key, _ = coalesce.Key("guid", request)
+			Expect(key).To(Equal("guid sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:"))
+		})
+
+		It("cannot identify requests without a checksum", func() {
+			request, _ := http.NewRequest("POST", "", nil)
+			_, ok := coalesce.Key("guid", request)
+			Expect(ok).To(BeFalse())
+		})
+	})
+})
@@ -2,10 +2,12 @@ package config
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
+	"maps"
+	"net/url"
 	"os"
-	"strings"
+	"os/user"
+	"strconv"
 	"time"
 
 	"code.cloudfoundry.org/debugserver"
@@ -42,66 +44,498 @@ type MutualTLS struct {
 	ServerKey     string `json:"server_key"`
 }
 
+// Listener serves the upload routes on an additional mutual TLS address, with
+// its own server certificate and client CA, so that clients trusted
+// differently, such as Diego cells and an external build service, can use
+// separate endpoints. Name identifies it in logs. Routes, if set, lists the
+// names of the routes it serves ("UploadDroplet", "UploadBuildArtifacts");
+// requests for the others get 404 Not Found.
+type Listener struct {
+	Name      string    `json:"name"`
+	MutualTLS MutualTLS `json:"mutual_tls"`
+	Routes    []string  `json:"routes"`
+	RateLimit RateLimit `json:"rate_limit"`
+}
+
+// RateLimit admits RequestsPerSecond requests per second on average, in
+// bursts of up to Burst, which defaults to RequestsPerSecond. Requests over
+// the limit get 429 Too Many Requests. A zero RequestsPerSecond disables it.
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+// HealthCheck configures the listener serving /healthz and /readyz. The
+// listener is plain HTTP unless ServerCert and ServerKey are set, and it
+// requires client certificates if CACert is also set. When CCProbeURL is
+// set, readiness also requires CC to be reachable at that URL. On shutdown,
+// readiness fails and new uploads are rejected for DrainDelay before the
+// upload listeners close, so that load balancers stop sending uploads first.
+// The delay applies even without the health check listener.
+type HealthCheck struct {
+	ListenAddress  string   `json:"listen_addr"`
+	CACert         string   `json:"ca_cert"`
+	ServerCert     string   `json:"server_cert"`
+	ServerKey      string   `json:"server_key"`
+	CCProbeURL     string   `json:"cc_probe_url"`
+	CCProbeTimeout Duration `json:"cc_probe_timeout"`
+	DrainDelay     Duration `json:"drain_delay"`
+}
+
+// RouteTimeouts bounds how long a single request to a route may take.
+// DefaultUploadTimeout applies when the client does not send a timeout, and
+// client supplied timeouts are clamped to MaxUploadTimeout. PollingTimeout
+// starts once the upload to CC has finished and only applies to routes that
+// poll for a CC job.
+type RouteTimeouts struct {
+	DefaultUploadTimeout Duration `json:"default_upload_timeout"`
+	MaxUploadTimeout     Duration `json:"max_upload_timeout"`
+	PollingTimeout       Duration `json:"polling_timeout"`
+}
+
+// UploadTimeout returns the upload-phase timeout to use for a client
+// requested timeout, where zero means the client did not ask for one. The
+// second return value reports whether the requested timeout was clamped.
+func (t RouteTimeouts) UploadTimeout(requested time.Duration) (time.Duration, bool) {
+	if requested <= 0 {
+		return time.Duration(t.DefaultUploadTimeout), false
+	}
+	if requested > time.Duration(t.MaxUploadTimeout) {
+		return time.Duration(t.MaxUploadTimeout), true
+	}
+	return requested, false
+}
+
+const (
+	DestinationTypeCC         = "cc"
+	DestinationTypePut        = "put"
+	DestinationTypeFilesystem = "filesystem"
+	DestinationTypeS3         = "s3"
+)
+
+// Destination selects where a route stores uploaded files. The default,
+// "cc", posts a multipart form to the upload URI given by the client. "put"
+// sends the raw file to that URI instead, "filesystem" writes it below
+// Directory and "s3" stores it in an S3-compatible bucket.
+type Destination struct {
+	Type      string        `json:"type"`
+	Directory string        `json:"directory"`
+	S3        S3Destination `json:"s3"`
+}
+
+// S3Destination configures an S3-compatible object store. Objects are
+// stored at <key_prefix>/<guid>/<filename>. PathStyle addresses the bucket
+// in the path rather than as a subdomain of the endpoint, as most
+// S3-compatible stores require.
+type S3Destination struct {
+	Endpoint        string `json:"endpoint"`
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	KeyPrefix       string `json:"key_prefix"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	PathStyle       bool   `json:"path_style"`
+}
+
+// Deduplication skips uploads whose Content-Digest matches a recent
+// successful upload to the same resource. At most MaxEntries digests are
+// remembered, each for TTL. If IndexPath is set the digests are also stored
+// in that file so that they survive restarts.
+type Deduplication struct {
+	Enabled    bool     `json:"enabled"`
+	TTL        Duration `json:"ttl"`
+	MaxEntries int      `json:"max_entries"`
+	IndexPath  string   `json:"index_path"`
+}
+
+// UploadQuotas limit the uploads of each guid in the upload routes, the app
+// guid for build artifacts and the droplet guid for droplets: how many run
+// at once, how many bytes are uploaded in each Window and how large a single
+// upload is. A zero limit is not enforced.
+type UploadQuotas struct {
+	MaxConcurrentUploads int      `json:"max_concurrent_uploads"`
+	MaxBytesPerWindow    int64    `json:"max_bytes_per_window"`
+	Window               Duration `json:"window"`
+	MaxObjectSize        int64    `json:"max_object_size"`
+}
+
+// Enabled reports whether any quota is set.
+func (q UploadQuotas) Enabled() bool {
+	return q.MaxConcurrentUploads > 0 || q.MaxBytesPerWindow > 0 || q.MaxObjectSize > 0
+}
+
+// How concurrent uploads of the same content for the same droplet guid are
+// handled. With "allow" each one is uploaded, with "wait" later ones wait
+// for and share the result of the first, and with "reject" they fail with
+// 409 Conflict.
+const (
+	DuplicateUploadsAllow  = "allow"
+	DuplicateUploadsWait   = "wait"
+	DuplicateUploadsReject = "reject"
+)
+
+// UploadForm describes the multipart form a route sends to CC. Filename and
+// ContentType describe the form file and Fields are sent as extra form
+// fields alongside it. A request may set the fields named in RequestFields
+// itself, overriding Fields, with FormFieldQueryPrefix query parameters. The
+// other destinations use Filename and ContentType only.
+type UploadForm struct {
+	Filename      string            `json:"filename"`
+	ContentType   string            `json:"content_type"`
+	Fields        map[string]string `json:"fields"`
+	RequestFields []string          `json:"request_fields"`
+}
+
+// FormFieldQueryPrefix prefixes the query parameters that set a request's
+// form fields, as in form.stack=cflinuxfs4.
+const FormFieldQueryPrefix = "form."
+
+// FieldsFor returns the form fields of a request with the given query
+// parameters: Fields, overridden by the parameters setting one of the
+// RequestFields. Parameters for other fields are ignored.
+func (f UploadForm) FieldsFor(query url.Values) map[string]string {
+	if len(f.RequestFields) == 0 {
+		return f.Fields
+	}
+
+	fields := maps.Clone(f.Fields)
+	for _, name := range f.RequestFields {
+		if values, ok := query[FormFieldQueryPrefix+name]; ok && len(values) > 0 {
+			if fields == nil {
+				fields = map[string]string{}
+			}
+			fields[name] = values[0]
+		}
+	}
+	return fields
+}
+
+// DropletMetadata reads droplets while they are uploaded to find their
+// detected buildpack and start command, from staging_info.yml, as well as
+// their uncompressed size and file count. The metadata is returned to the
+// client.
+type DropletMetadata struct {
+	Enabled bool `json:"enabled"`
+}
+
+const (
+	AuditLogDestinationFile   = "file"
+	AuditLogDestinationSyslog = "syslog"
+)
+
+// AuditLog writes a JSON record of every upload, independently of the log
+// level. With the "file" destination records are appended to Path, which is
+// rotated once it reaches MaxSizeMB, keeping MaxBackups old files. With
+// "syslog" they are sent to SyslogAddress over SyslogNetwork, or to the
+// local syslog daemon if no address is given.
+type AuditLog struct {
+	Destination   string `json:"destination"`
+	Path          string `json:"path"`
+	MaxSizeMB     int    `json:"max_size_mb"`
+	MaxBackups    int    `json:"max_backups"`
+	SyslogNetwork string `json:"syslog_network"`
+	SyslogAddress string `json:"syslog_address"`
+	SyslogTag     string `json:"syslog_tag"`
+}
+
+// Transport tunes the connection pools of the clients used for uploads to
+// CC, and the other destinations, and for polling CC. MaxIdleConnsPerHost
+// connections are kept open for reuse for up to IdleConnTimeout, and
+// MaxConnsPerHost, if set, bounds the connections to a single host.
+// ResponseHeaderTimeout bounds the wait for a response once the request has
+// been sent and ExpectContinueTimeout the wait for a 100 Continue. Zero
+// buffer sizes use the net/http defaults and zero timeouts disable the
+// corresponding limit. ExpectContinue sends uploads with
+// "Expect: 100-continue", so CC can reject them before the body is streamed.
+type Transport struct {
+	MaxIdleConnsPerHost   int      `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost       int      `json:"max_conns_per_host"`
+	IdleConnTimeout       Duration `json:"idle_conn_timeout"`
+	ResponseHeaderTimeout Duration `json:"response_header_timeout"`
+	ExpectContinueTimeout Duration `json:"expect_continue_timeout"`
+	WriteBufferSize       int      `json:"write_buffer_size"`
+	ReadBufferSize        int      `json:"read_buffer_size"`
+	ExpectContinue        bool     `json:"expect_continue"`
+}
+
+// ProxySchemes lists the proxy URL schemes net/http can connect through.
+// With "socks5h" host names are resolved by the proxy.
+var ProxySchemes = []string{"http", "https", "socks5", "socks5h"}
+
+// Proxy routes the connections to CC, and the other upload destinations,
+// through the HTTP, HTTPS or SOCKS5 proxy at URL instead of the one named by
+// the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables. Username
+// and Password authenticate to the proxy. Hosts matching an entry of NoProxy
+// are connected to directly, as are loopback hosts. The certificate of an
+// "https" proxy is verified against CACert, or the system pool if it is not
+// set, and never against cc_ca_cert.
+type Proxy struct {
+	URL      string   `json:"url"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	NoProxy  []string `json:"no_proxy"`
+	CACert   string   `json:"ca_cert"`
+}
+
+// HTTP2 offers HTTP/2, negotiated via ALPN, on the mutual TLS listener
+// (Inbound), and attempts it on connections to CC and the other upload
+// destinations (Outbound). Either side falls back to HTTP/1.1 when the peer
+// does not support it.
+type HTTP2 struct {
+	Inbound  bool `json:"inbound"`
+	Outbound bool `json:"outbound"`
+}
+
+// LogSyslog sends logs to the syslog endpoint at Address in RFC 5424 format,
+// in addition to stdout. Network is "udp", "tcp" or "tls". With "tls" the
+// endpoint's certificate is verified against CACert, or the system pool if it
+// is not set. AppName is the APP-NAME of every message.
+type LogSyslog struct {
+	Network string `json:"network"`
+	Address string `json:"address"`
+	CACert  string `json:"ca_cert"`
+	AppName string `json:"app_name"`
+}
+
+// UnixSocket additionally serves the upload routes, without TLS, on the Unix
+// domain socket at Path, for stagers on the same VM. The socket is created
+// with Mode, in octal, and, if set, the Owner and Group names or ids. Instead
+// of client certificates, peers are authorized by the credentials of their
+// process (SO_PEERCRED): they must run as one of AllowedUIDs or in one of
+// AllowedGIDs or, if neither is set, as cc-uploader's own user. Linux only.
+type UnixSocket struct {
+	Path        string   `json:"path"`
+	Mode        string   `json:"mode"`
+	Owner       string   `json:"owner"`
+	Group       string   `json:"group"`
+	AllowedUIDs []uint32 `json:"allowed_uids"`
+	AllowedGIDs []uint32 `json:"allowed_gids"`
+}
+
+func (s UnixSocket) FileMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s.Mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file mode %q", s.Mode)
+	}
+	if mode > 0777 {
+		return 0, fmt.Errorf("file mode %q has bits besides the permissions", s.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// OwnerUID returns the uid of Owner, or -1 if it is not set.
+func (s UnixSocket) OwnerUID() (int, error) {
+	if s.Owner == "" {
+		return -1, nil
+	}
+	if uid, err := strconv.Atoi(s.Owner); err == nil {
+		return uid, nil
+	}
+	u, err := user.Lookup(s.Owner)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// GroupGID returns the gid of Group, or -1 if it is not set.
+func (s UnixSocket) GroupGID() (int, error) {
+	if s.Group == "" {
+		return -1, nil
+	}
+	if gid, err := strconv.Atoi(s.Group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(s.Group)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+const (
+	MetricsBackendDropsonde   = "dropsonde"
+	MetricsBackendLoggregator = "loggregator"
+	MetricsBackendStatsd      = "statsd"
+)
+
+// Metrics selects where counters and durations are emitted. Backend is
+// "dropsonde", the legacy v1 UDP protocol sent to dropsonde_port, or
+// "loggregator" or "statsd". Tags are attached to every Loggregator envelope
+// and DogStatsD metric; dropsonde and plain statsd have no tags.
+type Metrics struct {
+	Backend     string            `json:"backend"`
+	Tags        map[string]string `json:"tags"`
+	Loggregator LoggregatorAgent  `json:"loggregator"`
+	Statsd      Statsd            `json:"statsd"`
+}
+
+// LoggregatorAgent is the v2 ingress of the Loggregator agent, which is
+// reached with mutual TLS. Metrics are sent as envelopes with SourceID every
+// FlushInterval.
+type LoggregatorAgent struct {
+	Address       string   `json:"address"`
+	CACert        string   `json:"ca_cert"`
+	ClientCert    string   `json:"client_cert"`
+	ClientKey     string   `json:"client_key"`
+	SourceID      string   `json:"source_id"`
+	FlushInterval Duration `json:"flush_interval"`
+}
+
+// Statsd is a statsd server that metrics are sent to over UDP, with their
+// names prefixed by Prefix. With DogStatsD set, tags are sent in the
+// DogStatsD format.
+type Statsd struct {
+	Address   string `json:"address"`
+	Prefix    string `json:"prefix"`
+	DogStatsD bool   `json:"dogstatsd"`
+}
+
+// DevMode runs cc-uploader without a CC. When Directory is set, both routes
+// write uploads to the filesystem below it, overriding the configured
+// destinations, and the CC client certificates become optional.
+type DevMode struct {
+	Directory string `json:"directory"`
+}
+
+func (d DevMode) Enabled() bool {
+	return d.Directory != ""
+}
+
 type UploaderConfig struct {
-	DropsondePort        int                           `json:"dropsonde_port"`
-	CCJobPollingInterval Duration                      `json:"job_polling_interval"`
-	LagerConfig          lagerflags.LagerConfig        `json:"lager_config"`
-	DebugServerConfig    debugserver.DebugServerConfig `json:"debug_server_config"`
-	CCClientCert         string                        `json:"cc_client_cert"`
-	CCClientKey          string                        `json:"cc_client_key"`
-	CCCACert             string                        `json:"cc_ca_cert"`
-	MutualTLS            MutualTLS                     `json:"mutual_tls"`
+	DropsondePort          int                           `json:"dropsonde_port"`
+	Metrics                Metrics                       `json:"metrics"`
+	CCJobPollingInterval   Duration                      `json:"job_polling_interval"`
+	LagerConfig            lagerflags.LagerConfig        `json:"lager_config"`
+	LogSyslog              LogSyslog                     `json:"log_syslog"`
+	DebugServerConfig      debugserver.DebugServerConfig `json:"debug_server_config"`
+	CCClientCert           string                        `json:"cc_client_cert"`
+	CCClientKey            string                        `json:"cc_client_key"`
+	CCCACert               string                        `json:"cc_ca_cert"`
+	MutualTLS              MutualTLS                     `json:"mutual_tls"`
+	UnixSocket             UnixSocket                    `json:"unix_socket"`
+	Listeners              []Listener                    `json:"listeners"`
+	HTTP2                  HTTP2                         `json:"http2"`
+	CCTransport            Transport                     `json:"cc_transport"`
+	CCProxy                Proxy                         `json:"cc_proxy"`
+	HealthCheck            HealthCheck                   `json:"health_check"`
+	MaxInFlightUploads     int                           `json:"max_in_flight_uploads"`
+	UploadQuotas           UploadQuotas                  `json:"upload_quotas"`
+	DropletTimeouts        RouteTimeouts                 `json:"droplet_timeouts"`
+	BuildArtifactsTimeouts RouteTimeouts                 `json:"build_artifacts_timeouts"`
+
+	DropletDestination        Destination `json:"droplet_destination"`
+	BuildArtifactsDestination Destination `json:"build_artifacts_destination"`
+	DevMode                   DevMode     `json:"dev_mode"`
+	DropletForm               UploadForm  `json:"droplet_form"`
+	BuildArtifactsForm        UploadForm  `json:"build_artifacts_form"`
+
+	Deduplication           Deduplication `json:"deduplication"`
+	DuplicateDropletUploads string        `json:"duplicate_droplet_uploads"`
+
+	// ValidateArchives checks that uploaded droplets and build artifacts are
+	// well-formed gzipped tarballs while they are forwarded, aborting the
+	// upload as soon as they are not.
+	ValidateArchives bool            `json:"validate_archives"`
+	DropletMetadata  DropletMetadata `json:"droplet_metadata"`
+
+	AuditLog AuditLog `json:"audit_log"`
+}
+
+func DefaultRouteTimeouts() RouteTimeouts {
+	return RouteTimeouts{
+		DefaultUploadTimeout: Duration(5 * time.Minute),
+		MaxUploadTimeout:     Duration(1 * time.Hour),
+		PollingTimeout:       Duration(5 * time.Minute),
+	}
 }
 
 func DefaultUploaderConfig() UploaderConfig {
 	return UploaderConfig{
-		DropsondePort:        3457,
-		LagerConfig:          lagerflags.DefaultLagerConfig(),
-		CCJobPollingInterval: Duration(1 * time.Second),
+		DropsondePort: 3457,
+		Metrics: Metrics{
+			Backend: MetricsBackendDropsonde,
+			Loggregator: LoggregatorAgent{
+				Address:       "localhost:3458",
+				SourceID:      "cc_uploader",
+				FlushInterval: Duration(time.Second),
+			},
+			Statsd: Statsd{
+				Address: "localhost:8125",
+				Prefix:  "cc_uploader.",
+			},
+		},
+		LagerConfig:               lagerflags.DefaultLagerConfig(),
+		LogSyslog:                 LogSyslog{Network: "udp", AppName: "cc-uploader"},
+		CCJobPollingInterval:      Duration(1 * time.Second),
+		DropletTimeouts:           DefaultRouteTimeouts(),
+		BuildArtifactsTimeouts:    DefaultRouteTimeouts(),
+		DropletDestination:        Destination{Type: DestinationTypeCC},
+		BuildArtifactsDestination: Destination{Type: DestinationTypeCC},
+		DropletForm:               UploadForm{Filename: "droplet.tgz"},
+		BuildArtifactsForm:        UploadForm{Filename: "buildpack_cache.tgz"},
+		UnixSocket:                UnixSocket{Mode: "0660"},
+		HealthCheck: HealthCheck{
+			CCProbeTimeout: Duration(2 * time.Second),
+			DrainDelay:     Duration(5 * time.Second),
+		},
+		CCTransport: Transport{
+			MaxIdleConnsPerHost:   16,
+			IdleConnTimeout:       Duration(90 * time.Second),
+			ExpectContinueTimeout: Duration(1 * time.Second),
+		},
+		Deduplication: Deduplication{
+			TTL:        Duration(24 * time.Hour),
+			MaxEntries: 10000,
+		},
+		DuplicateDropletUploads: DuplicateUploadsAllow,
+		UploadQuotas: UploadQuotas{
+			Window: Duration(time.Hour),
+		},
+		AuditLog: AuditLog{
+			MaxSizeMB:  100,
+			MaxBackups: 5,
+			SyslogTag:  "cc-uploader-audit",
+		},
 	}
 }
 
+// NewUploaderConfig parses the config file on top of the defaults and
+// validates it, returning a *ValidationError if it is not usable.
 func NewUploaderConfig(configPath string) (UploaderConfig, error) {
-	configFile, err := os.ReadFile(configPath)
+	uploaderConfig, err := ReadUploaderConfig(configPath)
 	if err != nil {
 		return UploaderConfig{}, err
 	}
 
-	uploaderConfig := DefaultUploaderConfig()
-
-	err = json.Unmarshal(configFile, &uploaderConfig)
+	err = uploaderConfig.Validate()
 	if err != nil {
 		return UploaderConfig{}, err
 	}
 
-	err = uploaderConfig.validate()
+	return uploaderConfig, nil
+}
+
+// ReadUploaderConfig parses the config file on top of the defaults without
+// checking for required values.
+func ReadUploaderConfig(configPath string) (UploaderConfig, error) {
+	configFile, err := os.ReadFile(configPath)
 	if err != nil {
 		return UploaderConfig{}, err
 	}
 
-	return uploaderConfig, nil
-}
-
-func (uploaderConfig *UploaderConfig) validate() error {
-	missingRequiredValues := make([]string, 0)
+	uploaderConfig := DefaultUploaderConfig()
 
-	if uploaderConfig.MutualTLS.ListenAddress == "" {
-		missingRequiredValues = append(missingRequiredValues, "'mutual_tls.listen_addr'")
-	}
-	if uploaderConfig.MutualTLS.CACert == "" {
-		missingRequiredValues = append(missingRequiredValues, "'mutual_tls.ca_cert'")
-	}
-	if uploaderConfig.MutualTLS.ServerCert == "" {
-		missingRequiredValues = append(missingRequiredValues, "'mutual_tls.server_cert'")
-	}
-	if uploaderConfig.MutualTLS.ServerKey == "" {
-		missingRequiredValues = append(missingRequiredValues, "'mutual_tls.server_key'")
+	err = json.Unmarshal(configFile, &uploaderConfig)
+	if err != nil {
+		return UploaderConfig{}, err
 	}
 
-	if len(missingRequiredValues) > 0 {
-		errorMsg := fmt.Sprintf("The following required config values were not provided: %s", strings.Join(missingRequiredValues, ","))
-		return errors.New(errorMsg)
+	if uploaderConfig.DevMode.Enabled() {
+		devModeDestination := Destination{Type: DestinationTypeFilesystem, Directory: uploaderConfig.DevMode.Directory}
+		uploaderConfig.DropletDestination = devModeDestination
+		uploaderConfig.BuildArtifactsDestination = devModeDestination
 	}
 
-	return nil
+	return uploaderConfig, nil
 }
@@ -1,6 +1,7 @@
 package config_test
 
 import (
+	"net/url"
 	"os"
 	"time"
 
@@ -38,10 +39,37 @@ var _ = Describe("Config", func() {
 						"debug_address": "debug_address"
 					},
 					"dropsonde_port": 12,
+					"metrics": {
+						"backend": "statsd",
+						"tags": {"deployment": "cf"},
+						"statsd": {
+							"dogstatsd": true
+						}
+					},
 					"lager_config": {
 						"log_level": "fatal"
 					},
 					"job_polling_interval": "5s",
+					"droplet_timeouts": {
+						"default_upload_timeout": "2m",
+						"max_upload_timeout": "10m",
+						"polling_timeout": "3m"
+					},
+					"build_artifacts_timeouts": {
+						"max_upload_timeout": "20m"
+					},
+					"droplet_destination": {
+						"type": "s3",
+						"s3": {
+							"endpoint": "https://s3.example.com",
+							"region": "us-east-1",
+							"bucket": "droplets",
+							"key_prefix": "cc",
+							"access_key_id": "access-key",
+							"secret_access_key": "secret-key",
+							"path_style": true
+						}
+					},
 
 					"cc_client_cert": "/path/to/server.cert",
 					"cc_client_key": "/path/to/server.key",
@@ -57,10 +85,17 @@ var _ = Describe("Config", func() {
 			})
 
 			It("reads from the config file and populates the config", func() {
-				uploaderConfig, err := NewUploaderConfig(configFile.Name())
+				uploaderConfig, err := ReadUploaderConfig(configFile.Name())
 				Expect(err).ToNot(HaveOccurred())
 
 				Expect(uploaderConfig.DropsondePort).To(Equal(12))
+				Expect(uploaderConfig.Metrics.Backend).To(Equal(MetricsBackendStatsd))
+				Expect(uploaderConfig.Metrics.Tags).To(Equal(map[string]string{"deployment": "cf"}))
+				Expect(uploaderConfig.Metrics.Statsd).To(Equal(Statsd{
+					Address:   "localhost:8125",
+					Prefix:    "cc_uploader.",
+					DogStatsD: true,
+				}))
 				Expect(uploaderConfig.LagerConfig.LogLevel).To(Equal("fatal"))
 				Expect(uploaderConfig.CCJobPollingInterval).To(Equal(Duration(5 * time.Second)))
 				Expect(uploaderConfig.DebugServerConfig.DebugAddress).To(Equal("debug_address"))
@@ -71,6 +106,29 @@ var _ = Describe("Config", func() {
 				Expect(uploaderConfig.MutualTLS.CACert).To(Equal("ca-cert"))
 				Expect(uploaderConfig.MutualTLS.ServerCert).To(Equal("server-cert"))
 				Expect(uploaderConfig.MutualTLS.ServerKey).To(Equal("server-key"))
+				Expect(uploaderConfig.DropletTimeouts).To(Equal(RouteTimeouts{
+					DefaultUploadTimeout: Duration(2 * time.Minute),
+					MaxUploadTimeout:     Duration(10 * time.Minute),
+					PollingTimeout:       Duration(3 * time.Minute),
+				}))
+				Expect(uploaderConfig.BuildArtifactsTimeouts).To(Equal(RouteTimeouts{
+					DefaultUploadTimeout: Duration(5 * time.Minute),
+					MaxUploadTimeout:     Duration(20 * time.Minute),
+					PollingTimeout:       Duration(5 * time.Minute),
+				}))
+				Expect(uploaderConfig.DropletDestination).To(Equal(Destination{
+					Type: DestinationTypeS3,
+					S3: S3Destination{
+						Endpoint:        "https://s3.example.com",
+						Region:          "us-east-1",
+						Bucket:          "droplets",
+						KeyPrefix:       "cc",
+						AccessKeyID:     "access-key",
+						SecretAccessKey: "secret-key",
+						PathStyle:       true,
+					},
+				}))
+				Expect(uploaderConfig.BuildArtifactsDestination).To(Equal(Destination{Type: DestinationTypeCC}))
 			})
 		})
 
@@ -87,12 +145,37 @@ var _ = Describe("Config", func() {
 			})
 
 			It("generates a config with the default values", func() {
-				uploaderConfig, err := NewUploaderConfig(configFile.Name())
+				uploaderConfig, err := ReadUploaderConfig(configFile.Name())
 				Expect(err).ToNot(HaveOccurred())
 
 				Expect(uploaderConfig.DropsondePort).To(Equal(3457))
+				Expect(uploaderConfig.Metrics.Backend).To(Equal(MetricsBackendDropsonde))
 				Expect(uploaderConfig.LagerConfig.LogLevel).To(Equal("info"))
 				Expect(uploaderConfig.CCJobPollingInterval).To(Equal(Duration(1 * time.Second)))
+				Expect(uploaderConfig.DropletTimeouts).To(Equal(DefaultRouteTimeouts()))
+				Expect(uploaderConfig.BuildArtifactsTimeouts).To(Equal(DefaultRouteTimeouts()))
+			})
+		})
+
+		Context("when dev mode is enabled", func() {
+			BeforeEach(func() {
+				configFileContent = `{
+					"dev_mode": {
+						"directory": "/tmp/cc-uploader"
+					},
+					"droplet_destination": {
+						"type": "put"
+					}
+				}`
+			})
+
+			It("stores both routes on the filesystem", func() {
+				uploaderConfig, err := ReadUploaderConfig(configFile.Name())
+				Expect(err).ToNot(HaveOccurred())
+
+				expected := Destination{Type: DestinationTypeFilesystem, Directory: "/tmp/cc-uploader"}
+				Expect(uploaderConfig.DropletDestination).To(Equal(expected))
+				Expect(uploaderConfig.BuildArtifactsDestination).To(Equal(expected))
 			})
 		})
 
@@ -101,9 +184,13 @@ var _ = Describe("Config", func() {
 				configFileContent = "{}"
 			})
 
-			It("returns an error", func() {
+			It("returns a validation error", func() {
 				_, err := NewUploaderConfig(configFile.Name())
-				Expect(err).To(MatchError("The following required config values were not provided: 'mutual_tls.listen_addr','mutual_tls.ca_cert','mutual_tls.server_cert','mutual_tls.server_key'"))
+				Expect(err).To(BeAssignableToTypeOf(&ValidationError{}))
+				Expect(err).To(MatchError(ContainSubstring("'mutual_tls.listen_addr': is required")))
+				Expect(err).To(MatchError(ContainSubstring("'mutual_tls.ca_cert': is required")))
+				Expect(err).To(MatchError(ContainSubstring("'mutual_tls.server_cert': is required")))
+				Expect(err).To(MatchError(ContainSubstring("'mutual_tls.server_key': is required")))
 			})
 		})
 
@@ -118,9 +205,10 @@ var _ = Describe("Config", func() {
 				}`
 			})
 
-			It("returns an error", func() {
+			It("returns a validation error", func() {
 				_, err := NewUploaderConfig(configFile.Name())
-				Expect(err).To(MatchError("The following required config values were not provided: 'mutual_tls.listen_addr'"))
+				Expect(err).To(BeAssignableToTypeOf(&ValidationError{}))
+				Expect(err).To(MatchError(ContainSubstring("'mutual_tls.listen_addr': is required")))
 			})
 		})
 
@@ -135,9 +223,10 @@ var _ = Describe("Config", func() {
 				}`
 			})
 
-			It("returns an error", func() {
+			It("returns a validation error", func() {
 				_, err := NewUploaderConfig(configFile.Name())
-				Expect(err).To(MatchError("The following required config values were not provided: 'mutual_tls.ca_cert'"))
+				Expect(err).To(BeAssignableToTypeOf(&ValidationError{}))
+				Expect(err).To(MatchError(ContainSubstring("'mutual_tls.ca_cert': is required")))
 			})
 		})
 
@@ -152,9 +241,10 @@ var _ = Describe("Config", func() {
 				}`
 			})
 
-			It("returns an error", func() {
+			It("returns a validation error", func() {
 				_, err := NewUploaderConfig(configFile.Name())
-				Expect(err).To(MatchError("The following required config values were not provided: 'mutual_tls.server_cert'"))
+				Expect(err).To(BeAssignableToTypeOf(&ValidationError{}))
+				Expect(err).To(MatchError(ContainSubstring("'mutual_tls.server_cert': is required")))
 			})
 		})
 
@@ -169,10 +259,76 @@ var _ = Describe("Config", func() {
 				}`
 			})
 
-			It("returns an error", func() {
+			It("returns a validation error", func() {
 				_, err := NewUploaderConfig(configFile.Name())
-				Expect(err).To(MatchError("The following required config values were not provided: 'mutual_tls.server_key'"))
+				Expect(err).To(BeAssignableToTypeOf(&ValidationError{}))
+				Expect(err).To(MatchError(ContainSubstring("'mutual_tls.server_key': is required")))
+			})
+		})
+	})
+
+	Describe("RouteTimeouts", func() {
+		var timeouts RouteTimeouts
+
+		BeforeEach(func() {
+			configFileContent = "{}"
+			timeouts = RouteTimeouts{
+				DefaultUploadTimeout: Duration(time.Minute),
+				MaxUploadTimeout:     Duration(10 * time.Minute),
+			}
+		})
+
+		It("uses the default when no timeout is requested", func() {
+			timeout, clamped := timeouts.UploadTimeout(0)
+			Expect(timeout).To(Equal(time.Minute))
+			Expect(clamped).To(BeFalse())
+		})
+
+		It("uses the requested timeout when it is within the maximum", func() {
+			timeout, clamped := timeouts.UploadTimeout(5 * time.Minute)
+			Expect(timeout).To(Equal(5 * time.Minute))
+			Expect(clamped).To(BeFalse())
+		})
+
+		It("clamps requested timeouts above the maximum", func() {
+			timeout, clamped := timeouts.UploadTimeout(time.Hour)
+			Expect(timeout).To(Equal(10 * time.Minute))
+			Expect(clamped).To(BeTrue())
+		})
+	})
+
+	Describe("UploadForm", func() {
+		var form UploadForm
+
+		BeforeEach(func() {
+			configFileContent = "{}"
+			form = UploadForm{
+				Filename:      "droplet.tgz",
+				Fields:        map[string]string{"stack": "cflinuxfs4", "lifecycle": "buildpack"},
+				RequestFields: []string{"stack", "buildpack"},
+			}
+		})
+
+		It("uses the static fields when the request sets none", func() {
+			Expect(form.FieldsFor(url.Values{})).To(Equal(map[string]string{"stack": "cflinuxfs4", "lifecycle": "buildpack"}))
+		})
+
+		It("lets the request set its allowed fields", func() {
+			fields := form.FieldsFor(url.Values{
+				"form.stack":     {"cflinuxfs5"},
+				"form.buildpack": {"ruby_buildpack"},
+			})
+			Expect(fields).To(Equal(map[string]string{"stack": "cflinuxfs5", "lifecycle": "buildpack", "buildpack": "ruby_buildpack"}))
+			Expect(form.Fields).To(Equal(map[string]string{"stack": "cflinuxfs4", "lifecycle": "buildpack"}))
+		})
+
+		It("ignores fields the request is not allowed to set", func() {
+			fields := form.FieldsFor(url.Values{
+				"form.lifecycle": {"docker"},
+				"form.file":      {"clash"},
+				"stack":          {"cflinuxfs5"},
 			})
+			Expect(fields).To(Equal(map[string]string{"stack": "cflinuxfs4", "lifecycle": "buildpack"}))
 		})
 	})
 })
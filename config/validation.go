@@ -0,0 +1,532 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"mime"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader"
+)
+
+type Problem struct {
+	Field   string
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("'%s': %s", p.Field, p.Message)
+}
+
+// ValidationError collects every problem found while validating a config so
+// that operators can fix them all in one pass.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		problems = append(problems, p.String())
+	}
+	return fmt.Sprintf("The config is invalid: %s", strings.Join(problems, "; "))
+}
+
+func (e *ValidationError) add(field, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, Problem{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate performs a full check of the config, including that every
+// referenced certificate and key can be loaded. It returns a *ValidationError
+// listing all problems, or nil if the config is usable.
+func (uploaderConfig UploaderConfig) Validate() error {
+	validationErr := &ValidationError{}
+
+	validationErr.checkListenAddress("mutual_tls.listen_addr", uploaderConfig.MutualTLS.ListenAddress, true)
+	validationErr.checkCACert("mutual_tls.ca_cert", uploaderConfig.MutualTLS.CACert)
+	validationErr.checkKeyPair(
+		"mutual_tls.server_cert", uploaderConfig.MutualTLS.ServerCert,
+		"mutual_tls.server_key", uploaderConfig.MutualTLS.ServerKey,
+	)
+
+	// Dev mode never talks to CC, so the CC certificates are only checked if
+	// they are given.
+	devModeWithoutCC := uploaderConfig.DevMode.Enabled() &&
+		uploaderConfig.CCCACert == "" && uploaderConfig.CCClientCert == "" && uploaderConfig.CCClientKey == ""
+	if !devModeWithoutCC {
+		validationErr.checkCACert("cc_ca_cert", uploaderConfig.CCCACert)
+		validationErr.checkKeyPair(
+			"cc_client_cert", uploaderConfig.CCClientCert,
+			"cc_client_key", uploaderConfig.CCClientKey,
+		)
+	}
+
+	validationErr.checkUnixSocket(uploaderConfig.UnixSocket)
+	validationErr.checkListeners(uploaderConfig.MutualTLS.ListenAddress, uploaderConfig.Listeners)
+	validationErr.checkListenAddress("debug_server_config.debug_address", uploaderConfig.DebugServerConfig.DebugAddress, false)
+	validationErr.checkPort("dropsonde_port", uploaderConfig.DropsondePort)
+	validationErr.checkPositiveDuration("job_polling_interval", uploaderConfig.CCJobPollingInterval)
+	validationErr.checkRouteTimeouts("droplet_timeouts", uploaderConfig.DropletTimeouts)
+	validationErr.checkRouteTimeouts("build_artifacts_timeouts", uploaderConfig.BuildArtifactsTimeouts)
+
+	validationErr.checkDestination("droplet_destination", uploaderConfig.DropletDestination)
+	validationErr.checkDestination("build_artifacts_destination", uploaderConfig.BuildArtifactsDestination)
+
+	validationErr.checkUploadForm("droplet_form", uploaderConfig.DropletForm)
+	validationErr.checkUploadForm("build_artifacts_form", uploaderConfig.BuildArtifactsForm)
+
+	validationErr.checkHealthCheck(uploaderConfig.HealthCheck)
+	validationErr.checkAuditLog(uploaderConfig.AuditLog)
+	validationErr.checkLogSyslog(uploaderConfig.LogSyslog)
+	validationErr.checkMetrics(uploaderConfig.Metrics)
+	validationErr.checkTransport("cc_transport", uploaderConfig.CCTransport)
+	validationErr.checkProxy("cc_proxy", uploaderConfig.CCProxy)
+
+	if uploaderConfig.Deduplication.Enabled {
+		validationErr.checkPositiveDuration("deduplication.ttl", uploaderConfig.Deduplication.TTL)
+		if uploaderConfig.Deduplication.MaxEntries < 0 {
+			validationErr.add("deduplication.max_entries", "must not be negative, got %d", uploaderConfig.Deduplication.MaxEntries)
+		}
+	}
+
+	switch uploaderConfig.DuplicateDropletUploads {
+	case "", DuplicateUploadsAllow, DuplicateUploadsWait, DuplicateUploadsReject:
+	default:
+		validationErr.add("duplicate_droplet_uploads", "must be one of %q, %q or %q, got %q",
+			DuplicateUploadsAllow, DuplicateUploadsWait, DuplicateUploadsReject, uploaderConfig.DuplicateDropletUploads)
+	}
+
+	if uploaderConfig.MaxInFlightUploads < 0 {
+		validationErr.add("max_in_flight_uploads", "must not be negative, got %d", uploaderConfig.MaxInFlightUploads)
+	}
+
+	validationErr.checkUploadQuotas(uploaderConfig.UploadQuotas)
+
+	if len(validationErr.Problems) > 0 {
+		return validationErr
+	}
+	return nil
+}
+
+func (e *ValidationError) checkListenAddress(field, address string, required bool) {
+	if address == "" {
+		if required {
+			e.add(field, "is required")
+		}
+		return
+	}
+
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		e.add(field, "is not a valid address: %s", err)
+		return
+	}
+
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		e.add(field, "has an invalid port %q", port)
+		return
+	}
+	if portNumber < 0 || portNumber > 65535 {
+		e.add(field, "has a port out of range: %d", portNumber)
+	}
+}
+
+func (e *ValidationError) checkListeners(primaryAddress string, listeners []Listener) {
+	names := map[string]bool{}
+	addresses := map[string]bool{primaryAddress: true}
+	for i, listener := range listeners {
+		field := fmt.Sprintf("listeners[%d]", i)
+
+		if listener.Name == "" {
+			e.add(field+".name", "is required")
+		} else if names[listener.Name] {
+			e.add(field+".name", "duplicates another listener's name %q", listener.Name)
+		}
+		names[listener.Name] = true
+
+		e.checkListenAddress(field+".mutual_tls.listen_addr", listener.MutualTLS.ListenAddress, true)
+		if listener.MutualTLS.ListenAddress != "" && addresses[listener.MutualTLS.ListenAddress] {
+			e.add(field+".mutual_tls.listen_addr", "duplicates another listener's address %q", listener.MutualTLS.ListenAddress)
+		}
+		addresses[listener.MutualTLS.ListenAddress] = true
+
+		e.checkCACert(field+".mutual_tls.ca_cert", listener.MutualTLS.CACert)
+		e.checkKeyPair(
+			field+".mutual_tls.server_cert", listener.MutualTLS.ServerCert,
+			field+".mutual_tls.server_key", listener.MutualTLS.ServerKey,
+		)
+
+		for _, route := range listener.Routes {
+			if _, ok := ccuploader.Routes.FindRouteByName(route); !ok {
+				e.add(field+".routes", "has an unknown route %q", route)
+			}
+		}
+
+		if listener.RateLimit.RequestsPerSecond < 0 {
+			e.add(field+".rate_limit.requests_per_second", "must not be negative")
+		}
+		if listener.RateLimit.Burst < 0 {
+			e.add(field+".rate_limit.burst", "must not be negative")
+		}
+	}
+}
+
+func (e *ValidationError) checkUnixSocket(unixSocket UnixSocket) {
+	if unixSocket.Path == "" {
+		return
+	}
+
+	if runtime.GOOS != "linux" {
+		e.add("unix_socket.path", "requires Linux, for peer credentials")
+	}
+	if info, err := os.Stat(filepath.Dir(unixSocket.Path)); err != nil || !info.IsDir() {
+		e.add("unix_socket.path", "must be in an existing directory")
+	}
+	if _, err := unixSocket.FileMode(); err != nil {
+		e.add("unix_socket.mode", "%s", err)
+	}
+	if _, err := unixSocket.OwnerUID(); err != nil {
+		e.add("unix_socket.owner", "is not a known user: %s", err)
+	}
+	if _, err := unixSocket.GroupGID(); err != nil {
+		e.add("unix_socket.group", "is not a known group: %s", err)
+	}
+}
+
+func (e *ValidationError) checkPort(field string, port int) {
+	if port < 1 || port > 65535 {
+		e.add(field, "must be between 1 and 65535, got %d", port)
+	}
+}
+
+func (e *ValidationError) checkPositiveDuration(field string, d Duration) {
+	if d <= 0 {
+		e.add(field, "must be a positive duration, got %s", time.Duration(d))
+	}
+}
+
+func (e *ValidationError) checkRouteTimeouts(field string, t RouteTimeouts) {
+	e.checkPositiveDuration(field+".default_upload_timeout", t.DefaultUploadTimeout)
+	e.checkPositiveDuration(field+".max_upload_timeout", t.MaxUploadTimeout)
+	e.checkPositiveDuration(field+".polling_timeout", t.PollingTimeout)
+
+	if t.DefaultUploadTimeout > t.MaxUploadTimeout {
+		e.add(field+".default_upload_timeout", "must not exceed '%s.max_upload_timeout'", field)
+	}
+}
+
+func (e *ValidationError) checkHealthCheck(healthCheck HealthCheck) {
+	if healthCheck.ListenAddress == "" {
+		return
+	}
+
+	e.checkListenAddress("health_check.listen_addr", healthCheck.ListenAddress, true)
+	if healthCheck.ServerCert != "" || healthCheck.ServerKey != "" {
+		e.checkKeyPair(
+			"health_check.server_cert", healthCheck.ServerCert,
+			"health_check.server_key", healthCheck.ServerKey,
+		)
+	}
+	if healthCheck.CACert != "" {
+		if healthCheck.ServerCert == "" {
+			e.add("health_check.ca_cert", "requires 'health_check.server_cert' and 'health_check.server_key'")
+		}
+		e.checkCACert("health_check.ca_cert", healthCheck.CACert)
+	}
+	if healthCheck.CCProbeURL != "" {
+		if _, err := url.ParseRequestURI(healthCheck.CCProbeURL); err != nil {
+			e.add("health_check.cc_probe_url", "is not a valid URL: %s", err)
+		}
+		e.checkPositiveDuration("health_check.cc_probe_timeout", healthCheck.CCProbeTimeout)
+	}
+	if healthCheck.DrainDelay < 0 {
+		e.add("health_check.drain_delay", "must not be negative, got %s", time.Duration(healthCheck.DrainDelay))
+	}
+}
+
+func (e *ValidationError) checkDestination(field string, destination Destination) {
+	switch destination.Type {
+	case "", DestinationTypeCC, DestinationTypePut:
+	case DestinationTypeFilesystem:
+		if destination.Directory == "" {
+			e.add(field+".directory", "is required for the %s destination", destination.Type)
+		}
+	case DestinationTypeS3:
+		s3 := destination.S3
+		if endpoint, err := url.Parse(s3.Endpoint); err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+			e.add(field+".s3.endpoint", "must be an absolute URL, got %q", s3.Endpoint)
+		}
+		for _, required := range []struct{ name, value string }{
+			{"region", s3.Region},
+			{"bucket", s3.Bucket},
+			{"access_key_id", s3.AccessKeyID},
+			{"secret_access_key", s3.SecretAccessKey},
+		} {
+			if required.value == "" {
+				e.add(field+".s3."+required.name, "is required for the %s destination", destination.Type)
+			}
+		}
+	default:
+		e.add(field+".type", "must be one of %q, %q, %q or %q, got %q",
+			DestinationTypeCC, DestinationTypePut, DestinationTypeFilesystem, DestinationTypeS3, destination.Type)
+	}
+}
+
+func (e *ValidationError) checkCACert(field, path string) {
+	contents, ok := e.readPEMFile(field, path)
+	if !ok {
+		return
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(contents) {
+		e.add(field, "does not contain any valid PEM certificates: %s", path)
+	}
+}
+
+func (e *ValidationError) checkKeyPair(certField, certPath, keyField, keyPath string) {
+	_, certOK := e.readPEMFile(certField, certPath)
+	_, keyOK := e.readPEMFile(keyField, keyPath)
+	if !certOK || !keyOK {
+		return
+	}
+
+	_, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		e.add(certField, "does not match '%s': %s", keyField, err)
+	}
+}
+
+func (e *ValidationError) readPEMFile(field, path string) ([]byte, bool) {
+	if path == "" {
+		e.add(field, "is required")
+		return nil, false
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		e.add(field, "cannot be read: %s", err)
+		return nil, false
+	}
+
+	if block, _ := pem.Decode(contents); block == nil {
+		e.add(field, "is not PEM encoded: %s", path)
+		return nil, false
+	}
+
+	return contents, true
+}
+
+func (e *ValidationError) checkUploadForm(field string, form UploadForm) {
+	// The filename is also used as a path element by the filesystem and s3
+	// destinations
+	switch {
+	case form.Filename == "":
+		e.add(field+".filename", "is required")
+	case form.Filename == "." || form.Filename == ".." || strings.ContainsAny(form.Filename, "/\\"):
+		e.add(field+".filename", "must be a plain file name, got %q", form.Filename)
+	}
+
+	if form.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(form.ContentType); err != nil {
+			e.add(field+".content_type", "is not a valid media type: %s", err)
+		}
+	}
+
+	for name := range form.Fields {
+		if name == "" || name == "file" {
+			e.add(field+".fields", "must not use the field name %q", name)
+		}
+	}
+	for _, name := range form.RequestFields {
+		if name == "" || name == "file" {
+			e.add(field+".request_fields", "must not use the field name %q", name)
+		}
+	}
+}
+
+func (e *ValidationError) checkAuditLog(auditLog AuditLog) {
+	switch auditLog.Destination {
+	case "":
+	case AuditLogDestinationFile:
+		if auditLog.Path == "" {
+			e.add("audit_log.path", "is required for the %s destination", auditLog.Destination)
+		}
+		if auditLog.MaxSizeMB < 0 {
+			e.add("audit_log.max_size_mb", "must not be negative, got %d", auditLog.MaxSizeMB)
+		}
+		if auditLog.MaxBackups < 0 {
+			e.add("audit_log.max_backups", "must not be negative, got %d", auditLog.MaxBackups)
+		}
+	case AuditLogDestinationSyslog:
+		switch auditLog.SyslogNetwork {
+		case "", "udp", "tcp", "unix", "unixgram":
+		default:
+			e.add("audit_log.syslog_network", "must be one of \"udp\", \"tcp\", \"unix\" or \"unixgram\", got %q", auditLog.SyslogNetwork)
+		}
+		if auditLog.SyslogAddress != "" && auditLog.SyslogNetwork == "" {
+			e.add("audit_log.syslog_network", "is required with 'audit_log.syslog_address'")
+		}
+	default:
+		e.add("audit_log.destination", "must be one of %q or %q, got %q",
+			AuditLogDestinationFile, AuditLogDestinationSyslog, auditLog.Destination)
+	}
+}
+
+func (e *ValidationError) checkLogSyslog(logSyslog LogSyslog) {
+	if logSyslog.Address == "" {
+		return
+	}
+
+	switch logSyslog.Network {
+	case "udp", "tcp", "tls":
+	default:
+		e.add("log_syslog.network", "must be one of \"udp\", \"tcp\" or \"tls\", got %q", logSyslog.Network)
+	}
+	if _, _, err := net.SplitHostPort(logSyslog.Address); err != nil {
+		e.add("log_syslog.address", "is not a valid address: %s", err)
+	}
+	if logSyslog.CACert != "" {
+		if logSyslog.Network != "tls" {
+			e.add("log_syslog.ca_cert", "requires the \"tls\" network")
+		}
+		e.checkCACert("log_syslog.ca_cert", logSyslog.CACert)
+	}
+}
+
+func (e *ValidationError) checkMetrics(metrics Metrics) {
+	switch metrics.Backend {
+	case "", MetricsBackendDropsonde:
+	case MetricsBackendLoggregator:
+		loggregator := metrics.Loggregator
+		if _, _, err := net.SplitHostPort(loggregator.Address); err != nil {
+			e.add("metrics.loggregator.address", "is not a valid address: %s", err)
+		}
+		e.checkCACert("metrics.loggregator.ca_cert", loggregator.CACert)
+		e.checkKeyPair(
+			"metrics.loggregator.client_cert", loggregator.ClientCert,
+			"metrics.loggregator.client_key", loggregator.ClientKey,
+		)
+		if loggregator.SourceID == "" {
+			e.add("metrics.loggregator.source_id", "is required")
+		}
+		e.checkPositiveDuration("metrics.loggregator.flush_interval", loggregator.FlushInterval)
+	case MetricsBackendStatsd:
+		if _, _, err := net.SplitHostPort(metrics.Statsd.Address); err != nil {
+			e.add("metrics.statsd.address", "is not a valid address: %s", err)
+		}
+	default:
+		e.add("metrics.backend", "must be one of %q, %q or %q, got %q",
+			MetricsBackendDropsonde, MetricsBackendLoggregator, MetricsBackendStatsd, metrics.Backend)
+	}
+}
+
+func (e *ValidationError) checkUploadQuotas(quotas UploadQuotas) {
+	for _, value := range []struct {
+		name  string
+		value int64
+	}{
+		{"max_concurrent_uploads", int64(quotas.MaxConcurrentUploads)},
+		{"max_bytes_per_window", quotas.MaxBytesPerWindow},
+		{"max_object_size", quotas.MaxObjectSize},
+	} {
+		if value.value < 0 {
+			e.add("upload_quotas."+value.name, "must not be negative, got %d", value.value)
+		}
+	}
+	if quotas.MaxBytesPerWindow > 0 {
+		e.checkPositiveDuration("upload_quotas.window", quotas.Window)
+	}
+}
+
+func (e *ValidationError) checkProxy(field string, proxy Proxy) {
+	if proxy.URL == "" {
+		if proxy.Username != "" || proxy.Password != "" || len(proxy.NoProxy) > 0 || proxy.CACert != "" {
+			e.add(field+".url", "must be set when other proxy settings are")
+		}
+		return
+	}
+
+	proxyURL, err := url.Parse(proxy.URL)
+	switch {
+	case err != nil:
+		e.add(field+".url", "is not a valid URL: %s", err)
+	case !slices.Contains(ProxySchemes, proxyURL.Scheme):
+		e.add(field+".url", "has unsupported scheme %q, must be one of %s", proxyURL.Scheme, strings.Join(ProxySchemes, ", "))
+		proxyURL = nil
+	case proxyURL.Host == "":
+		e.add(field+".url", "has no host")
+		proxyURL = nil
+	}
+	if proxy.Password != "" && proxy.Username == "" {
+		e.add(field+".username", "must be set when 'password' is")
+	}
+	for _, entry := range proxy.NoProxy {
+		if !validNoProxyEntry(entry) {
+			e.add(field+".no_proxy", "invalid entry %q", entry)
+		}
+	}
+	if proxy.CACert != "" {
+		if proxyURL != nil && proxyURL.Scheme != "https" {
+			e.add(field+".ca_cert", "requires an \"https\" proxy URL")
+		}
+		e.checkCACert(field+".ca_cert", proxy.CACert)
+	}
+}
+
+// validNoProxyEntry reports whether entry follows the NO_PROXY conventions:
+// "*", an IP address or CIDR range, or a domain, optionally with a leading
+// dot, each optionally followed by ":port".
+func validNoProxyEntry(entry string) bool {
+	entry = strings.TrimSpace(entry)
+	if entry == "*" {
+		return true
+	}
+	if _, _, err := net.ParseCIDR(entry); err == nil {
+		return true
+	}
+
+	host := entry
+	if h, _, err := net.SplitHostPort(entry); err == nil {
+		host = h
+	}
+	host = strings.TrimPrefix(host, ".")
+	return host != "" && !strings.ContainsAny(host, "/[], \t")
+}
+
+func (e *ValidationError) checkTransport(field string, transport Transport) {
+	for _, value := range []struct {
+		name  string
+		value int64
+	}{
+		{"max_idle_conns_per_host", int64(transport.MaxIdleConnsPerHost)},
+		{"max_conns_per_host", int64(transport.MaxConnsPerHost)},
+		{"idle_conn_timeout", int64(transport.IdleConnTimeout)},
+		{"response_header_timeout", int64(transport.ResponseHeaderTimeout)},
+		{"expect_continue_timeout", int64(transport.ExpectContinueTimeout)},
+		{"write_buffer_size", int64(transport.WriteBufferSize)},
+		{"read_buffer_size", int64(transport.ReadBufferSize)},
+	} {
+		if value.value < 0 {
+			e.add(field+"."+value.name, "must not be negative")
+		}
+	}
+	if transport.MaxConnsPerHost > 0 && transport.MaxIdleConnsPerHost > transport.MaxConnsPerHost {
+		e.add(field+".max_idle_conns_per_host", "must not exceed 'max_conns_per_host' (%d), got %d",
+			transport.MaxConnsPerHost, transport.MaxIdleConnsPerHost)
+	}
+	if transport.ExpectContinue && transport.ExpectContinueTimeout == 0 {
+		e.add(field+".expect_continue_timeout", "must be set when 'expect_continue' is enabled")
+	}
+}
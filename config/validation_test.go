@@ -0,0 +1,390 @@
+package config_test
+
+import (
+	"path/filepath"
+	"runtime"
+	"time"
+
+	. "code.cloudfoundry.org/cc-uploader/config"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Validate", func() {
+	var (
+		uploaderConfig UploaderConfig
+		fixturesPath   = filepath.Join("..", "fixtures")
+	)
+
+	BeforeEach(func() {
+		uploaderConfig = DefaultUploaderConfig()
+		uploaderConfig.CCCACert = filepath.Join(fixturesPath, "cc_uploader_ca_cn.crt")
+		uploaderConfig.CCClientCert = filepath.Join(fixturesPath, "cc_uploader_cn.crt")
+		uploaderConfig.CCClientKey = filepath.Join(fixturesPath, "cc_uploader_cn.key")
+		uploaderConfig.MutualTLS = MutualTLS{
+			ListenAddress: "localhost:9090",
+			CACert:        filepath.Join(fixturesPath, "certs", "ca.crt"),
+			ServerCert:    filepath.Join(fixturesPath, "certs", "server.crt"),
+			ServerKey:     filepath.Join(fixturesPath, "certs", "server.key"),
+		}
+	})
+
+	problemFields := func(err error) []string {
+		validationErr, ok := err.(*ValidationError)
+		Expect(ok).To(BeTrue())
+
+		fields := []string{}
+		for _, p := range validationErr.Problems {
+			fields = append(fields, p.Field)
+		}
+		return fields
+	}
+
+	It("accepts a config referencing valid files", func() {
+		Expect(uploaderConfig.Validate()).To(Succeed())
+	})
+
+	It("reports missing files", func() {
+		uploaderConfig.CCCACert = filepath.Join(fixturesPath, "does-not-exist.crt")
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf("cc_ca_cert"))
+		Expect(err).To(MatchError(ContainSubstring("'cc_ca_cert': cannot be read")))
+	})
+
+	It("reports files that are not PEM encoded", func() {
+		uploaderConfig.MutualTLS.CACert = filepath.Join(fixturesPath, "cc_uploader_ca_cn.crl")
+		uploaderConfig.CCCACert = filepath.Join("validation_test.go")
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf("mutual_tls.ca_cert", "cc_ca_cert"))
+	})
+
+	It("reports certificates that do not match their keys", func() {
+		uploaderConfig.CCClientKey = filepath.Join(fixturesPath, "certs", "client.key")
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf("cc_client_cert"))
+		Expect(err).To(MatchError(ContainSubstring("does not match 'cc_client_key'")))
+	})
+
+	It("reports listen addresses that do not parse", func() {
+		uploaderConfig.MutualTLS.ListenAddress = "localhost"
+		uploaderConfig.DebugServerConfig.DebugAddress = "localhost:99999"
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf("mutual_tls.listen_addr", "debug_server_config.debug_address"))
+	})
+
+	It("reports a default upload timeout above the maximum", func() {
+		uploaderConfig.DropletTimeouts.DefaultUploadTimeout = Duration(2 * time.Hour)
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf("droplet_timeouts.default_upload_timeout"))
+	})
+
+	It("reports problems with the health check listener", func() {
+		uploaderConfig.HealthCheck = HealthCheck{
+			ListenAddress:  "localhost:8080",
+			CACert:         filepath.Join(fixturesPath, "certs", "ca.crt"),
+			CCProbeURL:     "not a url",
+			CCProbeTimeout: Duration(time.Second),
+			DrainDelay:     Duration(-time.Second),
+		}
+		uploaderConfig.MaxInFlightUploads = -1
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf("health_check.ca_cert", "health_check.cc_probe_url", "health_check.drain_delay", "max_in_flight_uploads"))
+	})
+
+	It("accepts a mutual TLS health check listener", func() {
+		uploaderConfig.HealthCheck = HealthCheck{
+			ListenAddress: "localhost:8080",
+			CACert:        filepath.Join(fixturesPath, "certs", "ca.crt"),
+			ServerCert:    filepath.Join(fixturesPath, "certs", "server.crt"),
+			ServerKey:     filepath.Join(fixturesPath, "certs", "server.key"),
+		}
+
+		Expect(uploaderConfig.Validate()).To(Succeed())
+	})
+
+	It("reports incomplete upload destinations", func() {
+		uploaderConfig.DropletDestination = Destination{Type: DestinationTypeS3, S3: S3Destination{
+			Endpoint: "s3.example.com",
+			Region:   "us-east-1",
+			Bucket:   "droplets",
+		}}
+		uploaderConfig.BuildArtifactsDestination = Destination{Type: DestinationTypeFilesystem}
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf(
+			"droplet_destination.s3.endpoint",
+			"droplet_destination.s3.access_key_id",
+			"droplet_destination.s3.secret_access_key",
+			"build_artifacts_destination.directory",
+		))
+	})
+
+	It("reports unknown upload destinations", func() {
+		uploaderConfig.DropletDestination = Destination{Type: "ftp"}
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf("droplet_destination.type"))
+	})
+
+	It("does not require CC certificates in dev mode", func() {
+		uploaderConfig.DevMode = DevMode{Directory: "/tmp/cc-uploader"}
+		uploaderConfig.CCCACert = ""
+		uploaderConfig.CCClientCert = ""
+		uploaderConfig.CCClientKey = ""
+
+		Expect(uploaderConfig.Validate()).To(Succeed())
+	})
+
+	It("reports invalid deduplication settings", func() {
+		uploaderConfig.Deduplication = Deduplication{Enabled: true, MaxEntries: -1}
+		uploaderConfig.DuplicateDropletUploads = "ignore"
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf("deduplication.ttl", "deduplication.max_entries", "duplicate_droplet_uploads"))
+	})
+
+	It("reports invalid upload forms", func() {
+		uploaderConfig.DropletForm = UploadForm{Filename: "../droplet.tgz", ContentType: "not a media type"}
+		uploaderConfig.BuildArtifactsForm.Fields = map[string]string{"file": "clash"}
+		uploaderConfig.BuildArtifactsForm.RequestFields = []string{"stack", ""}
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf("droplet_form.filename", "droplet_form.content_type", "build_artifacts_form.fields", "build_artifacts_form.request_fields"))
+	})
+
+	It("reports incomplete audit log settings", func() {
+		uploaderConfig.AuditLog = AuditLog{Destination: AuditLogDestinationFile, MaxBackups: -1}
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf("audit_log.path", "audit_log.max_backups"))
+	})
+
+	It("reports unknown audit log destinations and syslog networks", func() {
+		uploaderConfig.AuditLog = AuditLog{Destination: AuditLogDestinationSyslog, SyslogNetwork: "http"}
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf("audit_log.syslog_network"))
+
+		uploaderConfig.AuditLog = AuditLog{Destination: "kafka"}
+
+		err = uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf("audit_log.destination"))
+	})
+
+	It("reports invalid syslog logging settings", func() {
+		uploaderConfig.LogSyslog = LogSyslog{Network: "udp", Address: "localhost", CACert: filepath.Join(fixturesPath, "certs", "ca.crt")}
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf("log_syslog.address", "log_syslog.ca_cert"))
+	})
+
+	It("reports invalid upload quotas", func() {
+		uploaderConfig.UploadQuotas = UploadQuotas{
+			MaxConcurrentUploads: -1,
+			MaxBytesPerWindow:    1024,
+			MaxObjectSize:        -1,
+		}
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf(
+			"upload_quotas.max_concurrent_uploads",
+			"upload_quotas.max_object_size",
+			"upload_quotas.window",
+		))
+	})
+
+	It("reports invalid metrics settings", func() {
+		uploaderConfig.Metrics.Backend = "graphite"
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf("metrics.backend"))
+
+		uploaderConfig.Metrics.Backend = MetricsBackendStatsd
+		uploaderConfig.Metrics.Statsd.Address = "localhost"
+
+		err = uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf("metrics.statsd.address"))
+	})
+
+	It("requires mutual TLS and a flush interval for the loggregator backend", func() {
+		uploaderConfig.Metrics.Backend = MetricsBackendLoggregator
+		uploaderConfig.Metrics.Loggregator.FlushInterval = 0
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf(
+			"metrics.loggregator.ca_cert",
+			"metrics.loggregator.client_cert",
+			"metrics.loggregator.client_key",
+			"metrics.loggregator.flush_interval",
+		))
+
+		uploaderConfig.Metrics.Loggregator = LoggregatorAgent{
+			Address:       "localhost:3458",
+			CACert:        filepath.Join(fixturesPath, "certs", "ca.crt"),
+			ClientCert:    filepath.Join(fixturesPath, "cc_uploader_cn.crt"),
+			ClientKey:     filepath.Join(fixturesPath, "cc_uploader_cn.key"),
+			SourceID:      "cc_uploader",
+			FlushInterval: Duration(time.Second),
+		}
+		Expect(uploaderConfig.Validate()).To(Succeed())
+	})
+
+	It("reports invalid connection pool settings", func() {
+		uploaderConfig.CCTransport.MaxConnsPerHost = 8
+		uploaderConfig.CCTransport.IdleConnTimeout = Duration(-1 * time.Second)
+		uploaderConfig.CCTransport.ReadBufferSize = -1
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf(
+			"cc_transport.max_idle_conns_per_host",
+			"cc_transport.idle_conn_timeout",
+			"cc_transport.read_buffer_size",
+		))
+	})
+
+	It("reports invalid listeners", func() {
+		valid := Listener{
+			Name:      "build-service",
+			MutualTLS: uploaderConfig.MutualTLS,
+			Routes:    []string{"UploadBuildArtifacts"},
+		}
+		valid.MutualTLS.ListenAddress = "0.0.0.0:9091"
+
+		duplicate := valid
+		duplicate.Routes = []string{"UploadEverything"}
+		duplicate.RateLimit = RateLimit{RequestsPerSecond: -1}
+
+		unnamed := valid
+		unnamed.Name = ""
+		unnamed.MutualTLS.ListenAddress = uploaderConfig.MutualTLS.ListenAddress
+
+		uploaderConfig.Listeners = []Listener{valid, duplicate, unnamed}
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf(
+			"listeners[1].name",
+			"listeners[1].mutual_tls.listen_addr",
+			"listeners[1].routes",
+			"listeners[1].rate_limit.requests_per_second",
+			"listeners[2].name",
+			"listeners[2].mutual_tls.listen_addr",
+		))
+	})
+
+	It("reports invalid unix socket settings", func() {
+		uploaderConfig.UnixSocket = UnixSocket{
+			Path:  filepath.Join(fixturesPath, "missing", "cc-uploader.sock"),
+			Mode:  "0999",
+			Owner: "no-such-user-for-cc-uploader",
+			Group: "no-such-group-for-cc-uploader",
+		}
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf(
+			"unix_socket.path",
+			"unix_socket.mode",
+			"unix_socket.owner",
+			"unix_socket.group",
+		))
+	})
+
+	It("accepts numeric unix socket owners and groups", func() {
+		if runtime.GOOS != "linux" {
+			Skip("unix sockets require Linux")
+		}
+		uploaderConfig.UnixSocket = UnixSocket{
+			Path:  filepath.Join(fixturesPath, "cc-uploader.sock"),
+			Mode:  "0600",
+			Owner: "1000",
+			Group: "1000",
+		}
+
+		Expect(uploaderConfig.Validate()).To(Succeed())
+	})
+
+	It("reports invalid proxy settings", func() {
+		uploaderConfig.CCProxy = Proxy{
+			URL:      "socks4://proxy.example.com:1080",
+			Password: "secret",
+			NoProxy:  []string{"cc.example.com", "example.com/path"},
+			CACert:   filepath.Join(fixturesPath, "certs", "ca.crt"),
+		}
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf("cc_proxy.url", "cc_proxy.username", "cc_proxy.no_proxy"))
+	})
+
+	It("accepts no_proxy entries following the NO_PROXY conventions", func() {
+		uploaderConfig.CCProxy = Proxy{
+			URL:     "socks5h://proxy.example.com:1080",
+			NoProxy: []string{"*", "10.0.0.0/8", "192.168.1.1", "::1", "[::1]:8443", "example.com", ".example.com", "cc.example.com:9023"},
+		}
+
+		Expect(uploaderConfig.Validate()).To(Succeed())
+	})
+
+	It("requires a proxy URL with the other proxy settings", func() {
+		uploaderConfig.CCProxy = Proxy{NoProxy: []string{"cc.example.com"}}
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf("cc_proxy.url"))
+	})
+
+	It("requires an https proxy for the proxy CA", func() {
+		uploaderConfig.CCProxy = Proxy{
+			URL:    "http://proxy.example.com:3128",
+			CACert: filepath.Join(fixturesPath, "certs", "ca.crt"),
+		}
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf("cc_proxy.ca_cert"))
+	})
+
+	It("requires a 100 Continue timeout when expect_continue is enabled", func() {
+		uploaderConfig.CCTransport.ExpectContinue = true
+		uploaderConfig.CCTransport.ExpectContinueTimeout = 0
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf("cc_transport.expect_continue_timeout"))
+	})
+
+	It("reports ports out of range and non-positive durations", func() {
+		uploaderConfig.DropsondePort = 0
+		uploaderConfig.CCJobPollingInterval = Duration(-1 * time.Second)
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf("dropsonde_port", "job_polling_interval"))
+	})
+
+	It("reports every problem at once", func() {
+		uploaderConfig = UploaderConfig{}
+
+		err := uploaderConfig.Validate()
+		Expect(problemFields(err)).To(ConsistOf(
+			"mutual_tls.listen_addr",
+			"mutual_tls.ca_cert",
+			"mutual_tls.server_cert",
+			"mutual_tls.server_key",
+			"cc_ca_cert",
+			"cc_client_cert",
+			"cc_client_key",
+			"dropsonde_port",
+			"job_polling_interval",
+			"droplet_timeouts.default_upload_timeout",
+			"droplet_timeouts.max_upload_timeout",
+			"droplet_timeouts.polling_timeout",
+			"build_artifacts_timeouts.default_upload_timeout",
+			"build_artifacts_timeouts.max_upload_timeout",
+			"build_artifacts_timeouts.polling_timeout",
+			"droplet_form.filename",
+			"build_artifacts_form.filename",
+		))
+	})
+})
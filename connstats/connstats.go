@@ -0,0 +1,112 @@
+// Package connstats counts how the connections of an HTTP client's pool are
+// used, so that pool settings can be tuned against real traffic.
+package connstats
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of a Transport's counters. NewConnections counts the
+// connections dialed for requests and ReusedConnections the requests that
+// were sent over an existing one, of which IdleConnections had been idle in
+// the pool. ActiveRequests are those that have not received a response yet.
+type Stats struct {
+	Requests             int64 `json:"requests"`
+	ActiveRequests       int64 `json:"active_requests"`
+	NewConnections       int64 `json:"new_connections"`
+	ReusedConnections    int64 `json:"reused_connections"`
+	IdleConnections      int64 `json:"idle_connections"`
+	DialFailures         int64 `json:"dial_failures"`
+	TLSHandshakes        int64 `json:"tls_handshakes"`
+	TLSHandshakeFailures int64 `json:"tls_handshake_failures"`
+}
+
+// Transport wraps an http.RoundTripper and traces every request it sends
+// with httptrace.
+type Transport struct {
+	base http.RoundTripper
+
+	requests             atomic.Int64
+	activeRequests       atomic.Int64
+	newConnections       atomic.Int64
+	reusedConnections    atomic.Int64
+	idleConnections      atomic.Int64
+	dialFailures         atomic.Int64
+	tlsHandshakes        atomic.Int64
+	tlsHandshakeFailures atomic.Int64
+}
+
+func NewTransport(base http.RoundTripper) *Transport {
+	return &Transport{base: base}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests.Add(1)
+	t.activeRequests.Add(1)
+	defer t.activeRequests.Add(-1)
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				t.newConnections.Add(1)
+				return
+			}
+			t.reusedConnections.Add(1)
+			if info.WasIdle {
+				t.idleConnections.Add(1)
+			}
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				t.dialFailures.Add(1)
+			}
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.tlsHandshakes.Add(1)
+			if err != nil {
+				t.tlsHandshakeFailures.Add(1)
+			}
+		},
+	}
+
+	return t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped transport,
+// so that http.Client.CloseIdleConnections keeps working.
+func (t *Transport) CloseIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+func (t *Transport) Stats() Stats {
+	return Stats{
+		Requests:             t.requests.Load(),
+		ActiveRequests:       t.activeRequests.Load(),
+		NewConnections:       t.newConnections.Load(),
+		ReusedConnections:    t.reusedConnections.Load(),
+		IdleConnections:      t.idleConnections.Load(),
+		DialFailures:         t.dialFailures.Load(),
+		TLSHandshakes:        t.tlsHandshakes.Load(),
+		TLSHandshakeFailures: t.tlsHandshakeFailures.Load(),
+	}
+}
+
+// NewHandler serves the stats of each transport as JSON, keyed by name. It
+// is meant to be mounted on the debug server.
+func NewHandler(transports map[string]*Transport) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := make(map[string]Stats, len(transports))
+		for name, transport := range transports {
+			stats[name] = transport.Stats()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+}
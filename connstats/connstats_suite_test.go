@@ -0,0 +1,13 @@
+package connstats_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestConnstats(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Connstats Suite")
+}
@@ -0,0 +1,94 @@
+package connstats_test
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	"code.cloudfoundry.org/cc-uploader/connstats"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Transport", func() {
+	var (
+		server    *httptest.Server
+		transport *connstats.Transport
+		client    *http.Client
+	)
+
+	get := func(url string) error {
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		return resp.Body.Close()
+	}
+
+	BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+		transport = connstats.NewTransport(&http.Transport{})
+		client = &http.Client{Transport: transport}
+	})
+
+	AfterEach(func() {
+		client.CloseIdleConnections()
+		server.Close()
+	})
+
+	It("counts new and reused connections", func() {
+		Expect(get(server.URL)).To(Succeed())
+		Expect(get(server.URL)).To(Succeed())
+
+		Expect(transport.Stats()).To(Equal(connstats.Stats{
+			Requests:          2,
+			NewConnections:    1,
+			ReusedConnections: 1,
+			IdleConnections:   1,
+		}))
+	})
+
+	It("counts TLS handshakes", func() {
+		tlsServer := httptest.NewTLSServer(server.Config.Handler)
+		defer tlsServer.Close()
+		transport = connstats.NewTransport(tlsServer.Client().Transport)
+		client = &http.Client{Transport: transport}
+
+		Expect(get(tlsServer.URL)).To(Succeed())
+
+		stats := transport.Stats()
+		Expect(stats.TLSHandshakes).To(Equal(int64(1)))
+		Expect(stats.TLSHandshakeFailures).To(BeZero())
+	})
+
+	It("counts failed dials", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		address := listener.Addr().String()
+		listener.Close()
+
+		Expect(get("http://" + address)).NotTo(Succeed())
+
+		stats := transport.Stats()
+		Expect(stats.DialFailures).To(Equal(int64(1)))
+		Expect(stats.ActiveRequests).To(BeZero())
+	})
+
+	It("serves the stats of every transport as JSON", func() {
+		Expect(get(server.URL)).To(Succeed())
+
+		recorder := httptest.NewRecorder()
+		connstats.NewHandler(map[string]*connstats.Transport{"upload": transport}).
+			ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/transport-stats", nil))
+
+		Expect(recorder.Header().Get("Content-Type")).To(Equal("application/json"))
+		var stats map[string]connstats.Stats
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &stats)).To(Succeed())
+		Expect(stats).To(HaveKeyWithValue("upload", transport.Stats()))
+	})
+})
@@ -0,0 +1,145 @@
+package dedup
+
+import (
+	"bytes"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"code.cloudfoundry.org/cc-uploader/metrics"
+	"code.cloudfoundry.org/cc-uploader/requestid"
+	"code.cloudfoundry.org/lager/v3"
+)
+
+const (
+	HitsCounter   = "DedupHits"
+	MissesCounter = "DedupMisses"
+)
+
+// Deduplicator skips uploads whose Content-Digest matches a recent
+// successful upload to the same resource. When deduplication is off the
+// Deduplicator is nil and Begin reports every upload as new.
+type Deduplicator struct {
+	logger lager.Logger
+	index  Index
+}
+
+func New(logger lager.Logger, index Index) *Deduplicator {
+	return &Deduplicator{
+		logger: logger.Session("dedup"),
+		index:  index,
+	}
+}
+
+// Resource identifies the resource an upload URL refers to, ignoring its
+// query parameters.
+func Resource(uploadURL *url.URL) string {
+	resource := *uploadURL
+	resource.RawQuery = ""
+	resource.Fragment = ""
+	resource.User = nil
+	return resource.String()
+}
+
+// Begin looks the request up in the index. It reports a hit if an upload
+// with the same digest to resource has already succeeded, in which case the
+// transfer can be skipped. Otherwise it returns an Upload that records the
+// digest once the upload succeeds, or nil if the request carries no usable
+// Content-Digest.
+func (d *Deduplicator) Begin(resource string, r *http.Request) (*Upload, bool) {
+	if d == nil {
+		return nil, false
+	}
+
+	digest, ok := ParseContentDigest(r.Header.Get(ContentDigestHeader))
+	if !ok {
+		return nil, false
+	}
+
+	key := resource + " " + digest.String()
+	logger := d.logger.WithData(requestid.Data(r.Context())).WithData(lager.Data{"resource": resource, "digest": digest.String()})
+	if d.index.Contains(key) {
+		logger.Info("hit")
+		metrics.IncrementCounter(HitsCounter)
+		return nil, true
+	}
+
+	logger.Info("miss")
+	metrics.IncrementCounter(MissesCounter)
+	return &Upload{
+		logger: logger,
+		index:  d.index,
+		key:    key,
+		digest: digest,
+		hash:   digest.newHash(),
+	}, false
+}
+
+// Upload computes the digest of an upload body so that only uploads whose
+// content matches the digest they claimed are recorded.
+type Upload struct {
+	logger lager.Logger
+	index  Index
+	key    string
+	digest Digest
+
+	lock sync.Mutex
+	hash hash.Hash
+	read bool
+}
+
+// TrackBody wraps the request body so that its digest is computed as the
+// body is read.
+func (u *Upload) TrackBody(body io.ReadCloser) io.ReadCloser {
+	if u == nil {
+		return body
+	}
+	return &hashingReadCloser{ReadCloser: body, upload: u}
+}
+
+// Succeeded records the upload in the index if the whole body was read and
+// matched the digest from the request.
+func (u *Upload) Succeeded() {
+	if u == nil {
+		return
+	}
+
+	u.lock.Lock()
+	matched := u.read && bytes.Equal(u.hash.Sum(nil), u.digest.Value)
+	u.lock.Unlock()
+
+	if !matched {
+		u.logger.Info("not-recording-mismatched-digest")
+		return
+	}
+	err := u.index.Add(u.key)
+	if err != nil {
+		u.logger.Error("failed-persisting-key", err)
+	}
+}
+
+// Skip discards the request body of a duplicate upload so the connection can
+// be reused.
+func Skip(body io.Reader) {
+	io.Copy(io.Discard, body)
+}
+
+type hashingReadCloser struct {
+	io.ReadCloser
+	upload *Upload
+}
+
+func (h *hashingReadCloser) Read(p []byte) (int, error) {
+	n, err := h.ReadCloser.Read(p)
+
+	h.upload.lock.Lock()
+	h.upload.hash.Write(p[:n])
+	if err == io.EOF {
+		h.upload.read = true
+	}
+	h.upload.lock.Unlock()
+
+	return n, err
+}
@@ -0,0 +1,13 @@
+package dedup_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestDedup(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Dedup Suite")
+}
@@ -0,0 +1,94 @@
+package dedup_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/dedup"
+	"code.cloudfoundry.org/lager/v3/lagertest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Deduplicator", func() {
+	var (
+		deduplicator *dedup.Deduplicator
+		resource     string
+	)
+
+	newRequest := func(body, claimedBody string) *http.Request {
+		request, err := http.NewRequest("POST", "", bytes.NewBufferString(body))
+		Expect(err).NotTo(HaveOccurred())
+		sum := sha256.Sum256([]byte(claimedBody))
+		request.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+		return request
+	}
+
+	upload := func(request *http.Request) {
+		dedupUpload, hit := deduplicator.Begin(resource, request)
+		Expect(hit).To(BeFalse())
+		Expect(dedupUpload).NotTo(BeNil())
+
+		io.ReadAll(dedupUpload.TrackBody(request.Body))
+		dedupUpload.Succeeded()
+	}
+
+	BeforeEach(func() {
+		deduplicator = dedup.New(lagertest.NewTestLogger("test"), dedup.NewMemoryIndex(time.Hour, 0))
+		uploadURL, _ := url.Parse("https://cc.example.com/staging/droplets/guid/upload?async=true")
+		resource = dedup.Resource(uploadURL)
+	})
+
+	It("ignores the query of the upload URL", func() {
+		Expect(resource).To(Equal("https://cc.example.com/staging/droplets/guid/upload"))
+	})
+
+	It("reports a hit for an identical upload to the same resource", func() {
+		upload(newRequest("droplet", "droplet"))
+
+		_, hit := deduplicator.Begin(resource, newRequest("droplet", "droplet"))
+		Expect(hit).To(BeTrue())
+
+		_, hit = deduplicator.Begin("https://cc.example.com/staging/droplets/other-guid/upload", newRequest("droplet", "droplet"))
+		Expect(hit).To(BeFalse())
+	})
+
+	It("does not record uploads whose body does not match their digest", func() {
+		upload(newRequest("droplet", "other-droplet"))
+
+		_, hit := deduplicator.Begin(resource, newRequest("other-droplet", "other-droplet"))
+		Expect(hit).To(BeFalse())
+	})
+
+	It("does not record uploads that were not fully read", func() {
+		request := newRequest("droplet", "droplet")
+		dedupUpload, _ := deduplicator.Begin(resource, request)
+		dedupUpload.TrackBody(request.Body).Read(make([]byte, 3))
+		dedupUpload.Succeeded()
+
+		_, hit := deduplicator.Begin(resource, newRequest("droplet", "droplet"))
+		Expect(hit).To(BeFalse())
+	})
+
+	It("skips requests without a Content-Digest", func() {
+		request, _ := http.NewRequest("POST", "", bytes.NewBufferString("droplet"))
+		dedupUpload, hit := deduplicator.Begin(resource, request)
+		Expect(hit).To(BeFalse())
+		Expect(dedupUpload).To(BeNil())
+	})
+
+	It("does nothing when disabled", func() {
+		var disabled *dedup.Deduplicator
+		dedupUpload, hit := disabled.Begin(resource, newRequest("droplet", "droplet"))
+		Expect(hit).To(BeFalse())
+		Expect(dedupUpload).To(BeNil())
+
+		dedupUpload.Succeeded()
+	})
+})
@@ -0,0 +1,60 @@
+package dedup
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"hash"
+	"strings"
+)
+
+const ContentDigestHeader = "Content-Digest"
+
+// Digest is a single digest from a Content-Digest header (RFC 9530).
+type Digest struct {
+	Algorithm string
+	Value     []byte
+}
+
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-512": sha512.New,
+	"sha-256": sha256.New,
+}
+
+// ParseContentDigest returns the strongest supported digest in a
+// Content-Digest header value, e.g. "sha-256=:RK/0qy18MlBSVnWgjwz6lZEWjP/lF5HF9bvEF8FabDg=:".
+// It reports false if the header contains no supported digest.
+func ParseContentDigest(header string) (Digest, bool) {
+	digests := map[string][]byte{}
+	for _, member := range strings.Split(header, ",") {
+		algorithm, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok {
+			continue
+		}
+		algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+		value = strings.TrimSpace(value)
+		if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		if err != nil || len(decoded) == 0 {
+			continue
+		}
+		digests[algorithm] = decoded
+	}
+
+	for _, algorithm := range []string{"sha-512", "sha-256"} {
+		if value, ok := digests[algorithm]; ok {
+			return Digest{Algorithm: algorithm, Value: value}, true
+		}
+	}
+	return Digest{}, false
+}
+
+func (d Digest) String() string {
+	return d.Algorithm + "=:" + base64.StdEncoding.EncodeToString(d.Value) + ":"
+}
+
+func (d Digest) newHash() hash.Hash {
+	return digestAlgorithms[d.Algorithm]()
+}
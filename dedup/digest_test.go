@@ -0,0 +1,31 @@
+package dedup_test
+
+import (
+	"code.cloudfoundry.org/cc-uploader/dedup"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseContentDigest", func() {
+	It("parses a sha-256 digest", func() {
+		digest, ok := dedup.ParseContentDigest("sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:")
+		Expect(ok).To(BeTrue())
+		Expect(digest.Algorithm).To(Equal("sha-256"))
+		Expect(digest.Value).To(HaveLen(32))
+		Expect(digest.String()).To(Equal("sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:"))
+	})
+
+	It("prefers the strongest supported algorithm", func() {
+		digest, ok := dedup.ParseContentDigest("sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:, SHA-512=:WZDPaVn/7XgHaAy8pmojAkGWoRx2UFChF41A2svX+TaPm+AbwAgBWnrIiYllu7BNNyealdVLvRwEmTHWXvJwew==:")
+		Expect(ok).To(BeTrue())
+		Expect(digest.Algorithm).To(Equal("sha-512"))
+	})
+
+	It("ignores unsupported and malformed digests", func() {
+		for _, header := range []string{"", "md5=:abc=:", "sha-256=abc", "sha-256=:not base64:"} {
+			_, ok := dedup.ParseContentDigest(header)
+			Expect(ok).To(BeFalse(), header)
+		}
+	})
+})
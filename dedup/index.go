@@ -0,0 +1,245 @@
+package dedup
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+)
+
+// Index remembers the keys of recent successful uploads. Add reports if a
+// key could only be remembered in memory.
+type Index interface {
+	Contains(key string) bool
+	Add(key string) error
+}
+
+type memoryEntry struct {
+	key     string
+	addedAt time.Time
+}
+
+type memoryIndex struct {
+	ttl        time.Duration
+	maxEntries int
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+// NewMemoryIndex returns an index that forgets keys after ttl. Once it holds
+// maxEntries keys the oldest is dropped for every key added; a maxEntries of
+// zero means there is no limit.
+func NewMemoryIndex(ttl time.Duration, maxEntries int) Index {
+	return newMemoryIndex(ttl, maxEntries)
+}
+
+func newMemoryIndex(ttl time.Duration, maxEntries int) *memoryIndex {
+	return &memoryIndex{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		order:      list.New(),
+	}
+}
+
+func (i *memoryIndex) Contains(key string) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	element, ok := i.entries[key]
+	if !ok {
+		return false
+	}
+	if time.Since(element.Value.(*memoryEntry).addedAt) > i.ttl {
+		i.remove(element)
+		return false
+	}
+	return true
+}
+
+func (i *memoryIndex) Add(key string) error {
+	i.add(key, time.Now())
+	return nil
+}
+
+func (i *memoryIndex) add(key string, addedAt time.Time) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if element, ok := i.entries[key]; ok {
+		i.remove(element)
+	}
+	i.entries[key] = i.order.PushBack(&memoryEntry{key: key, addedAt: addedAt})
+
+	for i.maxEntries > 0 && i.order.Len() > i.maxEntries {
+		i.remove(i.order.Front())
+	}
+}
+
+func (i *memoryIndex) remove(element *list.Element) {
+	i.order.Remove(element)
+	delete(i.entries, element.Value.(*memoryEntry).key)
+}
+
+func (i *memoryIndex) len() int {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return i.order.Len()
+}
+
+// live returns the entries that have not expired, oldest first.
+func (i *memoryIndex) live() []memoryEntry {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	entries := []memoryEntry{}
+	for element := i.order.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*memoryEntry)
+		if time.Since(entry.addedAt) <= i.ttl {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries
+}
+
+type fileRecord struct {
+	Key     string    `json:"key"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// minCompactionRecords is how many records the index file holds before it is
+// compacted at the earliest, so that small indexes are not rewritten on
+// every few uploads.
+const minCompactionRecords = 1000
+
+type fileIndex struct {
+	*memoryIndex
+	logger lager.Logger
+	path   string
+
+	fileLock sync.Mutex
+	file     *os.File
+	// records counts the records in file, live or not
+	records int
+}
+
+// NewFileIndex returns an in-memory index that is also appended to the file
+// at path, so that it survives restarts. The file is loaded and compacted
+// to the keys that are still live when the index is created, and compacted
+// again whenever it holds more than twice as many records as there are keys
+// in memory.
+func NewFileIndex(logger lager.Logger, path string, ttl time.Duration, maxEntries int) (Index, error) {
+	index := &fileIndex{
+		memoryIndex: newMemoryIndex(ttl, maxEntries),
+		logger:      logger.Session("dedup-index", lager.Data{"path": path}),
+		path:        path,
+	}
+
+	err := index.load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = index.reopenCompacted()
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func (i *fileIndex) load(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record fileRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			i.logger.Info("skipping-invalid-record", lager.Data{"error": err.Error()})
+			continue
+		}
+		if time.Since(record.AddedAt) <= i.ttl {
+			i.memoryIndex.add(record.Key, record.AddedAt)
+		}
+	}
+	return scanner.Err()
+}
+
+// reopenCompacted replaces the file with one holding only the live keys and
+// appends to it from then on. The current file is kept if that fails. Once
+// the index is in use, it must be called with fileLock held.
+func (i *fileIndex) reopenCompacted() error {
+	records, err := i.compact(i.path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(i.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if i.file != nil {
+		i.file.Close()
+	}
+	i.file = file
+	i.records = records
+	return nil
+}
+
+func (i *fileIndex) compact(path string) (int, error) {
+	tempFile, err := os.CreateTemp(filepath.Dir(path), ".dedup-index.*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tempFile.Name())
+
+	entries := i.live()
+	encoder := json.NewEncoder(tempFile)
+	for _, entry := range entries {
+		err = encoder.Encode(fileRecord{Key: entry.key, AddedAt: entry.addedAt})
+		if err != nil {
+			tempFile.Close()
+			return 0, err
+		}
+	}
+	err = tempFile.Close()
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), os.Rename(tempFile.Name(), path)
+}
+
+func (i *fileIndex) Add(key string) error {
+	record := fileRecord{Key: key, AddedAt: time.Now()}
+	i.memoryIndex.add(record.Key, record.AddedAt)
+
+	i.fileLock.Lock()
+	defer i.fileLock.Unlock()
+
+	err := json.NewEncoder(i.file).Encode(record)
+	if err != nil {
+		return err
+	}
+	i.records++
+
+	if i.records > max(2*i.len(), minCompactionRecords) {
+		err = i.reopenCompacted()
+		if err != nil {
+			i.logger.Error("failed-compacting", err)
+		}
+	}
+	return nil
+}
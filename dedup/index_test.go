@@ -0,0 +1,93 @@
+package dedup_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/dedup"
+	"code.cloudfoundry.org/lager/v3/lagertest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Index", func() {
+	Describe("NewMemoryIndex", func() {
+		It("remembers keys until they expire", func() {
+			index := dedup.NewMemoryIndex(50*time.Millisecond, 0)
+			index.Add("key")
+
+			Expect(index.Contains("key")).To(BeTrue())
+			Expect(index.Contains("other-key")).To(BeFalse())
+			Eventually(func() bool { return index.Contains("key") }).Should(BeFalse())
+		})
+
+		It("drops the oldest keys once full", func() {
+			index := dedup.NewMemoryIndex(time.Hour, 2)
+			index.Add("first")
+			index.Add("second")
+			index.Add("third")
+
+			Expect(index.Contains("first")).To(BeFalse())
+			Expect(index.Contains("second")).To(BeTrue())
+			Expect(index.Contains("third")).To(BeTrue())
+		})
+	})
+
+	Describe("NewFileIndex", func() {
+		var path string
+
+		BeforeEach(func() {
+			path = filepath.Join(GinkgoT().TempDir(), "dedup-index")
+		})
+
+		It("keeps keys across restarts", func() {
+			index, err := dedup.NewFileIndex(lagertest.NewTestLogger("test"), path, time.Hour, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(index.Add("key")).To(Succeed())
+
+			reloaded, err := dedup.NewFileIndex(lagertest.NewTestLogger("test"), path, time.Hour, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reloaded.Contains("key")).To(BeTrue())
+		})
+
+		It("compacts the file once it holds many more records than keys", func() {
+			index, err := dedup.NewFileIndex(lagertest.NewTestLogger("test"), path, time.Hour, 10)
+			Expect(err).NotTo(HaveOccurred())
+			for n := 0; n < 5000; n++ {
+				Expect(index.Add(fmt.Sprintf("key-%d", n))).To(Succeed())
+			}
+
+			contents, err := os.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(strings.Count(string(contents), "\n")).To(BeNumerically("<=", 1001))
+
+			reloaded, err := dedup.NewFileIndex(lagertest.NewTestLogger("test"), path, time.Hour, 10)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reloaded.Contains("key-4999")).To(BeTrue())
+			Expect(reloaded.Contains("key-4990")).To(BeTrue())
+			Expect(reloaded.Contains("key-4989")).To(BeFalse())
+		})
+
+		It("drops expired and invalid records when loading", func() {
+			Expect(os.WriteFile(path, []byte(
+				`{"key":"old","added_at":"2001-01-01T00:00:00Z"}`+"\n"+
+					"garbage\n"+
+					`{"key":"new","added_at":"`+time.Now().Format(time.RFC3339Nano)+`"}`+"\n",
+			), 0600)).To(Succeed())
+
+			index, err := dedup.NewFileIndex(lagertest.NewTestLogger("test"), path, time.Hour, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(index.Contains("old")).To(BeFalse())
+			Expect(index.Contains("new")).To(BeTrue())
+
+			contents, err := os.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).NotTo(ContainSubstring("old"))
+			Expect(string(contents)).NotTo(ContainSubstring("garbage"))
+		})
+	})
+})
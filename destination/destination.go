@@ -0,0 +1,131 @@
+package destination
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"code.cloudfoundry.org/cc-uploader/ccclient"
+	"code.cloudfoundry.org/cc-uploader/config"
+	"code.cloudfoundry.org/lager/v3"
+)
+
+// Destination stores a file uploaded to one of the routes. guid identifies
+// the droplet or app the file belongs to and uploadURL is the upload URI
+// given by the client. Only the CC destination sends the form fields in
+// options; the others use just the filename and content type.
+//
+// Destinations that complete the upload synchronously respond with a
+// finished CC job, so that the droplet route's poller returns immediately.
+//
+//go:generate counterfeiter -o fake_destination/fake_destination.go . Destination
+type Destination interface {
+	Upload(ctx context.Context, guid string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error)
+}
+
+// New builds the destination described by destinationConfig. CC uploads go
+// through uploader; the other network destinations use client.
+func New(logger lager.Logger, destinationConfig config.Destination, uploader ccclient.Uploader, client *http.Client) (Destination, error) {
+	switch destinationConfig.Type {
+	case "", config.DestinationTypeCC:
+		return NewCC(uploader), nil
+	case config.DestinationTypePut:
+		return NewPut(logger, client), nil
+	case config.DestinationTypeFilesystem:
+		return NewFilesystem(logger, destinationConfig.Directory), nil
+	case config.DestinationTypeS3:
+		return NewS3(logger, client, destinationConfig.S3)
+	}
+	return nil, fmt.Errorf("unknown destination type: %s", destinationConfig.Type)
+}
+
+type ccDestination struct {
+	uploader ccclient.Uploader
+}
+
+// NewCC returns a destination that posts a multipart form to the CC upload
+// URI.
+func NewCC(uploader ccclient.Uploader) Destination {
+	return &ccDestination{uploader: uploader}
+}
+
+func (d *ccDestination) Upload(ctx context.Context, guid string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+	if options.Async {
+		asyncURL := *uploadURL
+		query := asyncURL.Query()
+		query.Set("async", "true")
+		asyncURL.RawQuery = query.Encode()
+		uploadURL = &asyncURL
+	}
+	return d.uploader.Upload(ctx, uploadURL, options, r)
+}
+
+const (
+	contentMD5Header    = "Content-MD5"
+	contentDigestHeader = "Content-Digest"
+)
+
+// contentType is the content type the non-CC destinations store a file with.
+func contentType(options ccclient.UploadOptions) string {
+	if options.ContentType != "" {
+		return options.ContentType
+	}
+	return ccclient.DefaultContentType
+}
+
+func copyChecksumHeaders(from, to *http.Request) {
+	for _, header := range []string{contentMD5Header, contentDigestHeader} {
+		if value := from.Header.Get(header); value != "" {
+			to.Header.Set(header, value)
+		}
+	}
+}
+
+// finishedJobResponse mimics the response CC gives once an asynchronous
+// upload job has completed.
+func finishedJobResponse(guid string) *http.Response {
+	body, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]string{
+			"guid": guid,
+			"url":  "/v2/jobs/" + guid,
+		},
+		"entity": map[string]string{
+			"guid":   guid,
+			"status": ccclient.JOB_FINISHED,
+		},
+	})
+
+	return &http.Response{
+		StatusCode:    http.StatusCreated,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+	}
+}
+
+func missingContentLength() (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusLengthRequired}, fmt.Errorf("Missing Content Length")
+}
+
+// doRequest sends req and turns any non-2xx response into an error, in the
+// same form as the CC uploader.
+func doRequest(client *http.Client, req *http.Request, guid string) (*http.Response, error) {
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		return rsp, fmt.Errorf("status code: %d\n%s", rsp.StatusCode, string(respBody))
+	}
+
+	io.Copy(io.Discard, rsp.Body)
+	rsp.Body.Close()
+	return finishedJobResponse(guid), nil
+}
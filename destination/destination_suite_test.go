@@ -0,0 +1,13 @@
+package destination_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestDestination(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Destination Suite")
+}
@@ -0,0 +1,96 @@
+package destination_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+
+	"code.cloudfoundry.org/cc-uploader/ccclient"
+	"code.cloudfoundry.org/cc-uploader/ccclient/fake_ccclient"
+	"code.cloudfoundry.org/cc-uploader/config"
+	"code.cloudfoundry.org/cc-uploader/destination"
+	"code.cloudfoundry.org/lager/v3/lagertest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("New", func() {
+	var (
+		logger   *lagertest.TestLogger
+		uploader *fake_ccclient.FakeUploader
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		uploader = &fake_ccclient.FakeUploader{}
+	})
+
+	It("defaults to uploading to CC", func() {
+		uploadResponse := &http.Response{StatusCode: http.StatusCreated}
+		uploader.UploadReturns(uploadResponse, nil)
+
+		dest, err := destination.New(logger, config.Destination{}, uploader, http.DefaultClient)
+		Expect(err).NotTo(HaveOccurred())
+
+		uploadURL, _ := url.Parse("http://cc.example.com/upload")
+		request, _ := http.NewRequest("POST", "", bytes.NewBufferString("droplet"))
+		rsp, err := dest.Upload(context.Background(), "some-guid", uploadURL, ccclient.UploadOptions{Filename: "droplet.tgz"}, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rsp).To(Equal(uploadResponse))
+
+		Expect(uploader.UploadCallCount()).To(Equal(1))
+		_, calledURL, options, calledRequest := uploader.UploadArgsForCall(0)
+		Expect(calledURL).To(Equal(uploadURL))
+		Expect(options.Filename).To(Equal("droplet.tgz"))
+		Expect(calledRequest).To(Equal(request))
+	})
+
+	It("asks CC for asynchronous uploads without changing the caller's upload URI", func() {
+		dest, err := destination.New(logger, config.Destination{}, uploader, http.DefaultClient)
+		Expect(err).NotTo(HaveOccurred())
+
+		uploadURL, _ := url.Parse("http://cc.example.com/upload?token=abc")
+		request, _ := http.NewRequest("POST", "", bytes.NewBufferString("droplet"))
+		_, err = dest.Upload(context.Background(), "some-guid", uploadURL, ccclient.UploadOptions{Async: true}, request)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, calledURL, _, _ := uploader.UploadArgsForCall(0)
+		Expect(calledURL.String()).To(Equal("http://cc.example.com/upload?async=true&token=abc"))
+		Expect(uploadURL.String()).To(Equal("http://cc.example.com/upload?token=abc"))
+	})
+
+	It("rejects unknown destination types", func() {
+		_, err := destination.New(logger, config.Destination{Type: "ftp"}, uploader, http.DefaultClient)
+		Expect(err).To(MatchError("unknown destination type: ftp"))
+	})
+
+	It("rejects S3 destinations without an absolute endpoint", func() {
+		_, err := destination.New(logger, config.Destination{Type: config.DestinationTypeS3, S3: config.S3Destination{
+			Endpoint: "s3.example.com",
+		}}, uploader, http.DefaultClient)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+func expectFinishedJob(rsp *http.Response, guid string) {
+	Expect(rsp.StatusCode).To(Equal(http.StatusCreated))
+
+	body, err := io.ReadAll(rsp.Body)
+	Expect(err).NotTo(HaveOccurred())
+
+	var job struct {
+		Metadata struct {
+			Guid string `json:"guid"`
+		} `json:"metadata"`
+		Entity struct {
+			Status string `json:"status"`
+		} `json:"entity"`
+	}
+	Expect(json.Unmarshal(body, &job)).To(Succeed())
+	Expect(job.Metadata.Guid).To(Equal(guid))
+	Expect(job.Entity.Status).To(Equal(ccclient.JOB_FINISHED))
+}
@@ -0,0 +1,67 @@
+// This file was generated by counterfeiter
+package fake_destination
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"code.cloudfoundry.org/cc-uploader/ccclient"
+	"code.cloudfoundry.org/cc-uploader/destination"
+)
+
+type FakeDestination struct {
+	UploadStub        func(ctx context.Context, guid string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error)
+	uploadMutex       sync.RWMutex
+	uploadArgsForCall []struct {
+		ctx       context.Context
+		guid      string
+		uploadURL *url.URL
+		options   ccclient.UploadOptions
+		r         *http.Request
+	}
+	uploadReturns struct {
+		result1 *http.Response
+		result2 error
+	}
+}
+
+func (fake *FakeDestination) Upload(ctx context.Context, guid string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+	fake.uploadMutex.Lock()
+	fake.uploadArgsForCall = append(fake.uploadArgsForCall, struct {
+		ctx       context.Context
+		guid      string
+		uploadURL *url.URL
+		options   ccclient.UploadOptions
+		r         *http.Request
+	}{ctx, guid, uploadURL, options, r})
+	fake.uploadMutex.Unlock()
+	if fake.UploadStub != nil {
+		return fake.UploadStub(ctx, guid, uploadURL, options, r)
+	} else {
+		return fake.uploadReturns.result1, fake.uploadReturns.result2
+	}
+}
+
+func (fake *FakeDestination) UploadCallCount() int {
+	fake.uploadMutex.RLock()
+	defer fake.uploadMutex.RUnlock()
+	return len(fake.uploadArgsForCall)
+}
+
+func (fake *FakeDestination) UploadArgsForCall(i int) (context.Context, string, *url.URL, ccclient.UploadOptions, *http.Request) {
+	fake.uploadMutex.RLock()
+	defer fake.uploadMutex.RUnlock()
+	return fake.uploadArgsForCall[i].ctx, fake.uploadArgsForCall[i].guid, fake.uploadArgsForCall[i].uploadURL, fake.uploadArgsForCall[i].options, fake.uploadArgsForCall[i].r
+}
+
+func (fake *FakeDestination) UploadReturns(result1 *http.Response, result2 error) {
+	fake.UploadStub = nil
+	fake.uploadReturns = struct {
+		result1 *http.Response
+		result2 error
+	}{result1, result2}
+}
+
+var _ destination.Destination = new(FakeDestination)
@@ -0,0 +1,105 @@
+package destination
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/cc-uploader/ccclient"
+	"code.cloudfoundry.org/cc-uploader/requestid"
+	"code.cloudfoundry.org/lager/v3"
+)
+
+var errUploadCancelled = errors.New("upload cancelled")
+
+type filesystemDestination struct {
+	logger    lager.Logger
+	directory string
+}
+
+// NewFilesystem returns a destination that writes files to
+// <directory>/<guid>/<filename>, e.g. <directory>/<guid>/droplet.tgz. It is
+// meant for development and testing without a CC.
+func NewFilesystem(logger lager.Logger, directory string) Destination {
+	return &filesystemDestination{
+		logger:    logger.Session("filesystem-destination"),
+		directory: directory,
+	}
+}
+
+func (d *filesystemDestination) Upload(ctx context.Context, guid string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+	defer r.Body.Close()
+
+	if !isPathElement(guid) {
+		return &http.Response{StatusCode: http.StatusBadRequest}, fmt.Errorf("invalid guid: %q", guid)
+	}
+
+	path := filepath.Join(d.directory, guid, options.Filename)
+	logger := d.logger.WithData(requestid.Data(ctx)).WithData(lager.Data{"guid": guid, "path": path})
+
+	logger.Info("writing")
+	err := d.write(path, &cancellableReader{reader: r.Body, ctx: ctx})
+	if err != nil {
+		logger.Error("failed-writing", err)
+		return nil, err
+	}
+	logger.Info("succeeded-writing")
+
+	return finishedJobResponse(guid), nil
+}
+
+// write stores body at path via a temporary file in the same directory, so
+// that readers never see a partially written file and a failed upload
+// leaves any previous file in place.
+func (d *filesystemDestination) write(path string, body io.Reader) error {
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = io.Copy(tempFile, body)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempFile.Name(), 0644)
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), path)
+}
+
+// isPathElement reports whether name can be used as a single directory
+// name without escaping its parent.
+func isPathElement(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name
+}
+
+type cancellableReader struct {
+	reader io.Reader
+	ctx    context.Context
+}
+
+func (c *cancellableReader) Read(p []byte) (int, error) {
+	if c.ctx.Err() != nil {
+		return 0, errUploadCancelled
+	}
+	return c.reader.Read(p)
+}
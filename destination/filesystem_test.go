@@ -0,0 +1,84 @@
+package destination_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/cc-uploader/ccclient"
+	"code.cloudfoundry.org/cc-uploader/destination"
+	"code.cloudfoundry.org/lager/v3/lagertest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Filesystem", func() {
+	var (
+		directory string
+		dest      destination.Destination
+		request   *http.Request
+	)
+
+	BeforeEach(func() {
+		directory = GinkgoT().TempDir()
+		dest = destination.NewFilesystem(lagertest.NewTestLogger("test"), directory)
+		request, _ = http.NewRequest("POST", "", bytes.NewBufferString("droplet-contents"))
+	})
+
+	It("writes the file below the guid", func() {
+		rsp, err := dest.Upload(context.Background(), "some-guid", nil, ccclient.UploadOptions{Filename: "droplet.tgz"}, request)
+		Expect(err).NotTo(HaveOccurred())
+		expectFinishedJob(rsp, "some-guid")
+
+		Expect(os.ReadFile(filepath.Join(directory, "some-guid", "droplet.tgz"))).To(Equal([]byte("droplet-contents")))
+	})
+
+	It("rejects guids that would escape the directory", func() {
+		for _, guid := range []string{"", "..", "../other", "a/b"} {
+			rsp, err := dest.Upload(context.Background(), guid, nil, ccclient.UploadOptions{Filename: "droplet.tgz"}, request)
+			Expect(err).To(HaveOccurred())
+			Expect(rsp.StatusCode).To(Equal(http.StatusBadRequest))
+		}
+	})
+
+	It("replaces an existing file", func() {
+		Expect(os.MkdirAll(filepath.Join(directory, "some-guid"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(directory, "some-guid", "droplet.tgz"), []byte("old-droplet"), 0644)).To(Succeed())
+
+		_, err := dest.Upload(context.Background(), "some-guid", nil, ccclient.UploadOptions{Filename: "droplet.tgz"}, request)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(os.ReadFile(filepath.Join(directory, "some-guid", "droplet.tgz"))).To(Equal([]byte("droplet-contents")))
+		Expect(os.ReadDir(filepath.Join(directory, "some-guid"))).To(HaveLen(1))
+	})
+
+	Context("when the upload is cancelled", func() {
+		var ctx context.Context
+
+		BeforeEach(func() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithCancel(context.Background())
+			cancel()
+		})
+
+		It("does not leave a partial file behind", func() {
+			_, err := dest.Upload(ctx, "some-guid", nil, ccclient.UploadOptions{Filename: "droplet.tgz"}, request)
+			Expect(err).To(MatchError("upload cancelled"))
+
+			Expect(os.ReadDir(filepath.Join(directory, "some-guid"))).To(BeEmpty())
+		})
+
+		It("keeps the previous file", func() {
+			Expect(os.MkdirAll(filepath.Join(directory, "some-guid"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(directory, "some-guid", "droplet.tgz"), []byte("old-droplet"), 0644)).To(Succeed())
+
+			_, err := dest.Upload(ctx, "some-guid", nil, ccclient.UploadOptions{Filename: "droplet.tgz"}, request)
+			Expect(err).To(HaveOccurred())
+
+			Expect(os.ReadFile(filepath.Join(directory, "some-guid", "droplet.tgz"))).To(Equal([]byte("old-droplet")))
+		})
+	})
+})
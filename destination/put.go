@@ -0,0 +1,51 @@
+package destination
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"code.cloudfoundry.org/cc-uploader/ccclient"
+	"code.cloudfoundry.org/cc-uploader/requestid"
+	"code.cloudfoundry.org/lager/v3"
+)
+
+type putDestination struct {
+	logger lager.Logger
+	client *http.Client
+}
+
+// NewPut returns a destination that PUTs the raw file to the upload URI,
+// e.g. a pre-signed object store URL.
+func NewPut(logger lager.Logger, client *http.Client) Destination {
+	return &putDestination{
+		logger: logger.Session("put-destination"),
+		client: client,
+	}
+}
+
+func (d *putDestination) Upload(ctx context.Context, guid string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+	if r.ContentLength <= 0 {
+		return missingContentLength()
+	}
+	defer r.Body.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", uploadURL.String(), r.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = r.ContentLength
+	req.Header.Set("Content-Type", contentType(options))
+	copyChecksumHeaders(r, req)
+	requestid.Forward(req)
+
+	logger := d.logger.WithData(requestid.Data(ctx)).WithData(lager.Data{"guid": guid, "url": uploadURL.Redacted()})
+	logger.Info("uploading")
+	rsp, err := doRequest(d.client, req, guid)
+	if err != nil {
+		logger.Error("failed-uploading", err)
+		return rsp, err
+	}
+	logger.Info("succeeded-uploading")
+	return rsp, nil
+}
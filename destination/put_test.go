@@ -0,0 +1,108 @@
+package destination_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+
+	"code.cloudfoundry.org/cc-uploader/ccclient"
+	"code.cloudfoundry.org/cc-uploader/destination"
+	"code.cloudfoundry.org/cc-uploader/requestid"
+	"code.cloudfoundry.org/lager/v3/lagertest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Put", func() {
+	var (
+		server    *ghttp.Server
+		dest      destination.Destination
+		uploadURL *url.URL
+		request   *http.Request
+	)
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		dest = destination.NewPut(lagertest.NewTestLogger("test"), http.DefaultClient)
+		uploadURL, _ = url.Parse(server.URL() + "/bucket/droplet.tgz?signature=abc")
+
+		request, _ = http.NewRequest("POST", "", bytes.NewBufferString("droplet-contents"))
+		request.Header.Set("Content-MD5", "the-md5")
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("PUTs the raw file to the upload URI", func() {
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("PUT", "/bucket/droplet.tgz", "signature=abc"),
+			ghttp.VerifyHeaderKV("Content-MD5", "the-md5"),
+			ghttp.VerifyHeaderKV("Content-Type", "application/octet-stream"),
+			ghttp.VerifyBody([]byte("droplet-contents")),
+			ghttp.RespondWith(http.StatusOK, ""),
+		))
+
+		rsp, err := dest.Upload(context.Background(), "some-guid", uploadURL, ccclient.UploadOptions{Filename: "droplet.tgz"}, request)
+		Expect(err).NotTo(HaveOccurred())
+		expectFinishedJob(rsp, "some-guid")
+	})
+
+	It("forwards the request ID", func() {
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyHeaderKV(requestid.Header, "the-request-id"),
+			ghttp.RespondWith(http.StatusOK, ""),
+		))
+
+		ctx := requestid.NewContext(context.Background(), "the-request-id")
+		_, err := dest.Upload(ctx, "some-guid", uploadURL, ccclient.UploadOptions{Filename: "droplet.tgz"}, request)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("sends presigned upload URIs unchanged, even for asynchronous uploads", func() {
+		rawQuery := "X-Amz-Signature=abc&X-Amz-Credential=key%2F20261019%2Fus-east-1&X-Amz-Expires=300"
+		uploadURL, _ = url.Parse(server.URL() + "/bucket/droplet.tgz?" + rawQuery)
+
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("PUT", "/bucket/droplet.tgz"),
+			func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.URL.RawQuery).To(Equal(rawQuery))
+			},
+			ghttp.RespondWith(http.StatusOK, ""),
+		))
+
+		rsp, err := dest.Upload(context.Background(), "some-guid", uploadURL, ccclient.UploadOptions{Filename: "droplet.tgz", Async: true}, request)
+		Expect(err).NotTo(HaveOccurred())
+		expectFinishedJob(rsp, "some-guid")
+		Expect(uploadURL.RawQuery).To(Equal(rawQuery))
+	})
+
+	It("uses the content type from the upload options", func() {
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyHeaderKV("Content-Type", "application/gzip"),
+			ghttp.RespondWith(http.StatusOK, ""),
+		))
+
+		_, err := dest.Upload(context.Background(), "some-guid", uploadURL, ccclient.UploadOptions{Filename: "droplet.tgz", ContentType: "application/gzip"}, request)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("returns the status of failed uploads", func() {
+		server.AppendHandlers(ghttp.RespondWith(http.StatusForbidden, "denied"))
+
+		rsp, err := dest.Upload(context.Background(), "some-guid", uploadURL, ccclient.UploadOptions{Filename: "droplet.tgz"}, request)
+		Expect(err).To(MatchError("status code: 403\ndenied"))
+		Expect(rsp.StatusCode).To(Equal(http.StatusForbidden))
+	})
+
+	It("requires a content length", func() {
+		request.ContentLength = 0
+
+		rsp, err := dest.Upload(context.Background(), "some-guid", uploadURL, ccclient.UploadOptions{Filename: "droplet.tgz"}, request)
+		Expect(err).To(HaveOccurred())
+		Expect(rsp.StatusCode).To(Equal(http.StatusLengthRequired))
+	})
+})
@@ -0,0 +1,216 @@
+package destination
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/ccclient"
+	"code.cloudfoundry.org/cc-uploader/config"
+	"code.cloudfoundry.org/cc-uploader/requestid"
+	"code.cloudfoundry.org/lager/v3"
+)
+
+// UnsignedPayload is used as the payload hash so that uploads can be
+// streamed without reading them twice.
+const UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+type s3Destination struct {
+	logger   lager.Logger
+	client   *http.Client
+	config   config.S3Destination
+	endpoint *url.URL
+}
+
+// NewS3 returns a destination that PUTs files into an S3-compatible bucket
+// at <key_prefix>/<guid>/<filename>, authenticating with AWS Signature
+// Version 4.
+func NewS3(logger lager.Logger, client *http.Client, s3Config config.S3Destination) (Destination, error) {
+	endpoint, err := url.Parse(s3Config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3 endpoint must be an absolute URL: %s", s3Config.Endpoint)
+	}
+
+	return &s3Destination{
+		logger:   logger.Session("s3-destination"),
+		client:   client,
+		config:   s3Config,
+		endpoint: endpoint,
+	}, nil
+}
+
+func (d *s3Destination) Upload(ctx context.Context, guid string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+	if r.ContentLength <= 0 {
+		return missingContentLength()
+	}
+	defer r.Body.Close()
+
+	if !isPathElement(guid) {
+		return &http.Response{StatusCode: http.StatusBadRequest}, fmt.Errorf("invalid guid: %q", guid)
+	}
+
+	objectURL := d.objectURL(path.Join(d.config.KeyPrefix, guid, options.Filename))
+	req, err := http.NewRequestWithContext(ctx, "PUT", objectURL.String(), r.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = r.ContentLength
+	req.Header.Set("Content-Type", contentType(options))
+	if md5 := r.Header.Get(contentMD5Header); md5 != "" {
+		req.Header.Set(contentMD5Header, md5)
+	}
+	requestid.Forward(req)
+	SignV4(req, d.config.AccessKeyID, d.config.SecretAccessKey, d.config.Region, "s3", UnsignedPayload, time.Now())
+
+	logger := d.logger.WithData(requestid.Data(ctx)).WithData(lager.Data{"guid": guid, "url": objectURL.String()})
+	logger.Info("uploading")
+	rsp, err := doRequest(d.client, req, guid)
+	if err != nil {
+		logger.Error("failed-uploading", err)
+		return rsp, err
+	}
+	logger.Info("succeeded-uploading")
+	return rsp, nil
+}
+
+func (d *s3Destination) objectURL(key string) *url.URL {
+	objectURL := *d.endpoint
+	key = strings.TrimPrefix(key, "/")
+	if d.config.PathStyle {
+		objectURL.Path = path.Join("/", objectURL.Path, d.config.Bucket, key)
+	} else {
+		objectURL.Host = d.config.Bucket + "." + objectURL.Host
+		objectURL.Path = path.Join("/", objectURL.Path, key)
+	}
+	return &objectURL
+}
+
+// SignV4 signs req with AWS Signature Version 4, adding the X-Amz-Date,
+// X-Amz-Content-Sha256 and Authorization headers. Every header already set
+// on req is signed along with the host.
+func SignV4(req *http.Request, accessKeyID, secretAccessKey, region, service, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Del("Authorization")
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		trimmed := make([]string, 0, len(values))
+		for _, value := range values {
+			trimmed = append(trimmed, strings.Join(strings.Fields(value), " "))
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		accessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+// canonicalURI encodes the path that is sent for u, which may differ from
+// u.Path, segment by segment following the SigV4 rules.
+func canonicalURI(u *url.URL) string {
+	segments := strings.Split(u.EscapedPath(), "/")
+	for i, segment := range segments {
+		if unescaped, err := url.PathUnescape(segment); err == nil {
+			segment = unescaped
+		}
+		segments[i] = awsURIEscape(segment)
+	}
+
+	uri := strings.Join(segments, "/")
+	if uri == "" {
+		return "/"
+	}
+	return uri
+}
+
+func canonicalQuery(query url.Values) string {
+	pairs := []string{}
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsURIEscape(key)+"="+awsURIEscape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsURIEscape percent-encodes everything except the unreserved characters,
+// as SigV4 requires.
+func awsURIEscape(s string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~':
+			escaped.WriteByte(c)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,116 @@
+// Package egressproxy routes outbound connections through a configured HTTP,
+// HTTPS or SOCKS5 proxy, except to the hosts excluded from it.
+package egressproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// Proxy picks the proxy for each request sent through an http.Transport.
+type Proxy struct {
+	url       *url.URL
+	proxyFunc func(*url.URL) (*url.URL, error)
+	tlsConfig *tls.Config
+}
+
+// New returns a Proxy sending requests through the proxy at rawURL,
+// authenticating with username and password if username is set. Requests to
+// hosts matching an entry of noProxy are sent directly, following the
+// NO_PROXY conventions; as with NO_PROXY, requests to loopback hosts are
+// never proxied. tlsConfig verifies an "https" proxy.
+func New(rawURL, username, password string, noProxy []string, tlsConfig *tls.Config) (*Proxy, error) {
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("proxy URL %q has no host", rawURL)
+	}
+	if username != "" {
+		proxyURL.User = url.UserPassword(username, password)
+	}
+
+	proxyConfig := &httpproxy.Config{
+		HTTPProxy:  proxyURL.String(),
+		HTTPSProxy: proxyURL.String(),
+		NoProxy:    strings.Join(noProxy, ","),
+	}
+	return &Proxy{
+		url:       proxyURL,
+		proxyFunc: proxyConfig.ProxyFunc(),
+		tlsConfig: tlsConfig,
+	}, nil
+}
+
+// ProxyURL returns the proxy for req, or nil for a direct connection.
+func (p *Proxy) ProxyURL(req *http.Request) (*url.URL, error) {
+	return p.proxyFunc(req.URL)
+}
+
+// Configure routes the requests sent through transport via the proxy.
+//
+// net/http would verify an "https" proxy with the transport's
+// TLSClientConfig, which is meant for the destinations. Instead the
+// transport is handed the proxy as a plain "http" one, and its dialer adds
+// the TLS layer to the connections to the proxy, verified with the proxy's
+// own TLS config.
+func (p *Proxy) Configure(transport *http.Transport) {
+	if p.url.Scheme != "https" {
+		transport.Proxy = p.ProxyURL
+		return
+	}
+
+	port := p.url.Port()
+	if port == "" {
+		port = "443"
+	}
+	plainURL := *p.url
+	plainURL.Scheme = "http"
+	plainURL.Host = net.JoinHostPort(p.url.Hostname(), port)
+
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := p.ProxyURL(req)
+		if proxyURL == nil || err != nil {
+			return proxyURL, err
+		}
+		return &plainURL, nil
+	}
+
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil || addr != plainURL.Host {
+			return conn, err
+		}
+
+		tlsConn := tls.Client(conn, p.proxyTLSConfig())
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+func (p *Proxy) proxyTLSConfig() *tls.Config {
+	config := &tls.Config{}
+	if p.tlsConfig != nil {
+		config = p.tlsConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = p.url.Hostname()
+	}
+	return config
+}
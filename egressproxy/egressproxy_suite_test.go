@@ -0,0 +1,13 @@
+package egressproxy_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestEgressproxy(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Egressproxy Suite")
+}
@@ -0,0 +1,308 @@
+package egressproxy_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/cc-uploader/egressproxy"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Proxy", func() {
+	Describe("New", func() {
+		It("rejects URLs without a host", func() {
+			_, err := egressproxy.New("socks5://", "", "", nil, nil)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("ProxyURL", func() {
+		var proxy *egressproxy.Proxy
+
+		BeforeEach(func() {
+			var err error
+			proxy, err = egressproxy.New("http://proxy.example.com:3128", "user", "secret", []string{
+				"internal.example.com",
+				".cluster.local",
+				"10.0.0.0/8",
+				"192.168.1.1",
+				"cc.example.com:9023",
+			}, nil)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		proxyFor := func(rawURL string) *url.URL {
+			req, err := http.NewRequest("GET", rawURL, nil)
+			Expect(err).NotTo(HaveOccurred())
+			proxyURL, err := proxy.ProxyURL(req)
+			Expect(err).NotTo(HaveOccurred())
+			return proxyURL
+		}
+
+		It("proxies hosts that are not excluded, with the credentials", func() {
+			proxyURL := proxyFor("https://cc.example.com/upload")
+			Expect(proxyURL.Host).To(Equal("proxy.example.com:3128"))
+			Expect(proxyURL.User).To(Equal(url.UserPassword("user", "secret")))
+		})
+
+		It("connects directly to loopback hosts, as NO_PROXY does", func() {
+			Expect(proxyFor("http://127.0.0.1:8080")).To(BeNil())
+			Expect(proxyFor("http://localhost:8080")).To(BeNil())
+		})
+
+		DescribeTable("connects directly to excluded hosts",
+			func(rawURL string) {
+				Expect(proxyFor(rawURL)).To(BeNil())
+			},
+			Entry("a domain", "https://internal.example.com"),
+			Entry("a subdomain", "https://api.internal.example.com"),
+			Entry("a subdomain of a leading-dot entry", "https://cc.cluster.local"),
+			Entry("an address in a CIDR range", "http://10.1.2.3:9090"),
+			Entry("an IP address", "http://192.168.1.1"),
+			Entry("a host and port", "https://cc.example.com:9023"),
+		)
+
+		DescribeTable("proxies hosts that only look excluded",
+			func(rawURL string) {
+				Expect(proxyFor(rawURL)).NotTo(BeNil())
+			},
+			Entry("a domain sharing a suffix", "https://notinternal.example.com"),
+			Entry("the domain of a leading-dot entry", "https://cluster.local"),
+			Entry("an address outside the CIDR range", "http://11.0.0.1"),
+			Entry("a host on another port", "https://cc.example.com:9024"),
+		)
+
+		It("matches every host with *", func() {
+			var err error
+			proxy, err = egressproxy.New("http://proxy.example.com:3128", "", "", []string{"*"}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(proxyFor("https://cc.example.com")).To(BeNil())
+		})
+	})
+
+	Context("with an http.Transport", func() {
+		var target *httptest.Server
+		var targetURL string
+
+		BeforeEach(func() {
+			target = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("hello from CC"))
+			}))
+			// loopback hosts are never proxied, so the target is addressed by
+			// a name only the test proxies resolve
+			_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+			targetURL = "http://cc.example.test:" + port
+		})
+
+		AfterEach(func() {
+			target.Close()
+		})
+
+		get := func(proxy *egressproxy.Proxy, transport *http.Transport) (string, error) {
+			proxy.Configure(transport)
+			resp, err := (&http.Client{Transport: transport}).Get(targetURL)
+			if err != nil {
+				return "", err
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			return string(body), err
+		}
+
+		// forwardToLoopback forwards proxied requests to the loopback address,
+		// recording the proxy credentials they came with.
+		forwardToLoopback := func(proxyAuthorization *string) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				*proxyAuthorization = r.Header.Get("Proxy-Authorization")
+				(&httputil.ReverseProxy{Rewrite: func(pr *httputil.ProxyRequest) {
+					pr.SetURL(&url.URL{Scheme: "http", Host: net.JoinHostPort("127.0.0.1", r.URL.Port())})
+				}}).ServeHTTP(w, r)
+			})
+		}
+
+		It("connects through a SOCKS5 proxy", func() {
+			socks := newSOCKS5Proxy("user", "secret")
+			defer socks.Close()
+
+			proxy, err := egressproxy.New("socks5://"+socks.Addr(), "user", "secret", nil, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(get(proxy, &http.Transport{})).To(Equal("hello from CC"))
+			Expect(socks.Targets()).To(ConsistOf(strings.TrimPrefix(targetURL, "http://")))
+		})
+
+		It("sends requests through an HTTP proxy", func() {
+			var proxyAuthorization string
+			forwarder := httptest.NewServer(forwardToLoopback(&proxyAuthorization))
+			defer forwarder.Close()
+
+			proxy, err := egressproxy.New(forwarder.URL, "user", "secret", nil, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(get(proxy, &http.Transport{})).To(Equal("hello from CC"))
+			Expect(proxyAuthorization).To(Equal("Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))))
+		})
+
+		Context("through an HTTPS proxy", func() {
+			var forwarder *httptest.Server
+			var proxyAuthorization string
+
+			BeforeEach(func() {
+				forwarder = httptest.NewTLSServer(forwardToLoopback(&proxyAuthorization))
+			})
+
+			AfterEach(func() {
+				forwarder.Close()
+			})
+
+			// the transport's own TLS config trusts nothing, as it is only
+			// meant for the destinations
+			newTransport := func() *http.Transport {
+				return &http.Transport{TLSClientConfig: &tls.Config{RootCAs: x509.NewCertPool()}}
+			}
+
+			It("verifies the proxy with its own TLS config", func() {
+				rootCAs := x509.NewCertPool()
+				rootCAs.AddCert(forwarder.Certificate())
+				proxy, err := egressproxy.New(forwarder.URL, "user", "secret", nil, &tls.Config{RootCAs: rootCAs})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(get(proxy, newTransport())).To(Equal("hello from CC"))
+				Expect(proxyAuthorization).To(Equal("Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))))
+			})
+
+			It("fails if the proxy is not trusted", func() {
+				proxy, err := egressproxy.New(forwarder.URL, "", "", nil, &tls.Config{RootCAs: x509.NewCertPool()})
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = get(proxy, newTransport())
+				Expect(err).To(MatchError(ContainSubstring("certificate")))
+			})
+		})
+	})
+})
+
+// socks5Proxy is a minimal SOCKS5 server (RFC 1928) that only accepts
+// CONNECT requests authenticated with a username and password (RFC 1929).
+// It connects to every target host on the loopback address.
+type socks5Proxy struct {
+	listener           net.Listener
+	username, password string
+	targets            chan string
+}
+
+func newSOCKS5Proxy(username, password string) *socks5Proxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+
+	p := &socks5Proxy{listener: listener, username: username, password: password, targets: make(chan string, 10)}
+	go func() {
+		defer GinkgoRecover()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *socks5Proxy) Addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *socks5Proxy) Close() {
+	p.listener.Close()
+}
+
+func (p *socks5Proxy) Targets() []string {
+	var targets []string
+	for {
+		select {
+		case target := <-p.targets:
+			targets = append(targets, target)
+		default:
+			return targets
+		}
+	}
+}
+
+func (p *socks5Proxy) serve(conn net.Conn) {
+	defer conn.Close()
+
+	// greeting: version, methods; only username/password (2) is accepted
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 2})
+
+	// username/password sub-negotiation
+	if _, err := io.ReadFull(conn, header[:2]); err != nil {
+		return
+	}
+	username := make([]byte, header[1])
+	io.ReadFull(conn, username)
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return
+	}
+	password := make([]byte, header[0])
+	io.ReadFull(conn, password)
+	if string(username) != p.username || string(password) != p.password {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	// request: version, CONNECT, reserved, address type
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 3:
+		io.ReadFull(conn, header[:1])
+		name := make([]byte, header[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return
+	}
+	portBytes := make([]byte, 2)
+	io.ReadFull(conn, portBytes)
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(portBytes))))
+
+	upstream, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(binary.BigEndian.Uint16(portBytes)))))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	p.targets <- target
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
@@ -1,20 +1,96 @@
 package handlers
 
 import (
+	"fmt"
 	"net/http"
-	"sync"
 
 	"code.cloudfoundry.org/cc-uploader"
+	"code.cloudfoundry.org/cc-uploader/audit"
 	"code.cloudfoundry.org/cc-uploader/ccclient"
+	"code.cloudfoundry.org/cc-uploader/coalesce"
+	"code.cloudfoundry.org/cc-uploader/config"
+	"code.cloudfoundry.org/cc-uploader/dedup"
+	"code.cloudfoundry.org/cc-uploader/destination"
 	"code.cloudfoundry.org/cc-uploader/handlers/upload_build_artifacts"
 	"code.cloudfoundry.org/cc-uploader/handlers/upload_droplet"
+	"code.cloudfoundry.org/cc-uploader/quota"
+	"code.cloudfoundry.org/cc-uploader/uploads"
 	"code.cloudfoundry.org/lager/v3"
 	"github.com/tedsuo/rata"
 )
 
-func New(uploader ccclient.Uploader, poller ccclient.Poller, logger lager.Logger, uploadWaitGroup *sync.WaitGroup,) (http.Handler, error) {
-	return rata.NewRouter(ccuploader.Routes, rata.Handlers{
-		ccuploader.UploadDropletRoute:        upload_droplet.New(uploader, poller, logger, uploadWaitGroup),
-		ccuploader.UploadBuildArtifactsRoute: upload_build_artifacts.New(uploader, logger),
+// Options are the dependencies of the upload handlers. The Deduplicator,
+// Coalescer, Auditor and Quotas are optional; leaving one nil turns its
+// feature off for both routes.
+type Options struct {
+	Logger  lager.Logger
+	Tracker *uploads.Tracker
+	Poller  ccclient.Poller
+
+	DropletDestination        destination.Destination
+	BuildArtifactsDestination destination.Destination
+	DropletTimeouts           config.RouteTimeouts
+	BuildArtifactsTimeouts    config.RouteTimeouts
+	DropletForm               config.UploadForm
+	BuildArtifactsForm        config.UploadForm
+	DropletMetadata           config.DropletMetadata
+
+	Deduplicator     *dedup.Deduplicator
+	Coalescer        *coalesce.Coalescer
+	Auditor          *audit.Auditor
+	Quotas           *quota.Enforcer
+	ValidateArchives bool
+
+	// Routes names the subset of ccuploader.Routes to serve, or all of them
+	// if it is empty.
+	Routes []string
+}
+
+// New routes the requests for the routes named by options.Routes, or all of
+// ccuploader.Routes if it is empty, to their upload handler. Requests for the
+// other routes get 404 Not Found.
+func New(options Options) (http.Handler, error) {
+	routes := ccuploader.Routes
+	if len(options.Routes) > 0 {
+		routes = rata.Routes{}
+		for _, name := range options.Routes {
+			route, ok := ccuploader.Routes.FindRouteByName(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown route %q", name)
+			}
+			routes = append(routes, route)
+		}
+	}
+
+	router, err := rata.NewRouter(routes, rata.Handlers{
+		ccuploader.UploadDropletRoute: upload_droplet.New(upload_droplet.Options{
+			Destination:      options.DropletDestination,
+			Poller:           options.Poller,
+			Logger:           options.Logger,
+			Tracker:          options.Tracker,
+			Timeouts:         options.DropletTimeouts,
+			Form:             options.DropletForm,
+			Deduplicator:     options.Deduplicator,
+			Coalescer:        options.Coalescer,
+			Auditor:          options.Auditor,
+			Quotas:           options.Quotas,
+			ValidateArchives: options.ValidateArchives,
+			Metadata:         options.DropletMetadata,
+		}),
+		ccuploader.UploadBuildArtifactsRoute: upload_build_artifacts.New(upload_build_artifacts.Options{
+			Destination:      options.BuildArtifactsDestination,
+			Logger:           options.Logger,
+			Tracker:          options.Tracker,
+			Timeouts:         options.BuildArtifactsTimeouts,
+			Form:             options.BuildArtifactsForm,
+			Deduplicator:     options.Deduplicator,
+			Auditor:          options.Auditor,
+			Quotas:           options.Quotas,
+			ValidateArchives: options.ValidateArchives,
+		}),
 	})
+	if err != nil {
+		return nil, err
+	}
+	return router, nil
 }
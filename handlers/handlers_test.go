@@ -2,17 +2,30 @@ package handlers_test
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strconv"
-	"sync"
 	"time"
 
+	"code.cloudfoundry.org/cc-uploader"
+	"code.cloudfoundry.org/cc-uploader/audit"
+	"code.cloudfoundry.org/cc-uploader/audit/fake_audit"
 	"code.cloudfoundry.org/cc-uploader/ccclient"
+	"code.cloudfoundry.org/cc-uploader/coalesce"
+	"code.cloudfoundry.org/cc-uploader/config"
+	"code.cloudfoundry.org/cc-uploader/dedup"
+	"code.cloudfoundry.org/cc-uploader/destination"
 	"code.cloudfoundry.org/cc-uploader/handlers"
+	"code.cloudfoundry.org/cc-uploader/quota"
+	"code.cloudfoundry.org/cc-uploader/quota/fake_quota"
+	"code.cloudfoundry.org/cc-uploader/requestid"
+	"code.cloudfoundry.org/cc-uploader/uploads"
 	"code.cloudfoundry.org/lager/v3/lagertest"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
 	. "github.com/onsi/ginkgo/v2"
@@ -30,6 +43,7 @@ var _ = Describe("Handlers", func() {
 		incomingRequest  *http.Request
 		outgoingResponse *httptest.ResponseRecorder
 
+		options handlers.Options
 		handler http.Handler
 
 		postStatusCode   int
@@ -52,11 +66,20 @@ var _ = Describe("Handlers", func() {
 
 		fakeCloudController = ghttp.NewServer()
 
-		uploader := ccclient.NewUploader(logger, http.DefaultClient)
+		uploader := ccclient.NewUploader(logger, http.DefaultClient, false)
 		poller := ccclient.NewPoller(logger, http.DefaultClient, 100*time.Millisecond)
-		var wg sync.WaitGroup
-		handler, err = handlers.New(uploader, poller, logger, &wg)
-		Expect(err).NotTo(HaveOccurred())
+		ccDestination := destination.NewCC(uploader)
+		options = handlers.Options{
+			Logger:                    logger,
+			Tracker:                   uploads.NewTracker(logger, 0),
+			Poller:                    poller,
+			DropletDestination:        ccDestination,
+			BuildArtifactsDestination: ccDestination,
+			DropletTimeouts:           config.DefaultRouteTimeouts(),
+			BuildArtifactsTimeouts:    config.DefaultRouteTimeouts(),
+			DropletForm:               config.DefaultUploaderConfig().DropletForm,
+			BuildArtifactsForm:        config.DefaultUploaderConfig().BuildArtifactsForm,
+		}
 
 		postStatusCode = http.StatusCreated
 		uploadedBytes = nil
@@ -64,6 +87,13 @@ var _ = Describe("Handlers", func() {
 		uploadedHeaders = nil
 	})
 
+	JustBeforeEach(func() {
+		router, err := handlers.New(options)
+		Expect(err).NotTo(HaveOccurred())
+		// the servers give every request an ID before routing it
+		handler = requestid.Handler(router)
+	})
+
 	AfterEach(func() {
 		fakeCloudController.Close()
 	})
@@ -139,6 +169,46 @@ var _ = Describe("Handlers", func() {
 				Expect(uploadedFileName).To(Equal("droplet.tgz"))
 			})
 
+			Context("with a request ID", func() {
+				BeforeEach(func() {
+					incomingRequest.Header.Set("X-Vcap-Request-Id", "the-request-id")
+
+					digest := sha256.Sum256([]byte("the file I'm uploading"))
+					incomingRequest.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(digest[:])+":")
+
+					// failing sinks and backends make the components log
+					auditSink := &fake_audit.FakeSink{}
+					auditSink.WriteReturns(errors.New("disk full"))
+					quotaBackend := &fake_quota.FakeBackend{}
+					quotaBackend.AcquireSlotReturns(false, errors.New("backend down"))
+
+					options.Deduplicator = dedup.New(logger, dedup.NewMemoryIndex(time.Hour, 0))
+					options.Coalescer = coalesce.New(true)
+					options.Auditor = audit.New(logger, auditSink)
+					options.Quotas = quota.New(logger, quota.Limits{MaxConcurrentUploads: 1}, quotaBackend)
+				})
+
+				It("forwards it to CC, echoes it and logs it on every line", func() {
+					Expect(outgoingResponse.Code).To(Equal(http.StatusCreated))
+					Expect(uploadedHeaders.Get("X-Vcap-Request-Id")).To(Equal("the-request-id"))
+					Expect(outgoingResponse.Header().Get("X-Vcap-Request-Id")).To(Equal("the-request-id"))
+
+					var messages []string
+					for _, log := range logger.Logs() {
+						messages = append(messages, log.Message)
+						Expect(log.Data).To(HaveKeyWithValue("request-id", "the-request-id"), log.Message)
+					}
+					Expect(messages).To(ContainElements(
+						"test.droplet.upload.uploading-droplet",
+						"test.uploader.uploading",
+						"test.poller.cc-job-finished",
+						"test.dedup.miss",
+						"test.quota.failed-acquiring-upload-slot",
+						"test.audit.failed-writing-record",
+					))
+				})
+			})
+
 			It("should wait between polls", func() {
 				var firstTime, secondTime, thirdTime time.Time
 				Eventually(timeClicker).Should(Receive(&firstTime))
@@ -289,6 +359,45 @@ var _ = Describe("Handlers", func() {
 	})
 })
 
+var _ = Describe("Restricted routes", func() {
+	var handler http.Handler
+
+	BeforeEach(func() {
+		logger := lagertest.NewTestLogger("test")
+
+		var err error
+		handler, err = handlers.New(handlers.Options{
+			Logger:                 logger,
+			Tracker:                uploads.NewTracker(logger, 0),
+			BuildArtifactsTimeouts: config.DefaultRouteTimeouts(),
+			BuildArtifactsForm:     config.DefaultUploaderConfig().BuildArtifactsForm,
+			Routes:                 []string{ccuploader.UploadBuildArtifactsRoute},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	serve := func(method, path string) int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		return recorder.Code
+	}
+
+	It("serves the named routes", func() {
+		// without a callback URI the upload is rejected by the route's handler
+		Expect(serve("POST", "/v1/build_artifacts/app-guid")).To(Equal(http.StatusBadRequest))
+	})
+
+	It("responds with 404 to the other routes", func() {
+		Expect(serve("POST", "/v1/droplet/app-guid")).To(Equal(http.StatusNotFound))
+		Expect(serve("POST", "/v1/build_artifacts/")).To(Equal(http.StatusNotFound))
+	})
+
+	It("rejects unknown route names", func() {
+		_, err := handlers.New(handlers.Options{Routes: []string{"UploadEverything"}})
+		Expect(err).To(MatchError(ContainSubstring("UploadEverything")))
+	})
+})
+
 func pollingResponseBody(jobGuid, status string, baseUrl string) string {
 	url := "/v2/jobs/" + jobGuid
 	if baseUrl != "" {
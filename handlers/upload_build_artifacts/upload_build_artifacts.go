@@ -1,6 +1,7 @@
 package upload_build_artifacts
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -8,27 +9,65 @@ import (
 	"strconv"
 	"time"
 
+	"code.cloudfoundry.org/cc-uploader"
+	"code.cloudfoundry.org/cc-uploader/archive"
+	"code.cloudfoundry.org/cc-uploader/audit"
 	"code.cloudfoundry.org/cc-uploader/ccclient"
+	"code.cloudfoundry.org/cc-uploader/config"
+	"code.cloudfoundry.org/cc-uploader/dedup"
+	"code.cloudfoundry.org/cc-uploader/destination"
+	"code.cloudfoundry.org/cc-uploader/quota"
+	"code.cloudfoundry.org/cc-uploader/requestid"
+	"code.cloudfoundry.org/cc-uploader/uploads"
 	"code.cloudfoundry.org/lager/v3"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"github.com/tedsuo/rata"
 )
 
-func New(uploader ccclient.Uploader, logger lager.Logger) http.Handler {
+// Options are what New builds the build artifacts upload handler from, as
+// described by handlers.Options.
+type Options struct {
+	Destination      destination.Destination
+	Logger           lager.Logger
+	Tracker          *uploads.Tracker
+	Timeouts         config.RouteTimeouts
+	Form             config.UploadForm
+	Deduplicator     *dedup.Deduplicator
+	Auditor          *audit.Auditor
+	Quotas           *quota.Enforcer
+	ValidateArchives bool
+}
+
+func New(options Options) http.Handler {
 	return &buildArtifactUploader{
-		uploader: uploader,
-		logger:   logger,
+		destination:      options.Destination,
+		logger:           options.Logger,
+		tracker:          options.Tracker,
+		timeouts:         options.Timeouts,
+		form:             options.Form,
+		deduplicator:     options.Deduplicator,
+		auditor:          options.Auditor,
+		quotas:           options.Quotas,
+		validateArchives: options.ValidateArchives,
 	}
 }
 
 type buildArtifactUploader struct {
-	uploader ccclient.Uploader
-	logger   lager.Logger
+	destination      destination.Destination
+	logger           lager.Logger
+	tracker          *uploads.Tracker
+	timeouts         config.RouteTimeouts
+	form             config.UploadForm
+	deduplicator     *dedup.Deduplicator
+	auditor          *audit.Auditor
+	quotas           *quota.Enforcer
+	validateArchives bool
 }
 
 var MissingCCBuildArtifactsUploadUriKeyError = errors.New(fmt.Sprintf("missing %s parameter", cc_messages.CcBuildArtifactsUploadUriKey))
 
 func (h *buildArtifactUploader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	requestLogger := h.logger.Session("build-artifacts.upload")
+	requestLogger := h.logger.Session("build-artifacts.upload", requestid.Data(r.Context()))
 
 	uploadUriParameter := r.URL.Query().Get(cc_messages.CcBuildArtifactsUploadUriKey)
 	if uploadUriParameter == "" {
@@ -46,7 +85,7 @@ func (h *buildArtifactUploader) ServeHTTP(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	timeout := 5 * time.Minute
+	var requestedTimeout time.Duration
 	timeoutParameter := r.URL.Query().Get(cc_messages.CcTimeoutKey)
 	if timeoutParameter != "" {
 		t, err := strconv.Atoi(timeoutParameter)
@@ -56,7 +95,15 @@ func (h *buildArtifactUploader) ServeHTTP(w http.ResponseWriter, r *http.Request
 			w.Write([]byte(err.Error()))
 			return
 		}
-		timeout = time.Duration(t) * time.Second
+		requestedTimeout = time.Duration(t) * time.Second
+	}
+
+	timeout, clamped := h.timeouts.UploadTimeout(requestedTimeout)
+	if clamped {
+		requestLogger.Info("clamped-timeout", lager.Data{
+			"requested-timeout": requestedTimeout.String(),
+			"max-timeout":       timeout.String(),
+		})
 	}
 
 	requestLogger.Info("start", lager.Data{
@@ -64,40 +111,87 @@ func (h *buildArtifactUploader) ServeHTTP(w http.ResponseWriter, r *http.Request
 		"content-length": r.ContentLength,
 	})
 
-	cancelChan := make(chan struct{})
-	var writerClosed <-chan bool
-	closeNotifier, ok := w.(http.CloseNotifier)
-	if ok {
-		writerClosed = closeNotifier.CloseNotify()
+	appGuid := rata.Param(r, "app_guid")
+	auditEntry := h.auditor.Begin(r, ccuploader.UploadBuildArtifactsRoute, appGuid, uploadUrl)
+	ctx, upload, err := h.tracker.Start(r.Context(), ccuploader.UploadBuildArtifactsRoute, appGuid, uploadUrl, r.ContentLength)
+	if err != nil {
+		requestLogger.Error("failed", err)
+		auditEntry.Finish(http.StatusServiceUnavailable, err.Error(), 0)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
 	}
+	defer upload.Finish()
+	r.Body = upload.TrackBody(r.Body)
 
-	done := make(chan struct{})
-	go func() {
-		timer := time.NewTimer(timeout)
-		select {
-		case <-writerClosed:
-			close(cancelChan)
-		case <-timer.C:
-			close(cancelChan)
-		case <-done:
+	var grant *quota.Grant
+	respond := func(statusCode int, message string) {
+		// only successful uploads stay charged to the quotas
+		if statusCode < 200 || statusCode >= 300 {
+			grant.Refund()
+		}
+		auditEntry.Finish(statusCode, message, upload.BytesSent())
+		upload.EmitMetrics(statusCode)
+		w.WriteHeader(statusCode)
+		if message != "" {
+			w.Write([]byte(message))
 		}
-		timer.Stop()
-	}()
+	}
+
+	dedupUpload, duplicate := h.deduplicator.Begin(dedup.Resource(uploadUrl), r)
+	if duplicate {
+		requestLogger.Info("skipping-duplicate-build-artifacts")
+		dedup.Skip(r.Body)
+		respond(http.StatusOK, "")
+		return
+	}
+	r.Body = dedupUpload.TrackBody(r.Body)
 
-	uploadResponse, err := h.uploader.Upload(uploadUrl, "buildpack_cache.tgz", r, cancelChan)
-	close(done)
+	grant, err = h.quotas.Admit(ctx, appGuid, r.ContentLength)
 	if err != nil {
 		requestLogger.Error("failed", err)
+		auditEntry.Finish(quota.WriteError(w, err), err.Error(), 0)
+		return
+	}
+	defer grant.Release()
+
+	if h.validateArchives {
+		archiveReader := archive.NewReader(r.Body, true)
+		defer archiveReader.Close()
+		r.Body = archiveReader
+	}
+
+	// ctx is derived from the request's context, so the upload is also
+	// cancelled when the client goes away
+	uploadCtx, cancelUpload := context.WithTimeout(ctx, timeout)
+	defer cancelUpload()
+
+	uploadResponse, err := h.destination.Upload(uploadCtx, appGuid, uploadUrl, ccclient.UploadOptions{
+		Filename:    h.form.Filename,
+		ContentType: h.form.ContentType,
+		Fields:      h.form.FieldsFor(r.URL.Query()),
+	}, r)
+	if err != nil {
+		requestLogger.Error("failed", err)
+		if cause := uploads.CancellationCause(ctx); cause != nil {
+			respond(http.StatusServiceUnavailable, cause.Error())
+			return
+		}
+		var validationErr *archive.ValidationError
+		if errors.As(err, &validationErr) {
+			respond(http.StatusUnprocessableEntity, validationErr.Error())
+			return
+		}
 		if uploadResponse == nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			respond(http.StatusInternalServerError, err.Error())
 		} else {
-			w.WriteHeader(uploadResponse.StatusCode)
+			respond(uploadResponse.StatusCode, err.Error())
 		}
-		w.Write([]byte(err.Error()))
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	dedupUpload.Succeeded()
+	respond(http.StatusOK, "")
 	requestLogger.Info("success", lager.Data{
 		"upload-url":     uploadUrl,
 		"content-length": r.ContentLength,
@@ -2,16 +2,27 @@ package upload_build_artifacts_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"time"
 
-	"code.cloudfoundry.org/cc-uploader/ccclient/fake_ccclient"
-	"code.cloudfoundry.org/cc-uploader/handlers/test_helpers"
+	"code.cloudfoundry.org/cc-uploader"
+	"code.cloudfoundry.org/cc-uploader/audit"
+	"code.cloudfoundry.org/cc-uploader/audit/fake_audit"
+	"code.cloudfoundry.org/cc-uploader/ccclient"
+	"code.cloudfoundry.org/cc-uploader/config"
+	"code.cloudfoundry.org/cc-uploader/dedup"
+	"code.cloudfoundry.org/cc-uploader/destination/fake_destination"
 	"code.cloudfoundry.org/cc-uploader/handlers/upload_build_artifacts"
+	"code.cloudfoundry.org/cc-uploader/quota"
+	"code.cloudfoundry.org/cc-uploader/uploads"
 	"code.cloudfoundry.org/lager/v3"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
 	. "github.com/onsi/ginkgo/v2"
@@ -21,21 +32,41 @@ import (
 var _ = Describe("UploadBuildArtifacts", func() {
 	Describe("ServeHTTP", func() {
 		var incomingRequest *http.Request
-		var responseWriter http.ResponseWriter
 		var outgoingResponse *httptest.ResponseRecorder
-		var uploader fake_ccclient.FakeUploader
+		var uploader fake_destination.FakeDestination
 		var logger lager.Logger
+		var timeouts config.RouteTimeouts
+		var form config.UploadForm
+		var validateArchives bool
+		var deduplicator *dedup.Deduplicator
+		var auditor *audit.Auditor
+		var quotas *quota.Enforcer
 
 		BeforeEach(func() {
 			outgoingResponse = httptest.NewRecorder()
-			responseWriter = outgoingResponse
+			timeouts = config.DefaultRouteTimeouts()
+			form = config.UploadForm{Filename: "buildpack_cache.tgz"}
+			validateArchives = false
+			deduplicator = nil
+			auditor = nil
+			quotas = nil
 		})
 
 		JustBeforeEach(func() {
 			logger = lager.NewLogger("fake-logger")
-			buildArtifactsUploadHandler := upload_build_artifacts.New(&uploader, logger)
+			buildArtifactsUploadHandler := upload_build_artifacts.New(upload_build_artifacts.Options{
+				Destination:      &uploader,
+				Logger:           logger,
+				Tracker:          uploads.NewTracker(logger, 0),
+				Timeouts:         timeouts,
+				Form:             form,
+				Deduplicator:     deduplicator,
+				Auditor:          auditor,
+				Quotas:           quotas,
+				ValidateArchives: validateArchives,
+			})
 
-			buildArtifactsUploadHandler.ServeHTTP(responseWriter, incomingRequest)
+			buildArtifactsUploadHandler.ServeHTTP(outgoingResponse, incomingRequest)
 		})
 
 		Context("When the request does not include a build artifacts upload URI", func() {
@@ -44,7 +75,7 @@ var _ = Describe("UploadBuildArtifacts", func() {
 				incomingRequest, err = http.NewRequest("POST", "http://example.com", bytes.NewBufferString(""))
 				Expect(err).NotTo(HaveOccurred())
 
-				uploader = fake_ccclient.FakeUploader{}
+				uploader = fake_destination.FakeDestination{}
 			})
 
 			It("responds with an error code", func() {
@@ -71,7 +102,7 @@ var _ = Describe("UploadBuildArtifacts", func() {
 				)
 				Expect(err).NotTo(HaveOccurred())
 
-				uploader = fake_ccclient.FakeUploader{}
+				uploader = fake_destination.FakeDestination{}
 				uploader.UploadReturns(nil, errors.New("some-error"))
 			})
 
@@ -95,7 +126,7 @@ var _ = Describe("UploadBuildArtifacts", func() {
 				)
 				Expect(err).NotTo(HaveOccurred())
 
-				uploader = fake_ccclient.FakeUploader{}
+				uploader = fake_destination.FakeDestination{}
 				uploader.UploadReturns(&http.Response{StatusCode: 404}, errors.New("some-error"))
 			})
 
@@ -119,7 +150,7 @@ var _ = Describe("UploadBuildArtifacts", func() {
 				)
 				Expect(err).NotTo(HaveOccurred())
 
-				uploader = fake_ccclient.FakeUploader{}
+				uploader = fake_destination.FakeDestination{}
 				uploader.UploadReturns(&http.Response{StatusCode: http.StatusOK}, nil)
 			})
 
@@ -129,31 +160,28 @@ var _ = Describe("UploadBuildArtifacts", func() {
 		})
 
 		Context("when the requester (client) goes away", func() {
-			var fakeResponseWriter *test_helpers.FakeResponseWriter
-
 			BeforeEach(func() {
+				ctx, cancel := context.WithCancel(context.Background())
+
 				var err error
-				incomingRequest, err = http.NewRequest(
+				incomingRequest, err = http.NewRequestWithContext(
+					ctx,
 					"POST",
 					fmt.Sprintf("http://example.com?%s=upload-uri.com", cc_messages.CcBuildArtifactsUploadUriKey),
 					bytes.NewBufferString(""),
 				)
 				Expect(err).NotTo(HaveOccurred())
 
-				closedChan := make(chan bool)
-				fakeResponseWriter = test_helpers.NewFakeResponseWriter(closedChan)
-				responseWriter = fakeResponseWriter
-
-				uploader = fake_ccclient.FakeUploader{}
-				uploader.UploadStub = func(uploadURL *url.URL, filename string, r *http.Request, cancelChan <-chan struct{}) (*http.Response, error) {
-					closedChan <- true
-					Eventually(cancelChan).Should(BeClosed())
+				uploader = fake_destination.FakeDestination{}
+				uploader.UploadStub = func(ctx context.Context, _ string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+					cancel()
+					Eventually(ctx.Done()).Should(BeClosed())
 					return nil, errors.New("cancelled")
 				}
 			})
 
 			It("responds with an error code", func() {
-				Expect(fakeResponseWriter.Code).To(Equal(http.StatusInternalServerError))
+				Expect(outgoingResponse.Code).To(Equal(http.StatusInternalServerError))
 			})
 		})
 
@@ -167,9 +195,9 @@ var _ = Describe("UploadBuildArtifacts", func() {
 				)
 				Expect(err).NotTo(HaveOccurred())
 
-				uploader = fake_ccclient.FakeUploader{}
-				uploader.UploadStub = func(uploadURL *url.URL, filename string, r *http.Request, cancelChan <-chan struct{}) (*http.Response, error) {
-					Eventually(cancelChan, 2*time.Second).Should(BeClosed())
+				uploader = fake_destination.FakeDestination{}
+				uploader.UploadStub = func(ctx context.Context, _ string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+					Eventually(ctx.Done(), 2*time.Second).Should(BeClosed())
 					return nil, errors.New("cancelled")
 				}
 			})
@@ -178,5 +206,183 @@ var _ = Describe("UploadBuildArtifacts", func() {
 				Expect(outgoingResponse.Code).To(Equal(http.StatusInternalServerError))
 			})
 		})
+
+		Context("when the requested timeout exceeds the maximum", func() {
+			BeforeEach(func() {
+				var err error
+				incomingRequest, err = http.NewRequest(
+					"POST",
+					fmt.Sprintf("http://example.com?%s=upload-uri.com&timeout=3600", cc_messages.CcBuildArtifactsUploadUriKey),
+					bytes.NewBufferString(""),
+				)
+				Expect(err).NotTo(HaveOccurred())
+
+				timeouts.MaxUploadTimeout = config.Duration(time.Second)
+
+				uploader = fake_destination.FakeDestination{}
+				uploader.UploadStub = func(ctx context.Context, _ string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+					Eventually(ctx.Done(), 2*time.Second).Should(BeClosed())
+					return nil, errors.New("cancelled")
+				}
+			})
+
+			It("clamps the timeout to the maximum", func() {
+				Expect(outgoingResponse.Code).To(Equal(http.StatusInternalServerError))
+			})
+		})
+
+		Context("when archive validation is enabled and the build artifacts are not a gzipped tarball", func() {
+			BeforeEach(func() {
+				var err error
+				incomingRequest, err = http.NewRequest(
+					"POST",
+					fmt.Sprintf("http://example.com?%s=upload-uri.com", cc_messages.CcBuildArtifactsUploadUriKey),
+					bytes.NewBufferString("not-a-tarball"),
+				)
+				Expect(err).NotTo(HaveOccurred())
+
+				validateArchives = true
+
+				uploader = fake_destination.FakeDestination{}
+				uploader.UploadStub = func(ctx context.Context, _ string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+					_, err := io.ReadAll(r.Body)
+					return nil, err
+				}
+			})
+
+			It("aborts the upload with 422 Unprocessable Entity", func() {
+				Expect(outgoingResponse.Code).To(Equal(http.StatusUnprocessableEntity))
+			})
+		})
+
+		Context("when auditing is enabled", func() {
+			var sink *fake_audit.FakeSink
+
+			BeforeEach(func() {
+				sink = &fake_audit.FakeSink{}
+				auditor = audit.New(lager.NewLogger("fake-logger"), sink)
+
+				var err error
+				incomingRequest, err = http.NewRequest(
+					"POST",
+					fmt.Sprintf("http://example.com?%s=http://cc.example.com/upload&:app_guid=app-guid", cc_messages.CcBuildArtifactsUploadUriKey),
+					bytes.NewBufferString("build-artifacts"),
+				)
+				Expect(err).NotTo(HaveOccurred())
+
+				uploader = fake_destination.FakeDestination{}
+				uploader.UploadStub = func(ctx context.Context, _ string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+					io.ReadAll(r.Body)
+					return &http.Response{StatusCode: http.StatusOK}, nil
+				}
+			})
+
+			It("records the upload", func() {
+				Expect(sink.WriteCallCount()).To(Equal(1))
+				record := sink.WriteArgsForCall(0)
+				Expect(record.Route).To(Equal(ccuploader.UploadBuildArtifactsRoute))
+				Expect(record.Guid).To(Equal("app-guid"))
+				Expect(record.Size).To(Equal(int64(15)))
+				Expect(record.Outcome).To(Equal(audit.OutcomeSucceeded))
+				Expect(record.StatusCode).To(Equal(http.StatusOK))
+			})
+		})
+
+		Context("when the app has a bytes per window quota", func() {
+			remainingBytes := func() int64 {
+				for n := int64(15); n > 0; n-- {
+					grant, err := quotas.Admit(context.Background(), "app-guid", n)
+					if err == nil {
+						grant.Refund()
+						return n
+					}
+				}
+				return 0
+			}
+
+			BeforeEach(func() {
+				quotas = quota.New(lager.NewLogger("fake-logger"), quota.Limits{MaxBytesPerWindow: 15, Window: time.Hour}, quota.NewMemoryBackend())
+
+				var err error
+				incomingRequest, err = http.NewRequest(
+					"POST",
+					fmt.Sprintf("http://example.com?%s=http://cc.example.com/upload&:app_guid=app-guid", cc_messages.CcBuildArtifactsUploadUriKey),
+					bytes.NewBufferString("build-artifacts"),
+				)
+				Expect(err).NotTo(HaveOccurred())
+
+				uploader = fake_destination.FakeDestination{}
+				uploader.UploadReturns(&http.Response{StatusCode: http.StatusOK}, nil)
+			})
+
+			It("charges the build artifacts to the window once they are uploaded", func() {
+				Expect(outgoingResponse.Code).To(Equal(http.StatusOK))
+				Expect(remainingBytes()).To(BeZero())
+			})
+
+			Context("when the upload to the CC fails", func() {
+				BeforeEach(func() {
+					uploader.UploadReturns(&http.Response{StatusCode: http.StatusBadGateway}, errors.New("bad-gateway"))
+				})
+
+				It("refunds the build artifacts' bytes", func() {
+					Expect(outgoingResponse.Code).To(Equal(http.StatusBadGateway))
+					Expect(remainingBytes()).To(BeEquivalentTo(15))
+				})
+			})
+
+			Context("when the build artifacts were uploaded before", func() {
+				BeforeEach(func() {
+					sum := sha256.Sum256([]byte("build-artifacts"))
+					digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+					incomingRequest.Header.Set("Content-Digest", digest)
+
+					index := dedup.NewMemoryIndex(time.Hour, 0)
+					Expect(index.Add("http://cc.example.com/upload " + digest)).To(Succeed())
+					deduplicator = dedup.New(lager.NewLogger("fake-logger"), index)
+				})
+
+				It("skips the upload without charging it", func() {
+					Expect(outgoingResponse.Code).To(Equal(http.StatusOK))
+					Expect(uploader.UploadCallCount()).To(BeZero())
+					Expect(remainingBytes()).To(BeEquivalentTo(15))
+				})
+			})
+		})
+
+		Context("when the app has used up its bytes per window quota", func() {
+			var sink *fake_audit.FakeSink
+
+			BeforeEach(func() {
+				sink = &fake_audit.FakeSink{}
+				auditor = audit.New(lager.NewLogger("fake-logger"), sink)
+				quotas = quota.New(lager.NewLogger("fake-logger"), quota.Limits{MaxBytesPerWindow: 20, Window: time.Hour}, quota.NewMemoryBackend())
+				_, err := quotas.Admit(context.Background(), "app-guid", 10)
+				Expect(err).NotTo(HaveOccurred())
+
+				incomingRequest, err = http.NewRequest(
+					"POST",
+					fmt.Sprintf("http://example.com?%s=http://cc.example.com/upload&:app_guid=app-guid", cc_messages.CcBuildArtifactsUploadUriKey),
+					bytes.NewBufferString("build-artifacts"),
+				)
+				Expect(err).NotTo(HaveOccurred())
+
+				uploader = fake_destination.FakeDestination{}
+			})
+
+			It("responds with a structured 429 and when to retry, without uploading", func() {
+				Expect(outgoingResponse.Code).To(Equal(http.StatusTooManyRequests))
+				Expect(outgoingResponse.Header().Get("Retry-After")).To(Equal("3600"))
+				Expect(outgoingResponse.Body.String()).To(ContainSubstring(`"quota":"max_bytes_per_window"`))
+				Expect(uploader.UploadCallCount()).To(BeZero())
+			})
+
+			It("records the rejection", func() {
+				Expect(sink.WriteCallCount()).To(Equal(1))
+				record := sink.WriteArgsForCall(0)
+				Expect(record.Outcome).To(Equal(audit.OutcomeFailed))
+				Expect(record.StatusCode).To(Equal(http.StatusTooManyRequests))
+			})
+		})
 	})
 })
@@ -0,0 +1,236 @@
+package upload_droplet
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/archive"
+	"code.cloudfoundry.org/cc-uploader/ccclient"
+	"code.cloudfoundry.org/cc-uploader/quota"
+	"code.cloudfoundry.org/cc-uploader/uploads"
+	"code.cloudfoundry.org/lager/v3"
+)
+
+const EventStreamContentType = "text/event-stream"
+
+// Events sent to clients that ask for an event stream.
+const (
+	ProgressEvent       = "progress"
+	UploadCompleteEvent = "upload-complete"
+	MetadataEvent       = "droplet-metadata"
+	PollEvent           = "poll"
+	ResultEvent         = "result"
+)
+
+// Response headers carrying droplet metadata to clients that do not ask for
+// an event stream.
+const (
+	DetectedBuildpackHeader = "X-Droplet-Detected-Buildpack"
+	StartCommandHeader      = "X-Droplet-Start-Command"
+	UncompressedSizeHeader  = "X-Droplet-Uncompressed-Size"
+	FileCountHeader         = "X-Droplet-File-Count"
+)
+
+// ProgressInterval is how often progress events are sent while the droplet
+// is being uploaded to CC.
+var ProgressInterval = 5 * time.Second
+
+type ProgressPayload struct {
+	BytesSent     int64 `json:"bytes_sent"`
+	ContentLength int64 `json:"content_length"`
+}
+
+type UploadCompletePayload struct {
+	BytesSent int64  `json:"bytes_sent"`
+	Duration  string `json:"duration"`
+}
+
+type MetadataPayload struct {
+	DetectedBuildpack string `json:"detected_buildpack,omitempty"`
+	StartCommand      string `json:"start_command,omitempty"`
+	UncompressedSize  int64  `json:"uncompressed_size"`
+	FileCount         int    `json:"file_count"`
+}
+
+type ResultPayload struct {
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error,omitempty"`
+}
+
+// responder reports the progress and outcome of an upload back to the
+// client that posted the droplet.
+type responder interface {
+	UploadComplete(duration time.Duration)
+	Metadata(metadata archive.Metadata)
+	PollStatus(status ccclient.JobStatus)
+	Result(statusCode int, message string)
+	// Rejected reports that the upload quotas did not admit the upload.
+	Rejected(err error)
+}
+
+func acceptsEventStream(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == EventStreamContentType {
+			return true
+		}
+	}
+	return false
+}
+
+type plainResponder struct {
+	w http.ResponseWriter
+}
+
+func (p *plainResponder) UploadComplete(time.Duration)         {}
+func (p *plainResponder) PollStatus(status ccclient.JobStatus) {}
+
+func (p *plainResponder) Metadata(metadata archive.Metadata) {
+	if metadata.DetectedBuildpack != "" {
+		p.w.Header().Set(DetectedBuildpackHeader, metadata.DetectedBuildpack)
+	}
+	if metadata.StartCommand != "" {
+		p.w.Header().Set(StartCommandHeader, metadata.StartCommand)
+	}
+	p.w.Header().Set(UncompressedSizeHeader, strconv.FormatInt(metadata.UncompressedSize, 10))
+	p.w.Header().Set(FileCountHeader, strconv.Itoa(metadata.FileCount))
+}
+
+func (p *plainResponder) Result(statusCode int, message string) {
+	p.w.WriteHeader(statusCode)
+	if message != "" {
+		p.w.Write([]byte(message))
+	}
+}
+
+func (p *plainResponder) Rejected(err error) {
+	quota.WriteError(p.w, err)
+}
+
+// eventStream reports progress as Server-Sent Events. The response status
+// is always 200 once the stream is open; the outcome of the upload is
+// carried by the final result event.
+type eventStream struct {
+	logger     lager.Logger
+	w          http.ResponseWriter
+	controller *http.ResponseController
+	upload     *uploads.Upload
+
+	lock         sync.Mutex
+	stopProgress chan struct{}
+	progressDone chan struct{}
+	stopOnce     sync.Once
+}
+
+func newEventStream(logger lager.Logger, w http.ResponseWriter, upload *uploads.Upload) *eventStream {
+	controller := http.NewResponseController(w)
+	// The request body is still being read while events are written.
+	if err := controller.EnableFullDuplex(); err != nil {
+		logger.Debug("full-duplex-not-supported", lager.Data{"error": err.Error()})
+	}
+
+	w.Header().Set("Content-Type", EventStreamContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	s := &eventStream{
+		logger:       logger,
+		w:            w,
+		controller:   controller,
+		upload:       upload,
+		stopProgress: make(chan struct{}),
+		progressDone: make(chan struct{}),
+	}
+	s.send(ProgressEvent, s.progress())
+	go s.reportProgress()
+	return s
+}
+
+func (s *eventStream) reportProgress() {
+	defer close(s.progressDone)
+
+	ticker := time.NewTicker(ProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.send(ProgressEvent, s.progress())
+		case <-s.stopProgress:
+			return
+		}
+	}
+}
+
+func (s *eventStream) progress() ProgressPayload {
+	return ProgressPayload{
+		BytesSent:     s.upload.BytesSent(),
+		ContentLength: s.upload.ContentLength,
+	}
+}
+
+// stop stops the progress events and waits until no more can be sent, so
+// that nothing is written to the response after the handler returns.
+func (s *eventStream) stop() {
+	s.stopOnce.Do(func() { close(s.stopProgress) })
+	<-s.progressDone
+}
+
+func (s *eventStream) UploadComplete(duration time.Duration) {
+	s.stop()
+	s.send(UploadCompleteEvent, UploadCompletePayload{
+		BytesSent: s.upload.BytesSent(),
+		Duration:  duration.String(),
+	})
+}
+
+func (s *eventStream) Metadata(metadata archive.Metadata) {
+	s.send(MetadataEvent, MetadataPayload{
+		DetectedBuildpack: metadata.DetectedBuildpack,
+		StartCommand:      metadata.StartCommand,
+		UncompressedSize:  metadata.UncompressedSize,
+		FileCount:         metadata.FileCount,
+	})
+}
+
+func (s *eventStream) PollStatus(status ccclient.JobStatus) {
+	s.send(PollEvent, status)
+}
+
+func (s *eventStream) Result(statusCode int, message string) {
+	s.stop()
+	result := ResultPayload{StatusCode: statusCode}
+	if statusCode >= http.StatusBadRequest {
+		result.Error = message
+	}
+	s.send(ResultEvent, result)
+}
+
+func (s *eventStream) Rejected(err error) {
+	s.Result(quota.StatusCode(err), err.Error())
+}
+
+func (s *eventStream) send(event string, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		s.logger.Error("failed-encoding-event", err, lager.Data{"event": event})
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, data)
+	if err == nil {
+		err = s.controller.Flush()
+	}
+	if err != nil {
+		s.logger.Info("failed-sending-event", lager.Data{"event": event, "error": err.Error()})
+	}
+}
@@ -7,43 +7,78 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
-	"sync"
 	"time"
 
+	"code.cloudfoundry.org/cc-uploader"
+	"code.cloudfoundry.org/cc-uploader/archive"
+	"code.cloudfoundry.org/cc-uploader/audit"
 	"code.cloudfoundry.org/cc-uploader/ccclient"
+	"code.cloudfoundry.org/cc-uploader/coalesce"
+	"code.cloudfoundry.org/cc-uploader/config"
+	"code.cloudfoundry.org/cc-uploader/dedup"
+	"code.cloudfoundry.org/cc-uploader/destination"
+	"code.cloudfoundry.org/cc-uploader/quota"
+	"code.cloudfoundry.org/cc-uploader/requestid"
+	"code.cloudfoundry.org/cc-uploader/uploads"
 	"code.cloudfoundry.org/lager/v3"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"github.com/tedsuo/rata"
 )
 
-func New(
-	uploader ccclient.Uploader,
-	poller ccclient.Poller,
-	logger lager.Logger,
-	uploadWaitGroup *sync.WaitGroup,
-) http.Handler {
+// Options are what New builds the droplet upload handler from, as described
+// by handlers.Options.
+type Options struct {
+	Destination      destination.Destination
+	Poller           ccclient.Poller
+	Logger           lager.Logger
+	Tracker          *uploads.Tracker
+	Timeouts         config.RouteTimeouts
+	Form             config.UploadForm
+	Deduplicator     *dedup.Deduplicator
+	Coalescer        *coalesce.Coalescer
+	Auditor          *audit.Auditor
+	Quotas           *quota.Enforcer
+	ValidateArchives bool
+	Metadata         config.DropletMetadata
+}
+
+func New(options Options) http.Handler {
 	return &dropletUploader{
-		uploader:        uploader,
-		poller:          poller,
-		logger:          logger,
-		uploadWaitGroup: uploadWaitGroup,
+		destination:      options.Destination,
+		poller:           options.Poller,
+		logger:           options.Logger,
+		tracker:          options.Tracker,
+		timeouts:         options.Timeouts,
+		form:             options.Form,
+		deduplicator:     options.Deduplicator,
+		coalescer:        options.Coalescer,
+		auditor:          options.Auditor,
+		quotas:           options.Quotas,
+		validateArchives: options.ValidateArchives,
+		metadata:         options.Metadata,
 	}
 }
 
 type dropletUploader struct {
-	uploader        ccclient.Uploader
-	poller          ccclient.Poller
-	logger          lager.Logger
-	uploadWaitGroup *sync.WaitGroup
+	destination      destination.Destination
+	poller           ccclient.Poller
+	logger           lager.Logger
+	tracker          *uploads.Tracker
+	timeouts         config.RouteTimeouts
+	form             config.UploadForm
+	deduplicator     *dedup.Deduplicator
+	coalescer        *coalesce.Coalescer
+	auditor          *audit.Auditor
+	quotas           *quota.Enforcer
+	validateArchives bool
+	metadata         config.DropletMetadata
 }
 
 var MissingCCDropletUploadUriKeyError = errors.New(fmt.Sprintf("missing %s parameter", cc_messages.CcDropletUploadUriKey))
+var ConcurrentDuplicateUploadError = errors.New("an upload of the same droplet is already in progress")
 
 func (h *dropletUploader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	logger := h.logger.Session("droplet.upload")
-
-	// Track this in-flight upload + polling
-	h.uploadWaitGroup.Add(1)
-	defer h.uploadWaitGroup.Done()
+	logger := h.logger.Session("droplet.upload", requestid.Data(r.Context()))
 
 	logger.Info("extracting-droplet-upload-uri-key")
 	uploadUriParameter := r.URL.Query().Get(cc_messages.CcDropletUploadUriKey)
@@ -65,7 +100,7 @@ func (h *dropletUploader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	logger.Info("succeeded-parsing-upload-uri-parameter")
 
-	timeout := 5 * time.Minute
+	var requestedTimeout time.Duration
 	timeoutParameter := r.URL.Query().Get(cc_messages.CcTimeoutKey)
 	if timeoutParameter != "" {
 		t, err := strconv.Atoi(timeoutParameter)
@@ -75,48 +110,230 @@ func (h *dropletUploader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(err.Error()))
 			return
 		}
-		timeout = time.Duration(t) * time.Second
+		requestedTimeout = time.Duration(t) * time.Second
+	}
+
+	uploadTimeout, clamped := h.timeouts.UploadTimeout(requestedTimeout)
+	if clamped {
+		logger.Info("clamped-timeout-parameter", lager.Data{
+			"requested-timeout": requestedTimeout.String(),
+			"max-timeout":       uploadTimeout.String(),
+		})
+	}
+
+	// Track this in-flight upload + polling
+	guid := rata.Param(r, "guid")
+	auditEntry := h.auditor.Begin(r, ccuploader.UploadDropletRoute, guid, uploadUrl)
+	ctx, upload, err := h.tracker.Start(r.Context(), ccuploader.UploadDropletRoute, guid, uploadUrl, r.ContentLength)
+	if err != nil {
+		logger.Error("failed-admitting-upload", err)
+		auditEntry.Finish(http.StatusServiceUnavailable, err.Error(), 0)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
 	}
+	defer upload.Finish()
+	r.Body = upload.TrackBody(r.Body)
 
-	query := uploadUrl.Query()
-	query.Set("async", "true")
-	uploadUrl.RawQuery = query.Encode()
+	var respond responder = &plainResponder{w: w}
+	if acceptsEventStream(r) {
+		logger.Info("streaming-upload-progress")
+		respond = newEventStream(logger, w, upload)
+	}
+	respond = &auditedResponder{responder: respond, entry: auditEntry, upload: upload}
 
-	ctx, cancel := context.WithTimeout(r.Context(), timeout)
-	defer cancel()
-	cancelChan := ctx.Done()
+	dedupUpload, duplicate := h.deduplicator.Begin(dedup.Resource(uploadUrl), r)
+	if duplicate {
+		logger.Info("skipping-duplicate-droplet")
+		dedup.Skip(r.Body)
+		respond.Result(http.StatusCreated, "")
+		return
+	}
+	r.Body = dedupUpload.TrackBody(r.Body)
+
+	if key, ok := coalesce.Key(guid, r); ok {
+		call, leader := h.coalescer.Join(key)
+		if !leader {
+			h.handleConcurrentDuplicate(ctx, logger, r, call, respond)
+			return
+		}
+		defer call.Done(coalesce.Result{StatusCode: http.StatusInternalServerError, Message: "upload did not complete"})
+		respond = &sharedResponder{responder: respond, call: call}
+	}
+
+	// Only uploads that are sent on are charged to the quotas, not the ones
+	// rejected, skipped or answered by another upload above. Droplet uploads
+	// do not carry their app guid, so the quotas apply per droplet guid.
+	grant, err := h.quotas.Admit(ctx, guid, r.ContentLength)
+	if err != nil {
+		logger.Error("failed-admitting-upload-within-quota", err)
+		respond.Rejected(err)
+		return
+	}
+	defer grant.Release()
+	respond = &chargedResponder{responder: respond, grant: grant}
+
+	uploadOptions := ccclient.UploadOptions{
+		Filename:    h.form.Filename,
+		ContentType: h.form.ContentType,
+		Fields:      h.form.FieldsFor(r.URL.Query()),
+		Async:       true,
+	}
+	var archiveReader *archive.Reader
+	if h.validateArchives || h.metadata.Enabled {
+		archiveReader = archive.NewReader(r.Body, h.validateArchives)
+		defer archiveReader.Close()
+		r.Body = archiveReader
+	}
+
+	uploadCtx, cancelUpload := context.WithTimeout(ctx, uploadTimeout)
+	defer cancelUpload()
 
 	logger = logger.WithData(lager.Data{"upload-url": uploadUrl, "content-length": r.ContentLength})
 	logger.Info("uploading-droplet")
 	uploadStart := time.Now()
-	uploadResponse, err := h.uploader.Upload(uploadUrl, "droplet.tgz", r, cancelChan)
+	uploadResponse, err := h.destination.Upload(uploadCtx, guid, uploadUrl, uploadOptions, r)
 	if err != nil {
 		logger.Error("failed-uploading-droplet", err)
+		if cause := uploads.CancellationCause(ctx); cause != nil {
+			respond.Result(http.StatusServiceUnavailable, cause.Error())
+			return
+		}
+		var validationErr *archive.ValidationError
+		if errors.As(err, &validationErr) {
+			respond.Result(http.StatusUnprocessableEntity, validationErr.Error())
+			return
+		}
 		if uploadResponse == nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			respond.Result(http.StatusInternalServerError, err.Error())
 		} else {
-			w.WriteHeader(uploadResponse.StatusCode)
+			respond.Result(uploadResponse.StatusCode, err.Error())
 		}
-		w.Write([]byte(err.Error()))
 		return
 	}
 	uploadEnd := time.Now()
 	logger.Info("succeeded-uploading-droplet", lager.Data{
 		"upload-duration": uploadEnd.Sub(uploadStart).String(),
 	})
+	respond.UploadComplete(uploadEnd.Sub(uploadStart))
+
+	if h.metadata.Enabled {
+		if metadata, ok := archiveReader.Metadata(); ok {
+			logger.Info("read-droplet-metadata", lager.Data{
+				"detected-buildpack": metadata.DetectedBuildpack,
+				"uncompressed-size":  metadata.UncompressedSize,
+				"file-count":         metadata.FileCount,
+			})
+			respond.Metadata(metadata)
+		}
+	}
+
+	upload.SetPhase(uploads.PhasePolling)
+	pollingCtx, cancelPolling := context.WithTimeout(ctx, time.Duration(h.timeouts.PollingTimeout))
+	defer cancelPolling()
 
 	logger.Info("polling-cc-background-upload")
-	err = h.poller.Poll(uploadUrl, uploadResponse, cancelChan)
+	err = h.poller.Poll(pollingCtx, uploadUrl, uploadResponse, respond.PollStatus)
 	if err != nil {
 		logger.Error("failed-polling-cc-background-upload", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		if cause := uploads.CancellationCause(ctx); cause != nil {
+			respond.Result(http.StatusServiceUnavailable, cause.Error())
+			return
+		}
+		respond.Result(http.StatusInternalServerError, err.Error())
 		return
 	}
 	pollEnd := time.Now()
 	logger.Info("succeeded-polling-cc-background-upload", lager.Data{
 		"poll-duration": pollEnd.Sub(uploadEnd).String(),
 	})
+	dedupUpload.Succeeded()
+
+	respond.Result(http.StatusCreated, "")
+}
+
+// handleConcurrentDuplicate answers a request for content that is already
+// being uploaded, either by sharing the result of that upload or by
+// rejecting the request.
+func (h *dropletUploader) handleConcurrentDuplicate(ctx context.Context, logger lager.Logger, r *http.Request, call *coalesce.Call, respond responder) {
+	if !h.coalescer.Waits() {
+		logger.Info("rejecting-concurrent-duplicate-droplet")
+		respond.Result(http.StatusConflict, ConcurrentDuplicateUploadError.Error())
+		return
+	}
+
+	// The body is left unread while waiting, so that the client is not made
+	// to send content that is already being uploaded
+	logger.Info("waiting-for-concurrent-duplicate-droplet")
+	result, err := call.Wait(ctx.Done())
+	r.Body.Close()
+	if err != nil {
+		logger.Error("failed-waiting-for-concurrent-duplicate-droplet", err)
+		if cause := uploads.CancellationCause(ctx); cause != nil {
+			respond.Result(http.StatusServiceUnavailable, cause.Error())
+			return
+		}
+		respond.Result(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	logger.Info("sharing-concurrent-duplicate-droplet-result", lager.Data{"status-code": result.StatusCode})
+	respond.Result(result.StatusCode, result.Message)
+}
+
+// sharedResponder hands the result of an upload to the requests waiting for
+// it as well as to its own client.
+type sharedResponder struct {
+	responder
+	call *coalesce.Call
+}
+
+func (s *sharedResponder) Result(statusCode int, message string) {
+	s.call.Done(coalesce.Result{StatusCode: statusCode, Message: message})
+	s.responder.Result(statusCode, message)
+}
+
+func (s *sharedResponder) Rejected(err error) {
+	s.call.Done(coalesce.Result{StatusCode: quota.StatusCode(err), Message: err.Error()})
+	s.responder.Rejected(err)
+}
+
+// chargedResponder refunds the bytes an upload was charged to its quota
+// unless it succeeded.
+type chargedResponder struct {
+	responder
+	grant *quota.Grant
+}
+
+func (c *chargedResponder) Result(statusCode int, message string) {
+	if statusCode < 200 || statusCode >= 300 {
+		c.grant.Refund()
+	}
+	c.responder.Result(statusCode, message)
+}
+
+// auditedResponder completes the audit record of an upload with its CC job
+// and outcome, and emits the upload's metrics.
+type auditedResponder struct {
+	responder
+	entry  *audit.Entry
+	upload *uploads.Upload
+}
+
+func (a *auditedResponder) PollStatus(status ccclient.JobStatus) {
+	a.entry.SetCCJobGuid(status.Guid)
+	a.responder.PollStatus(status)
+}
+
+func (a *auditedResponder) Result(statusCode int, message string) {
+	a.entry.Finish(statusCode, message, a.upload.BytesSent())
+	a.upload.EmitMetrics(statusCode)
+	a.responder.Result(statusCode, message)
+}
 
-	w.WriteHeader(http.StatusCreated)
+// Rejected records the rejection without emitting metrics, as for uploads
+// the tracker rejects.
+func (a *auditedResponder) Rejected(err error) {
+	a.entry.Finish(quota.StatusCode(err), err.Error(), 0)
+	a.responder.Rejected(err)
 }
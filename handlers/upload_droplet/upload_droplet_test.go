@@ -1,18 +1,34 @@
 package upload_droplet_test
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
-	"sync"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"code.cloudfoundry.org/cc-uploader"
+	"code.cloudfoundry.org/cc-uploader/audit"
+	"code.cloudfoundry.org/cc-uploader/audit/fake_audit"
+	"code.cloudfoundry.org/cc-uploader/ccclient"
 	"code.cloudfoundry.org/cc-uploader/ccclient/fake_ccclient"
+	"code.cloudfoundry.org/cc-uploader/coalesce"
+	"code.cloudfoundry.org/cc-uploader/config"
+	"code.cloudfoundry.org/cc-uploader/dedup"
+	"code.cloudfoundry.org/cc-uploader/destination/fake_destination"
 	"code.cloudfoundry.org/cc-uploader/handlers/upload_droplet"
+	"code.cloudfoundry.org/cc-uploader/quota"
+	"code.cloudfoundry.org/cc-uploader/uploads"
 	"code.cloudfoundry.org/lager/v3"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
 	. "github.com/onsi/ginkgo/v2"
@@ -24,21 +40,51 @@ var _ = Describe("UploadDroplet", func() {
 		var incomingRequest *http.Request
 		var responseWriter http.ResponseWriter
 		var outgoingResponse *httptest.ResponseRecorder
-		var uploader fake_ccclient.FakeUploader
+		var uploader fake_destination.FakeDestination
 		var poller fake_ccclient.FakePoller
 		var logger lager.Logger
+		var timeouts config.RouteTimeouts
+		var form config.UploadForm
+		var tracker *uploads.Tracker
+		var deduplicator *dedup.Deduplicator
+		var coalescer *coalesce.Coalescer
+		var auditor *audit.Auditor
+		var quotas *quota.Enforcer
+		var validateArchives bool
+		var dropletMetadata config.DropletMetadata
 
 		BeforeEach(func() {
+			tracker = uploads.NewTracker(lager.NewLogger("fake-logger"), 0)
 			outgoingResponse = httptest.NewRecorder()
 			responseWriter = outgoingResponse
-			uploader = fake_ccclient.FakeUploader{}
+			uploader = fake_destination.FakeDestination{}
 			poller = fake_ccclient.FakePoller{}
+			timeouts = config.DefaultRouteTimeouts()
+			form = config.UploadForm{Filename: "droplet.tgz"}
+			deduplicator = nil
+			coalescer = nil
+			auditor = nil
+			quotas = nil
+			validateArchives = false
+			dropletMetadata = config.DropletMetadata{}
 		})
 
 		JustBeforeEach(func() {
 			logger = lager.NewLogger("fake-logger")
-			var wg sync.WaitGroup
-			dropletUploadHandler := upload_droplet.New(&uploader, &poller, logger, &wg)
+			dropletUploadHandler := upload_droplet.New(upload_droplet.Options{
+				Destination:      &uploader,
+				Poller:           &poller,
+				Logger:           logger,
+				Tracker:          tracker,
+				Timeouts:         timeouts,
+				Form:             form,
+				Deduplicator:     deduplicator,
+				Coalescer:        coalescer,
+				Auditor:          auditor,
+				Quotas:           quotas,
+				ValidateArchives: validateArchives,
+				Metadata:         dropletMetadata,
+			})
 
 			dropletUploadHandler.ServeHTTP(responseWriter, incomingRequest)
 		})
@@ -75,9 +121,61 @@ var _ = Describe("UploadDroplet", func() {
 				Expect(err).NotTo(HaveOccurred())
 			})
 
-			It("responds adds the async=true query parameter to the upload URI for the upload request", func() {
-				uploadUrl, _, _, _ := uploader.UploadArgsForCall(0)
-				Expect(uploadUrl).To(MatchRegexp("async=true"))
+			It("asks the destination for an asynchronous upload to the unchanged upload URI", func() {
+				_, _, uploadUrl, options, _ := uploader.UploadArgsForCall(0)
+				Expect(uploadUrl.String()).To(Equal("upload-uri.com"))
+				Expect(options.Async).To(BeTrue())
+			})
+		})
+
+		Context("When the request is routed with a droplet guid", func() {
+			BeforeEach(func() {
+				var err error
+				incomingRequest, err = http.NewRequest(
+					"POST",
+					fmt.Sprintf("http://example.com?%s=upload-uri.com&:guid=droplet-guid", cc_messages.CcDropletUploadUriKey),
+					bytes.NewBufferString(""),
+				)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("uploads the droplet to the destination under that guid", func() {
+				_, guid, _, options, _ := uploader.UploadArgsForCall(0)
+				Expect(guid).To(Equal("droplet-guid"))
+				Expect(options.Filename).To(Equal("droplet.tgz"))
+			})
+
+			Context("and the route has a custom upload form", func() {
+				BeforeEach(func() {
+					form = config.UploadForm{
+						Filename:    "droplet.tar.gz",
+						ContentType: "application/gzip",
+						Fields:      map[string]string{"stack": "cflinuxfs4"},
+					}
+				})
+
+				It("uploads the droplet in that form", func() {
+					_, _, _, options, _ := uploader.UploadArgsForCall(0)
+					Expect(options.Filename).To(Equal("droplet.tar.gz"))
+					Expect(options.ContentType).To(Equal("application/gzip"))
+					Expect(options.Fields).To(Equal(map[string]string{"stack": "cflinuxfs4"}))
+				})
+
+				Context("that lets requests set the stack", func() {
+					BeforeEach(func() {
+						form.RequestFields = []string{"stack"}
+
+						query := incomingRequest.URL.Query()
+						query.Set("form.stack", "cflinuxfs5")
+						query.Set("form.lifecycle", "docker")
+						incomingRequest.URL.RawQuery = query.Encode()
+					})
+
+					It("uploads the droplet with the stack from the request", func() {
+						_, _, _, options, _ := uploader.UploadArgsForCall(0)
+						Expect(options.Fields).To(Equal(map[string]string{"stack": "cflinuxfs5"}))
+					})
+				})
 			})
 		})
 
@@ -145,8 +243,8 @@ var _ = Describe("UploadDroplet", func() {
 			})
 
 			It("Polls for success of the upload", func() {
-				uploadURL, _, _, _ := uploader.UploadArgsForCall(0)
-				pollArgsURL, pollArgsUploadResponse, _ := poller.PollArgsForCall(0)
+				_, _, uploadURL, _, _ := uploader.UploadArgsForCall(0)
+				_, pollArgsURL, pollArgsUploadResponse, _ := poller.PollArgsForCall(0)
 				Expect(pollArgsURL).To(Equal(uploadURL))
 				Expect(pollArgsUploadResponse).To(Equal(uploadResponse))
 			})
@@ -190,14 +288,21 @@ var _ = Describe("UploadDroplet", func() {
 
 				rec := httptest.NewRecorder()
 
-				uploader.UploadStub = func(_ *url.URL, _ string, _ *http.Request, cancelChan <-chan struct{}) (*http.Response, error) {
-					<-cancelChan
+				uploader.UploadStub = func(ctx context.Context, _ string, _ *url.URL, _ ccclient.UploadOptions, _ *http.Request) (*http.Response, error) {
+					<-ctx.Done()
 					return nil, errors.New("cancelled")
 				}
 
 				done := make(chan struct{})
 				go func() {
-					h := upload_droplet.New(&uploader, &poller, lager.NewLogger("fake-logger"), &sync.WaitGroup{})
+					h := upload_droplet.New(upload_droplet.Options{
+						Destination: &uploader,
+						Poller:      &poller,
+						Logger:      lager.NewLogger("fake-logger"),
+						Tracker:     tracker,
+						Timeouts:    config.DefaultRouteTimeouts(),
+						Form:        config.UploadForm{Filename: "droplet.tgz"},
+					})
 					h.ServeHTTP(rec, req)
 					close(done)
 				}()
@@ -222,14 +327,21 @@ var _ = Describe("UploadDroplet", func() {
 
 				uploader.UploadReturns(&http.Response{StatusCode: http.StatusOK}, nil)
 
-				poller.PollStub = func(_ *url.URL, _ *http.Response, cancelChan <-chan struct{}) error {
-					<-cancelChan
+				poller.PollStub = func(ctx context.Context, _ *url.URL, _ *http.Response, _ func(ccclient.JobStatus)) error {
+					<-ctx.Done()
 					return errors.New("cancelled")
 				}
 
 				done := make(chan struct{})
 				go func() {
-					h := upload_droplet.New(&uploader, &poller, lager.NewLogger("fake-logger"), &sync.WaitGroup{})
+					h := upload_droplet.New(upload_droplet.Options{
+						Destination: &uploader,
+						Poller:      &poller,
+						Logger:      lager.NewLogger("fake-logger"),
+						Tracker:     tracker,
+						Timeouts:    config.DefaultRouteTimeouts(),
+						Form:        config.UploadForm{Filename: "droplet.tgz"},
+					})
 					h.ServeHTTP(rec, req)
 					close(done)
 				}()
@@ -255,8 +367,8 @@ var _ = Describe("UploadDroplet", func() {
 
 			Context("and we are uploading", func() {
 				BeforeEach(func() {
-					uploader.UploadStub = func(uploadURL *url.URL, filename string, r *http.Request, cancelChan <-chan struct{}) (*http.Response, error) {
-						Eventually(cancelChan, 2*time.Second).Should(BeClosed())
+					uploader.UploadStub = func(ctx context.Context, _ string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+						Eventually(ctx.Done(), 2*time.Second).Should(BeClosed())
 						return nil, errors.New("timeout")
 					}
 				})
@@ -268,8 +380,9 @@ var _ = Describe("UploadDroplet", func() {
 
 			Context("and we are polling", func() {
 				BeforeEach(func() {
-					poller.PollStub = func(fallbackURL *url.URL, res *http.Response, cancelChan <-chan struct{}) error {
-						Eventually(cancelChan, 2*time.Second).Should(BeClosed())
+					timeouts.PollingTimeout = config.Duration(time.Second)
+					poller.PollStub = func(ctx context.Context, fallbackURL *url.URL, res *http.Response, _ func(ccclient.JobStatus)) error {
+						Eventually(ctx.Done(), 2*time.Second).Should(BeClosed())
 						return errors.New("timeout")
 					}
 				})
@@ -279,5 +392,782 @@ var _ = Describe("UploadDroplet", func() {
 				})
 			})
 		})
+
+		Context("when the upload is cancelled because the drain deadline passed", func() {
+			BeforeEach(func() {
+				var err error
+				incomingRequest, err = http.NewRequest(
+					"POST",
+					fmt.Sprintf("http://example.com?%s=upload-uri.com", cc_messages.CcDropletUploadUriKey),
+					bytes.NewBufferString("droplet"),
+				)
+				Expect(err).NotTo(HaveOccurred())
+
+				uploader.UploadStub = func(ctx context.Context, _ string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+					Expect(tracker.Status().RemainingUploads).To(Equal(1))
+					tracker.CancelAll(uploads.ErrDrainTimeout)
+					Eventually(ctx.Done()).Should(BeClosed())
+					return nil, errors.New("cancelled")
+				}
+			})
+
+			It("responds with service unavailable and the drain error", func() {
+				Expect(outgoingResponse.Code).To(Equal(http.StatusServiceUnavailable))
+				Expect(outgoingResponse.Body.String()).To(Equal(uploads.ErrDrainTimeout.Error()))
+			})
+
+			It("stops tracking the upload", func() {
+				Expect(tracker.Status().RemainingUploads).To(BeZero())
+			})
+		})
+
+		Context("when the in-flight upload limit has been reached", func() {
+			BeforeEach(func() {
+				var err error
+				incomingRequest, err = http.NewRequest(
+					"POST",
+					fmt.Sprintf("http://example.com?%s=upload-uri.com", cc_messages.CcDropletUploadUriKey),
+					bytes.NewBufferString(""),
+				)
+				Expect(err).NotTo(HaveOccurred())
+
+				tracker = uploads.NewTracker(lager.NewLogger("fake-logger"), 1)
+				_, _, err = tracker.Start(context.Background(), "UploadDroplet", "other-guid", &url.URL{}, 1)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("responds with service unavailable without uploading", func() {
+				Expect(outgoingResponse.Code).To(Equal(http.StatusServiceUnavailable))
+				Expect(uploader.UploadCallCount()).To(BeZero())
+			})
+		})
+
+		Context("when upload quotas are enforced", func() {
+			BeforeEach(func() {
+				var err error
+				incomingRequest, err = http.NewRequest(
+					"POST",
+					fmt.Sprintf("http://example.com?%s=http://cc.example.com/upload&:guid=app-guid", cc_messages.CcDropletUploadUriKey),
+					bytes.NewBufferString("droplet-contents"),
+				)
+				Expect(err).NotTo(HaveOccurred())
+
+				uploader.UploadReturns(&http.Response{StatusCode: http.StatusCreated}, nil)
+			})
+
+			Context("and the upload is within them", func() {
+				BeforeEach(func() {
+					quotas = quota.New(lager.NewLogger("fake-logger"), quota.Limits{MaxConcurrentUploads: 1, MaxObjectSize: 16}, quota.NewMemoryBackend())
+				})
+
+				It("uploads the droplet and releases its slot", func() {
+					Expect(outgoingResponse.Code).To(Equal(http.StatusCreated))
+					Expect(uploader.UploadCallCount()).To(Equal(1))
+
+					grant, err := quotas.Admit(context.Background(), "app-guid", 16)
+					Expect(err).NotTo(HaveOccurred())
+					grant.Release()
+				})
+			})
+
+			Context("and the app has too many uploads in flight", func() {
+				BeforeEach(func() {
+					quotas = quota.New(lager.NewLogger("fake-logger"), quota.Limits{MaxConcurrentUploads: 1}, quota.NewMemoryBackend())
+					_, err := quotas.Admit(context.Background(), "app-guid", 1)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("responds with a structured 429 without uploading", func() {
+					Expect(outgoingResponse.Code).To(Equal(http.StatusTooManyRequests))
+					Expect(outgoingResponse.Header().Get("Content-Type")).To(Equal("application/json"))
+					Expect(outgoingResponse.Body.String()).To(ContainSubstring(`"quota":"max_concurrent_uploads"`))
+					Expect(uploader.UploadCallCount()).To(BeZero())
+					Expect(tracker.Status().RemainingUploads).To(BeZero())
+				})
+			})
+
+			Context("and the droplet is larger than the object size quota", func() {
+				BeforeEach(func() {
+					quotas = quota.New(lager.NewLogger("fake-logger"), quota.Limits{MaxObjectSize: 15}, quota.NewMemoryBackend())
+				})
+
+				It("responds with a structured 429 without uploading", func() {
+					Expect(outgoingResponse.Code).To(Equal(http.StatusTooManyRequests))
+					Expect(outgoingResponse.Body.String()).To(ContainSubstring(`"quota":"max_object_size"`))
+					Expect(uploader.UploadCallCount()).To(BeZero())
+				})
+			})
+
+			Context("and the app has a bytes per window quota", func() {
+				remainingBytes := func() int64 {
+					for n := int64(16); n > 0; n-- {
+						grant, err := quotas.Admit(context.Background(), "app-guid", n)
+						if err == nil {
+							grant.Refund()
+							return n
+						}
+					}
+					return 0
+				}
+
+				BeforeEach(func() {
+					quotas = quota.New(lager.NewLogger("fake-logger"), quota.Limits{MaxBytesPerWindow: 16, Window: time.Hour}, quota.NewMemoryBackend())
+				})
+
+				It("charges the droplet to the window once it is uploaded", func() {
+					Expect(outgoingResponse.Code).To(Equal(http.StatusCreated))
+					Expect(remainingBytes()).To(BeZero())
+				})
+
+				Context("when the upload to the CC fails", func() {
+					BeforeEach(func() {
+						uploader.UploadReturns(&http.Response{StatusCode: http.StatusBadGateway}, errors.New("bad-gateway"))
+					})
+
+					It("refunds the droplet's bytes", func() {
+						Expect(outgoingResponse.Code).To(Equal(http.StatusBadGateway))
+						Expect(remainingBytes()).To(BeEquivalentTo(16))
+					})
+				})
+
+				Context("when the droplet is not a valid archive", func() {
+					BeforeEach(func() {
+						validateArchives = true
+						uploader.UploadStub = func(ctx context.Context, _ string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+							_, err := io.ReadAll(r.Body)
+							return nil, &url.Error{Op: "Post", URL: uploadURL.String(), Err: err}
+						}
+					})
+
+					It("refunds the droplet's bytes", func() {
+						Expect(outgoingResponse.Code).To(Equal(http.StatusUnprocessableEntity))
+						Expect(remainingBytes()).To(BeEquivalentTo(16))
+					})
+				})
+
+				Context("when the in-flight upload limit has been reached", func() {
+					BeforeEach(func() {
+						tracker = uploads.NewTracker(lager.NewLogger("fake-logger"), 1)
+						_, _, err := tracker.Start(context.Background(), "UploadDroplet", "other-guid", &url.URL{}, 1)
+						Expect(err).NotTo(HaveOccurred())
+					})
+
+					It("does not charge the droplet", func() {
+						Expect(outgoingResponse.Code).To(Equal(http.StatusServiceUnavailable))
+						Expect(remainingBytes()).To(BeEquivalentTo(16))
+					})
+				})
+
+				Context("when the droplet was uploaded before", func() {
+					BeforeEach(func() {
+						sum := sha256.Sum256([]byte("droplet-contents"))
+						digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+						incomingRequest.Header.Set("Content-Digest", digest)
+
+						index := dedup.NewMemoryIndex(time.Hour, 0)
+						Expect(index.Add("http://cc.example.com/upload " + digest)).To(Succeed())
+						deduplicator = dedup.New(lager.NewLogger("fake-logger"), index)
+					})
+
+					It("skips the upload without charging it", func() {
+						Expect(outgoingResponse.Code).To(Equal(http.StatusCreated))
+						Expect(uploader.UploadCallCount()).To(BeZero())
+						Expect(remainingBytes()).To(BeEquivalentTo(16))
+					})
+				})
+
+				Context("when the window is used up", func() {
+					BeforeEach(func() {
+						_, err := quotas.Admit(context.Background(), "app-guid", 16)
+						Expect(err).NotTo(HaveOccurred())
+					})
+
+					It("responds with a structured 429 without uploading", func() {
+						Expect(outgoingResponse.Code).To(Equal(http.StatusTooManyRequests))
+						Expect(outgoingResponse.Body.String()).To(ContainSubstring(`"quota":"max_bytes_per_window"`))
+						Expect(uploader.UploadCallCount()).To(BeZero())
+					})
+
+					Context("and the client asks for an event stream", func() {
+						BeforeEach(func() {
+							incomingRequest.Header.Set("Accept", "text/event-stream")
+						})
+
+						It("reports the rejection in the result event", func() {
+							Expect(outgoingResponse.Code).To(Equal(http.StatusOK))
+							Expect(outgoingResponse.Body.String()).To(HaveSuffix(
+								"event: result\ndata: {\"status_code\":429,\"error\":\"upload quota max_bytes_per_window of 16 exceeded for app-guid\"}\n\n",
+							))
+							Expect(uploader.UploadCallCount()).To(BeZero())
+						})
+					})
+				})
+			})
+		})
+
+		Context("when the requested timeout exceeds the maximum", func() {
+			BeforeEach(func() {
+				var err error
+				incomingRequest, err = http.NewRequest(
+					"POST",
+					fmt.Sprintf("http://example.com?%s=upload-uri.com&timeout=3600", cc_messages.CcDropletUploadUriKey),
+					bytes.NewBufferString(""),
+				)
+				Expect(err).NotTo(HaveOccurred())
+
+				timeouts.MaxUploadTimeout = config.Duration(time.Second)
+				uploader.UploadStub = func(ctx context.Context, _ string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+					Eventually(ctx.Done(), 2*time.Second).Should(BeClosed())
+					return nil, errors.New("timeout")
+				}
+			})
+
+			It("clamps the upload timeout to the maximum", func() {
+				Expect(outgoingResponse.Code).To(Equal(http.StatusInternalServerError))
+			})
+		})
+
+		Context("when the upload phase used most of the upload timeout", func() {
+			BeforeEach(func() {
+				var err error
+				incomingRequest, err = http.NewRequest(
+					"POST",
+					fmt.Sprintf("http://example.com?%s=upload-uri.com&timeout=1", cc_messages.CcDropletUploadUriKey),
+					bytes.NewBufferString(""),
+				)
+				Expect(err).NotTo(HaveOccurred())
+
+				uploader.UploadStub = func(ctx context.Context, _ string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+					time.Sleep(900 * time.Millisecond)
+					return &http.Response{StatusCode: http.StatusCreated}, nil
+				}
+				poller.PollStub = func(ctx context.Context, fallbackURL *url.URL, res *http.Response, _ func(ccclient.JobStatus)) error {
+					Consistently(ctx.Done(), 500*time.Millisecond).ShouldNot(BeClosed())
+					return nil
+				}
+			})
+
+			It("gives polling its own deadline", func() {
+				Expect(outgoingResponse.Code).To(Equal(http.StatusCreated))
+			})
+		})
+
+		Context("when deduplication is enabled", func() {
+			var newRequest func(body string) *http.Request
+
+			BeforeEach(func() {
+				deduplicator = dedup.New(lager.NewLogger("fake-logger"), dedup.NewMemoryIndex(time.Hour, 0))
+
+				newRequest = func(body string) *http.Request {
+					request, err := http.NewRequest(
+						"POST",
+						fmt.Sprintf("http://example.com?%s=http://cc.example.com/droplets/guid/upload", cc_messages.CcDropletUploadUriKey),
+						bytes.NewBufferString(body),
+					)
+					Expect(err).NotTo(HaveOccurred())
+					sum := sha256.Sum256([]byte(body))
+					request.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+					return request
+				}
+				incomingRequest = newRequest("droplet-contents")
+
+				uploader.UploadStub = func(ctx context.Context, _ string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+					io.ReadAll(r.Body)
+					return &http.Response{StatusCode: http.StatusCreated}, nil
+				}
+				poller.PollReturns(nil)
+			})
+
+			serveAgain := func(request *http.Request) *httptest.ResponseRecorder {
+				recorder := httptest.NewRecorder()
+				upload_droplet.New(upload_droplet.Options{
+					Destination:      &uploader,
+					Poller:           &poller,
+					Logger:           logger,
+					Tracker:          tracker,
+					Timeouts:         timeouts,
+					Form:             form,
+					Deduplicator:     deduplicator,
+					Coalescer:        coalescer,
+					Auditor:          auditor,
+					Quotas:           quotas,
+					ValidateArchives: validateArchives,
+					Metadata:         dropletMetadata,
+				}).ServeHTTP(recorder, request)
+				return recorder
+			}
+
+			It("skips uploading an identical droplet again", func() {
+				Expect(outgoingResponse.Code).To(Equal(http.StatusCreated))
+
+				response := serveAgain(newRequest("droplet-contents"))
+				Expect(response.Code).To(Equal(http.StatusCreated))
+				Expect(uploader.UploadCallCount()).To(Equal(1))
+				Expect(poller.PollCallCount()).To(Equal(1))
+			})
+
+			It("uploads droplets with different contents", func() {
+				response := serveAgain(newRequest("other-droplet-contents"))
+				Expect(response.Code).To(Equal(http.StatusCreated))
+				Expect(uploader.UploadCallCount()).To(Equal(2))
+			})
+
+			Context("when polling fails", func() {
+				BeforeEach(func() {
+					poller.PollReturns(errors.New("poll-error"))
+				})
+
+				It("does not remember the droplet", func() {
+					serveAgain(newRequest("droplet-contents"))
+					Expect(uploader.UploadCallCount()).To(Equal(2))
+				})
+			})
+		})
+
+		Context("when auditing is enabled", func() {
+			var sink *fake_audit.FakeSink
+
+			BeforeEach(func() {
+				sink = &fake_audit.FakeSink{}
+				auditor = audit.New(lager.NewLogger("fake-logger"), sink)
+
+				var err error
+				incomingRequest, err = http.NewRequest(
+					"POST",
+					fmt.Sprintf("http://example.com?%s=http://cc.example.com/upload&:guid=droplet-guid", cc_messages.CcDropletUploadUriKey),
+					bytes.NewBufferString("droplet-contents"),
+				)
+				Expect(err).NotTo(HaveOccurred())
+				incomingRequest.Header.Set("Content-MD5", "the-md5")
+
+				uploader.UploadStub = func(ctx context.Context, _ string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+					io.ReadAll(r.Body)
+					return &http.Response{StatusCode: http.StatusCreated}, nil
+				}
+				poller.PollStub = func(ctx context.Context, fallbackURL *url.URL, res *http.Response, onStatus func(ccclient.JobStatus)) error {
+					onStatus(ccclient.JobStatus{Guid: "job-guid", Status: ccclient.JOB_FINISHED})
+					return nil
+				}
+			})
+
+			It("records the upload", func() {
+				Expect(sink.WriteCallCount()).To(Equal(1))
+				record := sink.WriteArgsForCall(0)
+				Expect(record.Route).To(Equal(ccuploader.UploadDropletRoute))
+				Expect(record.Guid).To(Equal("droplet-guid"))
+				Expect(record.DestinationHost).To(Equal("cc.example.com"))
+				Expect(record.Size).To(Equal(int64(16)))
+				Expect(record.Digest).To(Equal("md5=the-md5"))
+				Expect(record.Outcome).To(Equal(audit.OutcomeSucceeded))
+				Expect(record.StatusCode).To(Equal(http.StatusCreated))
+				Expect(record.CCJobGuid).To(Equal("job-guid"))
+			})
+
+			Context("when the upload fails", func() {
+				BeforeEach(func() {
+					uploader.UploadStub = nil
+					uploader.UploadReturns(nil, errors.New("upload-error"))
+				})
+
+				It("records the failure", func() {
+					Expect(sink.WriteCallCount()).To(Equal(1))
+					record := sink.WriteArgsForCall(0)
+					Expect(record.Outcome).To(Equal(audit.OutcomeFailed))
+					Expect(record.StatusCode).To(Equal(http.StatusInternalServerError))
+					Expect(record.Error).To(Equal("upload-error"))
+				})
+			})
+		})
+
+		Context("when archive validation is enabled", func() {
+			var newRequest func(body []byte) *http.Request
+
+			BeforeEach(func() {
+				validateArchives = true
+
+				newRequest = func(body []byte) *http.Request {
+					request, err := http.NewRequest(
+						"POST",
+						fmt.Sprintf("http://example.com?%s=upload-uri.com", cc_messages.CcDropletUploadUriKey),
+						bytes.NewReader(body),
+					)
+					Expect(err).NotTo(HaveOccurred())
+					return request
+				}
+				incomingRequest = newRequest(gzippedFiles("app/app.rb", "puts 'hello'"))
+
+				uploader.UploadStub = func(ctx context.Context, _ string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+					_, err := io.ReadAll(r.Body)
+					if err != nil {
+						return nil, &url.Error{Op: "Post", URL: uploadURL.String(), Err: err}
+					}
+					return &http.Response{StatusCode: http.StatusCreated}, nil
+				}
+				poller.PollReturns(nil)
+			})
+
+			It("forwards a valid droplet", func() {
+				Expect(outgoingResponse.Code).To(Equal(http.StatusCreated))
+			})
+
+			Context("when the droplet is not a gzipped tarball", func() {
+				BeforeEach(func() {
+					incomingRequest = newRequest([]byte("not-a-droplet"))
+				})
+
+				It("aborts the upload with 422 Unprocessable Entity", func() {
+					Expect(outgoingResponse.Code).To(Equal(http.StatusUnprocessableEntity))
+					Expect(outgoingResponse.Body.String()).To(ContainSubstring("invalid archive"))
+					Expect(poller.PollCallCount()).To(BeZero())
+				})
+			})
+
+			Context("when the droplet is truncated", func() {
+				BeforeEach(func() {
+					droplet := gzippedFiles("app/app.rb", "puts 'hello'")
+					incomingRequest = newRequest(droplet[:len(droplet)-10])
+				})
+
+				It("aborts the upload with 422 Unprocessable Entity", func() {
+					Expect(outgoingResponse.Code).To(Equal(http.StatusUnprocessableEntity))
+				})
+			})
+		})
+
+		Context("when droplet metadata is enabled", func() {
+			var droplet []byte
+
+			BeforeEach(func() {
+				dropletMetadata = config.DropletMetadata{Enabled: true}
+				droplet = gzippedFiles(
+					"staging_info.yml", `{"detected_buildpack":"ruby","start_command":"rackup"}`,
+					"app/config.ru", "run App",
+				)
+
+				var err error
+				incomingRequest, err = http.NewRequest(
+					"POST",
+					fmt.Sprintf("http://example.com?%s=upload-uri.com", cc_messages.CcDropletUploadUriKey),
+					bytes.NewReader(droplet),
+				)
+				Expect(err).NotTo(HaveOccurred())
+
+				uploader.UploadStub = func(ctx context.Context, _ string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+					io.ReadAll(r.Body)
+					return &http.Response{StatusCode: http.StatusCreated}, nil
+				}
+				poller.PollReturns(nil)
+			})
+
+			It("returns the metadata in response headers", func() {
+				Expect(outgoingResponse.Code).To(Equal(http.StatusCreated))
+				Expect(outgoingResponse.Header().Get(upload_droplet.DetectedBuildpackHeader)).To(Equal("ruby"))
+				Expect(outgoingResponse.Header().Get(upload_droplet.StartCommandHeader)).To(Equal("rackup"))
+				Expect(outgoingResponse.Header().Get(upload_droplet.UncompressedSizeHeader)).To(Equal("61"))
+				Expect(outgoingResponse.Header().Get(upload_droplet.FileCountHeader)).To(Equal("2"))
+			})
+		})
+
+		Context("when the client asks for an event stream", func() {
+			BeforeEach(func() {
+				var err error
+				incomingRequest, err = http.NewRequest(
+					"POST",
+					fmt.Sprintf("http://example.com?%s=upload-uri.com", cc_messages.CcDropletUploadUriKey),
+					bytes.NewBufferString("droplet-contents"),
+				)
+				Expect(err).NotTo(HaveOccurred())
+				incomingRequest.Header.Set("Accept", "text/event-stream")
+
+				uploader.UploadStub = func(ctx context.Context, _ string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+					io.ReadAll(r.Body)
+					return &http.Response{StatusCode: http.StatusCreated}, nil
+				}
+				poller.PollStub = func(ctx context.Context, fallbackURL *url.URL, res *http.Response, onStatus func(ccclient.JobStatus)) error {
+					onStatus(ccclient.JobStatus{Guid: "job-guid", Status: ccclient.JOB_QUEUED})
+					onStatus(ccclient.JobStatus{Guid: "job-guid", Status: ccclient.JOB_FINISHED})
+					return nil
+				}
+			})
+
+			It("streams the progress and the outcome of the upload", func() {
+				Expect(outgoingResponse.Code).To(Equal(http.StatusOK))
+				Expect(outgoingResponse.Header().Get("Content-Type")).To(Equal(upload_droplet.EventStreamContentType))
+				Expect(outgoingResponse.Flushed).To(BeTrue())
+
+				Expect(outgoingResponse.Body.String()).To(HavePrefix(
+					"event: progress\ndata: {\"bytes_sent\":0,\"content_length\":16}\n\n" +
+						"event: upload-complete\ndata: {\"bytes_sent\":16,",
+				))
+				Expect(outgoingResponse.Body.String()).To(HaveSuffix(
+					"event: poll\ndata: {\"guid\":\"job-guid\",\"status\":\"queued\"}\n\n" +
+						"event: poll\ndata: {\"guid\":\"job-guid\",\"status\":\"finished\"}\n\n" +
+						"event: result\ndata: {\"status_code\":201}\n\n",
+				))
+			})
+
+			Context("when polling fails", func() {
+				BeforeEach(func() {
+					poller.PollStub = nil
+					poller.PollReturns(errors.New("poll-error"))
+				})
+
+				It("reports the failure in the result event", func() {
+					Expect(outgoingResponse.Code).To(Equal(http.StatusOK))
+					Expect(outgoingResponse.Body.String()).To(HaveSuffix(
+						"event: result\ndata: {\"status_code\":500,\"error\":\"poll-error\"}\n\n",
+					))
+				})
+			})
+
+			Context("when droplet metadata is enabled", func() {
+				BeforeEach(func() {
+					dropletMetadata = config.DropletMetadata{Enabled: true}
+					droplet := gzippedFiles("staging_info.yml", `{"detected_buildpack":"ruby"}`)
+
+					var err error
+					incomingRequest, err = http.NewRequest(
+						"POST",
+						fmt.Sprintf("http://example.com?%s=upload-uri.com", cc_messages.CcDropletUploadUriKey),
+						bytes.NewReader(droplet),
+					)
+					Expect(err).NotTo(HaveOccurred())
+					incomingRequest.Header.Set("Accept", "text/event-stream")
+				})
+
+				It("sends the metadata once the upload is complete", func() {
+					Expect(outgoingResponse.Body.String()).To(ContainSubstring(
+						"event: droplet-metadata\ndata: {\"detected_buildpack\":\"ruby\",\"uncompressed_size\":29,\"file_count\":1}\n\n" +
+							"event: poll\n",
+					))
+				})
+			})
+
+			Context("when the upload takes longer than the progress interval", func() {
+				var originalInterval time.Duration
+
+				BeforeEach(func() {
+					originalInterval = upload_droplet.ProgressInterval
+					upload_droplet.ProgressInterval = 10 * time.Millisecond
+
+					uploader.UploadStub = func(ctx context.Context, _ string, uploadURL *url.URL, options ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+						io.ReadAll(r.Body)
+						time.Sleep(100 * time.Millisecond)
+						return &http.Response{StatusCode: http.StatusCreated}, nil
+					}
+				})
+
+				AfterEach(func() {
+					upload_droplet.ProgressInterval = originalInterval
+				})
+
+				It("sends periodic progress events", func() {
+					Expect(strings.Count(outgoingResponse.Body.String(), "data: {\"bytes_sent\":16,\"content_length\":16}")).To(BeNumerically(">", 1))
+				})
+			})
+		})
+	})
+
+	Describe("concurrent duplicate uploads", func() {
+		var (
+			uploader      fake_destination.FakeDestination
+			poller        fake_ccclient.FakePoller
+			coalescer     *coalesce.Coalescer
+			quotas        *quota.Enforcer
+			handler       http.Handler
+			releaseUpload chan struct{}
+			firstResponse chan *httptest.ResponseRecorder
+		)
+
+		newRequest := func(md5 string) *http.Request {
+			request, err := http.NewRequest(
+				"POST",
+				fmt.Sprintf("http://example.com?%s=upload-uri.com&:guid=droplet-guid", cc_messages.CcDropletUploadUriKey),
+				bytes.NewBufferString("droplet-contents"),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			request.Header.Set("Content-MD5", md5)
+			return request
+		}
+
+		BeforeEach(func() {
+			uploader = fake_destination.FakeDestination{}
+			poller = fake_ccclient.FakePoller{}
+			quotas = nil
+			releaseUpload = make(chan struct{})
+			firstResponse = make(chan *httptest.ResponseRecorder, 1)
+
+			uploader.UploadStub = func(_ context.Context, _ string, _ *url.URL, _ ccclient.UploadOptions, r *http.Request) (*http.Response, error) {
+				<-releaseUpload
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}
+		})
+
+		JustBeforeEach(func() {
+			logger := lager.NewLogger("fake-logger")
+			handler = upload_droplet.New(upload_droplet.Options{
+				Destination: &uploader,
+				Poller:      &poller,
+				Logger:      logger,
+				Tracker:     uploads.NewTracker(logger, 0),
+				Timeouts:    config.DefaultRouteTimeouts(),
+				Form:        config.UploadForm{Filename: "droplet.tgz"},
+				Coalescer:   coalescer,
+				Quotas:      quotas,
+			})
+
+			go func() {
+				defer GinkgoRecover()
+				recorder := httptest.NewRecorder()
+				handler.ServeHTTP(recorder, newRequest("the-md5"))
+				firstResponse <- recorder
+			}()
+			Eventually(uploader.UploadCallCount).Should(Equal(1))
+		})
+
+		Context("when duplicates wait", func() {
+			BeforeEach(func() {
+				coalescer = coalesce.New(true)
+			})
+
+			It("shares the result of the upload in progress", func() {
+				secondResponse := make(chan *httptest.ResponseRecorder, 1)
+				go func() {
+					defer GinkgoRecover()
+					recorder := httptest.NewRecorder()
+					handler.ServeHTTP(recorder, newRequest("the-md5"))
+					secondResponse <- recorder
+				}()
+
+				Consistently(secondResponse, 100*time.Millisecond).ShouldNot(Receive())
+				poller.PollReturns(errors.New("poll-error"))
+				close(releaseUpload)
+
+				var first, second *httptest.ResponseRecorder
+				Eventually(firstResponse).Should(Receive(&first))
+				Eventually(secondResponse).Should(Receive(&second))
+				Expect(first.Code).To(Equal(http.StatusInternalServerError))
+				Expect(second.Code).To(Equal(http.StatusInternalServerError))
+				Expect(second.Body.String()).To(Equal("poll-error"))
+				Expect(uploader.UploadCallCount()).To(Equal(1))
+			})
+
+			It("does not read the body of the waiting request", func() {
+				body := &watchedBody{Reader: bytes.NewBufferString("droplet-contents")}
+				request := newRequest("the-md5")
+				request.Body = body
+
+				secondResponse := make(chan *httptest.ResponseRecorder, 1)
+				go func() {
+					defer GinkgoRecover()
+					recorder := httptest.NewRecorder()
+					handler.ServeHTTP(recorder, request)
+					secondResponse <- recorder
+				}()
+
+				Consistently(secondResponse, 100*time.Millisecond).ShouldNot(Receive())
+				Expect(body.read.Load()).To(BeFalse())
+				Expect(body.closed.Load()).To(BeFalse())
+
+				close(releaseUpload)
+				var second *httptest.ResponseRecorder
+				Eventually(secondResponse).Should(Receive(&second))
+				Expect(second.Code).To(Equal(http.StatusCreated))
+				Expect(body.read.Load()).To(BeFalse())
+				Expect(body.closed.Load()).To(BeTrue())
+			})
+
+			Context("and upload quotas are enforced", func() {
+				BeforeEach(func() {
+					quotas = quota.New(lager.NewLogger("fake-logger"), quota.Limits{MaxConcurrentUploads: 1, MaxBytesPerWindow: 16, Window: time.Hour}, quota.NewMemoryBackend())
+				})
+
+				It("charges only the upload in progress", func() {
+					secondResponse := make(chan *httptest.ResponseRecorder, 1)
+					go func() {
+						defer GinkgoRecover()
+						recorder := httptest.NewRecorder()
+						handler.ServeHTTP(recorder, newRequest("the-md5"))
+						secondResponse <- recorder
+					}()
+
+					Consistently(secondResponse, 100*time.Millisecond).ShouldNot(Receive())
+					close(releaseUpload)
+
+					var first, second *httptest.ResponseRecorder
+					Eventually(firstResponse).Should(Receive(&first))
+					Eventually(secondResponse).Should(Receive(&second))
+					Expect(first.Code).To(Equal(http.StatusCreated))
+					Expect(second.Code).To(Equal(http.StatusCreated))
+
+					_, err := quotas.Admit(context.Background(), "droplet-guid", 1)
+					Expect(err).To(BeAssignableToTypeOf(&quota.ExceededError{}))
+				})
+			})
+
+			It("uploads different content for the same guid", func() {
+				go func() {
+					defer GinkgoRecover()
+					handler.ServeHTTP(httptest.NewRecorder(), newRequest("other-md5"))
+				}()
+
+				Eventually(uploader.UploadCallCount).Should(Equal(2))
+				close(releaseUpload)
+				Eventually(firstResponse).Should(Receive())
+			})
+		})
+
+		Context("when duplicates are rejected", func() {
+			BeforeEach(func() {
+				coalescer = coalesce.New(false)
+			})
+
+			It("responds with a conflict", func() {
+				recorder := httptest.NewRecorder()
+				handler.ServeHTTP(recorder, newRequest("the-md5"))
+				Expect(recorder.Code).To(Equal(http.StatusConflict))
+				Expect(recorder.Body.String()).To(Equal(upload_droplet.ConcurrentDuplicateUploadError.Error()))
+
+				close(releaseUpload)
+				var first *httptest.ResponseRecorder
+				Eventually(firstResponse).Should(Receive(&first))
+				Expect(first.Code).To(Equal(http.StatusCreated))
+				Expect(uploader.UploadCallCount()).To(Equal(1))
+			})
+		})
 	})
 })
+
+// watchedBody records whether a request body was read or closed.
+type watchedBody struct {
+	io.Reader
+	read   atomic.Bool
+	closed atomic.Bool
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	b.read.Store(true)
+	return b.Reader.Read(p)
+}
+
+func (b *watchedBody) Close() error {
+	b.closed.Store(true)
+	return nil
+}
+
+// gzippedFiles builds a droplet from alternating file names and contents.
+func gzippedFiles(namesAndContents ...string) []byte {
+	buffer := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for i := 0; i < len(namesAndContents); i += 2 {
+		contents := namesAndContents[i+1]
+		header := &tar.Header{Name: namesAndContents[i], Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))}
+		Expect(tarWriter.WriteHeader(header)).To(Succeed())
+		_, err := tarWriter.Write([]byte(contents))
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(tarWriter.Close()).To(Succeed())
+	Expect(gzipWriter.Close()).To(Succeed())
+	return buffer.Bytes()
+}
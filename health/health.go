@@ -0,0 +1,113 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/uploads"
+	"code.cloudfoundry.org/lager/v3"
+)
+
+const (
+	LivenessPath  = "/healthz"
+	ReadinessPath = "/readyz"
+)
+
+// Check is a named readiness condition. Check returns an error describing
+// why the process is not ready, or nil.
+type Check struct {
+	Name  string
+	Check func() error
+}
+
+type readinessResponse struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// New returns a handler serving liveness on LivenessPath and readiness on
+// ReadinessPath. Liveness always succeeds while the process can serve
+// requests; readiness fails with 503 if any of the checks fail.
+func New(logger lager.Logger, checks ...Check) http.Handler {
+	logger = logger.Session("health")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(LivenessPath, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc(ReadinessPath, func(w http.ResponseWriter, r *http.Request) {
+		response := readinessResponse{Ready: true, Checks: map[string]string{}}
+		for _, check := range checks {
+			if err := check.Check(); err != nil {
+				logger.Info("readiness-check-failed", lager.Data{"check": check.Name, "reason": err.Error()})
+				response.Ready = false
+				response.Checks[check.Name] = err.Error()
+				continue
+			}
+			response.Checks[check.Name] = "ok"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !response.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+
+	return mux
+}
+
+// NewDrainingCheck fails once the tracker has started draining for shutdown.
+func NewDrainingCheck(tracker *uploads.Tracker) Check {
+	return Check{
+		Name: "draining",
+		Check: func() error {
+			if tracker.Draining() {
+				return errors.New("shutting down, draining in-flight uploads")
+			}
+			return nil
+		},
+	}
+}
+
+// NewAdmissionCheck fails while the tracker is at its in-flight upload limit.
+func NewAdmissionCheck(tracker *uploads.Tracker) Check {
+	return Check{
+		Name: "admission",
+		Check: func() error {
+			if tracker.AtCapacity() {
+				return uploads.ErrTooManyUploads
+			}
+			return nil
+		},
+	}
+}
+
+// NewCCProbe returns a check that fails when probeURL cannot be reached
+// within timeout. Any HTTP response counts as reachable, since the probe
+// only verifies connectivity and not the health of CC itself.
+func NewCCProbe(client *http.Client, probeURL string, timeout time.Duration) Check {
+	probeClient := *client
+	probeClient.Timeout = timeout
+
+	return Check{
+		Name: "cloud-controller",
+		Check: func() error {
+			req, err := http.NewRequest("HEAD", probeURL, nil)
+			if err != nil {
+				return err
+			}
+
+			resp, err := probeClient.Do(req)
+			if err != nil {
+				return fmt.Errorf("cloud controller unreachable: %s", err)
+			}
+			resp.Body.Close()
+			return nil
+		},
+	}
+}
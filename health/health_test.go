@@ -0,0 +1,143 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/health"
+	"code.cloudfoundry.org/cc-uploader/uploads"
+	"code.cloudfoundry.org/lager/v3/lagertest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health", func() {
+	var (
+		logger  *lagertest.TestLogger
+		checks  []health.Check
+		handler http.Handler
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		checks = nil
+	})
+
+	JustBeforeEach(func() {
+		handler = health.New(logger, checks...)
+	})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+
+	readiness := func(recorder *httptest.ResponseRecorder) map[string]interface{} {
+		var body map[string]interface{}
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &body)).To(Succeed())
+		return body
+	}
+
+	Describe("liveness", func() {
+		BeforeEach(func() {
+			checks = []health.Check{{Name: "failing", Check: func() error { return errors.New("nope") }}}
+		})
+
+		It("succeeds regardless of the readiness checks", func() {
+			Expect(get(health.LivenessPath).Code).To(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("readiness", func() {
+		Context("when all checks pass", func() {
+			BeforeEach(func() {
+				checks = []health.Check{{Name: "passing", Check: func() error { return nil }}}
+			})
+
+			It("responds with 200 and the check results", func() {
+				recorder := get(health.ReadinessPath)
+				Expect(recorder.Code).To(Equal(http.StatusOK))
+				Expect(readiness(recorder)).To(Equal(map[string]interface{}{
+					"ready":  true,
+					"checks": map[string]interface{}{"passing": "ok"},
+				}))
+			})
+		})
+
+		Context("when a check fails", func() {
+			BeforeEach(func() {
+				checks = []health.Check{
+					{Name: "passing", Check: func() error { return nil }},
+					{Name: "failing", Check: func() error { return errors.New("nope") }},
+				}
+			})
+
+			It("responds with 503 and the failure reason", func() {
+				recorder := get(health.ReadinessPath)
+				Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+				Expect(readiness(recorder)).To(HaveKeyWithValue("ready", false))
+				Expect(readiness(recorder)).To(HaveKeyWithValue("checks", HaveKeyWithValue("failing", "nope")))
+			})
+		})
+	})
+
+	Describe("tracker checks", func() {
+		var tracker *uploads.Tracker
+
+		BeforeEach(func() {
+			tracker = uploads.NewTracker(logger, 1)
+		})
+
+		It("fails the draining check once draining starts", func() {
+			check := health.NewDrainingCheck(tracker)
+			Expect(check.Check()).To(Succeed())
+
+			tracker.StartDraining()
+			Expect(check.Check()).To(HaveOccurred())
+		})
+
+		It("fails the admission check while at the in-flight limit", func() {
+			check := health.NewAdmissionCheck(tracker)
+			Expect(check.Check()).To(Succeed())
+
+			_, upload, err := tracker.Start(context.Background(), "UploadDroplet", "guid", &url.URL{}, 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(check.Check()).To(MatchError(uploads.ErrTooManyUploads))
+
+			upload.Finish()
+			Expect(check.Check()).To(Succeed())
+		})
+	})
+
+	Describe("the CC probe", func() {
+		var fakeCC *httptest.Server
+
+		BeforeEach(func() {
+			fakeCC = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+			}))
+		})
+
+		AfterEach(func() {
+			fakeCC.Close()
+		})
+
+		It("succeeds when CC responds", func() {
+			check := health.NewCCProbe(http.DefaultClient, fakeCC.URL, time.Second)
+			Expect(check.Check()).To(Succeed())
+		})
+
+		It("fails when CC cannot be reached", func() {
+			check := health.NewCCProbe(http.DefaultClient, fakeCC.URL, time.Second)
+			fakeCC.Close()
+			Expect(check.Check()).To(MatchError(ContainSubstring("cloud controller unreachable")))
+		})
+	})
+})
@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/cloudfoundry/dropsonde"
+	dropsondemetrics "github.com/cloudfoundry/dropsonde/metrics"
+)
+
+// DropsondeEmitter sends metrics as dropsonde v1 events over UDP, to the
+// Metron agent's legacy port.
+type DropsondeEmitter struct{}
+
+func NewDropsondeEmitter(destination, origin string) (*DropsondeEmitter, error) {
+	err := dropsonde.Initialize(destination, origin)
+	if err != nil {
+		return nil, err
+	}
+	return &DropsondeEmitter{}, nil
+}
+
+func (e *DropsondeEmitter) AddToCounter(name string, delta uint64) {
+	dropsondemetrics.AddToCounter(name, delta)
+}
+
+func (e *DropsondeEmitter) SendDuration(name string, duration time.Duration) {
+	dropsondemetrics.SendValue(name, float64(duration)/float64(time.Millisecond), "ms")
+}
+
+func (e *DropsondeEmitter) Close() error {
+	return nil
+}
@@ -0,0 +1,104 @@
+// This file was generated by counterfeiter
+package fake_metrics
+
+import (
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/metrics"
+)
+
+type FakeEmitter struct {
+	AddToCounterStub        func(name string, delta uint64)
+	addToCounterMutex       sync.RWMutex
+	addToCounterArgsForCall []struct {
+		name  string
+		delta uint64
+	}
+	SendDurationStub        func(name string, duration time.Duration)
+	sendDurationMutex       sync.RWMutex
+	sendDurationArgsForCall []struct {
+		name     string
+		duration time.Duration
+	}
+	CloseStub        func() error
+	closeMutex       sync.RWMutex
+	closeArgsForCall []struct{}
+	closeReturns     struct {
+		result1 error
+	}
+}
+
+func (fake *FakeEmitter) AddToCounter(name string, delta uint64) {
+	fake.addToCounterMutex.Lock()
+	fake.addToCounterArgsForCall = append(fake.addToCounterArgsForCall, struct {
+		name  string
+		delta uint64
+	}{name, delta})
+	fake.addToCounterMutex.Unlock()
+	if fake.AddToCounterStub != nil {
+		fake.AddToCounterStub(name, delta)
+	}
+}
+
+func (fake *FakeEmitter) AddToCounterCallCount() int {
+	fake.addToCounterMutex.RLock()
+	defer fake.addToCounterMutex.RUnlock()
+	return len(fake.addToCounterArgsForCall)
+}
+
+func (fake *FakeEmitter) AddToCounterArgsForCall(i int) (string, uint64) {
+	fake.addToCounterMutex.RLock()
+	defer fake.addToCounterMutex.RUnlock()
+	return fake.addToCounterArgsForCall[i].name, fake.addToCounterArgsForCall[i].delta
+}
+
+func (fake *FakeEmitter) SendDuration(name string, duration time.Duration) {
+	fake.sendDurationMutex.Lock()
+	fake.sendDurationArgsForCall = append(fake.sendDurationArgsForCall, struct {
+		name     string
+		duration time.Duration
+	}{name, duration})
+	fake.sendDurationMutex.Unlock()
+	if fake.SendDurationStub != nil {
+		fake.SendDurationStub(name, duration)
+	}
+}
+
+func (fake *FakeEmitter) SendDurationCallCount() int {
+	fake.sendDurationMutex.RLock()
+	defer fake.sendDurationMutex.RUnlock()
+	return len(fake.sendDurationArgsForCall)
+}
+
+func (fake *FakeEmitter) SendDurationArgsForCall(i int) (string, time.Duration) {
+	fake.sendDurationMutex.RLock()
+	defer fake.sendDurationMutex.RUnlock()
+	return fake.sendDurationArgsForCall[i].name, fake.sendDurationArgsForCall[i].duration
+}
+
+func (fake *FakeEmitter) Close() error {
+	fake.closeMutex.Lock()
+	fake.closeArgsForCall = append(fake.closeArgsForCall, struct{}{})
+	fake.closeMutex.Unlock()
+	if fake.CloseStub != nil {
+		return fake.CloseStub()
+	} else {
+		return fake.closeReturns.result1
+	}
+}
+
+func (fake *FakeEmitter) CloseCallCount() int {
+	fake.closeMutex.RLock()
+	defer fake.closeMutex.RUnlock()
+	return len(fake.closeArgsForCall)
+}
+
+func (fake *FakeEmitter) CloseReturns(result1 error) {
+	fake.CloseStub = nil
+	fake.closeReturns = struct {
+		result1 error
+	}{result1}
+}
+
+var _ metrics.Emitter = new(FakeEmitter)
@@ -0,0 +1,137 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v10"
+	"code.cloudfoundry.org/lager/v3"
+)
+
+const maxBufferedDurations = 1000
+
+// LoggregatorEmitter sends metrics to a Loggregator agent's v2 ingress through
+// go-loggregator's IngressClient. Counter deltas are summed, and durations
+// buffered as timers, until they are handed to the client every flush
+// interval, so that emitting never waits on the agent.
+type LoggregatorEmitter struct {
+	client   *loggregator.IngressClient
+	sourceID string
+
+	lock      sync.Mutex
+	counters  map[string]uint64
+	durations []timer
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type timer struct {
+	name  string
+	start time.Time
+	stop  time.Time
+}
+
+func NewLoggregatorEmitter(logger lager.Logger, address string, tlsConfig *tls.Config, sourceID string, tags map[string]string, flushInterval time.Duration) (*LoggregatorEmitter, error) {
+	options := []loggregator.IngressOption{
+		loggregator.WithAddr(address),
+		loggregator.WithBatchFlushInterval(flushInterval),
+		loggregator.WithLogger(ingressLogger{logger: logger.Session("loggregator-emitter")}),
+	}
+	for name, value := range tags {
+		options = append(options, loggregator.WithTag(name, value))
+	}
+
+	client, err := loggregator.NewIngressClient(tlsConfig, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &LoggregatorEmitter{
+		client:   client,
+		sourceID: sourceID,
+		counters: map[string]uint64{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go e.flushEvery(flushInterval)
+	return e, nil
+}
+
+func (e *LoggregatorEmitter) AddToCounter(name string, delta uint64) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.counters[name] += delta
+}
+
+func (e *LoggregatorEmitter) SendDuration(name string, duration time.Duration) {
+	stop := time.Now()
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if len(e.durations) >= maxBufferedDurations {
+		return
+	}
+	e.durations = append(e.durations, timer{name: name, start: stop.Add(-duration), stop: stop})
+}
+
+// Close stops the periodic flushes, sends what is still buffered and closes
+// the stream to the agent.
+func (e *LoggregatorEmitter) Close() error {
+	close(e.stop)
+	<-e.done
+	e.flush()
+	return e.client.CloseSend()
+}
+
+func (e *LoggregatorEmitter) flushEvery(interval time.Duration) {
+	defer close(e.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.flush()
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+func (e *LoggregatorEmitter) flush() {
+	e.lock.Lock()
+	counters, durations := e.counters, e.durations
+	e.counters, e.durations = map[string]uint64{}, nil
+	e.lock.Unlock()
+
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		e.client.EmitCounter(name, loggregator.WithDelta(counters[name]), loggregator.WithCounterSourceInfo(e.sourceID, ""))
+	}
+	for _, d := range durations {
+		e.client.EmitTimer(d.name, d.start, d.stop, loggregator.WithTimerSourceInfo(e.sourceID, ""))
+	}
+}
+
+// ingressLogger logs the errors the IngressClient reports while sending.
+type ingressLogger struct {
+	logger lager.Logger
+}
+
+func (l ingressLogger) Printf(format string, args ...any) {
+	l.logger.Error("failed-to-send-envelopes", fmt.Errorf(format, args...))
+}
+
+func (l ingressLogger) Panicf(format string, args ...any) {
+	l.logger.Fatal("loggregator-client-failed", fmt.Errorf(format, args...))
+}
@@ -0,0 +1,152 @@
+package metrics_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/metrics"
+	"code.cloudfoundry.org/go-loggregator/v10/rpc/loggregator_v2"
+	"code.cloudfoundry.org/lager/v3/lagertest"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// fakeIngress is a Loggregator agent's v2 ingress that passes on the
+// envelopes it receives.
+type fakeIngress struct {
+	loggregator_v2.UnimplementedIngressServer
+	envelopes chan *loggregator_v2.Envelope
+}
+
+func (f *fakeIngress) BatchSender(stream loggregator_v2.Ingress_BatchSenderServer) error {
+	for {
+		batch, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&loggregator_v2.BatchSenderResponse{})
+		}
+		if err != nil {
+			return err
+		}
+		for _, e := range batch.Batch {
+			f.envelopes <- e
+		}
+	}
+}
+
+var _ = Describe("LoggregatorEmitter", func() {
+	var (
+		certsPath string
+		listener  net.Listener
+		agent     *grpc.Server
+		envelopes chan *loggregator_v2.Envelope
+		logger    *lagertest.TestLogger
+		tlsConfig *tls.Config
+		emitter   *metrics.LoggregatorEmitter
+	)
+
+	BeforeEach(func() {
+		certsPath = filepath.Join("..", "fixtures", "certs")
+		envelopes = make(chan *loggregator_v2.Envelope, 100)
+		logger = lagertest.NewTestLogger("test")
+
+		caCert, err := os.ReadFile(filepath.Join(certsPath, "ca.crt"))
+		Expect(err).NotTo(HaveOccurred())
+		certPool := x509.NewCertPool()
+		Expect(certPool.AppendCertsFromPEM(caCert)).To(BeTrue())
+
+		serverCert, err := tls.LoadX509KeyPair(filepath.Join(certsPath, "server.crt"), filepath.Join(certsPath, "server.key"))
+		Expect(err).NotTo(HaveOccurred())
+		clientCert, err := tls.LoadX509KeyPair(filepath.Join(certsPath, "client.crt"), filepath.Join(certsPath, "client.key"))
+		Expect(err).NotTo(HaveOccurred())
+
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		agent = grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    certPool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		})))
+		loggregator_v2.RegisterIngressServer(agent, &fakeIngress{envelopes: envelopes})
+		go agent.Serve(listener)
+
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{clientCert},
+			RootCAs:      certPool,
+		}
+		emitter, err = metrics.NewLoggregatorEmitter(
+			logger,
+			listener.Addr().String(),
+			tlsConfig,
+			"cc_uploader",
+			map[string]string{"deployment": "cf"},
+			50*time.Millisecond,
+		)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		agent.Stop()
+	})
+
+	It("sends summed counters and timers on each flush", func() {
+		emitter.AddToCounter("UploadDropletSucceeded", 1)
+		emitter.AddToCounter("UploadDropletSucceeded", 2)
+		emitter.SendDuration("UploadDropletDuration", time.Second)
+
+		var counter, timer *loggregator_v2.Envelope
+		Eventually(envelopes).Should(Receive(&counter))
+		Eventually(envelopes).Should(Receive(&timer))
+		Expect(emitter.Close()).To(Succeed())
+
+		Expect(counter.SourceId).To(Equal("cc_uploader"))
+		Expect(counter.Tags).To(Equal(map[string]string{"deployment": "cf"}))
+		Expect(counter.GetCounter().GetName()).To(Equal("UploadDropletSucceeded"))
+		Expect(counter.GetCounter().GetDelta()).To(BeEquivalentTo(3))
+
+		Expect(timer.SourceId).To(Equal("cc_uploader"))
+		Expect(timer.GetTimer().GetName()).To(Equal("UploadDropletDuration"))
+		Expect(time.Duration(timer.GetTimer().GetStop() - timer.GetTimer().GetStart())).To(Equal(time.Second))
+	})
+
+	It("sends what is still buffered when closed", func() {
+		Expect(emitter.Close()).To(Succeed())
+		Consistently(envelopes).ShouldNot(Receive())
+
+		var err error
+		emitter, err = metrics.NewLoggregatorEmitter(
+			logger,
+			listener.Addr().String(),
+			tlsConfig,
+			"cc_uploader",
+			nil,
+			time.Hour,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		emitter.AddToCounter("CCPollRequests", 1)
+		Expect(emitter.Close()).To(Succeed())
+
+		var counter *loggregator_v2.Envelope
+		Eventually(envelopes).Should(Receive(&counter))
+		Expect(counter.GetCounter().GetName()).To(Equal("CCPollRequests"))
+	})
+
+	Context("when the agent is unreachable", func() {
+		BeforeEach(func() {
+			agent.Stop()
+		})
+
+		It("logs the failure to send", func() {
+			emitter.AddToCounter("CCPollRequests", 1)
+			Eventually(logger).Should(gbytes.Say("failed-to-send-envelopes"))
+			emitter.Close()
+		})
+	})
+})
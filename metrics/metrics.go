@@ -0,0 +1,57 @@
+// Package metrics emits cc-uploader's counters and durations through the
+// backend selected in the config: Loggregator v2, statsd or the legacy
+// dropsonde protocol. Until Initialize is called they are discarded.
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Emitter sends metrics to a backend.
+type Emitter interface {
+	AddToCounter(name string, delta uint64)
+	SendDuration(name string, duration time.Duration)
+	// Close sends any metrics still buffered and releases the backend.
+	Close() error
+}
+
+type emitterHolder struct {
+	emitter Emitter
+}
+
+var current atomic.Value
+
+// Initialize sends all further metrics through emitter.
+func Initialize(emitter Emitter) {
+	current.Store(emitterHolder{emitter: emitter})
+}
+
+func IncrementCounter(name string) {
+	AddToCounter(name, 1)
+}
+
+func AddToCounter(name string, delta uint64) {
+	if emitter := load(); emitter != nil {
+		emitter.AddToCounter(name, delta)
+	}
+}
+
+func SendDuration(name string, duration time.Duration) {
+	if emitter := load(); emitter != nil {
+		emitter.SendDuration(name, duration)
+	}
+}
+
+// Close closes the emitter passed to Initialize, if any.
+func Close() error {
+	if emitter := load(); emitter != nil {
+		return emitter.Close()
+	}
+	return nil
+}
+
+func load() Emitter {
+	holder, _ := current.Load().(emitterHolder)
+	return holder.emitter
+}
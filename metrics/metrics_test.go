@@ -0,0 +1,54 @@
+package metrics_test
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/metrics"
+	"code.cloudfoundry.org/cc-uploader/metrics/fake_metrics"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	var emitter *fake_metrics.FakeEmitter
+
+	BeforeEach(func() {
+		emitter = &fake_metrics.FakeEmitter{}
+		metrics.Initialize(emitter)
+	})
+
+	AfterEach(func() {
+		metrics.Initialize(nil)
+	})
+
+	It("sends counters and durations through the emitter", func() {
+		metrics.IncrementCounter("Uploads")
+		metrics.AddToCounter("BytesSent", 42)
+		metrics.SendDuration("UploadDuration", time.Second)
+
+		Expect(emitter.AddToCounterCallCount()).To(Equal(2))
+		name, delta := emitter.AddToCounterArgsForCall(0)
+		Expect(name).To(Equal("Uploads"))
+		Expect(delta).To(Equal(uint64(1)))
+		name, delta = emitter.AddToCounterArgsForCall(1)
+		Expect(name).To(Equal("BytesSent"))
+		Expect(delta).To(Equal(uint64(42)))
+
+		Expect(emitter.SendDurationCallCount()).To(Equal(1))
+		name, duration := emitter.SendDurationArgsForCall(0)
+		Expect(name).To(Equal("UploadDuration"))
+		Expect(duration).To(Equal(time.Second))
+	})
+
+	It("closes the emitter", func() {
+		Expect(metrics.Close()).To(Succeed())
+		Expect(emitter.CloseCallCount()).To(Equal(1))
+	})
+
+	It("discards metrics without an emitter", func() {
+		metrics.Initialize(nil)
+		metrics.IncrementCounter("Uploads")
+		Expect(metrics.Close()).To(Succeed())
+		Expect(emitter.AddToCounterCallCount()).To(BeZero())
+	})
+})
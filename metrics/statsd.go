@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatsdEmitter sends every metric as its own statsd UDP packet: counters
+// as "<prefix><name>:<delta>|c" and durations as "<prefix><name>:<ms>|ms".
+// In DogStatsD mode the tags are appended as "|#key:value,...".
+type StatsdEmitter struct {
+	conn   net.Conn
+	prefix string
+	suffix string
+}
+
+func NewStatsdEmitter(address, prefix string, tags map[string]string, dogStatsD bool) (*StatsdEmitter, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	var suffix string
+	if dogStatsD && len(tags) > 0 {
+		keys := make([]string, 0, len(tags))
+		for key := range tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		pairs := make([]string, 0, len(keys))
+		for _, key := range keys {
+			pairs = append(pairs, key+":"+tags[key])
+		}
+		suffix = "|#" + strings.Join(pairs, ",")
+	}
+
+	return &StatsdEmitter{conn: conn, prefix: prefix, suffix: suffix}, nil
+}
+
+func (e *StatsdEmitter) AddToCounter(name string, delta uint64) {
+	e.send(name, strconv.FormatUint(delta, 10), "c")
+}
+
+func (e *StatsdEmitter) SendDuration(name string, duration time.Duration) {
+	e.send(name, strconv.FormatFloat(float64(duration)/float64(time.Millisecond), 'f', -1, 64), "ms")
+}
+
+func (e *StatsdEmitter) Close() error {
+	return e.conn.Close()
+}
+
+func (e *StatsdEmitter) send(name, value, metricType string) {
+	// metrics are best effort, as with dropsonde
+	e.conn.Write([]byte(e.prefix + name + ":" + value + "|" + metricType + e.suffix))
+}
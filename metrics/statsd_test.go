@@ -0,0 +1,53 @@
+package metrics_test
+
+import (
+	"net"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/metrics"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("StatsdEmitter", func() {
+	var listener net.PacketConn
+
+	BeforeEach(func() {
+		var err error
+		listener, err = net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	receive := func() string {
+		buffer := make([]byte, 1024)
+		listener.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := listener.ReadFrom(buffer)
+		Expect(err).NotTo(HaveOccurred())
+		return string(buffer[:n])
+	}
+
+	It("sends counters and durations in the statsd format", func() {
+		emitter, err := metrics.NewStatsdEmitter(listener.LocalAddr().String(), "cc_uploader.", map[string]string{"az": "z1"}, false)
+		Expect(err).NotTo(HaveOccurred())
+		defer emitter.Close()
+
+		emitter.AddToCounter("UploadDropletSucceeded", 2)
+		Expect(receive()).To(Equal("cc_uploader.UploadDropletSucceeded:2|c"))
+
+		emitter.SendDuration("UploadDropletDuration", 1500*time.Microsecond)
+		Expect(receive()).To(Equal("cc_uploader.UploadDropletDuration:1.5|ms"))
+	})
+
+	It("appends the tags in DogStatsD mode", func() {
+		emitter, err := metrics.NewStatsdEmitter(listener.LocalAddr().String(), "", map[string]string{"az": "z1", "deployment": "cf"}, true)
+		Expect(err).NotTo(HaveOccurred())
+		defer emitter.Close()
+
+		emitter.AddToCounter("CCPollRequests", 1)
+		Expect(receive()).To(Equal("CCPollRequests:1|c|#az:z1,deployment:cf"))
+	})
+})
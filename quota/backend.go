@@ -0,0 +1,109 @@
+package quota
+
+import (
+	"sync"
+	"time"
+)
+
+// Backend holds the quota counters of every app. The in-memory backend
+// counts the uploads of a single cc-uploader; a backend shared between
+// instances makes the quotas apply to all of them together.
+//
+//go:generate counterfeiter -o fake_quota/fake_backend.go . Backend
+type Backend interface {
+	// AcquireSlot takes one of limit concurrent upload slots for key. It
+	// reports false if all of them are taken.
+	AcquireSlot(key string, limit int) (bool, error)
+	// ReleaseSlot returns a slot taken by AcquireSlot.
+	ReleaseSlot(key string) error
+	// ReserveBytes adds n to the bytes key has used in its current window
+	// unless that would take them over limit. Windows are window long and
+	// start with the first reservation after the previous one ended. It
+	// reports whether the bytes were reserved and when the window ends.
+	ReserveBytes(key string, n, limit int64, window time.Duration) (bool, time.Time, error)
+	// RefundBytes gives back n bytes reserved by ReserveBytes in the window
+	// ending at windowEnd, unless that window has ended.
+	RefundBytes(key string, n int64, windowEnd time.Time) error
+}
+
+type byteWindow struct {
+	used int64
+	end  time.Time
+}
+
+type memoryBackend struct {
+	lock    sync.Mutex
+	slots   map[string]int
+	windows map[string]*byteWindow
+}
+
+func NewMemoryBackend() Backend {
+	return &memoryBackend{
+		slots:   map[string]int{},
+		windows: map[string]*byteWindow{},
+	}
+}
+
+func (b *memoryBackend) AcquireSlot(key string, limit int) (bool, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.slots[key] >= limit {
+		return false, nil
+	}
+	b.slots[key]++
+	return true, nil
+}
+
+func (b *memoryBackend) ReleaseSlot(key string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.slots[key] <= 1 {
+		delete(b.slots, key)
+		return nil
+	}
+	b.slots[key]--
+	return nil
+}
+
+func (b *memoryBackend) ReserveBytes(key string, n, limit int64, window time.Duration) (bool, time.Time, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	b.removeEndedWindows(now)
+
+	current, ok := b.windows[key]
+	if !ok {
+		current = &byteWindow{end: now.Add(window)}
+	}
+	if current.used+n > limit {
+		return false, current.end, nil
+	}
+	current.used += n
+	b.windows[key] = current
+	return true, current.end, nil
+}
+
+func (b *memoryBackend) RefundBytes(key string, n int64, windowEnd time.Time) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	current, ok := b.windows[key]
+	if !ok || !current.end.Equal(windowEnd) {
+		return nil
+	}
+	current.used = max(current.used-n, 0)
+	return nil
+}
+
+// removeEndedWindows forgets the apps whose window has ended, so that the
+// backend only holds the apps that uploaded recently.
+func (b *memoryBackend) removeEndedWindows(now time.Time) {
+	for key, w := range b.windows {
+		if !now.Before(w.end) {
+			delete(b.windows, key)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package quota_test
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/quota"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MemoryBackend", func() {
+	var backend quota.Backend
+
+	BeforeEach(func() {
+		backend = quota.NewMemoryBackend()
+	})
+
+	acquire := func(key string, limit int) bool {
+		acquired, err := backend.AcquireSlot(key, limit)
+		Expect(err).NotTo(HaveOccurred())
+		return acquired
+	}
+
+	reserve := func(key string, n, limit int64, window time.Duration) bool {
+		reserved, _, err := backend.ReserveBytes(key, n, limit, window)
+		Expect(err).NotTo(HaveOccurred())
+		return reserved
+	}
+
+	It("hands out up to limit slots per key", func() {
+		Expect(acquire("app-1", 2)).To(BeTrue())
+		Expect(acquire("app-1", 2)).To(BeTrue())
+		Expect(acquire("app-1", 2)).To(BeFalse())
+		Expect(acquire("app-2", 2)).To(BeTrue())
+
+		Expect(backend.ReleaseSlot("app-1")).To(Succeed())
+		Expect(acquire("app-1", 2)).To(BeTrue())
+	})
+
+	It("reserves bytes up to the limit within a window", func() {
+		Expect(reserve("app-1", 60, 100, time.Hour)).To(BeTrue())
+		Expect(reserve("app-1", 40, 100, time.Hour)).To(BeTrue())
+		Expect(reserve("app-1", 1, 100, time.Hour)).To(BeFalse())
+		Expect(reserve("app-2", 100, 100, time.Hour)).To(BeTrue())
+	})
+
+	It("reports when the window ends", func() {
+		_, firstEnd, err := backend.ReserveBytes("app-1", 60, 100, time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(firstEnd).To(BeTemporally("~", time.Now().Add(time.Hour), time.Second))
+
+		reserved, end, err := backend.ReserveBytes("app-1", 60, 100, time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reserved).To(BeFalse())
+		Expect(end).To(Equal(firstEnd))
+	})
+
+	It("refunds bytes to the window they were reserved in", func() {
+		reserved, end, err := backend.ReserveBytes("app-1", 100, 100, time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+
+		Expect(backend.RefundBytes("app-1", 60, end)).To(Succeed())
+		Expect(reserve("app-1", 60, 100, time.Hour)).To(BeTrue())
+		Expect(reserve("app-1", 1, 100, time.Hour)).To(BeFalse())
+	})
+
+	It("does not refund bytes to a later window", func() {
+		_, end, err := backend.ReserveBytes("app-1", 100, 100, 50*time.Millisecond)
+		Expect(err).NotTo(HaveOccurred())
+
+		Eventually(func() bool {
+			return reserve("app-1", 100, 100, 50*time.Millisecond)
+		}).Should(BeTrue())
+
+		Expect(backend.RefundBytes("app-1", 100, end)).To(Succeed())
+		Expect(reserve("app-1", 1, 100, 50*time.Millisecond)).To(BeFalse())
+	})
+
+	It("starts a new window once the current one has ended", func() {
+		Expect(reserve("app-1", 100, 100, 50*time.Millisecond)).To(BeTrue())
+		Expect(reserve("app-1", 1, 100, 50*time.Millisecond)).To(BeFalse())
+
+		Eventually(func() bool {
+			return reserve("app-1", 100, 100, 50*time.Millisecond)
+		}).Should(BeTrue())
+	})
+})
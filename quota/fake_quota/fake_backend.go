@@ -0,0 +1,192 @@
+// This file was generated by counterfeiter
+package fake_quota
+
+import (
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/quota"
+)
+
+type FakeBackend struct {
+	AcquireSlotStub        func(key string, limit int) (bool, error)
+	acquireSlotMutex       sync.RWMutex
+	acquireSlotArgsForCall []struct {
+		key   string
+		limit int
+	}
+	acquireSlotReturns struct {
+		result1 bool
+		result2 error
+	}
+	ReleaseSlotStub        func(key string) error
+	releaseSlotMutex       sync.RWMutex
+	releaseSlotArgsForCall []struct {
+		key string
+	}
+	releaseSlotReturns struct {
+		result1 error
+	}
+	ReserveBytesStub        func(key string, n, limit int64, window time.Duration) (bool, time.Time, error)
+	reserveBytesMutex       sync.RWMutex
+	reserveBytesArgsForCall []struct {
+		key    string
+		n      int64
+		limit  int64
+		window time.Duration
+	}
+	reserveBytesReturns struct {
+		result1 bool
+		result2 time.Time
+		result3 error
+	}
+	RefundBytesStub        func(key string, n int64, windowEnd time.Time) error
+	refundBytesMutex       sync.RWMutex
+	refundBytesArgsForCall []struct {
+		key       string
+		n         int64
+		windowEnd time.Time
+	}
+	refundBytesReturns struct {
+		result1 error
+	}
+}
+
+func (fake *FakeBackend) AcquireSlot(key string, limit int) (bool, error) {
+	fake.acquireSlotMutex.Lock()
+	fake.acquireSlotArgsForCall = append(fake.acquireSlotArgsForCall, struct {
+		key   string
+		limit int
+	}{key, limit})
+	fake.acquireSlotMutex.Unlock()
+	if fake.AcquireSlotStub != nil {
+		return fake.AcquireSlotStub(key, limit)
+	} else {
+		return fake.acquireSlotReturns.result1, fake.acquireSlotReturns.result2
+	}
+}
+
+func (fake *FakeBackend) AcquireSlotCallCount() int {
+	fake.acquireSlotMutex.RLock()
+	defer fake.acquireSlotMutex.RUnlock()
+	return len(fake.acquireSlotArgsForCall)
+}
+
+func (fake *FakeBackend) AcquireSlotArgsForCall(i int) (string, int) {
+	fake.acquireSlotMutex.RLock()
+	defer fake.acquireSlotMutex.RUnlock()
+	return fake.acquireSlotArgsForCall[i].key, fake.acquireSlotArgsForCall[i].limit
+}
+
+func (fake *FakeBackend) AcquireSlotReturns(result1 bool, result2 error) {
+	fake.AcquireSlotStub = nil
+	fake.acquireSlotReturns = struct {
+		result1 bool
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeBackend) ReleaseSlot(key string) error {
+	fake.releaseSlotMutex.Lock()
+	fake.releaseSlotArgsForCall = append(fake.releaseSlotArgsForCall, struct {
+		key string
+	}{key})
+	fake.releaseSlotMutex.Unlock()
+	if fake.ReleaseSlotStub != nil {
+		return fake.ReleaseSlotStub(key)
+	} else {
+		return fake.releaseSlotReturns.result1
+	}
+}
+
+func (fake *FakeBackend) ReleaseSlotCallCount() int {
+	fake.releaseSlotMutex.RLock()
+	defer fake.releaseSlotMutex.RUnlock()
+	return len(fake.releaseSlotArgsForCall)
+}
+
+func (fake *FakeBackend) ReleaseSlotArgsForCall(i int) string {
+	fake.releaseSlotMutex.RLock()
+	defer fake.releaseSlotMutex.RUnlock()
+	return fake.releaseSlotArgsForCall[i].key
+}
+
+func (fake *FakeBackend) ReleaseSlotReturns(result1 error) {
+	fake.ReleaseSlotStub = nil
+	fake.releaseSlotReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeBackend) ReserveBytes(key string, n, limit int64, window time.Duration) (bool, time.Time, error) {
+	fake.reserveBytesMutex.Lock()
+	fake.reserveBytesArgsForCall = append(fake.reserveBytesArgsForCall, struct {
+		key    string
+		n      int64
+		limit  int64
+		window time.Duration
+	}{key, n, limit, window})
+	fake.reserveBytesMutex.Unlock()
+	if fake.ReserveBytesStub != nil {
+		return fake.ReserveBytesStub(key, n, limit, window)
+	} else {
+		return fake.reserveBytesReturns.result1, fake.reserveBytesReturns.result2, fake.reserveBytesReturns.result3
+	}
+}
+
+func (fake *FakeBackend) ReserveBytesCallCount() int {
+	fake.reserveBytesMutex.RLock()
+	defer fake.reserveBytesMutex.RUnlock()
+	return len(fake.reserveBytesArgsForCall)
+}
+
+func (fake *FakeBackend) ReserveBytesArgsForCall(i int) (string, int64, int64, time.Duration) {
+	fake.reserveBytesMutex.RLock()
+	defer fake.reserveBytesMutex.RUnlock()
+	return fake.reserveBytesArgsForCall[i].key, fake.reserveBytesArgsForCall[i].n, fake.reserveBytesArgsForCall[i].limit, fake.reserveBytesArgsForCall[i].window
+}
+
+func (fake *FakeBackend) ReserveBytesReturns(result1 bool, result2 time.Time, result3 error) {
+	fake.ReserveBytesStub = nil
+	fake.reserveBytesReturns = struct {
+		result1 bool
+		result2 time.Time
+		result3 error
+	}{result1, result2, result3}
+}
+
+func (fake *FakeBackend) RefundBytes(key string, n int64, windowEnd time.Time) error {
+	fake.refundBytesMutex.Lock()
+	fake.refundBytesArgsForCall = append(fake.refundBytesArgsForCall, struct {
+		key       string
+		n         int64
+		windowEnd time.Time
+	}{key, n, windowEnd})
+	fake.refundBytesMutex.Unlock()
+	if fake.RefundBytesStub != nil {
+		return fake.RefundBytesStub(key, n, windowEnd)
+	} else {
+		return fake.refundBytesReturns.result1
+	}
+}
+
+func (fake *FakeBackend) RefundBytesCallCount() int {
+	fake.refundBytesMutex.RLock()
+	defer fake.refundBytesMutex.RUnlock()
+	return len(fake.refundBytesArgsForCall)
+}
+
+func (fake *FakeBackend) RefundBytesArgsForCall(i int) (string, int64, time.Time) {
+	fake.refundBytesMutex.RLock()
+	defer fake.refundBytesMutex.RUnlock()
+	return fake.refundBytesArgsForCall[i].key, fake.refundBytesArgsForCall[i].n, fake.refundBytesArgsForCall[i].windowEnd
+}
+
+func (fake *FakeBackend) RefundBytesReturns(result1 error) {
+	fake.RefundBytesStub = nil
+	fake.refundBytesReturns = struct {
+		result1 error
+	}{result1}
+}
+
+var _ quota.Backend = new(FakeBackend)
@@ -0,0 +1,222 @@
+// Package quota limits the uploads of each guid, so that a single app cannot
+// monopolize cc-uploader. The guid is the app guid for build artifacts and
+// the droplet guid for droplets.
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/requestid"
+	"code.cloudfoundry.org/lager/v3"
+)
+
+const (
+	MaxConcurrentUploads = "max_concurrent_uploads"
+	MaxBytesPerWindow    = "max_bytes_per_window"
+	MaxObjectSize        = "max_object_size"
+)
+
+// ErrUnknownSize is returned by Admit for uploads without a Content-Length
+// when a byte quota applies, as they cannot be checked against it.
+var ErrUnknownSize = errors.New("uploads must have a Content-Length when upload quotas are enforced")
+
+// Limits are the quotas of every app. A zero limit is not enforced.
+type Limits struct {
+	MaxConcurrentUploads int
+	MaxBytesPerWindow    int64
+	Window               time.Duration
+	MaxObjectSize        int64
+}
+
+// ExceededError is returned by Admit when an upload would exceed one of its
+// app's quotas.
+type ExceededError struct {
+	Quota string
+	Guid  string
+	Limit int64
+	// RetryAfter is how long until the quota may admit the upload, or zero
+	// if it never will.
+	RetryAfter time.Duration
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("upload quota %s of %d exceeded for %s", e.Quota, e.Limit, e.Guid)
+}
+
+type errorResponse struct {
+	Error             string `json:"error"`
+	Message           string `json:"message"`
+	Quota             string `json:"quota"`
+	Guid              string `json:"guid"`
+	Limit             int64  `json:"limit"`
+	RetryAfterSeconds int    `json:"retry_after_seconds,omitempty"`
+}
+
+// WriteResponse answers the rejected request with 429 Too Many Requests, a
+// JSON description of the quota and, if the upload can be retried, a
+// Retry-After header.
+func (e *ExceededError) WriteResponse(w http.ResponseWriter) {
+	retryAfterSeconds := int(math.Ceil(e.RetryAfter.Seconds()))
+	if retryAfterSeconds > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(errorResponse{
+		Error:             "upload_quota_exceeded",
+		Message:           e.Error(),
+		Quota:             e.Quota,
+		Guid:              e.Guid,
+		Limit:             e.Limit,
+		RetryAfterSeconds: retryAfterSeconds,
+	})
+}
+
+// StatusCode is the status code of the response to a request that Admit
+// rejected with err: 429 Too Many Requests for an exceeded quota, or 411
+// Length Required for ErrUnknownSize.
+func StatusCode(err error) int {
+	var exceeded *ExceededError
+	if errors.As(err, &exceeded) {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusLengthRequired
+}
+
+// WriteError answers a request that Admit rejected with err: a structured
+// 429 for an exceeded quota, or 411 Length Required for ErrUnknownSize. It
+// returns the status code written.
+func WriteError(w http.ResponseWriter, err error) int {
+	var exceeded *ExceededError
+	if errors.As(err, &exceeded) {
+		exceeded.WriteResponse(w)
+		return http.StatusTooManyRequests
+	}
+
+	w.WriteHeader(http.StatusLengthRequired)
+	w.Write([]byte(err.Error()))
+	return http.StatusLengthRequired
+}
+
+// Enforcer admits uploads within their app's quotas. Without quotas the
+// Enforcer is nil, and Admit lets every upload through with a nil Grant.
+type Enforcer struct {
+	logger  lager.Logger
+	limits  Limits
+	backend Backend
+}
+
+func New(logger lager.Logger, limits Limits, backend Backend) *Enforcer {
+	return &Enforcer{
+		logger:  logger.Session("quota"),
+		limits:  limits,
+		backend: backend,
+	}
+}
+
+// Admit checks an upload of contentLength bytes for guid, made by the
+// request with ctx, against its quotas. If they admit it, it takes a
+// concurrent upload slot and charges the bytes to the current window; the
+// returned Grant must be released once the upload is finished, and refunded
+// if it failed. Uploads are admitted if the backend fails, so that quotas
+// never keep apps from staging.
+func (e *Enforcer) Admit(ctx context.Context, guid string, contentLength int64) (*Grant, error) {
+	if e == nil {
+		return nil, nil
+	}
+
+	limits := e.limits
+	logger := e.logger.WithData(requestid.Data(ctx)).WithData(lager.Data{"guid": guid, "content-length": contentLength})
+
+	if contentLength < 0 && (limits.MaxObjectSize > 0 || limits.MaxBytesPerWindow > 0) {
+		return nil, ErrUnknownSize
+	}
+
+	if limits.MaxObjectSize > 0 && contentLength > limits.MaxObjectSize {
+		logger.Info("object-size-exceeded", lager.Data{"limit": limits.MaxObjectSize})
+		return nil, &ExceededError{Quota: MaxObjectSize, Guid: guid, Limit: limits.MaxObjectSize}
+	}
+
+	grant := &Grant{logger: logger, backend: e.backend, guid: guid}
+	if limits.MaxConcurrentUploads > 0 {
+		acquired, err := e.backend.AcquireSlot(guid, limits.MaxConcurrentUploads)
+		switch {
+		case err != nil:
+			logger.Error("failed-acquiring-upload-slot", err)
+		case !acquired:
+			logger.Info("concurrent-uploads-exceeded", lager.Data{"limit": limits.MaxConcurrentUploads})
+			return nil, &ExceededError{Quota: MaxConcurrentUploads, Guid: guid, Limit: int64(limits.MaxConcurrentUploads)}
+		default:
+			grant.holdsSlot = true
+		}
+	}
+
+	if limits.MaxBytesPerWindow > 0 {
+		reserved, windowEnd, err := e.backend.ReserveBytes(guid, contentLength, limits.MaxBytesPerWindow, limits.Window)
+		switch {
+		case err != nil:
+			logger.Error("failed-reserving-bytes", err)
+		case reserved:
+			grant.reservedBytes = contentLength
+			grant.windowEnd = windowEnd
+		default:
+			grant.Release()
+
+			exceeded := &ExceededError{Quota: MaxBytesPerWindow, Guid: guid, Limit: limits.MaxBytesPerWindow}
+			// an upload larger than the whole quota never fits in a window
+			if contentLength <= limits.MaxBytesPerWindow {
+				exceeded.RetryAfter = time.Until(windowEnd)
+			}
+			logger.Info("bytes-per-window-exceeded", lager.Data{"limit": limits.MaxBytesPerWindow, "retry-after": exceeded.RetryAfter.String()})
+			return nil, exceeded
+		}
+	}
+
+	return grant, nil
+}
+
+// Grant is an upload admitted by an Enforcer.
+type Grant struct {
+	logger        lager.Logger
+	backend       Backend
+	guid          string
+	holdsSlot     bool
+	reservedBytes int64
+	windowEnd     time.Time
+}
+
+// Release gives back the upload's concurrent upload slot. The bytes it was
+// charged stay charged to the window unless it is refunded.
+func (g *Grant) Release() {
+	if g == nil || !g.holdsSlot {
+		return
+	}
+	g.holdsSlot = false
+
+	err := g.backend.ReleaseSlot(g.guid)
+	if err != nil {
+		g.logger.Error("failed-releasing-upload-slot", err)
+	}
+}
+
+// Refund gives back the bytes the upload was charged, so that uploads that
+// did not succeed do not count against the app's quota.
+func (g *Grant) Refund() {
+	if g == nil || g.reservedBytes == 0 {
+		return
+	}
+	reservedBytes := g.reservedBytes
+	g.reservedBytes = 0
+
+	err := g.backend.RefundBytes(g.guid, reservedBytes, g.windowEnd)
+	if err != nil {
+		g.logger.Error("failed-refunding-bytes", err)
+	}
+}
@@ -0,0 +1,258 @@
+package quota_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/quota"
+	"code.cloudfoundry.org/cc-uploader/quota/fake_quota"
+	"code.cloudfoundry.org/lager/v3/lagertest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Enforcer", func() {
+	var (
+		logger   *lagertest.TestLogger
+		limits   quota.Limits
+		backend  quota.Backend
+		enforcer *quota.Enforcer
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		limits = quota.Limits{}
+		backend = quota.NewMemoryBackend()
+	})
+
+	JustBeforeEach(func() {
+		enforcer = quota.New(logger, limits, backend)
+	})
+
+	admit := func(guid string, contentLength int64) *quota.Grant {
+		grant, err := enforcer.Admit(context.Background(), guid, contentLength)
+		Expect(err).NotTo(HaveOccurred())
+		return grant
+	}
+
+	exceeded := func(guid string, contentLength int64) *quota.ExceededError {
+		_, err := enforcer.Admit(context.Background(), guid, contentLength)
+		var exceededErr *quota.ExceededError
+		Expect(errors.As(err, &exceededErr)).To(BeTrue(), "expected a quota to be exceeded, got %v", err)
+		return exceededErr
+	}
+
+	Context("with a concurrent uploads quota", func() {
+		BeforeEach(func() {
+			limits.MaxConcurrentUploads = 2
+		})
+
+		It("admits up to the limit per app until the uploads are released", func() {
+			first := admit("app-1", 10)
+			admit("app-1", 10)
+			admit("app-2", 10)
+
+			err := exceeded("app-1", 10)
+			Expect(err.Quota).To(Equal(quota.MaxConcurrentUploads))
+			Expect(err.Guid).To(Equal("app-1"))
+			Expect(err.Limit).To(Equal(int64(2)))
+			Expect(err.RetryAfter).To(BeZero())
+
+			first.Release()
+			first.Release()
+			admit("app-1", 10)
+			exceeded("app-1", 10)
+		})
+
+		It("admits uploads without a Content-Length", func() {
+			admit("app-1", -1)
+		})
+	})
+
+	Context("with a bytes per window quota", func() {
+		BeforeEach(func() {
+			limits.MaxBytesPerWindow = 100
+			limits.Window = time.Hour
+		})
+
+		It("admits uploads until the app's window is used up", func() {
+			admit("app-1", 60)
+			admit("app-1", 40)
+			admit("app-2", 100)
+
+			err := exceeded("app-1", 1)
+			Expect(err.Quota).To(Equal(quota.MaxBytesPerWindow))
+			Expect(err.Limit).To(Equal(int64(100)))
+			Expect(err.RetryAfter).To(BeNumerically("~", time.Hour, time.Second))
+		})
+
+		It("admits uploads again once refunded", func() {
+			grant := admit("app-1", 100)
+			exceeded("app-1", 1)
+
+			grant.Refund()
+			admit("app-1", 100)
+		})
+
+		It("never asks uploads larger than the quota to retry", func() {
+			err := exceeded("app-1", 101)
+			Expect(err.RetryAfter).To(BeZero())
+		})
+
+		It("rejects uploads without a Content-Length", func() {
+			_, err := enforcer.Admit(context.Background(), "app-1", -1)
+			Expect(err).To(Equal(quota.ErrUnknownSize))
+		})
+	})
+
+	Context("with an object size quota", func() {
+		BeforeEach(func() {
+			limits.MaxObjectSize = 100
+		})
+
+		It("rejects larger uploads", func() {
+			admit("app-1", 100)
+
+			err := exceeded("app-1", 101)
+			Expect(err.Quota).To(Equal(quota.MaxObjectSize))
+			Expect(err.Limit).To(Equal(int64(100)))
+			Expect(err.RetryAfter).To(BeZero())
+		})
+	})
+
+	Context("with every quota", func() {
+		var fakeBackend *fake_quota.FakeBackend
+
+		BeforeEach(func() {
+			limits = quota.Limits{MaxConcurrentUploads: 1, MaxBytesPerWindow: 100, Window: time.Hour, MaxObjectSize: 100}
+			fakeBackend = &fake_quota.FakeBackend{}
+			fakeBackend.AcquireSlotReturns(true, nil)
+			fakeBackend.ReserveBytesReturns(true, time.Now().Add(time.Hour), nil)
+			backend = fakeBackend
+		})
+
+		It("gives the slot back when the bytes quota rejects the upload", func() {
+			fakeBackend.ReserveBytesReturns(false, time.Now().Add(time.Hour), nil)
+
+			exceeded("app-1", 10)
+			Expect(fakeBackend.ReleaseSlotCallCount()).To(Equal(1))
+			Expect(fakeBackend.ReleaseSlotArgsForCall(0)).To(Equal("app-1"))
+		})
+
+		It("does not consult the backend for oversized uploads", func() {
+			exceeded("app-1", 101)
+			Expect(fakeBackend.AcquireSlotCallCount()).To(Equal(0))
+			Expect(fakeBackend.ReserveBytesCallCount()).To(Equal(0))
+		})
+
+		It("refunds the bytes charged to the window once", func() {
+			windowEnd := time.Now().Add(time.Hour)
+			fakeBackend.ReserveBytesReturns(true, windowEnd, nil)
+
+			grant := admit("app-1", 10)
+			grant.Refund()
+			grant.Refund()
+			grant.Release()
+
+			Expect(fakeBackend.RefundBytesCallCount()).To(Equal(1))
+			key, n, end := fakeBackend.RefundBytesArgsForCall(0)
+			Expect(key).To(Equal("app-1"))
+			Expect(n).To(BeEquivalentTo(10))
+			Expect(end).To(Equal(windowEnd))
+		})
+
+		It("logs failures to refund", func() {
+			fakeBackend.RefundBytesReturns(errors.New("backend unavailable"))
+
+			admit("app-1", 10).Refund()
+			Expect(logger.LogMessages()).To(ContainElement("test.quota.failed-refunding-bytes"))
+		})
+
+		Context("when the backend fails", func() {
+			BeforeEach(func() {
+				fakeBackend.AcquireSlotReturns(false, errors.New("backend unavailable"))
+				fakeBackend.ReserveBytesReturns(false, time.Time{}, errors.New("backend unavailable"))
+			})
+
+			It("admits the upload and logs the failure", func() {
+				grant := admit("app-1", 10)
+				grant.Release()
+
+				Expect(fakeBackend.ReleaseSlotCallCount()).To(Equal(0))
+				Expect(logger.LogMessages()).To(ContainElements(
+					"test.quota.failed-acquiring-upload-slot",
+					"test.quota.failed-reserving-bytes",
+				))
+			})
+		})
+	})
+
+	It("admits everything when it is nil", func() {
+		var nilEnforcer *quota.Enforcer
+		grant, err := nilEnforcer.Admit(context.Background(), "app-1", -1)
+		Expect(err).NotTo(HaveOccurred())
+		grant.Refund()
+		grant.Release()
+	})
+})
+
+var _ = Describe("WriteError", func() {
+	It("answers uploads of unknown size with 411", func() {
+		recorder := httptest.NewRecorder()
+		statusCode := quota.WriteError(recorder, quota.ErrUnknownSize)
+
+		Expect(statusCode).To(Equal(http.StatusLengthRequired))
+		Expect(recorder.Code).To(Equal(http.StatusLengthRequired))
+		Expect(recorder.Body.String()).To(Equal(quota.ErrUnknownSize.Error()))
+	})
+})
+
+var _ = Describe("ExceededError", func() {
+	It("is written as a structured 429 response", func() {
+		recorder := httptest.NewRecorder()
+		(&quota.ExceededError{
+			Quota:      quota.MaxBytesPerWindow,
+			Guid:       "app-1",
+			Limit:      100,
+			RetryAfter: 1500 * time.Millisecond,
+		}).WriteResponse(recorder)
+
+		Expect(recorder.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(recorder.Header().Get("Content-Type")).To(Equal("application/json"))
+		Expect(recorder.Header().Get("Retry-After")).To(Equal("2"))
+
+		var body map[string]interface{}
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &body)).To(Succeed())
+		Expect(body).To(Equal(map[string]interface{}{
+			"error":               "upload_quota_exceeded",
+			"message":             "upload quota max_bytes_per_window of 100 exceeded for app-1",
+			"quota":               "max_bytes_per_window",
+			"guid":                "app-1",
+			"limit":               float64(100),
+			"retry_after_seconds": float64(2),
+		}))
+	})
+
+	It("is written by WriteError", func() {
+		recorder := httptest.NewRecorder()
+		statusCode := quota.WriteError(recorder, &quota.ExceededError{Quota: quota.MaxObjectSize, Guid: "app-1", Limit: 100})
+
+		Expect(statusCode).To(Equal(http.StatusTooManyRequests))
+		Expect(recorder.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(recorder.Body.String()).To(ContainSubstring(`"quota":"max_object_size"`))
+	})
+
+	It("has no Retry-After when the upload can never be admitted", func() {
+		recorder := httptest.NewRecorder()
+		(&quota.ExceededError{Quota: quota.MaxObjectSize, Guid: "app-1", Limit: 100}).WriteResponse(recorder)
+
+		Expect(recorder.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(recorder.Header()).NotTo(HaveKey("Retry-After"))
+		Expect(recorder.Body.String()).NotTo(ContainSubstring("retry_after_seconds"))
+	})
+})
@@ -0,0 +1,80 @@
+// Package ratelimit limits the rate of requests a listener accepts.
+package ratelimit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/requestid"
+	"code.cloudfoundry.org/lager/v3"
+)
+
+// Limiter is a token bucket: it admits requestsPerSecond requests per second
+// on average, in bursts of up to burst. A nil *Limiter admits everything.
+type Limiter struct {
+	requestsPerSecond float64
+	burst             float64
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// New returns a limiter that starts with a full bucket. A burst below one
+// defaults to requestsPerSecond, rounded up.
+func New(requestsPerSecond float64, burst int) *Limiter {
+	b := float64(burst)
+	if burst < 1 {
+		b = math.Max(1, math.Ceil(requestsPerSecond))
+	}
+	return &Limiter{
+		requestsPerSecond: requestsPerSecond,
+		burst:             b,
+		tokens:            b,
+		last:              time.Now(),
+	}
+}
+
+// Allow takes a token if one is available. Otherwise it reports false and
+// how long it will be until the next token is.
+func (l *Limiter) Allow() (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.requestsPerSecond)
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - l.tokens) / l.requestsPerSecond * float64(time.Second))
+}
+
+// Handler wraps handler so that requests the limiter does not admit are
+// answered with 429 Too Many Requests and a Retry-After header.
+func (l *Limiter) Handler(logger lager.Logger, handler http.Handler) http.Handler {
+	if l == nil {
+		return handler
+	}
+
+	logger = logger.Session("rate-limit")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, retryAfter := l.Allow()
+		if !allowed {
+			logger.Info("rejected-request", requestid.Data(r.Context()), lager.Data{"path": r.URL.Path, "retry-after": retryAfter.String()})
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
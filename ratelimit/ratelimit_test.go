@@ -0,0 +1,88 @@
+package ratelimit_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/ratelimit"
+	"code.cloudfoundry.org/cc-uploader/requestid"
+	"code.cloudfoundry.org/lager/v3/lagertest"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Limiter", func() {
+	allow := func(limiter *ratelimit.Limiter) bool {
+		allowed, _ := limiter.Allow()
+		return allowed
+	}
+
+	It("admits a burst and then the sustained rate", func() {
+		limiter := ratelimit.New(10, 2)
+
+		Expect(allow(limiter)).To(BeTrue())
+		Expect(allow(limiter)).To(BeTrue())
+
+		allowed, retryAfter := limiter.Allow()
+		Expect(allowed).To(BeFalse())
+		Expect(retryAfter).To(BeNumerically("~", 100*time.Millisecond, 20*time.Millisecond))
+
+		time.Sleep(120 * time.Millisecond)
+		Expect(allow(limiter)).To(BeTrue())
+		Expect(allow(limiter)).To(BeFalse())
+	})
+
+	It("defaults the burst to the rate", func() {
+		limiter := ratelimit.New(2.5, 0)
+
+		for i := 0; i < 3; i++ {
+			Expect(allow(limiter)).To(BeTrue())
+		}
+		Expect(allow(limiter)).To(BeFalse())
+	})
+
+	It("admits everything when nil", func() {
+		var limiter *ratelimit.Limiter
+		Expect(allow(limiter)).To(BeTrue())
+	})
+
+	Describe("Handler", func() {
+		var (
+			logger  *lagertest.TestLogger
+			handler http.Handler
+		)
+
+		BeforeEach(func() {
+			logger = lagertest.NewTestLogger("test")
+			handler = ratelimit.New(1, 1).Handler(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusCreated)
+			}))
+		})
+
+		serve := func() *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("POST", "/v1/droplet/app-guid", nil)
+			handler.ServeHTTP(recorder, request.WithContext(requestid.NewContext(request.Context(), "the-request-id")))
+			return recorder
+		}
+
+		It("rejects requests over the limit with 429 and Retry-After", func() {
+			Expect(serve().Code).To(Equal(http.StatusCreated))
+
+			rejected := serve()
+			Expect(rejected.Code).To(Equal(http.StatusTooManyRequests))
+			Expect(rejected.Header().Get("Retry-After")).To(Equal("1"))
+		})
+
+		It("logs rejections with the request's ID", func() {
+			serve()
+			serve()
+
+			logs := logger.Logs()
+			Expect(logs).To(HaveLen(1))
+			Expect(logs[0].Message).To(Equal("test.rate-limit.rejected-request"))
+			Expect(logs[0].Data).To(HaveKeyWithValue("request-id", "the-request-id"))
+		})
+	})
+})
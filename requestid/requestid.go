@@ -0,0 +1,100 @@
+// Package requestid ties the log lines of an inbound request, and the
+// requests made to CC on its behalf, together with a single request ID.
+package requestid
+
+import (
+	"context"
+	"net/http"
+
+	"code.cloudfoundry.org/lager/v3"
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+const (
+	// Header carries the request ID in the Cloud Foundry convention. It is
+	// the header forwarded to CC.
+	Header = "X-Vcap-Request-Id"
+	// AlternateHeader is accepted from clients that do not use Header.
+	AlternateHeader = "X-Request-Id"
+
+	maxLength = 256
+)
+
+type contextKey struct{}
+
+// Handler serves every request with a request ID: the one the client sent
+// in Header or AlternateHeader, or a new one. The ID is put in the request's
+// context and echoed in both headers of the response.
+func Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := fromHeaders(r.Header)
+		if id == "" {
+			id = generate()
+		}
+		if id != "" {
+			w.Header().Set(Header, id)
+			w.Header().Set(AlternateHeader, id)
+			r = r.WithContext(NewContext(r.Context(), id))
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID in ctx, or "" if there is none.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Forward sets Header on an outbound request to the ID in its context.
+func Forward(req *http.Request) {
+	if id := FromContext(req.Context()); id != "" {
+		req.Header.Set(Header, id)
+	}
+}
+
+// Data is the lager data that adds the request ID in ctx to log lines. It is
+// nil if ctx has no ID.
+func Data(ctx context.Context) lager.Data {
+	id := FromContext(ctx)
+	if id == "" {
+		return nil
+	}
+	return lager.Data{"request-id": id}
+}
+
+// fromHeaders returns the client's request ID, ignoring IDs that are too
+// long or contain anything but printable ASCII, so they are safe to log and
+// forward.
+func fromHeaders(header http.Header) string {
+	for _, name := range []string{Header, AlternateHeader} {
+		if id := header.Get(name); valid(id) {
+			return id
+		}
+	}
+	return ""
+}
+
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func generate() string {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return ""
+	}
+	return id.String()
+}
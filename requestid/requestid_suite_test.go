@@ -0,0 +1,13 @@
+package requestid_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestRequestid(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Requestid Suite")
+}
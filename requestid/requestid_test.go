@@ -0,0 +1,101 @@
+package requestid_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"code.cloudfoundry.org/cc-uploader/requestid"
+	"code.cloudfoundry.org/lager/v3"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Handler", func() {
+	var (
+		handler    http.Handler
+		request    *http.Request
+		recorder   *httptest.ResponseRecorder
+		contextIDs []string
+	)
+
+	BeforeEach(func() {
+		contextIDs = nil
+		handler = requestid.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			contextIDs = append(contextIDs, requestid.FromContext(r.Context()))
+		}))
+		request = httptest.NewRequest("POST", "/v1/droplet/app-guid", nil)
+		recorder = httptest.NewRecorder()
+	})
+
+	serve := func() string {
+		handler.ServeHTTP(recorder, request)
+		Expect(contextIDs).To(HaveLen(1))
+		return contextIDs[0]
+	}
+
+	It("uses the X-Vcap-Request-Id the client sent", func() {
+		request.Header.Set("X-Vcap-Request-Id", "vcap-request-id")
+		request.Header.Set("X-Request-Id", "request-id")
+
+		Expect(serve()).To(Equal("vcap-request-id"))
+		Expect(recorder.Header().Get("X-Vcap-Request-Id")).To(Equal("vcap-request-id"))
+		Expect(recorder.Header().Get("X-Request-Id")).To(Equal("vcap-request-id"))
+	})
+
+	It("falls back to the X-Request-Id the client sent", func() {
+		request.Header.Set("X-Request-Id", "request-id")
+
+		Expect(serve()).To(Equal("request-id"))
+		Expect(recorder.Header().Get("X-Vcap-Request-Id")).To(Equal("request-id"))
+	})
+
+	It("generates an ID when the client sent none", func() {
+		id := serve()
+		Expect(id).To(MatchRegexp(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`))
+		Expect(recorder.Header().Get("X-Vcap-Request-Id")).To(Equal(id))
+		Expect(recorder.Header().Get("X-Request-Id")).To(Equal(id))
+	})
+
+	It("replaces IDs that are not safe to log or forward", func() {
+		request.Header.Set("X-Vcap-Request-Id", "id with spaces")
+		request.Header.Set("X-Request-Id", strings.Repeat("a", 257))
+
+		id := serve()
+		Expect(id).NotTo(BeEmpty())
+		Expect(id).NotTo(ContainSubstring(" "))
+		Expect(len(id)).To(BeNumerically("<", 257))
+	})
+})
+
+var _ = Describe("Forward", func() {
+	It("sets the ID in the request's context as X-Vcap-Request-Id", func() {
+		ctx := requestid.NewContext(context.Background(), "request-id")
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://cc.example.com", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		requestid.Forward(req)
+		Expect(req.Header.Get("X-Vcap-Request-Id")).To(Equal("request-id"))
+	})
+
+	It("leaves requests without an ID alone", func() {
+		req, err := http.NewRequest("GET", "http://cc.example.com", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		requestid.Forward(req)
+		Expect(req.Header).NotTo(HaveKey("X-Vcap-Request-Id"))
+	})
+})
+
+var _ = Describe("Data", func() {
+	It("is the request ID as lager data", func() {
+		ctx := requestid.NewContext(context.Background(), "request-id")
+		Expect(requestid.Data(ctx)).To(Equal(lager.Data{"request-id": "request-id"}))
+	})
+
+	It("is nil without a request ID", func() {
+		Expect(requestid.Data(context.Background())).To(BeNil())
+	})
+})
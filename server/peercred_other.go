@@ -0,0 +1,11 @@
+//go:build !linux
+
+package server
+
+import "net"
+
+const peerCredentialsSupported = false
+
+func peerCredentials(conn net.Conn) (PeerCredentials, error) {
+	return PeerCredentials{}, errPeerCredentialsUnsupported
+}
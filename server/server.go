@@ -0,0 +1,88 @@
+// Package server runs cc-uploader's TLS listeners.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/requestid"
+	"github.com/tedsuo/ifrit"
+)
+
+const (
+	keepAlivePeriod = 3 * time.Minute
+	shutdownTimeout = 1 * time.Minute
+
+	http2Proto = "h2"
+	http1Proto = "http/1.1"
+)
+
+type tlsServer struct {
+	address     string
+	handler     http.Handler
+	tlsConfig   *tls.Config
+	enableHTTP2 bool
+}
+
+// NewTLS returns a runner that serves handler over TLS on address. HTTP/2 is
+// only offered, via ALPN, when enableHTTP2 is set; otherwise clients are
+// limited to HTTP/1.1. Every request is given a request ID before it reaches
+// handler. As with ifrit's http_server, a signal closes the listener and
+// in-flight requests are given a minute to finish.
+func NewTLS(address string, handler http.Handler, tlsConfig *tls.Config, enableHTTP2 bool) ifrit.Runner {
+	return &tlsServer{
+		address:     address,
+		handler:     handler,
+		tlsConfig:   tlsConfig,
+		enableHTTP2: enableHTTP2,
+	}
+}
+
+func (s *tlsServer) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(s.enableHTTP2)
+
+	tlsConfig := s.tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{http1Proto}
+	if s.enableHTTP2 {
+		tlsConfig.NextProtos = []string{http2Proto, http1Proto}
+	}
+
+	server := &http.Server{
+		Handler:   requestid.Handler(s.handler),
+		TLSConfig: tlsConfig,
+		Protocols: protocols,
+	}
+
+	listenConfig := net.ListenConfig{KeepAlive: keepAlivePeriod}
+	listener, err := listenConfig.Listen(context.Background(), "tcp", s.address)
+	if err != nil {
+		return err
+	}
+	listener = tls.NewListener(listener, tlsConfig)
+
+	serverErrChan := make(chan error, 1)
+	go func() {
+		serverErrChan <- server.Serve(listener)
+	}()
+
+	close(ready)
+
+	select {
+	case err = <-serverErrChan:
+		return err
+	case <-signals:
+		listener.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+
+		return nil
+	}
+}
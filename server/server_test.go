@@ -0,0 +1,102 @@
+package server_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/cc-uploader/requestid"
+	"code.cloudfoundry.org/cc-uploader/server"
+	"code.cloudfoundry.org/tlsconfig"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tedsuo/ifrit"
+)
+
+var _ = Describe("TLS server", func() {
+	var (
+		address     string
+		enableHTTP2 bool
+		process     ifrit.Process
+		client      *http.Client
+	)
+
+	BeforeEach(func() {
+		address = fmt.Sprintf("localhost:%d", 18443+GinkgoParallelProcess())
+		enableHTTP2 = false
+
+		certsPath := filepath.Join("..", "fixtures", "certs")
+		clientTLSConfig, err := tlsconfig.Build(
+			tlsconfig.WithIdentityFromFile(filepath.Join(certsPath, "client.crt"), filepath.Join(certsPath, "client.key")),
+		).Client(tlsconfig.WithAuthorityFromFile(filepath.Join(certsPath, "ca.crt")))
+		Expect(err).NotTo(HaveOccurred())
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLSConfig, ForceAttemptHTTP2: true}}
+	})
+
+	JustBeforeEach(func() {
+		certsPath := filepath.Join("..", "fixtures", "certs")
+		serverTLSConfig, err := tlsconfig.Build(
+			tlsconfig.WithIdentityFromFile(filepath.Join(certsPath, "server.crt"), filepath.Join(certsPath, "server.key")),
+		).Server(tlsconfig.WithClientAuthenticationFromFile(filepath.Join(certsPath, "ca.crt")))
+		Expect(err).NotTo(HaveOccurred())
+
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		})
+		process = ifrit.Invoke(server.NewTLS(address, handler, serverTLSConfig, enableHTTP2))
+	})
+
+	AfterEach(func() {
+		process.Signal(os.Interrupt)
+		Eventually(process.Wait()).Should(Receive())
+	})
+
+	proto := func() string {
+		resp, err := client.Get("https://" + address)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Proto).To(Equal(string(body)))
+		return resp.Proto
+	}
+
+	It("gives every request an ID", func() {
+		resp, err := client.Get("https://" + address)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.Header.Get(requestid.Header)).NotTo(BeEmpty())
+	})
+
+	It("only speaks HTTP/1.1 by default", func() {
+		Expect(proto()).To(Equal("HTTP/1.1"))
+	})
+
+	Context("when HTTP/2 is enabled", func() {
+		BeforeEach(func() {
+			enableHTTP2 = true
+		})
+
+		It("negotiates HTTP/2", func() {
+			Expect(proto()).To(Equal("HTTP/2.0"))
+		})
+
+		It("still serves HTTP/1.1 clients", func() {
+			client.Transport.(*http.Transport).ForceAttemptHTTP2 = false
+			client.Transport.(*http.Transport).TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+			Expect(proto()).To(Equal("HTTP/1.1"))
+		})
+	})
+
+	It("stops accepting connections when signalled", func() {
+		process.Signal(os.Interrupt)
+		Eventually(process.Wait()).Should(Receive(BeNil()))
+
+		_, err := client.Get("https://" + address)
+		Expect(err).To(HaveOccurred())
+	})
+})
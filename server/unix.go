@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+
+	"code.cloudfoundry.org/cc-uploader/requestid"
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/tedsuo/ifrit"
+)
+
+// PeerCredentials identify the process at the other end of a Unix socket
+// connection, as reported by the kernel when it connected.
+type PeerCredentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+type peerCredentialsKey struct{}
+
+type unixServer struct {
+	logger    lager.Logger
+	path      string
+	mode      os.FileMode
+	uid       int
+	gid       int
+	authorize func(PeerCredentials) bool
+	handler   http.Handler
+}
+
+// NewUnix returns a runner that serves handler over plain HTTP on a Unix
+// domain socket at path. The socket is given mode and, unless they are -1,
+// the uid and gid as its owner. Requests are only passed to handler when
+// authorize accepts the credentials of the peer's process; others are
+// answered with 403 Forbidden. As with NewTLS, every request, rejected or
+// not, is given a request ID. Peer credentials are only available on Linux,
+// elsewhere the runner fails to start. A stale socket left at path is
+// replaced.
+func NewUnix(logger lager.Logger, path string, mode os.FileMode, uid, gid int, authorize func(PeerCredentials) bool, handler http.Handler) ifrit.Runner {
+	return &unixServer{
+		logger:    logger.Session("unix-server", lager.Data{"path": path}),
+		path:      path,
+		mode:      mode,
+		uid:       uid,
+		gid:       gid,
+		authorize: authorize,
+		handler:   handler,
+	}
+}
+
+func (s *unixServer) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	if !peerCredentialsSupported {
+		return errPeerCredentialsUnsupported
+	}
+
+	if info, err := os.Lstat(s.path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(s.path); err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.Listen("unix", s.path)
+	if err != nil {
+		return err
+	}
+	// peers are authorized by their credentials, so connections accepted
+	// before the mode and owner are set are still checked
+	if err := os.Chmod(s.path, s.mode); err != nil {
+		listener.Close()
+		return err
+	}
+	if s.uid != -1 || s.gid != -1 {
+		if err := os.Lchown(s.path, s.uid, s.gid); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	server := &http.Server{
+		Handler: requestid.Handler(http.HandlerFunc(s.serveAuthorized)),
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			creds, err := peerCredentials(conn)
+			if err != nil {
+				s.logger.Error("failed-to-read-peer-credentials", err)
+				return ctx
+			}
+			return context.WithValue(ctx, peerCredentialsKey{}, creds)
+		},
+	}
+
+	serverErrChan := make(chan error, 1)
+	go func() {
+		serverErrChan <- server.Serve(listener)
+	}()
+
+	close(ready)
+
+	select {
+	case err = <-serverErrChan:
+		return err
+	case <-signals:
+		listener.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+
+		return nil
+	}
+}
+
+func (s *unixServer) serveAuthorized(w http.ResponseWriter, r *http.Request) {
+	creds, ok := r.Context().Value(peerCredentialsKey{}).(PeerCredentials)
+	if !ok || !s.authorize(creds) {
+		s.logger.Info("rejected-peer", requestid.Data(r.Context()), lager.Data{"pid": creds.PID, "uid": creds.UID, "gid": creds.GID})
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	s.handler.ServeHTTP(w, r)
+}
+
+var errPeerCredentialsUnsupported = errors.New("unix socket peer credentials are only supported on Linux")
@@ -0,0 +1,132 @@
+//go:build linux
+
+package server_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/cc-uploader/requestid"
+	"code.cloudfoundry.org/cc-uploader/server"
+	"code.cloudfoundry.org/lager/v3/lagertest"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tedsuo/ifrit"
+)
+
+var _ = Describe("Unix server", func() {
+	var (
+		logger     *lagertest.TestLogger
+		socketPath string
+		authorized bool
+		peers      chan server.PeerCredentials
+		process    ifrit.Process
+		client     *http.Client
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		socketPath = filepath.Join(GinkgoT().TempDir(), "cc-uploader.sock")
+		authorized = true
+		peers = make(chan server.PeerCredentials, 10)
+
+		client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+			},
+		}}
+	})
+
+	JustBeforeEach(func() {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("uploaded"))
+		})
+		authorize := func(creds server.PeerCredentials) bool {
+			peers <- creds
+			return authorized
+		}
+		process = ifrit.Invoke(server.NewUnix(logger, socketPath, 0600, -1, -1, authorize, handler))
+	})
+
+	AfterEach(func() {
+		process.Signal(os.Interrupt)
+		Eventually(process.Wait()).Should(Receive())
+	})
+
+	get := func() *http.Response {
+		resp, err := client.Get("http://cc-uploader/v1/droplet/app-guid")
+		Expect(err).NotTo(HaveOccurred())
+		return resp
+	}
+
+	It("creates the socket with the given mode", func() {
+		info, err := os.Stat(socketPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode() & os.ModeSocket).NotTo(BeZero())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+	})
+
+	It("authorizes requests by the credentials of the peer's process", func() {
+		resp := get()
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(Equal("uploaded"))
+
+		var creds server.PeerCredentials
+		Expect(peers).To(Receive(&creds))
+		Expect(creds.PID).To(Equal(int32(os.Getpid())))
+		Expect(creds.UID).To(Equal(uint32(os.Getuid())))
+		Expect(creds.GID).To(Equal(uint32(os.Getgid())))
+	})
+
+	Context("when the peer is not authorized", func() {
+		BeforeEach(func() {
+			authorized = false
+		})
+
+		It("responds with 403 Forbidden", func() {
+			resp := get()
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+		})
+
+		It("logs the rejection with the request's ID", func() {
+			resp := get()
+			defer resp.Body.Close()
+
+			id := resp.Header.Get(requestid.Header)
+			Expect(id).NotTo(BeEmpty())
+			Expect(logger.LogMessages()).To(ContainElement("test.unix-server.rejected-peer"))
+			Expect(logger.Logs()[len(logger.Logs())-1].Data).To(HaveKeyWithValue("request-id", id))
+		})
+	})
+
+	Context("when a stale socket is left at the path", func() {
+		BeforeEach(func() {
+			listener, err := net.Listen("unix", socketPath)
+			Expect(err).NotTo(HaveOccurred())
+			listener.(*net.UnixListener).SetUnlinkOnClose(false)
+			listener.Close()
+		})
+
+		It("replaces it", func() {
+			resp := get()
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+	})
+
+	It("removes the socket when signalled", func() {
+		process.Signal(os.Interrupt)
+		Eventually(process.Wait()).Should(Receive(BeNil()))
+
+		_, err := os.Stat(socketPath)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+})
@@ -0,0 +1,129 @@
+package syslogsink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+)
+
+const (
+	facilityUser = 1
+
+	// StructuredDataID identifies the structured data element carrying the
+	// lager source, log level, session and data fields. 47450 is the Cloud
+	// Foundry Foundation's private enterprise number.
+	StructuredDataID = "lager@47450"
+
+	timestampFormat = "2006-01-02T15:04:05.000000Z07:00"
+	maxNameLength   = 32
+)
+
+var severities = map[lager.LogLevel]int{
+	lager.DEBUG: 7,
+	lager.INFO:  6,
+	lager.ERROR: 3,
+	lager.FATAL: 2,
+}
+
+// format renders a log line as an RFC 5424 message. The lager message is the
+// MSG and everything else is carried as structured data.
+func format(log lager.LogFormat, now time.Time, hostname, appName, procID string) []byte {
+	severity, ok := severities[log.LogLevel]
+	if !ok {
+		severity = severities[lager.INFO]
+	}
+
+	buffer := &bytes.Buffer{}
+	fmt.Fprintf(buffer, "<%d>1 %s %s %s %s - ",
+		facilityUser*8+severity,
+		now.UTC().Format(timestampFormat),
+		headerField(hostname, 255),
+		headerField(appName, 48),
+		headerField(procID, 128),
+	)
+
+	buffer.WriteString("[" + StructuredDataID)
+	writeParam(buffer, "source", log.Source)
+	writeParam(buffer, "log_level", log.LogLevel.String())
+
+	keys := make([]string, 0, len(log.Data))
+	for key := range log.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		writeParam(buffer, paramName(key), paramValue(log.Data[key]))
+	}
+	buffer.WriteString("] ")
+
+	buffer.WriteString(log.Message)
+	return buffer.Bytes()
+}
+
+func writeParam(buffer *bytes.Buffer, name, value string) {
+	buffer.WriteString(" " + name + `="`)
+	for _, r := range value {
+		if r == '"' || r == '\\' || r == ']' {
+			buffer.WriteByte('\\')
+		}
+		buffer.WriteRune(r)
+	}
+	buffer.WriteByte('"')
+}
+
+// headerField replaces an empty value with the nil value and anything
+// outside printable US-ASCII with an underscore.
+func headerField(value string, maxLength int) string {
+	if value == "" {
+		return "-"
+	}
+	value = printableASCII(value, "")
+	if len(value) > maxLength {
+		value = value[:maxLength]
+	}
+	return value
+}
+
+// paramName makes a lager data key a valid SD-NAME, which may not contain
+// '=', ' ', ']' or '"'.
+func paramName(key string) string {
+	name := printableASCII(key, `= ]"`)
+	if name == "" {
+		return "_"
+	}
+	if len(name) > maxNameLength {
+		name = name[:maxNameLength]
+	}
+	return name
+}
+
+func printableASCII(value, excluded string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 || strings.ContainsRune(excluded, r) {
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+func paramValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
@@ -0,0 +1,190 @@
+// Package syslogsink provides a lager sink that sends logs to a syslog
+// endpoint in RFC 5424 format.
+package syslogsink
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+)
+
+const (
+	NetworkUDP = "udp"
+	NetworkTCP = "tcp"
+	NetworkTLS = "tls"
+
+	// BufferSize is how many messages are held while the endpoint is slow or
+	// unreachable. Further messages are dropped until there is room again.
+	BufferSize = 1024
+
+	dialTimeout  = 5 * time.Second
+	writeTimeout = 5 * time.Second
+	minBackoff   = 100 * time.Millisecond
+	maxBackoff   = 10 * time.Second
+)
+
+// Sink sends each log line as a syslog message. Over UDP every message is a
+// datagram; over TCP and TLS messages are framed by octet counting, as in
+// RFC 6587 and RFC 5425.
+//
+// Log never waits for the endpoint: messages are queued and written by a
+// background goroutine, which reconnects with exponential backoff when a
+// connection cannot be established or a write fails.
+type Sink struct {
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	hostname  string
+	appName   string
+	procID    string
+
+	messages chan []byte
+	dropped  atomic.Uint64
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closing   chan struct{}
+	closeOnce sync.Once
+	stopped   chan struct{}
+}
+
+// New returns a sink sending to the syslog endpoint at address. tlsConfig is
+// only used with the "tls" network. The endpoint does not have to be
+// reachable yet; the sink connects to it in the background.
+func New(network, address string, tlsConfig *tls.Config, appName string) (*Sink, error) {
+	switch network {
+	case NetworkUDP, NetworkTCP, NetworkTLS:
+	default:
+		return nil, fmt.Errorf("unsupported syslog network: %q", network)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+
+	s := &Sink{
+		network:   network,
+		address:   address,
+		tlsConfig: tlsConfig,
+		hostname:  hostname,
+		appName:   appName,
+		procID:    fmt.Sprint(os.Getpid()),
+		messages:  make(chan []byte, BufferSize),
+		closing:   make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	go s.run()
+	return s, nil
+}
+
+func (s *Sink) Log(log lager.LogFormat) {
+	message := format(log, time.Now(), s.hostname, s.appName, s.procID)
+	if s.network != NetworkUDP {
+		message = append([]byte(fmt.Sprintf("%d ", len(message))), message...)
+	}
+
+	select {
+	case s.messages <- message:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Dropped returns how many messages have been dropped because the buffer
+// was full.
+func (s *Sink) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close sends the messages still buffered, waiting at most timeout for
+// them, and closes the connection to the syslog endpoint. It returns an
+// error if messages had to be discarded. Messages logged after Close are
+// not sent.
+func (s *Sink) Close(timeout time.Duration) error {
+	s.closeOnce.Do(func() { close(s.closing) })
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-s.stopped:
+	case <-timer.C:
+		err = fmt.Errorf("discarded %d buffered syslog messages after %s", len(s.messages), timeout)
+	}
+	s.cancel()
+	<-s.stopped
+	return err
+}
+
+// run writes the buffered messages until the sink is closed, or until the
+// buffer is empty once Close was called. A message whose write fails is
+// retried on the next connection.
+func (s *Sink) run() {
+	defer close(s.stopped)
+
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	backoff := minBackoff
+	for {
+		var message []byte
+		select {
+		case <-s.ctx.Done():
+			return
+		case message = <-s.messages:
+		case <-s.closing:
+			select {
+			case message = <-s.messages:
+			default:
+				return
+			}
+		}
+
+		for {
+			var err error
+			if conn == nil {
+				conn, err = s.dial()
+			}
+			if err == nil {
+				conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+				_, err = conn.Write(message)
+				if err == nil {
+					backoff = minBackoff
+					break
+				}
+				conn.Close()
+				conn = nil
+			}
+
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, maxBackoff)
+		}
+	}
+}
+
+func (s *Sink) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if s.network == NetworkTLS {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: s.tlsConfig}
+		return tlsDialer.DialContext(s.ctx, "tcp", s.address)
+	}
+	return dialer.DialContext(s.ctx, s.network, s.address)
+}
@@ -0,0 +1,13 @@
+package syslogsink_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestSyslogSink(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "SyslogSink Suite")
+}
@@ -0,0 +1,324 @@
+package syslogsink_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/syslogsink"
+	"code.cloudfoundry.org/lager/v3"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// readFrame reads one octet-counted syslog message.
+func readFrame(reader *bufio.Reader) (string, error) {
+	length, err := reader.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil {
+		return "", err
+	}
+	message := make([]byte, n)
+	_, err = io.ReadFull(reader, message)
+	return string(message), err
+}
+
+// acceptFrames reads octet-counted messages from every connection accepted
+// by listener. The returned function closes the connections accepted so far.
+func acceptFrames(listener net.Listener) (<-chan string, func()) {
+	messages := make(chan string, 10)
+	var lock sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			conns = append(conns, conn)
+			lock.Unlock()
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					message, err := readFrame(reader)
+					if err != nil {
+						return
+					}
+					messages <- message
+				}
+			}()
+		}
+	}()
+
+	closeConnections := func() {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	return messages, closeConnections
+}
+
+var _ = Describe("Sink", func() {
+	var logger lager.Logger
+
+	BeforeEach(func() {
+		logger = lager.NewLogger("cc-uploader")
+	})
+
+	Context("over UDP", func() {
+		var conn net.PacketConn
+
+		BeforeEach(func() {
+			var err error
+			conn, err = net.ListenPacket("udp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+
+			sink, err := syslogsink.New(syslogsink.NetworkUDP, conn.LocalAddr().String(), nil, "cc-uploader")
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(func() { sink.Close(0) })
+			logger.RegisterSink(sink)
+		})
+
+		AfterEach(func() {
+			conn.Close()
+		})
+
+		receive := func() string {
+			buffer := make([]byte, 4096)
+			n, _, err := conn.ReadFrom(buffer)
+			Expect(err).NotTo(HaveOccurred())
+			return string(buffer[:n])
+		}
+
+		It("sends each log line as an RFC 5424 message", func() {
+			hostname, err := os.Hostname()
+			Expect(err).NotTo(HaveOccurred())
+
+			logger.Info("started")
+
+			Expect(receive()).To(MatchRegexp(
+				`^<14>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}Z %s cc-uploader %d - \[lager@47450 source="cc-uploader" log_level="info"\] cc-uploader\.started$`,
+				hostname, os.Getpid(),
+			))
+		})
+
+		It("carries the session and data fields as structured data", func() {
+			session := logger.Session("upload", lager.Data{"guid": "some-guid"})
+			session.Info("start", lager.Data{"content-length": 42, "header": `a "quoted" [value]`})
+
+			message := receive()
+			Expect(message).To(ContainSubstring(`session="1"`))
+			Expect(message).To(ContainSubstring(`guid="some-guid"`))
+			Expect(message).To(ContainSubstring(`content-length="42"`))
+			Expect(message).To(ContainSubstring(`header="a \"quoted\" [value\]"`))
+			Expect(message).To(HaveSuffix("] cc-uploader.upload.start"))
+		})
+
+		It("maps lager log levels to syslog severities", func() {
+			logger.Debug("debugging")
+			Expect(receive()).To(HavePrefix("<15>1 "))
+
+			logger.Error("failed", errors.New("boom"))
+			message := receive()
+			Expect(message).To(HavePrefix("<11>1 "))
+			Expect(message).To(ContainSubstring(`error="boom"`))
+		})
+
+		It("makes data keys valid parameter names", func() {
+			logger.Info("odd-keys", lager.Data{`a key="x"]`: "value"})
+
+			Expect(receive()).To(ContainSubstring(`a_key__x__="value"`))
+		})
+	})
+
+	Context("over TCP", func() {
+		var listener net.Listener
+		var messages <-chan string
+		var closeConnections func()
+
+		BeforeEach(func() {
+			var err error
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			messages, closeConnections = acceptFrames(listener)
+
+			sink, err := syslogsink.New(syslogsink.NetworkTCP, listener.Addr().String(), nil, "cc-uploader")
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(func() { sink.Close(0) })
+			logger.RegisterSink(sink)
+		})
+
+		AfterEach(func() {
+			listener.Close()
+		})
+
+		It("frames messages by octet counting", func() {
+			logger.Info("first")
+			logger.Info("second", lager.Data{"multi": "line\nvalue"})
+
+			Eventually(messages).Should(Receive(HaveSuffix("cc-uploader.first")))
+			Eventually(messages).Should(Receive(And(ContainSubstring("multi=\"line\nvalue\""), HaveSuffix("cc-uploader.second"))))
+		})
+
+		It("reconnects after the connection is lost", func() {
+			logger.Info("before")
+			Eventually(messages).Should(Receive(HaveSuffix("cc-uploader.before")))
+
+			closeConnections()
+
+			// writes can succeed until the sink notices the connection is gone
+			Eventually(func() <-chan string {
+				logger.Info("after")
+				return messages
+			}).Should(Receive(HaveSuffix("cc-uploader.after")))
+		})
+	})
+
+	Context("when closed", func() {
+		var listener net.Listener
+		var sink *syslogsink.Sink
+
+		BeforeEach(func() {
+			var err error
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+
+			sink, err = syslogsink.New(syslogsink.NetworkTCP, listener.Addr().String(), nil, "cc-uploader")
+			Expect(err).NotTo(HaveOccurred())
+			logger.RegisterSink(sink)
+		})
+
+		AfterEach(func() {
+			listener.Close()
+		})
+
+		It("sends the messages still buffered first", func() {
+			messages, _ := acceptFrames(listener)
+			for i := 0; i < 5; i++ {
+				logger.Info("before-close")
+			}
+			logger.Info("last")
+
+			Expect(sink.Close(5 * time.Second)).To(Succeed())
+			for i := 0; i < 5; i++ {
+				Eventually(messages).Should(Receive(HaveSuffix("cc-uploader.before-close")))
+			}
+			Eventually(messages).Should(Receive(HaveSuffix("cc-uploader.last")))
+		})
+
+		It("gives up on the buffered messages after the timeout", func() {
+			listener.Close()
+			logger.Info("undeliverable")
+
+			start := time.Now()
+			Expect(sink.Close(200 * time.Millisecond)).To(MatchError(ContainSubstring("discarded")))
+			Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+		})
+	})
+
+	Context("when the endpoint is unreachable", func() {
+		var address string
+		var sink *syslogsink.Sink
+
+		BeforeEach(func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			address = listener.Addr().String()
+			listener.Close()
+
+			sink, err = syslogsink.New(syslogsink.NetworkTCP, address, nil, "cc-uploader")
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(func() { sink.Close(0) })
+			logger.RegisterSink(sink)
+		})
+
+		It("delivers buffered messages once the endpoint is reachable", func() {
+			logger.Info("while-down")
+			time.Sleep(300 * time.Millisecond)
+
+			listener, err := net.Listen("tcp", address)
+			Expect(err).NotTo(HaveOccurred())
+			defer listener.Close()
+			messages, _ := acceptFrames(listener)
+
+			Eventually(messages, 5*time.Second).Should(Receive(HaveSuffix("cc-uploader.while-down")))
+		})
+
+		It("drops messages once its buffer is full, without blocking", func() {
+			for i := 0; i < syslogsink.BufferSize+10; i++ {
+				logger.Info("flood")
+			}
+			// the sink may be holding one message for its next attempt
+			Expect(sink.Dropped()).To(BeNumerically(">=", 9))
+		})
+	})
+
+	Context("over TLS", func() {
+		var listener net.Listener
+		var tlsConfig *tls.Config
+
+		BeforeEach(func() {
+			certsPath := filepath.Join("..", "fixtures", "certs")
+			serverCert, err := tls.LoadX509KeyPair(filepath.Join(certsPath, "server.crt"), filepath.Join(certsPath, "server.key"))
+			Expect(err).NotTo(HaveOccurred())
+
+			listener, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverCert}})
+			Expect(err).NotTo(HaveOccurred())
+
+			caCert, err := os.ReadFile(filepath.Join(certsPath, "ca.crt"))
+			Expect(err).NotTo(HaveOccurred())
+			rootCAs := x509.NewCertPool()
+			Expect(rootCAs.AppendCertsFromPEM(caCert)).To(BeTrue())
+			tlsConfig = &tls.Config{RootCAs: rootCAs}
+		})
+
+		AfterEach(func() {
+			listener.Close()
+		})
+
+		It("sends octet-counted messages over the TLS connection", func() {
+			messages, _ := acceptFrames(listener)
+
+			sink, err := syslogsink.New(syslogsink.NetworkTLS, listener.Addr().String(), tlsConfig, "cc-uploader")
+			Expect(err).NotTo(HaveOccurred())
+			defer sink.Close(0)
+			logger.RegisterSink(sink)
+
+			logger.Info("secure")
+			Eventually(messages).Should(Receive(HaveSuffix("cc-uploader.secure")))
+		})
+
+		It("sends nothing if the endpoint's certificate is not trusted", func() {
+			messages, _ := acceptFrames(listener)
+
+			sink, err := syslogsink.New(syslogsink.NetworkTLS, listener.Addr().String(), &tls.Config{RootCAs: x509.NewCertPool()}, "cc-uploader")
+			Expect(err).NotTo(HaveOccurred())
+			defer sink.Close(0)
+			logger.RegisterSink(sink)
+
+			logger.Info("secure")
+			Consistently(messages, 300*time.Millisecond).ShouldNot(Receive())
+		})
+	})
+
+	It("rejects unknown networks", func() {
+		_, err := syslogsink.New("http", "127.0.0.1:514", nil, "cc-uploader")
+		Expect(err).To(MatchError(ContainSubstring("unsupported syslog network")))
+	})
+})
@@ -0,0 +1,15 @@
+package uploads
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// NewStatusHandler serves the tracker's drain status as JSON. It is meant
+// to be mounted on the debug server.
+func NewStatusHandler(tracker *Tracker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tracker.Status())
+	})
+}
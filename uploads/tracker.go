@@ -0,0 +1,343 @@
+package uploads
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/metrics"
+	"code.cloudfoundry.org/cc-uploader/requestid"
+	"code.cloudfoundry.org/lager/v3"
+)
+
+type Phase string
+
+const (
+	PhaseUploading Phase = "uploading"
+	PhasePolling   Phase = "polling"
+)
+
+// ErrTooManyUploads is returned by Start when the tracker is already at its
+// in-flight upload limit.
+var ErrTooManyUploads = errors.New("too many uploads in flight, try again later")
+
+// ErrDraining is returned by Start once the tracker is draining, as uploads
+// started then would be cut short by the shutdown.
+var ErrDraining = errors.New("cc-uploader is shutting down, try again later")
+
+// ErrDrainTimeout is the cancellation cause given to uploads that were
+// still running when the graceful shutdown deadline passed.
+var ErrDrainTimeout = errors.New("upload cancelled: cc-uploader shut down before the upload finished")
+
+// ErrCancelledByOperator is the cancellation cause given to uploads that
+// were cancelled through the admin API.
+var ErrCancelledByOperator = errors.New("upload cancelled by an operator")
+
+// CancellationCause returns the cause given when the tracker cancelled the
+// upload owning ctx, or nil if the tracker did not cancel it.
+func CancellationCause(ctx context.Context) error {
+	switch cause := context.Cause(ctx); cause {
+	case ErrDrainTimeout, ErrCancelledByOperator:
+		return cause
+	}
+	return nil
+}
+
+// Tracker keeps a registry of in-flight uploads so that they can be drained,
+// reported on and cancelled on shutdown.
+type Tracker struct {
+	logger      lager.Logger
+	maxInFlight int
+
+	lock     sync.Mutex
+	uploads  map[string]*Upload
+	draining bool
+	nextID   uint64
+
+	waitGroup sync.WaitGroup
+}
+
+// NewTracker returns a tracker that admits at most maxInFlight concurrent
+// uploads. A maxInFlight of zero means there is no limit.
+func NewTracker(logger lager.Logger, maxInFlight int) *Tracker {
+	return &Tracker{
+		logger:      logger.Session("upload-tracker"),
+		maxInFlight: maxInFlight,
+		uploads:     map[string]*Upload{},
+	}
+}
+
+// Start registers a new in-flight upload. The returned context is derived
+// from ctx and is cancelled, with a cause, if the tracker cancels the upload.
+// Callers must call Finish on the returned Upload once they are done.
+func (t *Tracker) Start(ctx context.Context, route, guid string, uploadURL *url.URL, contentLength int64) (context.Context, *Upload, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.draining {
+		return nil, nil, ErrDraining
+	}
+	if t.maxInFlight > 0 && len(t.uploads) >= t.maxInFlight {
+		return nil, nil, ErrTooManyUploads
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	t.nextID++
+	upload := &Upload{
+		ID:            strconv.FormatUint(t.nextID, 10),
+		Route:         route,
+		Guid:          guid,
+		Host:          uploadURL.Host,
+		ContentLength: contentLength,
+		StartedAt:     time.Now(),
+		RequestID:     requestid.FromContext(ctx),
+		tracker:       t,
+		cancel:        cancel,
+	}
+	upload.phase.Store(PhaseUploading)
+
+	t.uploads[upload.ID] = upload
+	t.waitGroup.Add(1)
+
+	return ctx, upload, nil
+}
+
+func (t *Tracker) finish(upload *Upload) {
+	t.lock.Lock()
+	_, ok := t.uploads[upload.ID]
+	delete(t.uploads, upload.ID)
+	t.lock.Unlock()
+
+	if ok {
+		upload.cancel(nil)
+		t.waitGroup.Done()
+	}
+}
+
+// StartDraining marks the tracker as draining. Running uploads are not
+// affected, but Start rejects new ones from then on.
+func (t *Tracker) StartDraining() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.draining = true
+}
+
+func (t *Tracker) Draining() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.draining
+}
+
+// AtCapacity reports whether the in-flight upload limit has been reached.
+func (t *Tracker) AtCapacity() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.maxInFlight > 0 && len(t.uploads) >= t.maxInFlight
+}
+
+// Drained returns a channel that is closed once every tracked upload has
+// finished.
+func (t *Tracker) Drained() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		t.waitGroup.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// CancelAll cancels every in-flight upload with the given cause and returns
+// how many were cancelled.
+func (t *Tracker) CancelAll(cause error) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, upload := range t.uploads {
+		t.logger.Info("cancelling-upload", upload.logData())
+		upload.cancel(cause)
+	}
+	return len(t.uploads)
+}
+
+// Cancel cancels the in-flight upload with the given id. It reports whether
+// such an upload was found.
+func (t *Tracker) Cancel(id string, cause error) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	upload, ok := t.uploads[id]
+	if !ok {
+		return false
+	}
+
+	t.logger.Info("cancelling-upload", upload.logData())
+	upload.cancel(cause)
+	return true
+}
+
+// Snapshots returns the state of every in-flight upload, oldest first.
+func (t *Tracker) Snapshots() []Snapshot {
+	t.lock.Lock()
+	snapshots := make([]Snapshot, 0, len(t.uploads))
+	for _, upload := range t.uploads {
+		snapshots = append(snapshots, upload.Snapshot())
+	}
+	t.lock.Unlock()
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].StartedAt.Before(snapshots[j].StartedAt)
+	})
+	return snapshots
+}
+
+// Status summarises the tracker for drain progress reporting.
+func (t *Tracker) Status() Status {
+	snapshots := t.Snapshots()
+	status := Status{
+		Draining:         t.Draining(),
+		RemainingUploads: len(snapshots),
+		Uploads:          snapshots,
+	}
+	for _, s := range snapshots {
+		if s.ContentLength > s.BytesSent {
+			status.BytesRemaining += s.ContentLength - s.BytesSent
+		}
+	}
+	return status
+}
+
+// LogProgress logs the drain status every interval until stop is closed.
+func (t *Tracker) LogProgress(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			status := t.Status()
+			t.logger.Info("draining-progress", lager.Data{
+				"remaining-uploads": status.RemainingUploads,
+				"bytes-remaining":   status.BytesRemaining,
+			})
+		case <-stop:
+			return
+		}
+	}
+}
+
+type Status struct {
+	Draining         bool       `json:"draining"`
+	RemainingUploads int        `json:"remaining_uploads"`
+	BytesRemaining   int64      `json:"bytes_remaining"`
+	Uploads          []Snapshot `json:"uploads"`
+}
+
+type Upload struct {
+	ID            string
+	Route         string
+	Guid          string
+	Host          string
+	ContentLength int64
+	StartedAt     time.Time
+	// RequestID is the ID of the request making the upload, logged with
+	// the tracker's lines about it.
+	RequestID string
+
+	bytesSent atomic.Int64
+	phase     atomic.Value
+	tracker   *Tracker
+	cancel    context.CancelCauseFunc
+}
+
+// TrackBody wraps the inbound request body so that bytes read from it are
+// counted as sent.
+func (u *Upload) TrackBody(body io.ReadCloser) io.ReadCloser {
+	return &countingReadCloser{ReadCloser: body, count: &u.bytesSent}
+}
+
+func (u *Upload) SetPhase(phase Phase) {
+	u.phase.Store(phase)
+}
+
+func (u *Upload) Phase() Phase {
+	return u.phase.Load().(Phase)
+}
+
+func (u *Upload) BytesSent() int64 {
+	return u.bytesSent.Load()
+}
+
+// EmitMetrics emits the outcome of the upload, as answered with statusCode:
+// a <Route>Succeeded or <Route>Failed count, the <Route>Duration since it
+// started and the <Route>BytesSent.
+func (u *Upload) EmitMetrics(statusCode int) {
+	if statusCode >= 200 && statusCode < 300 {
+		metrics.IncrementCounter(u.Route + "Succeeded")
+	} else {
+		metrics.IncrementCounter(u.Route + "Failed")
+	}
+	metrics.SendDuration(u.Route+"Duration", time.Since(u.StartedAt))
+	metrics.AddToCounter(u.Route+"BytesSent", uint64(u.BytesSent()))
+}
+
+// Finish removes the upload from the tracker.
+func (u *Upload) Finish() {
+	u.tracker.finish(u)
+}
+
+type Snapshot struct {
+	ID            string    `json:"id"`
+	Route         string    `json:"route"`
+	Guid          string    `json:"guid"`
+	Host          string    `json:"host"`
+	Phase         Phase     `json:"phase"`
+	BytesSent     int64     `json:"bytes_sent"`
+	ContentLength int64     `json:"content_length"`
+	StartedAt     time.Time `json:"started_at"`
+	Age           string    `json:"age"`
+}
+
+func (u *Upload) Snapshot() Snapshot {
+	return Snapshot{
+		ID:            u.ID,
+		Route:         u.Route,
+		Guid:          u.Guid,
+		Host:          u.Host,
+		Phase:         u.Phase(),
+		BytesSent:     u.BytesSent(),
+		ContentLength: u.ContentLength,
+		StartedAt:     u.StartedAt,
+		Age:           time.Since(u.StartedAt).Round(time.Second).String(),
+	}
+}
+
+func (u *Upload) logData() lager.Data {
+	data := lager.Data{
+		"upload-id":  u.ID,
+		"route":      u.Route,
+		"guid":       u.Guid,
+		"phase":      u.Phase(),
+		"bytes-sent": u.BytesSent(),
+	}
+	if u.RequestID != "" {
+		data["request-id"] = u.RequestID
+	}
+	return data
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	count *atomic.Int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.count.Add(int64(n))
+	return n, err
+}
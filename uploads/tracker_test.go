@@ -0,0 +1,231 @@
+package uploads_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"code.cloudfoundry.org/cc-uploader/metrics"
+	"code.cloudfoundry.org/cc-uploader/metrics/fake_metrics"
+	"code.cloudfoundry.org/cc-uploader/requestid"
+	"code.cloudfoundry.org/cc-uploader/uploads"
+	"code.cloudfoundry.org/lager/v3/lagertest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("Tracker", func() {
+	var (
+		logger    *lagertest.TestLogger
+		tracker   *uploads.Tracker
+		uploadURL *url.URL
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		tracker = uploads.NewTracker(logger, 0)
+
+		var err error
+		uploadURL, err = url.Parse("https://cc.example.com/staging/droplets/guid/upload")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("tracks uploads until they finish", func() {
+		_, first, _ := tracker.Start(context.Background(), "UploadDroplet", "guid-1", uploadURL, 10)
+		_, second, _ := tracker.Start(context.Background(), "UploadBuildArtifacts", "guid-2", uploadURL, 20)
+		Expect(first.ID).NotTo(Equal(second.ID))
+
+		drained := tracker.Drained()
+		Expect(tracker.Status().RemainingUploads).To(Equal(2))
+
+		first.Finish()
+		Consistently(drained).ShouldNot(BeClosed())
+
+		second.Finish()
+		Eventually(drained).Should(BeClosed())
+		Expect(tracker.Status().RemainingUploads).To(BeZero())
+	})
+
+	Describe("EmitMetrics", func() {
+		var emitter *fake_metrics.FakeEmitter
+
+		BeforeEach(func() {
+			emitter = &fake_metrics.FakeEmitter{}
+			metrics.Initialize(emitter)
+		})
+
+		AfterEach(func() {
+			metrics.Initialize(nil)
+		})
+
+		counters := func() map[string]uint64 {
+			counters := map[string]uint64{}
+			for i := 0; i < emitter.AddToCounterCallCount(); i++ {
+				name, delta := emitter.AddToCounterArgsForCall(i)
+				counters[name] += delta
+			}
+			return counters
+		}
+
+		It("emits the outcome, duration and bytes sent of the upload by route", func() {
+			_, upload, _ := tracker.Start(context.Background(), "UploadDroplet", "guid", uploadURL, 10)
+			io.ReadAll(upload.TrackBody(io.NopCloser(bytes.NewBufferString("droplet"))))
+
+			upload.EmitMetrics(http.StatusCreated)
+			Expect(counters()).To(Equal(map[string]uint64{
+				"UploadDropletSucceeded": 1,
+				"UploadDropletBytesSent": 7,
+			}))
+			Expect(emitter.SendDurationCallCount()).To(Equal(1))
+			name, _ := emitter.SendDurationArgsForCall(0)
+			Expect(name).To(Equal("UploadDropletDuration"))
+		})
+
+		It("counts failed uploads", func() {
+			_, upload, _ := tracker.Start(context.Background(), "UploadBuildArtifacts", "guid", uploadURL, 10)
+
+			upload.EmitMetrics(http.StatusBadGateway)
+			Expect(counters()).To(HaveKeyWithValue("UploadBuildArtifactsFailed", uint64(1)))
+		})
+	})
+
+	It("ignores repeated calls to Finish", func() {
+		_, upload, _ := tracker.Start(context.Background(), "UploadDroplet", "guid", uploadURL, 10)
+		upload.Finish()
+		upload.Finish()
+		Eventually(tracker.Drained()).Should(BeClosed())
+	})
+
+	It("reports the bytes sent, bytes remaining and phase of each upload", func() {
+		_, upload, _ := tracker.Start(context.Background(), "UploadDroplet", "guid", uploadURL, 10)
+		body := upload.TrackBody(io.NopCloser(bytes.NewBufferString("0123456789")))
+
+		buf := make([]byte, 4)
+		_, err := io.ReadFull(body, buf)
+		Expect(err).NotTo(HaveOccurred())
+		upload.SetPhase(uploads.PhasePolling)
+
+		status := tracker.Status()
+		Expect(status.BytesRemaining).To(BeEquivalentTo(6))
+		Expect(status.Uploads).To(HaveLen(1))
+		Expect(status.Uploads[0].Guid).To(Equal("guid"))
+		Expect(status.Uploads[0].Route).To(Equal("UploadDroplet"))
+		Expect(status.Uploads[0].Host).To(Equal("cc.example.com"))
+		Expect(status.Uploads[0].BytesSent).To(BeEquivalentTo(4))
+		Expect(status.Uploads[0].Phase).To(Equal(uploads.PhasePolling))
+	})
+
+	It("cancels in-flight uploads with the given cause", func() {
+		ctx, _, _ := tracker.Start(context.Background(), "UploadDroplet", "guid", uploadURL, 10)
+		Expect(tracker.CancelAll(uploads.ErrDrainTimeout)).To(Equal(1))
+
+		Eventually(ctx.Done()).Should(BeClosed())
+		Expect(errors.Is(context.Cause(ctx), uploads.ErrDrainTimeout)).To(BeTrue())
+	})
+
+	Context("when a limit on in-flight uploads is configured", func() {
+		BeforeEach(func() {
+			tracker = uploads.NewTracker(logger, 1)
+		})
+
+		It("rejects uploads over the limit until one finishes", func() {
+			_, upload, err := tracker.Start(context.Background(), "UploadDroplet", "guid-1", uploadURL, 10)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tracker.AtCapacity()).To(BeTrue())
+
+			_, _, err = tracker.Start(context.Background(), "UploadDroplet", "guid-2", uploadURL, 10)
+			Expect(err).To(Equal(uploads.ErrTooManyUploads))
+
+			upload.Finish()
+			Expect(tracker.AtCapacity()).To(BeFalse())
+
+			_, _, err = tracker.Start(context.Background(), "UploadDroplet", "guid-2", uploadURL, 10)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	It("cancels a single upload by id", func() {
+		ctx, upload, _ := tracker.Start(context.Background(), "UploadDroplet", "guid-1", uploadURL, 10)
+		otherCtx, _, _ := tracker.Start(context.Background(), "UploadDroplet", "guid-2", uploadURL, 10)
+
+		Expect(tracker.Cancel(upload.ID, uploads.ErrCancelledByOperator)).To(BeTrue())
+		Eventually(ctx.Done()).Should(BeClosed())
+		Expect(uploads.CancellationCause(ctx)).To(Equal(uploads.ErrCancelledByOperator))
+		Consistently(otherCtx.Done()).ShouldNot(BeClosed())
+
+		Expect(tracker.Cancel("unknown", uploads.ErrCancelledByOperator)).To(BeFalse())
+	})
+
+	It("logs cancellations with the ID of the request making the upload", func() {
+		_, upload, _ := tracker.Start(requestid.NewContext(context.Background(), "the-request-id"), "UploadDroplet", "guid", uploadURL, 10)
+		Expect(upload.RequestID).To(Equal("the-request-id"))
+
+		tracker.Cancel(upload.ID, uploads.ErrCancelledByOperator)
+		Expect(logger.Logs()).To(ContainElement(SatisfyAll(
+			HaveField("Message", "test.upload-tracker.cancelling-upload"),
+			HaveField("Data", HaveKeyWithValue("request-id", "the-request-id")),
+		)))
+	})
+
+	It("does not report a cancellation cause for uploads that finished normally", func() {
+		ctx, upload, _ := tracker.Start(context.Background(), "UploadDroplet", "guid", uploadURL, 10)
+		upload.Finish()
+
+		Expect(ctx.Done()).To(BeClosed())
+		Expect(uploads.CancellationCause(ctx)).To(BeNil())
+	})
+
+	It("reports whether it is draining", func() {
+		Expect(tracker.Draining()).To(BeFalse())
+		tracker.StartDraining()
+		Expect(tracker.Draining()).To(BeTrue())
+	})
+
+	It("rejects new uploads once it is draining", func() {
+		_, upload, err := tracker.Start(context.Background(), "UploadDroplet", "guid-1", uploadURL, 10)
+		Expect(err).NotTo(HaveOccurred())
+
+		tracker.StartDraining()
+
+		_, _, err = tracker.Start(context.Background(), "UploadDroplet", "guid-2", uploadURL, 10)
+		Expect(err).To(Equal(uploads.ErrDraining))
+		Expect(tracker.Status().RemainingUploads).To(Equal(1))
+
+		upload.Finish()
+		Eventually(tracker.Drained()).Should(BeClosed())
+	})
+
+	It("logs drain progress periodically", func() {
+		tracker.Start(context.Background(), "UploadDroplet", "guid", uploadURL, 10)
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go tracker.LogProgress(10*time.Millisecond, stop)
+
+		Eventually(logger).Should(gbytes.Say(`draining-progress.*"bytes-remaining":10,"remaining-uploads":1`))
+	})
+
+	Describe("the status handler", func() {
+		It("serves the status as JSON", func() {
+			tracker.Start(context.Background(), "UploadDroplet", "guid", uploadURL, 10)
+			tracker.StartDraining()
+
+			recorder := httptest.NewRecorder()
+			uploads.NewStatusHandler(tracker).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/drain-status", nil))
+
+			var status uploads.Status
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &status)).To(Succeed())
+			Expect(status.Draining).To(BeTrue())
+			Expect(status.RemainingUploads).To(Equal(1))
+			Expect(status.Uploads[0].Guid).To(Equal("guid"))
+		})
+	})
+})
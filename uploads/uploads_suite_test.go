@@ -0,0 +1,13 @@
+package uploads_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestUploads(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Uploads Suite")
+}